@@ -0,0 +1,420 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"payment-gateway/billing"
+	"payment-gateway/customers"
+	"payment-gateway/money"
+	"payment-gateway/payments"
+	"payment-gateway/validation"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Create a plan
+// @Description Create a plan, charging the amount every interval-count intervals to the customers subscribed to it
+// @ID create-plan
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param planData body PlanJsonRequest true "Plan Data"
+// @Param Idempotency-Key header string false "Unique key for the plan, retries with the same key and body replay the original response"
+// @Success 201 {object} PlanResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /plans [post]
+func HandleCreatePlan(c *gin.Context, p *payments.PaymentGatewayService) {
+	var body PlanJsonRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid json body"})
+		return
+	}
+	currency, ok := money.NormaliseCurrency(body.Currency)
+	if !ok || !validation.ValidateCurrency(currency) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid currency"})
+		return
+	}
+	amount, err := money.Parse(body.Amount.String(), currency)
+	if err != nil || !validation.ValidatePaymentAmount(amount) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+		return
+	}
+	intervalCount := 1
+	if body.IntervalCount != nil {
+		intervalCount = *body.IntervalCount
+	}
+	plan, err := p.Billing.CreatePlan(merchantFrom(c).ID, body.Name, amount, billing.Interval(body.Interval), intervalCount)
+	if err != nil {
+		respondWithBillingError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, planResponse(plan))
+}
+
+// @Summary List plans
+// @Description List the merchant's plans, oldest first
+// @ID list-plans
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {array} PlanResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /plans [get]
+func HandleListPlans(c *gin.Context, p *payments.PaymentGatewayService) {
+	plans, err := p.Billing.Plans(merchantFrom(c).ID)
+	if err != nil {
+		respondWithBillingError(c, err)
+		return
+	}
+	response := make([]PlanResponse, 0, len(plans))
+	for _, plan := range plans {
+		response = append(response, planResponse(plan))
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// @Summary Get a plan
+// @Description Get one of the merchant's plans
+// @ID get-plan
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path string true "Plan ID"
+// @Success 200 {object} PlanResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /plans/{id} [get]
+func HandleGetPlan(c *gin.Context, p *payments.PaymentGatewayService) {
+	plan, err := p.Billing.Plan(merchantFrom(c).ID, c.Param("id"))
+	if err != nil {
+		respondWithBillingError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, planResponse(plan))
+}
+
+// @Summary Subscribe a customer to a plan
+// @Description Subscribe one of the merchant's customers to a plan, charging the card they saved as payment-method-id for the first period straight away, and for every period after it as it starts. The card is charged by the merchant, without its CVV. A declined charge is retried after 1, 3 and 7 days, after which the subscription is cancelled
+// @ID create-subscription
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param subscriptionData body SubscriptionJsonRequest true "Subscription Data"
+// @Param Idempotency-Key header string false "Unique key for the subscription, retries with the same key and body replay the original response"
+// @Success 201 {object} SubscriptionResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /subscriptions [post]
+func HandleCreateSubscription(c *gin.Context, p *payments.PaymentGatewayService) {
+	var body SubscriptionJsonRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid json body"})
+		return
+	}
+	merchantId := merchantFrom(c).ID
+	if body.CustomerID == "" || body.PaymentMethodID == "" || body.PlanID == "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "customer-id, payment-method-id and plan-id must be given"})
+		return
+	}
+	if !checkSubscriptionCard(c, p, merchantId, body.CustomerID, body.PaymentMethodID) {
+		return
+	}
+	subscription, err := p.Billing.Subscribe(merchantId, body.CustomerID, body.PaymentMethodID, body.PlanID)
+	if errors.Is(err, billing.ErrPlanNotFound) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid plan-id"})
+		return
+	}
+	if err != nil {
+		respondWithBillingError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, subscriptionResponse(subscription))
+}
+
+// @Summary List subscriptions
+// @Description List the merchant's subscriptions, oldest first, along with their charges
+// @ID list-subscriptions
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {array} SubscriptionResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /subscriptions [get]
+func HandleListSubscriptions(c *gin.Context, p *payments.PaymentGatewayService) {
+	subscriptions, err := p.Billing.Subscriptions(merchantFrom(c).ID)
+	if err != nil {
+		respondWithBillingError(c, err)
+		return
+	}
+	response := make([]SubscriptionResponse, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		response = append(response, subscriptionResponse(subscription))
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// @Summary Get a subscription
+// @Description Get one of the merchant's subscriptions, along with its charges
+// @ID get-subscription
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path string true "Subscription ID"
+// @Success 200 {object} SubscriptionResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /subscriptions/{id} [get]
+func HandleGetSubscription(c *gin.Context, p *payments.PaymentGatewayService) {
+	subscription, err := p.Billing.Subscription(merchantFrom(c).ID, c.Param("id"))
+	if err != nil {
+		respondWithBillingError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, subscriptionResponse(subscription))
+}
+
+// @Summary Update a subscription
+// @Description Move a subscription to another plan with the same currency and interval, or charge another of the customer's saved cards for it, leaving out either to keep the current one. Moving to another plan part way through a period carries the difference between the plans, for the rest of the period, over to the next charge as the balance. A past-due subscription is charged with a new card straight away
+// @ID update-subscription
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path string true "Subscription ID"
+// @Param subscriptionData body SubscriptionUpdateJsonRequest true "Subscription Data"
+// @Success 200 {object} SubscriptionResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /subscriptions/{id} [put]
+func HandleUpdateSubscription(c *gin.Context, p *payments.PaymentGatewayService) {
+	var body SubscriptionUpdateJsonRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid json body"})
+		return
+	}
+	merchantId := merchantFrom(c).ID
+	subscription, err := p.Billing.Subscription(merchantId, c.Param("id"))
+	if err != nil {
+		respondWithBillingError(c, err)
+		return
+	}
+	if body.PaymentMethodID != "" && !checkSubscriptionCard(c, p, merchantId, subscription.CustomerID, body.PaymentMethodID) {
+		return
+	}
+	subscription, err = p.Billing.Update(merchantId, subscription.ID, body.PlanID, body.PaymentMethodID)
+	if errors.Is(err, billing.ErrPlanNotFound) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid plan-id"})
+		return
+	}
+	if err != nil {
+		respondWithBillingError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, subscriptionResponse(subscription))
+}
+
+// @Summary Cancel a subscription
+// @Description Stop a subscription being charged, either straight away or, with at-period-end, once the period already paid for ends. The period already paid for is not refunded
+// @ID cancel-subscription
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path string true "Subscription ID"
+// @Param cancelData body CancelSubscriptionJsonRequest false "Cancellation Data"
+// @Param Idempotency-Key header string false "Unique key for the cancellation, retries with the same key and body replay the original response"
+// @Success 200 {object} SubscriptionResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /subscriptions/{id}/cancel [post]
+func HandleCancelSubscription(c *gin.Context, p *payments.PaymentGatewayService) {
+	// The body is optional, and cancels the subscription straight away when left out
+	var body CancelSubscriptionJsonRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid json body"})
+			return
+		}
+	}
+	subscription, err := p.Billing.Cancel(merchantFrom(c).ID, c.Param("id"), body.AtPeriodEnd)
+	if err != nil {
+		respondWithBillingError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, subscriptionResponse(subscription))
+}
+
+// checkSubscriptionCard checks the customer has saved the card a subscription is to charge, and
+// that it has not expired, responding with the problem if it has not.
+func checkSubscriptionCard(c *gin.Context, p *payments.PaymentGatewayService, merchantId, customerId, paymentMethodId string) bool {
+	card, err := p.SavedCard(merchantId, customerId, paymentMethodId)
+	switch {
+	case errors.Is(err, customers.ErrCustomerNotFound):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid customer-id"})
+		return false
+	case errors.Is(err, customers.ErrPaymentMethodNotFound):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid payment-method-id"})
+		return false
+	case err != nil:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve card"})
+		return false
+	case !validation.ValidateExpirationDate(card.ExpiryDate):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Card has expired"})
+		return false
+	}
+	return true
+}
+
+// respondWithBillingError maps an error from an operation on a plan or subscription to its HTTP response.
+func respondWithBillingError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, billing.ErrPlanNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "plan not found"})
+	case errors.Is(err, billing.ErrSubscriptionNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
+	case errors.Is(err, billing.ErrInvalidInterval):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid interval"})
+	case errors.Is(err, billing.ErrInvalidAmount):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+	case errors.Is(err, billing.ErrIncompatiblePlan):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Plans can only be changed for one with the same currency and interval"})
+	case errors.Is(err, billing.ErrSubscriptionCancelled):
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": "Subscription has been cancelled"})
+	case errors.Is(err, billing.ErrSubscriptionCharging):
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": "Subscription is being charged"})
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not update subscription"})
+	}
+}
+
+// planResponse converts a plan into its JSON representation.
+func planResponse(plan billing.Plan) PlanResponse {
+	return PlanResponse{
+		ID:            plan.ID,
+		Name:          plan.Name,
+		Amount:        json.Number(plan.Amount.String()),
+		Currency:      plan.Amount.Currency,
+		Interval:      string(plan.Interval),
+		IntervalCount: plan.IntervalCount,
+		CreatedAt:     plan.CreatedAt,
+	}
+}
+
+// subscriptionResponse converts a subscription, and its charges, into its JSON representation.
+func subscriptionResponse(subscription billing.Subscription) SubscriptionResponse {
+	charges := make([]ChargeResponse, 0, len(subscription.Charges))
+	for _, charge := range subscription.Charges {
+		charges = append(charges, ChargeResponse{
+			PaymentID:   charge.PaymentID,
+			Amount:      json.Number(charge.Amount.String()),
+			Status:      string(charge.Status),
+			Error:       charge.Error,
+			PeriodStart: charge.PeriodStart,
+			PeriodEnd:   charge.PeriodEnd,
+			CreatedAt:   charge.CreatedAt,
+		})
+	}
+	response := SubscriptionResponse{
+		ID:                 subscription.ID,
+		CustomerID:         subscription.CustomerID,
+		PaymentMethodID:    subscription.PaymentMethodID,
+		PlanID:             subscription.PlanID,
+		Status:             string(subscription.Status),
+		CurrentPeriodStart: subscription.CurrentPeriodStart,
+		CurrentPeriodEnd:   subscription.CurrentPeriodEnd,
+		Balance:            json.Number(subscription.Balance.String()),
+		Currency:           subscription.Balance.Currency,
+		FailedAttempts:     subscription.FailedAttempts,
+		CancelAtPeriodEnd:  subscription.CancelAtPeriodEnd,
+		Charges:            charges,
+		CreatedAt:          subscription.CreatedAt,
+		UpdatedAt:          subscription.UpdatedAt,
+	}
+	if !subscription.NextChargeAt.IsZero() {
+		response.NextChargeAt = &subscription.NextChargeAt
+	}
+	if !subscription.CancelledAt.IsZero() {
+		response.CancelledAt = &subscription.CancelledAt
+	}
+	return response
+}
+
+// PlanJsonRequest represents the JSON data expected when creating a plan.
+type PlanJsonRequest struct {
+	Name          string      `json:"name" example:"Premium"`
+	Amount        json.Number `json:"amount" example:"9.99" binding:"required" swaggertype:"number"` // Charged every period, kept as the literal decimal so it is never rounded
+	Currency      string      `json:"currency" example:"GBP" binding:"required"`
+	Interval      string      `json:"interval" example:"month" binding:"required" enums:"day,week,month,year"`
+	IntervalCount *int        `json:"interval-count,omitempty" example:"1"` // How many intervals make up a period, 1 when left out
+}
+
+// SubscriptionJsonRequest represents the JSON data expected when subscribing a customer to a plan.
+type SubscriptionJsonRequest struct {
+	CustomerID      string `json:"customer-id" example:"5b0f1d8e-3c2a-4e7b-9f61-0a8d2c4e6b13"`
+	PaymentMethodID string `json:"payment-method-id" example:"9a7c3e51-2d4b-4f68-8e1a-6b5c0d9f2e47"` // The customer's saved card that is charged
+	PlanID          string `json:"plan-id" example:"2c6e8a14-7b3d-4f59-a0e2-1d9c5b7f3a68"`
+}
+
+// SubscriptionUpdateJsonRequest represents the JSON data accepted when updating a subscription.
+type SubscriptionUpdateJsonRequest struct {
+	PlanID          string `json:"plan-id,omitempty" example:"2c6e8a14-7b3d-4f59-a0e2-1d9c5b7f3a68"`           // Left out to keep the current plan
+	PaymentMethodID string `json:"payment-method-id,omitempty" example:"9a7c3e51-2d4b-4f68-8e1a-6b5c0d9f2e47"` // Left out to keep charging the current card
+}
+
+// CancelSubscriptionJsonRequest represents the JSON data accepted when cancelling a subscription.
+type CancelSubscriptionJsonRequest struct {
+	AtPeriodEnd bool `json:"at-period-end,omitempty" example:"true"` // Cancel once the period already paid for ends, rather than straight away
+}
+
+// swagger:model
+type PlanResponse struct {
+	ID            string      `json:"id" example:"2c6e8a14-7b3d-4f59-a0e2-1d9c5b7f3a68"`
+	Name          string      `json:"name" example:"Premium"`
+	Amount        json.Number `json:"amount" example:"9.99" swaggertype:"number"`
+	Currency      string      `json:"currency" example:"GBP"`
+	Interval      string      `json:"interval" example:"month"`
+	IntervalCount int         `json:"interval-count" example:"1"`
+	CreatedAt     time.Time   `json:"created-at" example:"2023-08-01T12:00:00Z"`
+}
+
+// swagger:model
+type SubscriptionResponse struct {
+	ID                 string           `json:"id" example:"7d4b2f91-5e3a-4c68-b1d7-3a9e6c2f8b45"`
+	CustomerID         string           `json:"customer-id" example:"5b0f1d8e-3c2a-4e7b-9f61-0a8d2c4e6b13"`
+	PaymentMethodID    string           `json:"payment-method-id" example:"9a7c3e51-2d4b-4f68-8e1a-6b5c0d9f2e47"`
+	PlanID             string           `json:"plan-id" example:"2c6e8a14-7b3d-4f59-a0e2-1d9c5b7f3a68"`
+	Status             string           `json:"status" example:"active" enums:"active,past-due,cancelled"`
+	CurrentPeriodStart time.Time        `json:"current-period-start" example:"2023-08-01T12:00:00Z"` // The start of the last period paid for
+	CurrentPeriodEnd   time.Time        `json:"current-period-end" example:"2023-09-01T12:00:00Z"`   // The end of the last period paid for, the same as its start until the first is paid
+	NextChargeAt       *time.Time       `json:"next-charge-at,omitempty" example:"2023-09-01T12:00:00Z"`
+	Balance            json.Number      `json:"balance" example:"0.00" swaggertype:"number"` // Added to the next charge, negative for a credit
+	Currency           string           `json:"currency" example:"GBP"`
+	FailedAttempts     int              `json:"failed-attempts" example:"0"` // How many times in a row the next period has failed to be charged
+	CancelAtPeriodEnd  bool             `json:"cancel-at-period-end" example:"false"`
+	CancelledAt        *time.Time       `json:"cancelled-at,omitempty" example:"2023-09-01T12:00:00Z"`
+	Charges            []ChargeResponse `json:"charges"`
+	CreatedAt          time.Time        `json:"created-at" example:"2023-08-01T12:00:00Z"`
+	UpdatedAt          time.Time        `json:"updated-at" example:"2023-08-01T12:00:00Z"`
+}
+
+// swagger:model
+type ChargeResponse struct {
+	PaymentID   string      `json:"payment-id,omitempty" example:"0e3f5a7c-9b1d-4e26-8f40-6c2a8e4b1d93"` // Left out when the period was paid from the balance
+	Amount      json.Number `json:"amount" example:"9.99" swaggertype:"number"`
+	Status      string      `json:"status" example:"paid" enums:"paid,pending,failed"`
+	Error       string      `json:"error,omitempty"` // Why the charge failed
+	PeriodStart time.Time   `json:"period-start" example:"2023-08-01T12:00:00Z"`
+	PeriodEnd   time.Time   `json:"period-end" example:"2023-09-01T12:00:00Z"`
+	CreatedAt   time.Time   `json:"created-at" example:"2023-08-01T12:00:00Z"`
+}
@@ -0,0 +1,320 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"payment-gateway/customers"
+	"payment-gateway/data"
+	"payment-gateway/payments"
+	"payment-gateway/validation"
+	"payment-gateway/vault"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Create a customer
+// @Description Create a customer, who can save cards to be paid with later by payment-method-id
+// @ID create-customer
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param customerData body CustomerJsonRequest true "Customer Data"
+// @Param Idempotency-Key header string false "Unique key for the customer, retries with the same key and body replay the original response"
+// @Success 201 {object} CustomerResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /customers [post]
+func HandleCreateCustomer(c *gin.Context, p *payments.PaymentGatewayService) {
+	var body CustomerJsonRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid json body"})
+		return
+	}
+	customer, err := p.Customers.Create(merchantFrom(c).ID, body.Name, body.Email)
+	if err != nil {
+		respondWithCustomerError(c, err)
+		return
+	}
+	respondWithCustomer(c, p, http.StatusCreated, customer)
+}
+
+// @Summary List customers
+// @Description List the merchant's customers, oldest first, along with their saved cards
+// @ID list-customers
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {array} CustomerResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /customers [get]
+func HandleListCustomers(c *gin.Context, p *payments.PaymentGatewayService) {
+	list, err := p.Customers.List(merchantFrom(c).ID)
+	if err != nil {
+		respondWithCustomerError(c, err)
+		return
+	}
+	response := make([]CustomerResponse, 0, len(list))
+	for _, customer := range list {
+		resp, err := customerResponse(p, customer)
+		if err != nil {
+			respondWithCustomerError(c, err)
+			return
+		}
+		response = append(response, resp)
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// @Summary Get a customer
+// @Description Get one of the merchant's customers, along with their saved cards
+// @ID get-customer
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path string true "Customer ID"
+// @Success 200 {object} CustomerResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /customers/{id} [get]
+func HandleGetCustomer(c *gin.Context, p *payments.PaymentGatewayService) {
+	customer, err := p.Customers.Customer(merchantFrom(c).ID, c.Param("id"))
+	if err != nil {
+		respondWithCustomerError(c, err)
+		return
+	}
+	respondWithCustomer(c, p, http.StatusOK, customer)
+}
+
+// @Summary Update a customer
+// @Description Replace the name and email of one of the merchant's customers, leaving their saved cards as they are
+// @ID update-customer
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path string true "Customer ID"
+// @Param customerData body CustomerJsonRequest true "Customer Data"
+// @Success 200 {object} CustomerResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /customers/{id} [put]
+func HandleUpdateCustomer(c *gin.Context, p *payments.PaymentGatewayService) {
+	var body CustomerJsonRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid json body"})
+		return
+	}
+	customer, err := p.Customers.Update(merchantFrom(c).ID, c.Param("id"), body.Name, body.Email)
+	if err != nil {
+		respondWithCustomerError(c, err)
+		return
+	}
+	respondWithCustomer(c, p, http.StatusOK, customer)
+}
+
+// @Summary Delete a customer
+// @Description Delete one of the merchant's customers along with their saved cards. Payments already made with the cards are kept
+// @ID delete-customer
+// @Security ApiKeyAuth
+// @Param id path string true "Customer ID"
+// @Success 204
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /customers/{id} [delete]
+func HandleDeleteCustomer(c *gin.Context, p *payments.PaymentGatewayService) {
+	if err := p.Customers.Delete(merchantFrom(c).ID, c.Param("id")); err != nil {
+		respondWithCustomerError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Save a card for a customer
+// @Description Save a card for one of the merchant's customers, given either in full or by the card-token of a card tokenised with /tokens. The card is kept encrypted by the gateway, and can be paid with by giving the customer-id and payment-method-id to /pay
+// @ID create-payment-method
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path string true "Customer ID"
+// @Param cardData body PaymentMethodJsonRequest true "Card Data"
+// @Param Idempotency-Key header string false "Unique key for the saved card, retries with the same key and body replay the original response"
+// @Success 201 {object} PaymentMethodResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /customers/{id}/payment-methods [post]
+func HandleCreatePaymentMethod(c *gin.Context, p *payments.PaymentGatewayService) {
+	var body PaymentMethodJsonRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid json body"})
+		return
+	}
+	merchantId := merchantFrom(c).ID
+	// Check the customer exists before tokenising anything for them
+	if _, err := p.Customers.Customer(merchantId, c.Param("id")); err != nil {
+		respondWithCustomerError(c, err)
+		return
+	}
+
+	// The card is given either in full, when it is tokenised, or by the token of a card the
+	// merchant tokenised before
+	cardNumber := strings.ReplaceAll(body.CardNumber, " ", "")
+	var card vault.Card
+	var err error
+	switch {
+	case (body.CardToken == "") == (cardNumber == ""):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Either card-number or card-token must be given"})
+		return
+	case body.CardToken != "":
+		if body.ExpiryDate != "" {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "expiry-date cannot be given with card-token"})
+			return
+		}
+		card, err = p.Vault.Card(merchantId, body.CardToken)
+		if errors.Is(err, vault.ErrTokenNotFound) {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid card token"})
+			return
+		}
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve card"})
+			return
+		}
+		if !validation.ValidateExpirationDate(card.ExpiryDate) {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Card has expired"})
+			return
+		}
+	default:
+		if ok, message := payments.ValidateCard(cardNumber, body.ExpiryDate); !ok {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+			return
+		}
+		brand, _ := validation.DetectCardBrand(cardNumber)
+		card, err = p.Vault.Tokenise(merchantId, cardNumber, body.ExpiryDate, brand.Name)
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not store card"})
+			return
+		}
+	}
+
+	method, err := p.Customers.AddPaymentMethod(merchantId, c.Param("id"), card.Token)
+	if err != nil {
+		respondWithCustomerError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, paymentMethodResponse(method, card))
+}
+
+// @Summary Remove a saved card
+// @Description Remove one of a customer's saved cards, so it can no longer be paid with by payment-method-id. Payments already made with it are kept
+// @ID delete-payment-method
+// @Security ApiKeyAuth
+// @Param id path string true "Customer ID"
+// @Param paymentMethodId path string true "Payment Method ID"
+// @Success 204
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /customers/{id}/payment-methods/{paymentMethodId} [delete]
+func HandleDeletePaymentMethod(c *gin.Context, p *payments.PaymentGatewayService) {
+	if err := p.Customers.RemovePaymentMethod(merchantFrom(c).ID, c.Param("id"), c.Param("paymentMethodId")); err != nil {
+		respondWithCustomerError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// respondWithCustomerError maps an error from an operation on a customer to its HTTP response.
+func respondWithCustomerError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, customers.ErrCustomerNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+	case errors.Is(err, customers.ErrPaymentMethodNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "payment method not found"})
+	case errors.Is(err, customers.ErrInvalidEmail):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid email"})
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not update customer"})
+	}
+}
+
+// respondWithCustomer responds with the customer, along with the details of their saved cards,
+// which are only kept by the vault.
+func respondWithCustomer(c *gin.Context, p *payments.PaymentGatewayService, status int, customer customers.Customer) {
+	response, err := customerResponse(p, customer)
+	if err != nil {
+		respondWithCustomerError(c, err)
+		return
+	}
+	c.IndentedJSON(status, response)
+}
+
+// customerResponse converts a customer into its JSON representation, looking up their saved cards in the vault.
+func customerResponse(p *payments.PaymentGatewayService, customer customers.Customer) (CustomerResponse, error) {
+	methods := make([]PaymentMethodResponse, 0, len(customer.PaymentMethods))
+	for _, method := range customer.PaymentMethods {
+		card, err := p.Vault.Card(customer.MerchantID, method.CardToken)
+		if err != nil {
+			return CustomerResponse{}, err
+		}
+		methods = append(methods, paymentMethodResponse(method, card))
+	}
+	return CustomerResponse{
+		ID:             customer.ID,
+		Name:           customer.Name,
+		Email:          customer.Email,
+		PaymentMethods: methods,
+		CreatedAt:      customer.CreatedAt,
+		UpdatedAt:      customer.UpdatedAt,
+	}, nil
+}
+
+// paymentMethodResponse converts a saved card, and the vault's card it refers to, into its JSON representation.
+func paymentMethodResponse(method customers.PaymentMethod, card vault.Card) PaymentMethodResponse {
+	return PaymentMethodResponse{
+		ID:             method.ID,
+		CardToken:      method.CardToken,
+		MaskCardNumber: data.StoredCard{CardLastFour: card.LastFour}.MaskedCardNumber(),
+		CardBrand:      card.Brand,
+		ExpiryDate:     card.ExpiryDate,
+		CreatedAt:      method.CreatedAt,
+	}
+}
+
+// CustomerJsonRequest represents the JSON data accepted when creating or updating a customer.
+type CustomerJsonRequest struct {
+	Name  string `json:"name" example:"Jane Doe"`
+	Email string `json:"email,omitempty" example:"jane@example.com"` // Optional, must be a bare email address when given
+}
+
+// PaymentMethodJsonRequest represents the JSON data expected when saving a card for a customer.
+type PaymentMethodJsonRequest struct {
+	CardNumber string `json:"card-number,omitempty" example:"4032 0341 3083 5070"` // Given along with expiry-date, or replaced by card-token
+	ExpiryDate string `json:"expiry-date,omitempty" example:"11/26"`
+	CardToken  string `json:"card-token,omitempty"` // The token of a card the merchant tokenised before, see POST /tokens
+}
+
+// swagger:model
+type CustomerResponse struct {
+	ID             string                  `json:"id" example:"5b0f1d8e-3c2a-4e7b-9f61-0a8d2c4e6b13"`
+	Name           string                  `json:"name" example:"Jane Doe"`
+	Email          string                  `json:"email,omitempty" example:"jane@example.com"`
+	PaymentMethods []PaymentMethodResponse `json:"payment-methods"`
+	CreatedAt      time.Time               `json:"created-at" example:"2023-08-01T12:00:00Z"`
+	UpdatedAt      time.Time               `json:"updated-at" example:"2023-08-01T12:00:00Z"`
+}
+
+// swagger:model
+type PaymentMethodResponse struct {
+	ID             string    `json:"id" example:"9a7c3e51-2d4b-4f68-8e1a-6b5c0d9f2e47"`
+	CardToken      string    `json:"card-token" example:"tok_4f1c2b3a5d6e7f8091a2b3c4d5e6f708"`
+	MaskCardNumber string    `json:"card-number-masked" example:"****5070"`
+	CardBrand      string    `json:"card-brand" example:"Visa"`
+	ExpiryDate     string    `json:"expiry-date" example:"11/26"`
+	CreatedAt      time.Time `json:"created-at" example:"2023-08-01T12:00:00Z"`
+}
@@ -1,23 +1,43 @@
 package api
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"payment-gateway/bank"
+	"payment-gateway/customers"
 	"payment-gateway/data"
+	"payment-gateway/money"
 	"payment-gateway/payments"
+	"payment-gateway/validation"
+	"payment-gateway/vault"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
 // @Summary Make a payment
-// @Description Make a payment
+// @Description Make a payment with either the card details, the card-token of a card tokenised with /tokens, or the payment-method-id of a card saved by the customer-id. Payments are initiated by the customer unless initiated-by is merchant, which charges a saved card without its CVV while the customer is not there. By default the payment is authorised and captured in one go, set capture to false to only authorise it and capture it later
 // @ID make-payment
 // @Accept json
 // @Produce json
 // @Param paymentData body PostJsonRequest true "Payment Data"
+// @Security ApiKeyAuth
+// @Param Idempotency-Key header string false "Unique key for the payment, retries with the same key and body replay the original response"
 // @Success 200 {object} PostResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 502 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
 // @Router /pay [post]
 func HandlePostPayment(c *gin.Context, p *payments.PaymentGatewayService) {
 	// Bind the JSON data from the request body to the PostJsonRequest struct
@@ -28,20 +48,105 @@ func HandlePostPayment(c *gin.Context, p *payments.PaymentGatewayService) {
 		return
 	}
 
+	// Normalise the currency code, as the number of decimal places in the amount depends on it
+	currency, ok := money.NormaliseCurrency(body.Currency)
+	if !ok {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid currency"})
+		return
+	}
+
+	// Parse the amount exactly into minor units, rejecting anything more precise than the currency allows
+	amount, err := money.Parse(body.Amount.String(), currency)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid payment amount"})
+		return
+	}
+
 	// Convert the PostJsonRequest data to a CardData struct
 	cd := data.CardData{
 		CardNumber: strings.ReplaceAll(body.CardNumber, " ", ""),
 		ExpiryDate: body.ExpiryDate,
-		Amount:     body.Amount,
-		Currency:   body.Currency,
+		Amount:     amount,
 		Cvv:        body.Cvv,
+		Token:      body.CardToken,
+		Initiator:  data.Initiator(body.InitiatedBy),
+	}
+	if cd.Initiator == "" {
+		cd.Initiator = data.CustomerInitiated
+	}
+
+	// The card is given either in full, by the token of a card the merchant tokenised before, or
+	// by a card a customer saved, whose expiry date and brand are then checked as held by the vault
+	switch {
+	case body.CustomerID != "" || body.PaymentMethodID != "":
+		if body.CustomerID == "" || body.PaymentMethodID == "" {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "customer-id and payment-method-id must be given together"})
+			return
+		}
+		if cd.CardNumber != "" || cd.Token != "" || cd.ExpiryDate != "" {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "card-number, card-token and expiry-date cannot be given with payment-method-id"})
+			return
+		}
+		card, err := p.SavedCard(merchantFrom(c).ID, body.CustomerID, body.PaymentMethodID)
+		switch {
+		case errors.Is(err, customers.ErrCustomerNotFound):
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid customer-id"})
+			return
+		case errors.Is(err, customers.ErrPaymentMethodNotFound):
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid payment-method-id"})
+			return
+		case err != nil:
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve card"})
+			return
+		}
+		cd.Token = card.Token
+		cd.ExpiryDate = card.ExpiryDate
+		cd.Brand = card.Brand
+		cd.CustomerID = body.CustomerID
+	case (cd.Token == "") == (cd.CardNumber == ""):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Either card-number or card-token must be given"})
+		return
+	case cd.Token != "":
+		if cd.ExpiryDate != "" {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "expiry-date cannot be given with card-token"})
+			return
+		}
+		card, err := p.Vault.Card(merchantFrom(c).ID, cd.Token)
+		if errors.Is(err, vault.ErrTokenNotFound) {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid card token"})
+			return
+		}
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve card"})
+			return
+		}
+		cd.ExpiryDate = card.ExpiryDate
+		cd.Brand = card.Brand
 	}
 
 	// Validate the payment data using the ValidatePayment function
 	isValid, message := payments.ValidatePayment(cd)
 	if isValid {
-		// If the payment data is valid, call the MakePayment method of the PaymentGatewayService
-		paymentId := p.MakePayment(cd)
+		// If the payment data is valid, either take the payment now or only authorise it for a later capture
+		makePayment := p.MakePayment
+		if body.Capture != nil && !*body.Capture {
+			makePayment = p.AuthorisePayment
+		}
+		paymentId, err := makePayment(c.Request.Context(), merchantFrom(c).ID, cd)
+		if errors.Is(err, vault.ErrTokenNotFound) {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid card token"})
+			return
+		}
+		if status, message, ok := bankErrorResponse(err); ok {
+			// The bank gave no answer, the payment has been recorded as failed so it can still be looked up
+			keepUnknownOutcome(c, err)
+			c.IndentedJSON(status, gin.H{"error": message, "uuid": uuid.UUID(paymentId).String()})
+			return
+		}
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not store payment"})
+			return
+		}
 		// Respond with the generated UUID for the payment
 		c.IndentedJSON(http.StatusOK, gin.H{"uuid": uuid.UUID(paymentId).String()})
 		return
@@ -55,10 +160,13 @@ func HandlePostPayment(c *gin.Context, p *payments.PaymentGatewayService) {
 // @Description Get payment information by UUID
 // @ID get-payment-by-uuid
 // @Produce json
+// @Security ApiKeyAuth
 // @Param uuid path string true "Payment UUID"
 // @Success 200 {object} GetResponse
 // @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
 // @Router /findpayment/{uuid} [get]
 func HandleGetPayment(c *gin.Context, p *payments.PaymentGatewayService) {
 	// Parse the UUID parameter from the request URL
@@ -72,14 +180,13 @@ func HandleGetPayment(c *gin.Context, p *payments.PaymentGatewayService) {
 	paymentId := data.PaymentID(u)
 
 	// Call the GetPayment method of the PaymentGatewayService to retrieve payment information
-	if ok, bankPaymentStatus, maskedCardData := p.GetPayment(paymentId); ok {
-		c.IndentedJSON(http.StatusOK, gin.H{
-			"bank-payment-status": bankPaymentStatus,
-			"amount":              maskedCardData.Amount,
-			"currency":            maskedCardData.Currency,
-			"card-number-masked":  maskedCardData.CardNumber,
-			"expiry-date":         maskedCardData.ExpiryDate,
-		})
+	ok, payment, err := p.GetPayment(merchantFrom(c).ID, paymentId)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve payment"})
+		return
+	}
+	if ok {
+		respondWithPayment(c, p, payment)
 		return
 	}
 
@@ -87,6 +194,550 @@ func HandleGetPayment(c *gin.Context, p *payments.PaymentGatewayService) {
 	c.IndentedJSON(http.StatusNotFound, gin.H{"error": "payment not found"})
 }
 
+// Page sizes of GET /payments.
+const (
+	defaultPaymentsLimit = 20  // How many payments are listed when no limit is given
+	maxPaymentsLimit     = 100 // The most payments that can be listed at once
+)
+
+// @Summary List and search payments
+// @Description List the merchant's payments, newest first unless order is oldest, filtered by any of the query parameters. The list is paged: when there are more payments next-cursor is returned, which is given as cursor, along with the same filters and order, to list the next page
+// @ID list-payments
+// @Produce json
+// @Security ApiKeyAuth
+// @Param status query string false "Only payments in these states, separated by commas, e.g. captured,refunded"
+// @Param currency query string false "Only payments in this currency"
+// @Param min-amount query string false "Only payments of at least this amount, given along with currency"
+// @Param max-amount query string false "Only payments of at most this amount, given along with currency"
+// @Param created-from query string false "Only payments created at or after this time, in RFC 3339 format"
+// @Param created-to query string false "Only payments created before this time, in RFC 3339 format"
+// @Param last-four query string false "Only payments made with a card ending in these four digits"
+// @Param brand query string false "Only payments made with a card of this scheme, e.g. Visa, in any case"
+// @Param order query string false "newest (default) or oldest first"
+// @Param limit query int false "The most payments listed, 20 by default and at most 100"
+// @Param cursor query string false "The next-cursor of the previous page"
+// @Success 200 {object} PaymentListResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /payments [get]
+func HandleListPayments(c *gin.Context, p *payments.PaymentGatewayService) {
+	query, message := paymentQuery(c)
+	if message != "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		return
+	}
+	found, next, err := p.SearchPayments(merchantFrom(c).ID, query)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not list payments"})
+		return
+	}
+	response := PaymentListResponse{Payments: make([]PaymentSummaryResponse, 0, len(found))}
+	for _, payment := range found {
+		response.Payments = append(response.Payments, paymentSummaryResponse(payment))
+	}
+	if next != nil {
+		response.NextCursor = encodeCursor(*next, query.Oldest)
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// paymentQuery builds the query of GET /payments from the request's query parameters, returning
+// the message to respond with when any of them are invalid.
+func paymentQuery(c *gin.Context) (data.PaymentQuery, string) {
+	query := data.PaymentQuery{Limit: defaultPaymentsLimit}
+	if status := c.Query("status"); status != "" {
+		for _, state := range strings.Split(status, ",") {
+			if !validState(data.PaymentState(state)) {
+				return query, "Invalid status"
+			}
+			query.States = append(query.States, data.PaymentState(state))
+		}
+	}
+	if currency := c.Query("currency"); currency != "" {
+		normalised, ok := money.NormaliseCurrency(currency)
+		if !ok {
+			return query, "Invalid currency"
+		}
+		query.Currency = normalised
+	}
+	// Amounts are compared in minor units, which depend on the currency
+	for _, bound := range []struct {
+		param string
+		value **int64
+	}{{"min-amount", &query.MinAmount}, {"max-amount", &query.MaxAmount}} {
+		amount := c.Query(bound.param)
+		if amount == "" {
+			continue
+		}
+		if query.Currency == "" {
+			return query, "currency must be given with min-amount and max-amount"
+		}
+		parsed, err := money.Parse(amount, query.Currency)
+		if err != nil {
+			return query, "Invalid " + bound.param
+		}
+		*bound.value = &parsed.MinorUnits
+	}
+	for _, bound := range []struct {
+		param string
+		value *time.Time
+	}{{"created-from", &query.CreatedFrom}, {"created-to", &query.CreatedTo}} {
+		if at := c.Query(bound.param); at != "" {
+			parsed, err := time.Parse(time.RFC3339, at)
+			if err != nil {
+				return query, "Invalid " + bound.param
+			}
+			*bound.value = parsed.UTC()
+		}
+	}
+	if lastFour := c.Query("last-four"); lastFour != "" {
+		if len(lastFour) != 4 || strings.Trim(lastFour, "0123456789") != "" {
+			return query, "Invalid last-four"
+		}
+		query.CardLastFour = lastFour
+	}
+	if name := c.Query("brand"); name != "" {
+		// Payments are stored with the brand's own name, which the filter is given in any case
+		brand, ok := validation.LookupCardBrand(name)
+		if !ok {
+			return query, "Invalid brand"
+		}
+		query.Brand = brand.Name
+	}
+	switch c.DefaultQuery("order", "newest") {
+	case "newest":
+	case "oldest":
+		query.Oldest = true
+	default:
+		return query, "Invalid order"
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPaymentsLimit {
+			return query, "Invalid limit"
+		}
+		query.Limit = n
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		after, ok := decodeCursor(cursor, query.Oldest)
+		if !ok {
+			return query, "Invalid cursor"
+		}
+		query.After = &after
+	}
+	return query, ""
+}
+
+// validState reports whether the state is one a payment can be in.
+func validState(state data.PaymentState) bool {
+	for _, s := range data.States {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeCursor returns the opaque form of a cursor given to merchants, which holds the order it
+// was made for so it cannot be used to page through the payments in the other order.
+func encodeCursor(cursor data.PaymentCursor, oldest bool) string {
+	order := "n"
+	if oldest {
+		order = "o"
+	}
+	// Payments recorded before their creation time was kept have none, which is held as 0
+	var createdAt int64
+	if !cursor.CreatedAt.IsZero() {
+		createdAt = cursor.CreatedAt.UnixNano()
+	}
+	raw := fmt.Sprintf("%s:%d:%s", order, createdAt, uuid.UUID(cursor.PaymentID))
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor returns the cursor given in its opaque form by encodeCursor, and whether it is
+// a valid cursor for the order.
+func decodeCursor(encoded string, oldest bool) (data.PaymentCursor, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return data.PaymentCursor{}, false
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 || (parts[0] == "o") != oldest || parts[0] != "o" && parts[0] != "n" {
+		return data.PaymentCursor{}, false
+	}
+	createdAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return data.PaymentCursor{}, false
+	}
+	paymentId, err := uuid.Parse(parts[2])
+	if err != nil {
+		return data.PaymentCursor{}, false
+	}
+	cursor := data.PaymentCursor{PaymentID: data.PaymentID(paymentId)}
+	if createdAt != 0 {
+		cursor.CreatedAt = time.Unix(0, createdAt).UTC()
+	}
+	return cursor, true
+}
+
+// paymentSummaryResponse converts a payment into the JSON representation it is listed with.
+func paymentSummaryResponse(payment data.Payment) PaymentSummaryResponse {
+	return PaymentSummaryResponse{
+		Uuid:              uuid.UUID(payment.PaymentID).String(),
+		State:             string(payment.State),
+		BankPaymentStatus: string(payment.BankPaymentStatus),
+		Amount:            json.Number(payment.Amount.String()),
+		AmountCaptured:    json.Number(payment.CapturedAmount.String()),
+		AmountRefundable:  json.Number(payment.RefundableAmount().String()),
+		Currency:          payment.Amount.Currency,
+		MaskCardNumber:    payment.MaskedCardNumber(),
+		CardBrand:         payment.Brand,
+		InitiatedBy:       string(payment.Initiator),
+		CustomerID:        payment.CustomerID,
+		CreatedAt:         payment.CreatedAt,
+	}
+}
+
+// @Summary Capture an authorised payment
+// @Description Capture the funds of a payment made with capture set to false. The amount can be less than the authorised amount, or left out to capture it in full
+// @ID capture-payment
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param uuid path string true "Payment UUID"
+// @Param captureData body CaptureJsonRequest false "Amount to capture"
+// @Param Idempotency-Key header string false "Unique key for the capture, retries with the same key and body replay the original response"
+// @Success 200 {object} GetResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 402 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 502 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /payments/{uuid}/capture [post]
+func HandleCapturePayment(c *gin.Context, p *payments.PaymentGatewayService) {
+	// Parse the UUID parameter from the request URL
+	u, err := uuid.Parse(c.Param("uuid"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid uuid"})
+		return
+	}
+
+	// The body is optional, without one the payment is captured in full
+	var body CaptureJsonRequest
+	if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid json body"})
+		return
+	}
+
+	payment, err := p.CapturePayment(c.Request.Context(), merchantFrom(c).ID, data.PaymentID(u), body.Amount.String())
+	if err != nil {
+		respondWithPaymentError(c, err)
+		return
+	}
+	respondWithPayment(c, p, payment)
+}
+
+// @Summary Void an authorised payment
+// @Description Cancel a payment made with capture set to false before it is captured, releasing the authorised funds
+// @ID void-payment
+// @Produce json
+// @Security ApiKeyAuth
+// @Param uuid path string true "Payment UUID"
+// @Param Idempotency-Key header string false "Unique key for the void, retries with the same key replay the original response"
+// @Success 200 {object} GetResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 402 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 502 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /payments/{uuid}/void [post]
+func HandleVoidPayment(c *gin.Context, p *payments.PaymentGatewayService) {
+	// Parse the UUID parameter from the request URL
+	u, err := uuid.Parse(c.Param("uuid"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid uuid"})
+		return
+	}
+
+	payment, err := p.VoidPayment(c.Request.Context(), merchantFrom(c).ID, data.PaymentID(u))
+	if err != nil {
+		respondWithPaymentError(c, err)
+		return
+	}
+	respondWithPayment(c, p, payment)
+}
+
+// @Summary Refund a payment
+// @Description Give back some, or all, of a captured payment. A payment can be refunded many times, as long as the refunds add up to no more than was captured. The amount can be left out to refund everything not already refunded
+// @ID refund-payment
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param uuid path string true "Payment UUID"
+// @Param refundData body RefundJsonRequest false "Amount to refund"
+// @Param Idempotency-Key header string false "Unique key for the refund, retries with the same key and body replay the original response"
+// @Success 201 {object} RefundResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 402 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 502 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Router /payments/{uuid}/refunds [post]
+func HandleRefundPayment(c *gin.Context, p *payments.PaymentGatewayService) {
+	// Parse the UUID parameter from the request URL
+	u, err := uuid.Parse(c.Param("uuid"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid uuid"})
+		return
+	}
+
+	// The body is optional, without one everything not already refunded is refunded
+	var body RefundJsonRequest
+	if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid json body"})
+		return
+	}
+
+	refund, _, err := p.RefundPayment(c.Request.Context(), merchantFrom(c).ID, data.PaymentID(u), body.Amount.String())
+	if err != nil {
+		respondWithPaymentError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, refundResponse(refund))
+}
+
+// @Summary Health of the gateway
+// @Description Reports whether the gateway is up, and the state of the circuit breaker in front of each acquiring bank. The status is degraded while any breaker is not closed
+// @ID health
+// @Produce json
+// @Success 200 {object} HealthResponse
+// @Router /health [get]
+func HandleHealth(c *gin.Context, p *payments.PaymentGatewayService) {
+	response := HealthResponse{Status: "ok", Acquirers: []bank.Health{}}
+	// Only Bankers with a circuit breaker can report on the health of their banks
+	if reporter, ok := p.Banker.(bank.HealthReporter); ok {
+		response.Acquirers = reporter.Health()
+	}
+	for _, acquirer := range response.Acquirers {
+		if acquirer.State != bank.BreakerClosed {
+			response.Status = "degraded"
+		}
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// @Summary Receive a decision on a pending payment
+// @Description Called by an acquiring bank with its decision on a payment it answered as pending. The notification is signed with the secret shared with the bank, in the same way as requests to it, and a decision that was already recorded is accepted again
+// @ID bank-notification
+// @Accept json
+// @Produce json
+// @Param X-Bank-Timestamp header string true "Unix time in seconds when the notification was signed"
+// @Param X-Bank-Signature header string true "Hex encoded HMAC-SHA256 of the notification"
+// @Param notification body bank.Notification true "Decision on the payment"
+// @Success 204
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /bank/notifications [post]
+func HandleBankNotification(c *gin.Context, p *payments.PaymentGatewayService) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid notification"})
+		return
+	}
+
+	// The notification must be signed by one of the acquirers, which is the only one it can be about
+	acquirer, ok := signedBy(p.BankSecrets, c.GetHeader(bank.TimestampHeader), c.GetHeader(bank.SignatureHeader), c.Request.URL.Path, body)
+	if !ok {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+		return
+	}
+
+	var notification bank.Notification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid notification"})
+		return
+	}
+	paymentId, err := uuid.Parse(notification.Reference)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid reference"})
+		return
+	}
+	bpid, err := uuid.Parse(notification.ID)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+	if notification.Status != "Success" && notification.Status != "Failure" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+
+	if _, err := p.CompletePendingPayment(acquirer, data.PaymentID(paymentId), data.BankPaymentID(bpid), data.BankPaymentStatus(notification.Status)); err != nil {
+		respondWithPaymentError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// signedBy returns the name of the acquirer whose secret a notification is signed with, and
+// whether there is one.
+func signedBy(secrets map[string][]byte, timestamp, signature, path string, body []byte) (string, bool) {
+	for acquirer, secret := range secrets {
+		if bank.VerifySignature(secret, timestamp, signature, http.MethodPost, path, body, bank.MaxSignatureAge) {
+			return acquirer, true
+		}
+	}
+	return "", false
+}
+
+// respondWithPaymentError maps an error from an operation on an existing payment to its HTTP response.
+func respondWithPaymentError(c *gin.Context, err error) {
+	if status, message, ok := bankErrorResponse(err); ok {
+		keepUnknownOutcome(c, err)
+		c.IndentedJSON(status, gin.H{"error": message})
+		return
+	}
+	switch {
+	case errors.Is(err, data.ErrPaymentNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "payment not found"})
+	case errors.Is(err, payments.ErrInvalidAmount):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+	case errors.Is(err, payments.ErrAmountExceedsCapture):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Amount exceeds the authorised amount"})
+	case errors.Is(err, payments.ErrAmountExceedsRefund):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Amount exceeds the refundable amount"})
+	case errors.Is(err, payments.ErrInvalidState):
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": "Payment is not in a state that allows this operation"})
+	case errors.Is(err, payments.ErrAuthorisationExpired):
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": "Payment authorisation has expired"})
+	case errors.Is(err, payments.ErrDeclinedByBank):
+		c.IndentedJSON(http.StatusPaymentRequired, gin.H{"error": "Declined by the bank"})
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not update payment"})
+	}
+}
+
+// bankErrorResponse returns the HTTP status and message for an error from the bank, and false if
+// the error did not come from the bank. Declines are answers rather than errors, so never get here.
+func bankErrorResponse(err error) (int, string, bool) {
+	switch {
+	case errors.Is(err, bank.ErrInvalidRequest):
+		return http.StatusBadRequest, "The bank rejected the request as invalid", true
+	case errors.Is(err, bank.ErrNetwork):
+		return http.StatusBadGateway, "Could not reach the bank", true
+	case errors.Is(err, bank.ErrCircuitOpen):
+		return http.StatusServiceUnavailable, "Acquirer unavailable", true
+	case errors.Is(err, bank.ErrUnavailable):
+		return http.StatusServiceUnavailable, "The bank is unavailable", true
+	case errors.Is(err, bank.ErrTimeout):
+		return http.StatusGatewayTimeout, "Timed out waiting for the bank", true
+	}
+	return 0, "", false
+}
+
+// keepUnknownOutcome keeps the response to a request the bank gave no answer to, when it may
+// still have acted on it, so a retry with the same Idempotency-Key is answered with the same
+// response rather than sending the request to the bank a second time. Errors where the bank
+// is known to have done nothing are left for the request to be retried.
+func keepUnknownOutcome(c *gin.Context, err error) {
+	if errors.Is(err, bank.ErrTimeout) || errors.Is(err, bank.ErrNetwork) {
+		keepResponse(c)
+	}
+}
+
+// respondWithPayment responds with the payment, along with the expiry date of its card, which
+// is only kept, encrypted, by the vault.
+func respondWithPayment(c *gin.Context, p *payments.PaymentGatewayService, payment data.Payment) {
+	var card vault.Card
+	// Payments made before cards were tokenised have no card in the vault
+	if payment.CardToken != "" {
+		var err error
+		card, err = p.Vault.Card(payment.MerchantID, payment.CardToken)
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve card"})
+			return
+		}
+	}
+	c.IndentedJSON(http.StatusOK, paymentResponse(payment, card))
+}
+
+// paymentResponse converts a payment, and the vault's card it was made with, into its JSON representation.
+func paymentResponse(payment data.Payment, card vault.Card) gin.H {
+	// Convert the state history into its JSON representation
+	history := make([]StateTransitionResponse, 0, len(payment.History))
+	for _, transition := range payment.History {
+		history = append(history, StateTransitionResponse{From: string(transition.From), To: string(transition.To), At: transition.At})
+	}
+	// Convert the refunds into their JSON representation
+	refunds := make([]RefundResponse, 0, len(payment.Refunds))
+	for _, refund := range payment.Refunds {
+		refunds = append(refunds, refundResponse(refund))
+	}
+	response := gin.H{
+		"state":               payment.State,
+		"history":             history,
+		"bank-payment-status": payment.BankPaymentStatus,
+		"amount":              json.Number(payment.Amount.String()),
+		"amount-captured":     json.Number(payment.CapturedAmount.String()),
+		"amount-refundable":   json.Number(payment.RefundableAmount().String()),
+		"bank-attempts":       payment.BankAttempts,
+		"refunds":             refunds,
+		"currency":            payment.Amount.Currency,
+		"card-number-masked":  payment.MaskedCardNumber(),
+		"card-brand":          payment.Brand,
+	}
+	// Payments made before customers could save cards have no initiator recorded
+	if payment.Initiator != "" {
+		response["initiated-by"] = payment.Initiator
+	}
+	if payment.CustomerID != "" {
+		response["customer-id"] = payment.CustomerID
+	}
+	// Payments made before cards were tokenised have no token
+	if payment.CardToken != "" {
+		response["card-token"] = payment.CardToken
+		response["expiry-date"] = card.ExpiryDate
+	}
+	// Only an authorised payment that is waiting to be captured can expire
+	if payment.State == data.StateAuthorised {
+		response["authorisation-expires-at"] = payment.AuthorisationExpiry
+	}
+	// The acquirer is only known when payments are routed between several
+	if payment.Acquirer != "" {
+		response["acquirer"] = payment.Acquirer
+	}
+	return response
+}
+
+// refundResponse converts a refund into its JSON representation.
+func refundResponse(refund data.Refund) RefundResponse {
+	return RefundResponse{
+		RefundID:     uuid.UUID(refund.RefundID).String(),
+		BankRefundID: uuid.UUID(refund.BankRefundID).String(),
+		Status:       string(refund.Status),
+		Amount:       json.Number(refund.Amount.String()),
+		Currency:     refund.Amount.Currency,
+		CreatedAt:    refund.CreatedAt,
+		BankAttempts: refund.BankAttempts,
+	}
+}
+
 // swagger:model
 type PostResponse struct {
 	Uuid uuid.UUID `json:"uuid"`
@@ -94,23 +745,97 @@ type PostResponse struct {
 
 // swagger:model
 type GetResponse struct {
-	BankPaymentStatus string  `json:"bank-payment-status" example:"Success"`
-	Amount            float64 `json:"amount" example:"100.00"`
-	Currency          string  `json:"currency" example:"GBP"`
-	MaskCardNumber    string  `json:"card-number-masked" example:"****5070"`
-	ExpiryDate        string  `json:"expiry-date" example:"11/26"`
+	State             string                    `json:"state" example:"captured"`
+	History           []StateTransitionResponse `json:"history"`
+	BankPaymentStatus string                    `json:"bank-payment-status" example:"Success"`
+	Amount            json.Number               `json:"amount" example:"100.00" swaggertype:"number"`
+	AmountCaptured    json.Number               `json:"amount-captured" example:"100.00" swaggertype:"number"`
+	AuthorisedUntil   *time.Time                `json:"authorisation-expires-at,omitempty" example:"2023-08-08T12:00:00Z"`
+	AmountRefundable  json.Number               `json:"amount-refundable" example:"75.00" swaggertype:"number"`
+	BankAttempts      int                       `json:"bank-attempts" example:"1"`
+	Acquirer          string                    `json:"acquirer,omitempty" example:"acquirer-a"`
+	Refunds           []RefundResponse          `json:"refunds"`
+	Currency          string                    `json:"currency" example:"GBP"`
+	MaskCardNumber    string                    `json:"card-number-masked" example:"****5070"`
+	CardToken         string                    `json:"card-token,omitempty" example:"tok_4f1c2b3a5d6e7f8091a2b3c4d5e6f708"`
+	CardBrand         string                    `json:"card-brand" example:"Visa"`
+	ExpiryDate        string                    `json:"expiry-date,omitempty" example:"11/26"`
+	InitiatedBy       string                    `json:"initiated-by,omitempty" example:"customer"`
+	CustomerID        string                    `json:"customer-id,omitempty" example:"5b0f1d8e-3c2a-4e7b-9f61-0a8d2c4e6b13"`
+}
+
+// swagger:model
+type PaymentListResponse struct {
+	Payments   []PaymentSummaryResponse `json:"payments"`
+	NextCursor string                   `json:"next-cursor,omitempty" example:"bjoxNjkxMDAwMDAwMDAwMDAwMDAwOjNmMmI..."` // Only returned when there are more payments
+}
+
+// swagger:model
+type PaymentSummaryResponse struct {
+	Uuid              string      `json:"uuid" example:"8d3c1f0e-2b4a-4c5d-9e6f-7a8b9c0d1e2f"`
+	State             string      `json:"state" example:"captured"`
+	BankPaymentStatus string      `json:"bank-payment-status" example:"Success"`
+	Amount            json.Number `json:"amount" example:"100.00" swaggertype:"number"`
+	AmountCaptured    json.Number `json:"amount-captured" example:"100.00" swaggertype:"number"`
+	AmountRefundable  json.Number `json:"amount-refundable" example:"75.00" swaggertype:"number"`
+	Currency          string      `json:"currency" example:"GBP"`
+	MaskCardNumber    string      `json:"card-number-masked" example:"****5070"`
+	CardBrand         string      `json:"card-brand" example:"Visa"`
+	InitiatedBy       string      `json:"initiated-by,omitempty" example:"customer"`
+	CustomerID        string      `json:"customer-id,omitempty"`
+	CreatedAt         time.Time   `json:"created-at" example:"2023-08-01T12:00:00Z"`
+}
+
+// swagger:model
+type StateTransitionResponse struct {
+	From string    `json:"from" example:"authorised"`
+	To   string    `json:"to" example:"captured"`
+	At   time.Time `json:"at" example:"2023-08-01T12:00:00Z"`
+}
+
+// swagger:model
+type RefundResponse struct {
+	RefundID     string      `json:"id" example:"6f1c5fa4-7a44-4c41-9d5e-2b7c0c1e8d3a"`
+	BankRefundID string      `json:"bank-refund-id" example:"0d9e3a8e-5b7f-4a3b-9a43-1c2d3e4f5a6b"`
+	Status       string      `json:"status" example:"Success"`
+	Amount       json.Number `json:"amount" example:"25.00" swaggertype:"number"`
+	Currency     string      `json:"currency" example:"GBP"`
+	CreatedAt    time.Time   `json:"created-at" example:"2023-08-02T12:00:00Z"`
+	BankAttempts int         `json:"bank-attempts" example:"1"`
+}
+
+// swagger:model
+type HealthResponse struct {
+	Status    string        `json:"status" example:"ok"`
+	Acquirers []bank.Health `json:"acquirers"`
 }
 
 // swagger:model
 type ErrorResponse struct {
 	Error string `json:"error"`
+	Uuid  string `json:"uuid,omitempty"` // Set when a payment was recorded before the error, so it can still be looked up
 }
 
 // PostJsonRequest represents the JSON data expected in POST requests for making a payment.
 type PostJsonRequest struct {
-	CardNumber string  `json:"card-number" example:"4032 0341 3083 5070" binding:"required"`
-	ExpiryDate string  `json:"expiry-date" example:"11/26" binding:"required"`
-	Amount     float64 `json:"amount" example:"100.00" binding:"required"`
-	Currency   string  `json:"currency" example:"GBP" binding:"required"`
-	Cvv        string  `json:"cvv" example:"975" binding:"required"`
+	CardNumber      string      `json:"card-number,omitempty" example:"4032 0341 3083 5070"` // Given along with expiry-date and cvv, or replaced by card-token
+	ExpiryDate      string      `json:"expiry-date,omitempty" example:"11/26"`
+	CardToken       string      `json:"card-token,omitempty"`                                                // The token of a card the merchant tokenised before, see POST /tokens
+	CustomerID      string      `json:"customer-id,omitempty"`                                               // Given along with payment-method-id to pay with a card the customer saved
+	PaymentMethodID string      `json:"payment-method-id,omitempty"`                                         // One of the customer's saved cards, see POST /customers/{id}/payment-methods
+	InitiatedBy     string      `json:"initiated-by,omitempty" example:"customer" enums:"customer,merchant"` // Defaults to customer, merchant charges a saved card while the customer is not there
+	Amount          json.Number `json:"amount" example:"100.00" binding:"required" swaggertype:"number"`     // Kept as the literal decimal so it is never rounded
+	Currency        string      `json:"currency" example:"GBP" binding:"required"`
+	Cvv             string      `json:"cvv,omitempty" example:"975"`      // Optional with card-token or payment-method-id, and left out when initiated-by is merchant
+	Capture         *bool       `json:"capture,omitempty" example:"true"` // Defaults to true, false only authorises the payment
+}
+
+// CaptureJsonRequest represents the JSON data accepted when capturing a payment.
+type CaptureJsonRequest struct {
+	Amount json.Number `json:"amount,omitempty" example:"50.00" swaggertype:"number"` // Left out to capture the full authorised amount
+}
+
+// RefundJsonRequest represents the JSON data accepted when refunding a payment.
+type RefundJsonRequest struct {
+	Amount json.Number `json:"amount,omitempty" example:"25.00" swaggertype:"number"` // Left out to refund everything not already refunded
 }
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"payment-gateway/idempotency"
+	"payment-gateway/merchants"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxIdempotencyKeyLength is the longest Idempotency-Key header value that is accepted.
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotentBodySize is the largest request body, in bytes, that is read to be hashed by
+// Idempotency. No request to the gateway needs to be anywhere near as large.
+const maxIdempotentBodySize = 1 << 20
+
+// responseRecorder is a gin.ResponseWriter that keeps a copy of the response body as it is written.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+// Write writes the data to the response and keeps a copy of it.
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// WriteString writes the string to the response and keeps a copy of it.
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// Idempotency returns middleware that honours the Idempotency-Key header. The response to the
+// first request with a key is stored and replayed for any retry with the same key and body,
+// retries arriving while the first request is still in flight wait for it to finish, and reusing
+// a key with a different body is rejected with a 409. Requests without the header are unaffected.
+// Keys are scoped to the authenticated merchant, so merchants can never collide with each other.
+func Idempotency(store *idempotency.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Idempotency-Key")
+		if header == "" {
+			c.Next()
+			return
+		}
+		if len(header) > maxIdempotencyKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			return
+		}
+		key := merchantFrom(c).ID + ":" + header
+
+		// Read the body so it can be hashed, then put it back for the handler
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIdempotentBodySize))
+		if err != nil && len(body) >= maxIdempotentBodySize {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body is too large"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid json body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(append([]byte(c.Request.Method+" "+c.Request.URL.Path+"\n"), body...))
+
+		first, response, err := store.Begin(c.Request.Context(), key, hash[:])
+		if errors.Is(err, idempotency.ErrKeyReused) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Idempotency-Key has already been used for a different request"})
+			return
+		}
+		if err != nil {
+			// The client went away while waiting for the original request to finish
+			c.Abort()
+			return
+		}
+		if !first {
+			// Replay the stored response rather than processing the request again
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(response.StatusCode, response.ContentType, response.Body)
+			c.Abort()
+			return
+		}
+
+		// A handler that panics releases the key, so retries are not left waiting on a request
+		// that will never finish, before the panic carries on to the recovery middleware
+		defer func() {
+			if r := recover(); r != nil {
+				store.Abandon(key)
+				panic(r)
+			}
+		}()
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		// Server errors are not stored, so the request can be retried once the problem has cleared,
+		// unless the bank may already have acted on the request, see keepResponse
+		if recorder.Status() >= http.StatusInternalServerError && !c.GetBool(keepResponseKey) {
+			store.Abandon(key)
+			return
+		}
+		store.Complete(key, idempotency.Response{
+			StatusCode:  recorder.Status(),
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+		})
+	}
+}
+
+// keepResponseKey is the key a handler sets in the gin.Context to have its response stored by
+// Idempotency even when it is a server error, see keepResponse.
+const keepResponseKey = "idempotency-keep-response"
+
+// keepResponse marks the response as the final answer to the request, even when it is a server
+// error, so Idempotency replays it to retries rather than letting them make the request again.
+// It is for errors the bank may have acted on regardless, where doing it again could charge twice.
+func keepResponse(c *gin.Context) {
+	c.Set(keepResponseKey, true)
+}
+
+// merchantKey is the key the authenticated merchant is stored under in the gin.Context.
+const merchantKey = "merchant"
+
+// Authenticate returns middleware that requires an "Authorization: Bearer <api key>" header
+// belonging to a registered merchant. The merchant is stored in the context for the handlers,
+// and requests without a valid key are rejected with a 401.
+func Authenticate(registry *merchants.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		apiKey := strings.TrimPrefix(header, "Bearer ")
+		merchant, ok := registry.Authenticate(apiKey)
+		if !ok || apiKey == header {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+			return
+		}
+		c.Set(merchantKey, merchant)
+		c.Next()
+	}
+}
+
+// merchantFrom returns the merchant authenticated for the request.
+func merchantFrom(c *gin.Context) merchants.Merchant {
+	merchant, _ := c.Get(merchantKey)
+	m, _ := merchant.(merchants.Merchant)
+	return m
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"payment-gateway/data"
+	"payment-gateway/payments"
+	"payment-gateway/validation"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Tokenise a card
+// @Description Exchange a card number and expiry date for a token, which can be given to /pay as card-token in place of the card. The card number is kept encrypted by the gateway, and the token can only be used by the merchant that created it
+// @ID create-card-token
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param cardData body CardTokenJsonRequest true "Card Data"
+// @Param Idempotency-Key header string false "Unique key for the token, retries with the same key and body replay the original response"
+// @Success 201 {object} CardTokenResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /tokens [post]
+func HandleCreateCardToken(c *gin.Context, p *payments.PaymentGatewayService) {
+	var body CardTokenJsonRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid json body"})
+		return
+	}
+	cardNumber := strings.ReplaceAll(body.CardNumber, " ", "")
+	if ok, message := payments.ValidateCard(cardNumber, body.ExpiryDate); !ok {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": message})
+		return
+	}
+	brand, _ := validation.DetectCardBrand(cardNumber)
+	card, err := p.Vault.Tokenise(merchantFrom(c).ID, cardNumber, body.ExpiryDate, brand.Name)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not store card"})
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, CardTokenResponse{
+		CardToken:      card.Token,
+		MaskCardNumber: data.StoredCard{CardLastFour: card.LastFour}.MaskedCardNumber(),
+		CardBrand:      card.Brand,
+		ExpiryDate:     card.ExpiryDate,
+	})
+}
+
+// CardTokenJsonRequest represents the JSON data expected in POST requests for tokenising a card.
+type CardTokenJsonRequest struct {
+	CardNumber string `json:"card-number" example:"4032 0341 3083 5070" binding:"required"`
+	ExpiryDate string `json:"expiry-date" example:"11/26" binding:"required"`
+}
+
+// swagger:model
+type CardTokenResponse struct {
+	CardToken      string `json:"card-token" example:"tok_4f1c2b3a5d6e7f8091a2b3c4d5e6f708"`
+	MaskCardNumber string `json:"card-number-masked" example:"****5070"`
+	CardBrand      string `json:"card-brand" example:"Visa"`
+	ExpiryDate     string `json:"expiry-date" example:"11/26"`
+}
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"payment-gateway/payments"
+	"payment-gateway/webhooks"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Register a webhook
+// @Description Register a URL to be sent a signed JSON event every time one of the merchant's payments changes state. The secret the events are signed with is only returned here
+// @ID create-webhook
+// @Accept json
+// @Produce json
+// @Security ApiKeyAuth
+// @Param webhookData body WebhookJsonRequest true "Webhook URL"
+// @Param Idempotency-Key header string false "Unique key for the webhook, retries with the same key and body replay the original response"
+// @Success 201 {object} WebhookResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /webhooks [post]
+func HandleCreateWebhook(c *gin.Context, p *payments.PaymentGatewayService) {
+	var body WebhookJsonRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid body"})
+		return
+	}
+	endpoint, err := p.Webhooks.AddEndpoint(merchantFrom(c).ID, body.URL)
+	if err != nil {
+		respondWithWebhookError(c, err)
+		return
+	}
+	response := webhookResponse(endpoint)
+	response.Secret = endpoint.Secret
+	c.IndentedJSON(http.StatusCreated, response)
+}
+
+// @Summary List webhooks
+// @Description List the merchant's webhooks, oldest first
+// @ID list-webhooks
+// @Produce json
+// @Security ApiKeyAuth
+// @Success 200 {array} WebhookResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /webhooks [get]
+func HandleListWebhooks(c *gin.Context, p *payments.PaymentGatewayService) {
+	endpoints, err := p.Webhooks.Endpoints(merchantFrom(c).ID)
+	if err != nil {
+		respondWithWebhookError(c, err)
+		return
+	}
+	response := make([]WebhookResponse, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		response = append(response, webhookResponse(endpoint))
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// @Summary Remove a webhook
+// @Description Stop sending events to one of the merchant's webhooks. Events already queued for it fail
+// @ID delete-webhook
+// @Security ApiKeyAuth
+// @Param id path string true "Webhook ID"
+// @Success 204
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /webhooks/{id} [delete]
+func HandleDeleteWebhook(c *gin.Context, p *payments.PaymentGatewayService) {
+	if err := p.Webhooks.RemoveEndpoint(merchantFrom(c).ID, c.Param("id")); err != nil {
+		respondWithWebhookError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary List webhook deliveries
+// @Description List the merchant's webhook deliveries with the given status, oldest first. By default the failed deliveries are listed, which were given up on after being retried and can be redelivered
+// @ID list-webhook-deliveries
+// @Produce json
+// @Security ApiKeyAuth
+// @Param status query string false "pending, delivered or failed (default)"
+// @Success 200 {array} DeliveryResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /webhooks/deliveries [get]
+func HandleListWebhookDeliveries(c *gin.Context, p *payments.PaymentGatewayService) {
+	status := webhooks.DeliveryStatus(c.DefaultQuery("status", string(webhooks.DeliveryFailed)))
+	if status != webhooks.DeliveryPending && status != webhooks.DeliveryDelivered && status != webhooks.DeliveryFailed {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+	deliveries, err := p.Webhooks.Deliveries(merchantFrom(c).ID, status)
+	if err != nil {
+		respondWithWebhookError(c, err)
+		return
+	}
+	response := make([]DeliveryResponse, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		response = append(response, deliveryResponse(delivery))
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// @Summary Redeliver a failed webhook delivery
+// @Description Send a failed delivery again straight away. The delivery is returned with the outcome, and stays failed if it fails again
+// @ID redeliver-webhook
+// @Produce json
+// @Security ApiKeyAuth
+// @Param id path string true "Delivery ID"
+// @Param Idempotency-Key header string false "Unique key for the redelivery, retries with the same key replay the original response"
+// @Success 200 {object} DeliveryResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /webhooks/deliveries/{id}/redeliver [post]
+func HandleRedeliverWebhook(c *gin.Context, p *payments.PaymentGatewayService) {
+	delivery, err := p.Webhooks.Redeliver(c.Request.Context(), merchantFrom(c).ID, c.Param("id"))
+	if err != nil {
+		respondWithWebhookError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, deliveryResponse(delivery))
+}
+
+// respondWithWebhookError maps an error from the webhooks Dispatcher to its HTTP response.
+func respondWithWebhookError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, webhooks.ErrInvalidURL):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid url, it must be an absolute http or https url"})
+	case errors.Is(err, webhooks.ErrPrivateURL):
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Invalid url, its host must only resolve to public addresses"})
+	case errors.Is(err, webhooks.ErrEndpointNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+	case errors.Is(err, webhooks.ErrDeliveryNotFound):
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": "delivery not found"})
+	case errors.Is(err, webhooks.ErrDeliveryNotFailed):
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": "Only failed deliveries can be redelivered"})
+	case errors.Is(err, webhooks.ErrDeliveryInProgress):
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": "Delivery is already being sent"})
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Could not update webhooks"})
+	}
+}
+
+// webhookResponse converts an endpoint into its JSON representation, without its secret.
+func webhookResponse(endpoint webhooks.Endpoint) WebhookResponse {
+	return WebhookResponse{ID: endpoint.ID, URL: endpoint.URL, CreatedAt: endpoint.CreatedAt}
+}
+
+// deliveryResponse converts a delivery into its JSON representation.
+func deliveryResponse(delivery webhooks.Delivery) DeliveryResponse {
+	response := DeliveryResponse{
+		ID:        delivery.ID,
+		WebhookID: delivery.EndpointID,
+		URL:       delivery.URL,
+		EventID:   delivery.EventID,
+		EventType: delivery.EventType,
+		Status:    string(delivery.Status),
+		Attempts:  delivery.Attempts,
+		LastError: delivery.LastError,
+		CreatedAt: delivery.CreatedAt,
+		Event:     json.RawMessage(delivery.Payload),
+	}
+	// Only a pending delivery is waiting to be sent again
+	if delivery.Status == webhooks.DeliveryPending {
+		nextAttempt := delivery.NextAttempt
+		response.NextAttemptAt = &nextAttempt
+	}
+	return response
+}
+
+// WebhookJsonRequest represents the JSON data expected in POST requests for registering a webhook.
+type WebhookJsonRequest struct {
+	URL string `json:"url" example:"https://merchant.example.com/webhooks" binding:"required"`
+}
+
+// swagger:model
+type WebhookResponse struct {
+	ID        string    `json:"id" example:"3b0b8a52-8f6e-4b2a-9d0c-3c5e7f1a2b4d"`
+	URL       string    `json:"url" example:"https://merchant.example.com/webhooks"`
+	Secret    string    `json:"secret,omitempty" example:"whsec_5f2b..."` // Only returned when the webhook is registered
+	CreatedAt time.Time `json:"created-at" example:"2023-08-01T12:00:00Z"`
+}
+
+// swagger:model
+type DeliveryResponse struct {
+	ID            string          `json:"id" example:"9a7c1e2d-4b5f-4c3a-8e6d-1f2a3b4c5d6e"`
+	WebhookID     string          `json:"webhook-id" example:"3b0b8a52-8f6e-4b2a-9d0c-3c5e7f1a2b4d"`
+	URL           string          `json:"url" example:"https://merchant.example.com/webhooks"`
+	EventID       string          `json:"event-id" example:"5d4c3b2a-1f0e-4d9c-8b7a-6f5e4d3c2b1a"`
+	EventType     string          `json:"event-type" example:"payment.captured"`
+	Status        string          `json:"status" example:"failed"`
+	Attempts      int             `json:"attempts" example:"8"`
+	NextAttemptAt *time.Time      `json:"next-attempt-at,omitempty" example:"2023-08-01T12:30:00Z"`
+	LastError     string          `json:"last-error,omitempty" example:"endpoint responded 500 Internal Server Error"`
+	CreatedAt     time.Time       `json:"created-at" example:"2023-08-01T12:00:00Z"`
+	Event         json.RawMessage `json:"event" swaggertype:"object"`
+}
@@ -1,26 +1,143 @@
 package bank
 
 import (
+	"context"
+	"errors"
 	"payment-gateway/data"
+	"payment-gateway/money"
 
 	"github.com/google/uuid"
 )
 
+// Errors returned by a Banker when the bank could not give an answer. These are kept separate
+// from declines, which are an answer, and are reported through the returned BankPaymentStatus.
+// Implementations wrap them with the detail of what went wrong, so check for them with errors.Is.
+var (
+	ErrNetwork        = errors.New("network failure talking to the bank")      // The request or its answer was lost, or the bank failed handling it, the outcome is unknown
+	ErrTimeout        = errors.New("timed out waiting for the bank")           // The bank did not answer before the context's deadline, the outcome is unknown
+	ErrUnavailable    = errors.New("the bank is unavailable")                  // The bank refused to handle the request, so nothing happened
+	ErrInvalidRequest = errors.New("the bank rejected the request as invalid") // The bank could not make sense of the request, so nothing happened
+	ErrNotFound       = errors.New("the bank has no such payment")             // The bank has no payment with the id or reference, so it never received it
+)
+
+// Error is a Banker error along with the underlying cause, so that both errors.Is(err, ErrNetwork)
+// and checks against the cause, such as errors.Is(err, syscall.ECONNREFUSED), can be made.
+type Error struct {
+	Kind error // One of the errors above
+	Err  error // What went wrong
+}
+
+// Error returns the kind of error followed by its cause.
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Is reports whether the target is the kind of the error.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the cause of the error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 // Bank represents a concrete implementation of the Banker interface.
 type Bank struct {
 	Banker // Embedding the Banker interface to satisfy the interface contract.
 }
 
-// Banker is the interface that defines the contract for a bank service.
+// Banker is the interface that defines the contract for a bank service. Every call takes a
+// context, whose deadline bounds how long the bank is waited on and whose cancellation abandons
+// the call. A decline is not an error: it is returned as a "Failure" status with a nil error.
+// An error means the bank gave no answer, and is one of the errors above. The bank can also
+// answer a new payment with a "Pending" status, giving its final answer later, either in a
+// notification or when asked with PaymentStatusFromBank. A new payment whose answer was lost is
+// looked up with PaymentStatusByReference, by the CallInfo reference it was sent with.
 type Banker interface {
-	MakePaymentToBank(cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID)
+	MakePaymentToBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error)
+	AuthorisePaymentWithBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error)
+	CapturePaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (data.BankPaymentStatus, error)
+	VoidPaymentWithBank(ctx context.Context, bpid data.BankPaymentID) (data.BankPaymentStatus, error)
+	RefundPaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (data.BankPaymentStatus, data.BankPaymentID, error)
+	PaymentStatusFromBank(ctx context.Context, bpid data.BankPaymentID) (data.BankPaymentStatus, error)
+	PaymentStatusByReference(ctx context.Context, reference string) (data.BankPaymentStatus, data.BankPaymentID, error)
 }
 
 // MakePaymentToBank simulates making a payment to the bank and receiving a response.
-// We get back a resonse message, as well as uuid for refernce, This Uuid is NOT the
-// Same as the payment uuid, and is simply a reference for the bank transaction
-func (b *Bank) MakePaymentToBank(cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID) {
+// In a real-world scenario, this function would interact with a bank's API.
+func (b *Bank) MakePaymentToBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", data.BankPaymentID{}, ContextError(err)
+	}
+	// In this simulation, we generate a random payment ID and set the status as "Success".
+	bankPaymentStatus := data.BankPaymentStatus("Success")
+	bankPaymentId := data.BankPaymentID(uuid.New())
+	return bankPaymentStatus, bankPaymentId, nil
+}
+
+// AuthorisePaymentWithBank simulates asking the bank to reserve the funds for a payment without
+// taking them. As with MakePaymentToBank, the returned uuid is the bank's reference for the
+// transaction, which is used to capture or void it later.
+func (b *Bank) AuthorisePaymentWithBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", data.BankPaymentID{}, ContextError(err)
+	}
 	bankPaymentStatus := data.BankPaymentStatus("Success")
 	bankPaymentId := data.BankPaymentID(uuid.New())
-	return bankPaymentStatus, bankPaymentId
+	return bankPaymentStatus, bankPaymentId, nil
+}
+
+// CapturePaymentWithBank simulates asking the bank to take some, or all, of the funds it
+// reserved for an authorised payment.
+func (b *Bank) CapturePaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (data.BankPaymentStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return "", ContextError(err)
+	}
+	return data.BankPaymentStatus("Success"), nil
+}
+
+// VoidPaymentWithBank simulates asking the bank to release the funds it reserved for an
+// authorised payment.
+func (b *Bank) VoidPaymentWithBank(ctx context.Context, bpid data.BankPaymentID) (data.BankPaymentStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return "", ContextError(err)
+	}
+	return data.BankPaymentStatus("Success"), nil
+}
+
+// RefundPaymentWithBank simulates asking the bank to give back some, or all, of the funds it
+// captured for a payment. The returned uuid is the bank's reference for the refund.
+func (b *Bank) RefundPaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", data.BankPaymentID{}, ContextError(err)
+	}
+	return data.BankPaymentStatus("Success"), data.BankPaymentID(uuid.New()), nil
+}
+
+// PaymentStatusFromBank simulates asking the bank for the status of a payment it was sent.
+// Every payment made with the simulation succeeds, so it is never left pending.
+func (b *Bank) PaymentStatusFromBank(ctx context.Context, bpid data.BankPaymentID) (data.BankPaymentStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return "", ContextError(err)
+	}
+	return data.BankPaymentStatus("Success"), nil
+}
+
+// PaymentStatusByReference simulates asking the bank for the status of a payment by the reference
+// it was sent with. Every payment made with the simulation succeeds, so it is found approved.
+func (b *Bank) PaymentStatusByReference(ctx context.Context, reference string) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	if err := ctx.Err(); err != nil {
+		return "", data.BankPaymentID{}, ContextError(err)
+	}
+	return data.BankPaymentStatus("Success"), data.BankPaymentID(uuid.New()), nil
+}
+
+// ContextError converts the error of a finished context into a Banker error. A passed deadline
+// is a timeout, while a cancelled call is reported as is, as nobody is waiting for its answer.
+func ContextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &Error{Kind: ErrTimeout, Err: err}
+	}
+	return err
 }
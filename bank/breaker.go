@@ -0,0 +1,209 @@
+package bank
+
+import (
+	"context"
+	"errors"
+	"payment-gateway/data"
+	"payment-gateway/money"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is the cause of the ErrUnavailable error returned by a CircuitBreaker that is
+// failing calls fast rather than sending them to a bank that is known to be failing.
+var ErrCircuitOpen = errors.New("acquirer unavailable")
+
+// BreakerState is a custom type representing the state of a CircuitBreaker.
+type BreakerState string
+
+// The states a CircuitBreaker can be in.
+const (
+	BreakerClosed   BreakerState = "closed"    // Calls are sent to the bank
+	BreakerOpen     BreakerState = "open"      // Calls fail fast without reaching the bank
+	BreakerHalfOpen BreakerState = "half-open" // A trial call is sent to the bank to see if it has recovered
+)
+
+// Health describes the health of an acquiring bank.
+type Health struct {
+	Acquirer            string       `json:"acquirer"`             // The name of the acquiring bank
+	State               BreakerState `json:"state"`                // The state of the circuit breaker in front of it
+	ConsecutiveFailures int          `json:"consecutive-failures"` // Failed calls since the last successful one
+}
+
+// HealthReporter is implemented by Bankers that can report the health of the banks behind them.
+type HealthReporter interface {
+	Health() []Health
+}
+
+// CircuitBreaker is a Banker that stops sending calls to the Banker it wraps once the bank has
+// failed FailureThreshold calls in a row, so that callers fail fast instead of piling up waiting
+// on a bank that is down. After the CoolDown a single trial call is let through: if it succeeds
+// calls flow again, otherwise the breaker opens for another CoolDown. Only failures to get an
+// answer count, declines and invalid requests are answers from a working bank.
+type CircuitBreaker struct {
+	Banker // Embedding the Banker that calls are sent to while the breaker is closed
+
+	Name             string           // The name of the acquiring bank, reported in its Health
+	FailureThreshold int              // Failed calls in a row that open the breaker
+	CoolDown         time.Duration    // How long the breaker stays open before a trial call
+	Clock            func() time.Time // Source of the current time, which tests can replace
+
+	state    BreakerState
+	failures int        // Failed calls since the last successful one
+	openedAt time.Time  // When the breaker last opened
+	trial    bool       // Whether a trial call is in flight while half-open
+	mu       sync.Mutex // Mutex to protect concurrent access to the breaker's state
+}
+
+// NewCircuitBreaker creates a CircuitBreaker in front of b, opening after failureThreshold
+// failed calls in a row and staying open for coolDown.
+func NewCircuitBreaker(name string, b Banker, failureThreshold int, coolDown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Banker:           b,
+		Name:             name,
+		FailureThreshold: failureThreshold,
+		CoolDown:         coolDown,
+		Clock:            time.Now,
+		state:            BreakerClosed,
+	}
+}
+
+// MakePaymentToBank makes the payment with the wrapped Banker, unless the breaker is open.
+func (c *CircuitBreaker) MakePaymentToBank(ctx context.Context, cd data.CardData) (status data.BankPaymentStatus, bpid data.BankPaymentID, err error) {
+	err = c.call(func() error {
+		status, bpid, err = c.Banker.MakePaymentToBank(ctx, cd)
+		return err
+	})
+	return status, bpid, err
+}
+
+// AuthorisePaymentWithBank authorises the payment with the wrapped Banker, unless the breaker is open.
+func (c *CircuitBreaker) AuthorisePaymentWithBank(ctx context.Context, cd data.CardData) (status data.BankPaymentStatus, bpid data.BankPaymentID, err error) {
+	err = c.call(func() error {
+		status, bpid, err = c.Banker.AuthorisePaymentWithBank(ctx, cd)
+		return err
+	})
+	return status, bpid, err
+}
+
+// CapturePaymentWithBank captures the payment with the wrapped Banker, unless the breaker is open.
+func (c *CircuitBreaker) CapturePaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (status data.BankPaymentStatus, err error) {
+	err = c.call(func() error {
+		status, err = c.Banker.CapturePaymentWithBank(ctx, bpid, amount)
+		return err
+	})
+	return status, err
+}
+
+// VoidPaymentWithBank voids the payment with the wrapped Banker, unless the breaker is open.
+func (c *CircuitBreaker) VoidPaymentWithBank(ctx context.Context, bpid data.BankPaymentID) (status data.BankPaymentStatus, err error) {
+	err = c.call(func() error {
+		status, err = c.Banker.VoidPaymentWithBank(ctx, bpid)
+		return err
+	})
+	return status, err
+}
+
+// RefundPaymentWithBank refunds the payment with the wrapped Banker, unless the breaker is open.
+func (c *CircuitBreaker) RefundPaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (status data.BankPaymentStatus, refundId data.BankPaymentID, err error) {
+	err = c.call(func() error {
+		status, refundId, err = c.Banker.RefundPaymentWithBank(ctx, bpid, amount)
+		return err
+	})
+	return status, refundId, err
+}
+
+// PaymentStatusFromBank asks the wrapped Banker for the status of the payment, unless the breaker is open.
+func (c *CircuitBreaker) PaymentStatusFromBank(ctx context.Context, bpid data.BankPaymentID) (status data.BankPaymentStatus, err error) {
+	err = c.call(func() error {
+		status, err = c.Banker.PaymentStatusFromBank(ctx, bpid)
+		return err
+	})
+	return status, err
+}
+
+// PaymentStatusByReference asks the wrapped Banker for the status of the payment sent with the
+// reference, unless the breaker is open.
+func (c *CircuitBreaker) PaymentStatusByReference(ctx context.Context, reference string) (status data.BankPaymentStatus, bpid data.BankPaymentID, err error) {
+	err = c.call(func() error {
+		status, bpid, err = c.Banker.PaymentStatusByReference(ctx, reference)
+		return err
+	})
+	return status, bpid, err
+}
+
+// Health reports the state of the breaker.
+func (c *CircuitBreaker) Health() []Health {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return []Health{{Acquirer: c.Name, State: c.currentState(), ConsecutiveFailures: c.failures}}
+}
+
+// call makes the call if the breaker allows it, and records how it went.
+func (c *CircuitBreaker) call(fn func() error) error {
+	ok, trial := c.allow()
+	if !ok {
+		return &Error{Kind: ErrUnavailable, Err: ErrCircuitOpen}
+	}
+	err := fn()
+	c.record(err, trial)
+	return err
+}
+
+// allow reports whether a call can be sent to the bank, and whether it is the trial call, which
+// it claims when half-open.
+func (c *CircuitBreaker) allow() (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.currentState() {
+	case BreakerClosed:
+		return true, false
+	case BreakerHalfOpen:
+		if c.trial {
+			return false, false
+		}
+		c.trial = true
+		return true, true
+	}
+	return false, false
+}
+
+// record updates the breaker with the outcome of a call, releasing the trial call if it was it.
+func (c *CircuitBreaker) record(err error, trial bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if trial {
+		c.trial = false
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The caller gave up on the call, so it says nothing about the bank. A cancelled trial
+		// leaves the breaker half-open for the next call to try
+		return
+	case !countsAsFailure(err):
+		// The bank answered, so it is working
+		c.failures = 0
+		c.state = BreakerClosed
+		return
+	}
+	c.failures++
+	if trial || c.failures >= c.FailureThreshold {
+		c.state = BreakerOpen
+		c.openedAt = c.Clock()
+	}
+}
+
+// currentState returns the state of the breaker, moving an open breaker to half-open once its
+// cool down has passed. It must be called with the mutex held.
+func (c *CircuitBreaker) currentState() BreakerState {
+	if c.state == BreakerOpen && c.Clock().Sub(c.openedAt) >= c.CoolDown {
+		c.state = BreakerHalfOpen
+	}
+	return c.state
+}
+
+// countsAsFailure reports whether an error from the bank means it is failing. Invalid requests
+// are the caller's fault, and a cancelled call was given up on by the caller, so neither count.
+func countsAsFailure(err error) bool {
+	return errors.Is(err, ErrNetwork) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrUnavailable)
+}
@@ -0,0 +1,26 @@
+package bank
+
+import "context"
+
+// CallInfo carries details of a call to the bank alongside its context. The caller sets the
+// details it knows before the call, and the Banker, or any Banker wrapping it, fills in the rest.
+type CallInfo struct {
+	Reference  string // Stable reference for the operation, sent to the bank as an idempotency key on every attempt
+	MerchantID string // The merchant the operation is for
+	Acquirer   string // The acquirer that made the payment, set by the AcquirerRouter for new payments
+	Attempts   int    // How many times the bank was called, set by the RetryingBank
+}
+
+// callInfoKey is the context key CallInfo is stored under.
+type callInfoKey struct{}
+
+// WithCallInfo returns a copy of ctx carrying info.
+func WithCallInfo(ctx context.Context, info *CallInfo) context.Context {
+	return context.WithValue(ctx, callInfoKey{}, info)
+}
+
+// CallInfoFrom returns the CallInfo carried by ctx, or nil if it has none.
+func CallInfoFrom(ctx context.Context) *CallInfo {
+	info, _ := ctx.Value(callInfoKey{}).(*CallInfo)
+	return info
+}
@@ -0,0 +1,276 @@
+package bank
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"payment-gateway/data"
+	"payment-gateway/money"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Headers used to sign requests to, and notifications from, the acquiring bank.
+const (
+	TimestampHeader = "X-Bank-Timestamp" // Unix time in seconds when the request was signed
+	SignatureHeader = "X-Bank-Signature" // Hex encoded HMAC-SHA256 of the request, see Sign
+)
+
+// IdempotencyHeader carries the CallInfo reference of a request to the bank, which the bank uses
+// to answer a repeated request with its original answer rather than acting on it twice.
+const IdempotencyHeader = "Idempotency-Key"
+
+// MaxSignatureAge is how far the timestamp of a signed request or notification can be from now
+// before it is rejected, which limits how long a captured message can be replayed for.
+const MaxSignatureAge = 5 * time.Minute
+
+// Notification is the body of a notification from the bank giving its decision on a payment it
+// answered as "Pending". The notification is signed with the secret shared with the bank, see Sign.
+type Notification struct {
+	Reference string `json:"reference"` // The CallInfo reference the payment was sent with, the gateway's id for it
+	ID        string `json:"id"`        // The bank's id for the payment
+	Status    string `json:"status"`    // The bank's decision, "Success" or "Failure"
+}
+
+// maxResponseSize is the largest response body read from the bank.
+const maxResponseSize = 1 << 20
+
+// HTTPBank is a Banker that talks JSON over HTTP to an acquiring bank. Every request is signed
+// with a secret shared with the bank, and connections are pooled and reused between calls.
+//
+// The bank's API is made up of the following endpoints, all of which take and return JSON:
+//
+//	POST /payments               {card-number, expiry-date, cvv, amount, currency, capture, initiator} -> {id, status}
+//	GET  /payments/{id}                                                                              -> {id, status}
+//	GET  /references/{reference}                                                                     -> {id, status}
+//	POST /payments/{id}/capture  {amount, currency}                                                  -> {status}
+//	POST /payments/{id}/void     {}                                                                  -> {status}
+//	POST /payments/{id}/refunds  {amount, currency}                                                  -> {id, status}
+//
+// The initiator is "customer" when the cardholder is there to make the payment, or "merchant"
+// when the merchant charges a card the cardholder saved with them, which is sent without a CVV.
+// Amounts are integers in the minor units of their currency. A decline is a 200 response with
+// a "Failure" status, and a payment the bank will decide on later has a "Pending" status. The
+// bank sends its decision to the gateway as a Notification, signed in the same way as requests. Any other response is an error: a 400 or 422 is an invalid request, a
+// 404 is a payment the bank does not have, a 503 is the bank being unavailable, and anything
+// else leaves the outcome unknown. A payment is looked up by reference, the idempotency key it
+// was sent with, when its answer was lost.
+type HTTPBank struct {
+	BaseURL string        // The URL the bank's API is served from, e.g. https://acquirer.example.com/v1
+	Timeout time.Duration // How long each call is waited on, zero waits for as long as the caller's context allows
+
+	secret []byte       // Secret shared with the bank, used to sign requests
+	client *http.Client // Client shared between calls, so its connections are pooled
+}
+
+// bankRequest is the body of a request to the bank. Fields not used by an endpoint are left out.
+type bankRequest struct {
+	CardNumber string `json:"card-number,omitempty"`
+	ExpiryDate string `json:"expiry-date,omitempty"`
+	Cvv        string `json:"cvv,omitempty"`
+	Amount     int64  `json:"amount,omitempty"`
+	Currency   string `json:"currency,omitempty"`
+	Capture    *bool  `json:"capture,omitempty"`
+	Initiator  string `json:"initiator,omitempty"` // "customer" or "merchant", who started the payment
+}
+
+// bankResponse is the body of a response from the bank.
+type bankResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// NewHTTPBank creates an HTTPBank for the bank's API at baseURL, signing requests with secret.
+// Each call is abandoned if the bank has not answered within timeout.
+func NewHTTPBank(baseURL string, secret []byte, timeout time.Duration) *HTTPBank {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Every request goes to the same host, so keep enough idle connections to it to avoid
+	// reconnecting under load
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 100
+	transport.IdleConnTimeout = 90 * time.Second
+	return &HTTPBank{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Timeout: timeout,
+		secret:  secret,
+		client:  &http.Client{Transport: transport},
+	}
+}
+
+// MakePaymentToBank asks the bank to authorise and capture the payment in one go.
+func (b *HTTPBank) MakePaymentToBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	return b.createPayment(ctx, cd, true)
+}
+
+// AuthorisePaymentWithBank asks the bank to reserve the funds for the payment without taking them.
+func (b *HTTPBank) AuthorisePaymentWithBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	return b.createPayment(ctx, cd, false)
+}
+
+// CapturePaymentWithBank asks the bank to take some, or all, of the funds it reserved for a payment.
+func (b *HTTPBank) CapturePaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (data.BankPaymentStatus, error) {
+	var resp bankResponse
+	err := b.call(ctx, http.MethodPost, "/payments/"+uuid.UUID(bpid).String()+"/capture", &bankRequest{Amount: amount.MinorUnits, Currency: amount.Currency}, &resp)
+	return data.BankPaymentStatus(resp.Status), err
+}
+
+// VoidPaymentWithBank asks the bank to release the funds it reserved for a payment.
+func (b *HTTPBank) VoidPaymentWithBank(ctx context.Context, bpid data.BankPaymentID) (data.BankPaymentStatus, error) {
+	var resp bankResponse
+	err := b.call(ctx, http.MethodPost, "/payments/"+uuid.UUID(bpid).String()+"/void", &bankRequest{}, &resp)
+	return data.BankPaymentStatus(resp.Status), err
+}
+
+// RefundPaymentWithBank asks the bank to give back some, or all, of the funds it captured for a payment.
+func (b *HTTPBank) RefundPaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	var resp bankResponse
+	if err := b.call(ctx, http.MethodPost, "/payments/"+uuid.UUID(bpid).String()+"/refunds", &bankRequest{Amount: amount.MinorUnits, Currency: amount.Currency}, &resp); err != nil {
+		return "", data.BankPaymentID{}, err
+	}
+	return parseCreated(resp)
+}
+
+// createPayment sends a new payment to the bank, to be captured straight away or only authorised.
+func (b *HTTPBank) createPayment(ctx context.Context, cd data.CardData, capture bool) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	req := bankRequest{
+		CardNumber: cd.CardNumber,
+		ExpiryDate: cd.ExpiryDate,
+		Cvv:        cd.Cvv,
+		Amount:     cd.Amount.MinorUnits,
+		Currency:   cd.Amount.Currency,
+		Capture:    &capture,
+		Initiator:  string(cd.Initiator),
+	}
+	var resp bankResponse
+	if err := b.call(ctx, http.MethodPost, "/payments", &req, &resp); err != nil {
+		return "", data.BankPaymentID{}, err
+	}
+	return parseCreated(resp)
+}
+
+// PaymentStatusFromBank asks the bank for the status of a payment, to learn its decision on a pending payment.
+func (b *HTTPBank) PaymentStatusFromBank(ctx context.Context, bpid data.BankPaymentID) (data.BankPaymentStatus, error) {
+	var resp bankResponse
+	err := b.call(ctx, http.MethodGet, "/payments/"+uuid.UUID(bpid).String(), nil, &resp)
+	return data.BankPaymentStatus(resp.Status), err
+}
+
+// PaymentStatusByReference asks the bank for the status of the payment sent with the reference,
+// to learn the outcome of a payment whose answer was lost. A payment the bank never received
+// returns ErrNotFound.
+func (b *HTTPBank) PaymentStatusByReference(ctx context.Context, reference string) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	var resp bankResponse
+	if err := b.call(ctx, http.MethodGet, "/references/"+url.PathEscape(reference), nil, &resp); err != nil {
+		return "", data.BankPaymentID{}, err
+	}
+	return parseCreated(resp)
+}
+
+// parseCreated reads the status and the bank's reference from the answer to a request that created something.
+func parseCreated(resp bankResponse) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	id, err := uuid.Parse(resp.ID)
+	if err != nil {
+		return "", data.BankPaymentID{}, &Error{Kind: ErrNetwork, Err: fmt.Errorf("invalid id in response: %w", err)}
+	}
+	return data.BankPaymentStatus(resp.Status), data.BankPaymentID(id), nil
+}
+
+// call signs and sends a request to the bank, and decodes its answer into resp. A request
+// without a body is sent with an empty one.
+func (b *HTTPBank) call(ctx context.Context, method, path string, req *bankRequest, resp *bankResponse) error {
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+
+	var body []byte
+	if req != nil {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return &Error{Kind: ErrInvalidRequest, Err: err}
+		}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, b.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return &Error{Kind: ErrInvalidRequest, Err: err}
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(TimestampHeader, timestamp)
+	httpReq.Header.Set(SignatureHeader, Sign(b.secret, timestamp, method, httpReq.URL.Path, body))
+	// The reference is the same on every attempt at the operation, so the bank can spot a repeat
+	if info := CallInfoFrom(ctx); info != nil && info.Reference != "" {
+		httpReq.Header.Set(IdempotencyHeader, info.Reference)
+	}
+
+	httpResp, err := b.client.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ContextError(ctx.Err())
+		}
+		return &Error{Kind: ErrNetwork, Err: err}
+	}
+	defer httpResp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(httpResp.Body, maxResponseSize))
+	if err != nil {
+		if ctx.Err() != nil {
+			return ContextError(ctx.Err())
+		}
+		return &Error{Kind: ErrNetwork, Err: err}
+	}
+
+	switch {
+	case httpResp.StatusCode == http.StatusBadRequest || httpResp.StatusCode == http.StatusUnprocessableEntity:
+		return &Error{Kind: ErrInvalidRequest, Err: fmt.Errorf("bank responded %s", httpResp.Status)}
+	case httpResp.StatusCode == http.StatusNotFound:
+		return &Error{Kind: ErrNotFound, Err: fmt.Errorf("bank responded %s", httpResp.Status)}
+	case httpResp.StatusCode == http.StatusServiceUnavailable:
+		return &Error{Kind: ErrUnavailable, Err: fmt.Errorf("bank responded %s", httpResp.Status)}
+	case httpResp.StatusCode != http.StatusOK:
+		return &Error{Kind: ErrNetwork, Err: fmt.Errorf("bank responded %s", httpResp.Status)}
+	}
+	if err := json.Unmarshal(respBody, resp); err != nil {
+		return &Error{Kind: ErrNetwork, Err: fmt.Errorf("invalid response: %w", err)}
+	}
+	if resp.Status == "" {
+		return &Error{Kind: ErrNetwork, Err: errors.New("invalid response: missing status")}
+	}
+	return nil
+}
+
+// Sign returns the signature of a request to, or notification from, the bank. It is the hex
+// encoded HMAC-SHA256, keyed with the shared secret, of the timestamp, method, path and body
+// each separated by a newline.
+func Sign(secret []byte, timestamp, method, path string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + path + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature reports whether the signature of a request or notification is valid and was
+// made within maxAge of now, so that old messages cannot be replayed.
+func VerifySignature(secret []byte, timestamp, signature, method, path string, body []byte, maxAge time.Duration) bool {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(seconds, 0))
+	if age > maxAge || age < -maxAge {
+		return false
+	}
+	expected := Sign(secret, timestamp, method, path, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
@@ -0,0 +1,158 @@
+package bank
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"payment-gateway/data"
+	"payment-gateway/money"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryingBank is a Banker that retries calls to the Banker it wraps when they fail in a way that
+// is known to have left the bank untouched: the bank being unavailable, the connection being
+// refused, or the connection timing out before the request was sent. Failures that may have
+// reached the bank, such as a timeout waiting for its answer, are never retried, as the bank may
+// have acted on them. Retries are spaced out with capped exponential backoff and full jitter, and
+// every attempt carries the same CallInfo reference so the bank can recognise a repeat.
+type RetryingBank struct {
+	Banker // Embedding the Banker that calls are retried against
+
+	MaxAttempts int           // The most times a call is made, including the first
+	BaseDelay   time.Duration // The longest wait before the first retry, doubled for each retry after it
+	MaxDelay    time.Duration // The cap on the longest wait between retries
+
+	rand *rand.Rand // Source of the jitter
+	mu   sync.Mutex // Mutex to protect concurrent access to rand
+}
+
+// NewRetryingBank creates a RetryingBank making up to maxAttempts calls to b, waiting up to
+// baseDelay before the first retry and never more than maxDelay between retries.
+func NewRetryingBank(b Banker, maxAttempts int, baseDelay, maxDelay time.Duration) *RetryingBank {
+	return &RetryingBank{
+		Banker:      b,
+		MaxAttempts: maxAttempts,
+		BaseDelay:   baseDelay,
+		MaxDelay:    maxDelay,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// MakePaymentToBank makes the payment with the wrapped Banker, retrying safe failures.
+func (r *RetryingBank) MakePaymentToBank(ctx context.Context, cd data.CardData) (status data.BankPaymentStatus, bpid data.BankPaymentID, err error) {
+	err = r.retry(ctx, func(ctx context.Context) error {
+		status, bpid, err = r.Banker.MakePaymentToBank(ctx, cd)
+		return err
+	})
+	return status, bpid, err
+}
+
+// AuthorisePaymentWithBank authorises the payment with the wrapped Banker, retrying safe failures.
+func (r *RetryingBank) AuthorisePaymentWithBank(ctx context.Context, cd data.CardData) (status data.BankPaymentStatus, bpid data.BankPaymentID, err error) {
+	err = r.retry(ctx, func(ctx context.Context) error {
+		status, bpid, err = r.Banker.AuthorisePaymentWithBank(ctx, cd)
+		return err
+	})
+	return status, bpid, err
+}
+
+// CapturePaymentWithBank captures the payment with the wrapped Banker, retrying safe failures.
+func (r *RetryingBank) CapturePaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (status data.BankPaymentStatus, err error) {
+	err = r.retry(ctx, func(ctx context.Context) error {
+		status, err = r.Banker.CapturePaymentWithBank(ctx, bpid, amount)
+		return err
+	})
+	return status, err
+}
+
+// VoidPaymentWithBank voids the payment with the wrapped Banker, retrying safe failures.
+func (r *RetryingBank) VoidPaymentWithBank(ctx context.Context, bpid data.BankPaymentID) (status data.BankPaymentStatus, err error) {
+	err = r.retry(ctx, func(ctx context.Context) error {
+		status, err = r.Banker.VoidPaymentWithBank(ctx, bpid)
+		return err
+	})
+	return status, err
+}
+
+// RefundPaymentWithBank refunds the payment with the wrapped Banker, retrying safe failures.
+func (r *RetryingBank) RefundPaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (status data.BankPaymentStatus, refundId data.BankPaymentID, err error) {
+	err = r.retry(ctx, func(ctx context.Context) error {
+		status, refundId, err = r.Banker.RefundPaymentWithBank(ctx, bpid, amount)
+		return err
+	})
+	return status, refundId, err
+}
+
+// PaymentStatusFromBank asks the wrapped Banker for the status of the payment, retrying safe failures.
+func (r *RetryingBank) PaymentStatusFromBank(ctx context.Context, bpid data.BankPaymentID) (status data.BankPaymentStatus, err error) {
+	err = r.retry(ctx, func(ctx context.Context) error {
+		status, err = r.Banker.PaymentStatusFromBank(ctx, bpid)
+		return err
+	})
+	return status, err
+}
+
+// PaymentStatusByReference asks the wrapped Banker for the status of the payment sent with the
+// reference, retrying safe failures.
+func (r *RetryingBank) PaymentStatusByReference(ctx context.Context, reference string) (status data.BankPaymentStatus, bpid data.BankPaymentID, err error) {
+	err = r.retry(ctx, func(ctx context.Context) error {
+		status, bpid, err = r.Banker.PaymentStatusByReference(ctx, reference)
+		return err
+	})
+	return status, bpid, err
+}
+
+// retry calls fn until it succeeds, fails in a way that is not safe to retry, runs out of
+// attempts or the context finishes. The number of attempts made is recorded in the CallInfo.
+func (r *RetryingBank) retry(ctx context.Context, fn func(ctx context.Context) error) error {
+	info := CallInfoFrom(ctx)
+	var err error
+	for attempt := 1; ; attempt++ {
+		if info != nil {
+			info.Attempts = attempt
+		}
+		err = fn(ctx)
+		if err == nil || !Retryable(err) || attempt >= r.MaxAttempts {
+			return err
+		}
+
+		// Wait before trying again, giving up if the context finishes first
+		timer := time.NewTimer(r.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// backoff returns how long to wait before the retry following the given attempt. The longest
+// wait doubles with each attempt up to the MaxDelay, and the actual wait is picked at random
+// up to that, so that callers failing together do not retry together.
+func (r *RetryingBank) backoff(attempt int) time.Duration {
+	ceiling := r.MaxDelay
+	if shift := attempt - 1; shift < 32 && r.BaseDelay<<shift < r.MaxDelay && r.BaseDelay<<shift > 0 {
+		ceiling = r.BaseDelay << shift
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Duration(r.rand.Int63n(int64(ceiling) + 1))
+}
+
+// Retryable reports whether a Banker error is known to have left the bank untouched, so the
+// call is safe to make again.
+func Retryable(err error) bool {
+	if errors.Is(err, ErrUnavailable) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	// Failing to connect, including timing out while connecting, means nothing was sent
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,257 @@
+package bank
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"payment-gateway/data"
+	"payment-gateway/money"
+	"sync"
+	"time"
+)
+
+// Acquirer is an acquiring bank known to an AcquirerRouter by name.
+type Acquirer struct {
+	Name   string
+	Banker Banker
+}
+
+// Target is an acquirer a Rule sends payments to, along with its share of them.
+type Target struct {
+	Acquirer string `json:"acquirer"` // The name of the acquirer
+	Weight   int    `json:"weight"`   // The acquirer's share of the payments matching the rule, relative to the other targets
+}
+
+// Rule selects the acquirers for the payments it matches. A payment matches a rule when it
+// matches every one of the rule's conditions, and a condition left empty matches everything.
+type Rule struct {
+	Brands     []string `json:"brands,omitempty"`     // Card brands, e.g. Visa
+	Currencies []string `json:"currencies,omitempty"` // Currency codes, e.g. GBP
+	Merchants  []string `json:"merchants,omitempty"`  // Merchant ids
+	MinAmount  int64    `json:"min-amount,omitempty"` // Smallest amount matched, in minor units
+	MaxAmount  int64    `json:"max-amount,omitempty"` // Largest amount matched, in minor units, zero for no limit
+	Targets    []Target `json:"targets"`              // Acquirers the payments are split between by weight
+	Failover   []string `json:"failover,omitempty"`   // Acquirers tried in order when the chosen one fails
+}
+
+// AcquirerRouter is a Banker that holds several acquiring banks and picks one for each payment
+// using the first of its rules that matches the payment. If the chosen acquirer fails in a way
+// that means it never acted on the payment, see Retryable, the payment fails over to the rule's
+// failover acquirers in turn. The acquirer used is recorded in the call's CallInfo, and any
+// later call about the payment must name it in the CallInfo to reach the same bank.
+type AcquirerRouter struct {
+	acquirers []Acquirer          // Every acquirer, in the order they were given
+	byName    map[string]Acquirer // The acquirers by name
+	rules     []Rule              // Rules, in the order they are tried
+	rand      *rand.Rand          // Source of the weighted split
+	mu        sync.Mutex          // Mutex to protect concurrent access to rand
+}
+
+// NewAcquirerRouter creates an AcquirerRouter for the acquirers and rules. Payments that match
+// no rule go to the first acquirer, failing over to the others in order.
+func NewAcquirerRouter(acquirers []Acquirer, rules []Rule) (*AcquirerRouter, error) {
+	if len(acquirers) == 0 {
+		return nil, fmt.Errorf("at least one acquirer is needed")
+	}
+	r := &AcquirerRouter{
+		acquirers: acquirers,
+		byName:    make(map[string]Acquirer),
+		rules:     rules,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, acquirer := range acquirers {
+		if _, ok := r.byName[acquirer.Name]; ok || acquirer.Name == "" {
+			return nil, fmt.Errorf("acquirer names must be unique and not empty, got %q", acquirer.Name)
+		}
+		r.byName[acquirer.Name] = acquirer
+	}
+	for i, rule := range rules {
+		if len(rule.Targets) == 0 {
+			return nil, fmt.Errorf("rule %d has no targets", i+1)
+		}
+		for _, target := range rule.Targets {
+			if _, ok := r.byName[target.Acquirer]; !ok {
+				return nil, fmt.Errorf("rule %d targets unknown acquirer %q", i+1, target.Acquirer)
+			}
+			if target.Weight <= 0 {
+				return nil, fmt.Errorf("rule %d gives acquirer %q a weight that is not positive", i+1, target.Acquirer)
+			}
+		}
+		for _, name := range rule.Failover {
+			if _, ok := r.byName[name]; !ok {
+				return nil, fmt.Errorf("rule %d fails over to unknown acquirer %q", i+1, name)
+			}
+		}
+	}
+	return r, nil
+}
+
+// MakePaymentToBank makes the payment with the acquirer its rules pick.
+func (r *AcquirerRouter) MakePaymentToBank(ctx context.Context, cd data.CardData) (status data.BankPaymentStatus, bpid data.BankPaymentID, err error) {
+	err = r.route(ctx, cd, func(b Banker) error {
+		status, bpid, err = b.MakePaymentToBank(ctx, cd)
+		return err
+	})
+	return status, bpid, err
+}
+
+// AuthorisePaymentWithBank authorises the payment with the acquirer its rules pick.
+func (r *AcquirerRouter) AuthorisePaymentWithBank(ctx context.Context, cd data.CardData) (status data.BankPaymentStatus, bpid data.BankPaymentID, err error) {
+	err = r.route(ctx, cd, func(b Banker) error {
+		status, bpid, err = b.AuthorisePaymentWithBank(ctx, cd)
+		return err
+	})
+	return status, bpid, err
+}
+
+// CapturePaymentWithBank captures the payment with the acquirer that made it.
+func (r *AcquirerRouter) CapturePaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (data.BankPaymentStatus, error) {
+	b, err := r.acquirerFor(ctx)
+	if err != nil {
+		return "", err
+	}
+	return b.CapturePaymentWithBank(ctx, bpid, amount)
+}
+
+// VoidPaymentWithBank voids the payment with the acquirer that made it.
+func (r *AcquirerRouter) VoidPaymentWithBank(ctx context.Context, bpid data.BankPaymentID) (data.BankPaymentStatus, error) {
+	b, err := r.acquirerFor(ctx)
+	if err != nil {
+		return "", err
+	}
+	return b.VoidPaymentWithBank(ctx, bpid)
+}
+
+// RefundPaymentWithBank refunds the payment with the acquirer that made it.
+func (r *AcquirerRouter) RefundPaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	b, err := r.acquirerFor(ctx)
+	if err != nil {
+		return "", data.BankPaymentID{}, err
+	}
+	return b.RefundPaymentWithBank(ctx, bpid, amount)
+}
+
+// PaymentStatusFromBank asks the acquirer that made the payment for its status.
+func (r *AcquirerRouter) PaymentStatusFromBank(ctx context.Context, bpid data.BankPaymentID) (data.BankPaymentStatus, error) {
+	b, err := r.acquirerFor(ctx)
+	if err != nil {
+		return "", err
+	}
+	return b.PaymentStatusFromBank(ctx, bpid)
+}
+
+// PaymentStatusByReference asks the acquirer the payment was sent to for its status.
+func (r *AcquirerRouter) PaymentStatusByReference(ctx context.Context, reference string) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	b, err := r.acquirerFor(ctx)
+	if err != nil {
+		return "", data.BankPaymentID{}, err
+	}
+	return b.PaymentStatusByReference(ctx, reference)
+}
+
+// Health reports the health of every acquirer that can report it.
+func (r *AcquirerRouter) Health() []Health {
+	health := []Health{}
+	for _, acquirer := range r.acquirers {
+		if reporter, ok := acquirer.Banker.(HealthReporter); ok {
+			health = append(health, reporter.Health()...)
+		}
+	}
+	return health
+}
+
+// route sends a new payment to the acquirers picked for it in turn, until one answers or fails
+// in a way that may have reached the bank. The acquirer last tried is recorded in the CallInfo.
+func (r *AcquirerRouter) route(ctx context.Context, cd data.CardData, fn func(b Banker) error) error {
+	info := CallInfoFrom(ctx)
+	var merchantId string
+	if info != nil {
+		merchantId = info.MerchantID
+	}
+
+	var err error
+	for _, name := range r.pick(cd, merchantId) {
+		if info != nil {
+			info.Acquirer = name
+		}
+		err = fn(r.byName[name].Banker)
+		if err == nil || !Retryable(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// pick returns the names of the acquirers to try for a payment, in the order to try them.
+func (r *AcquirerRouter) pick(cd data.CardData, merchantId string) []string {
+	for _, rule := range r.rules {
+		if !rule.matches(cd, merchantId) {
+			continue
+		}
+		names := []string{r.split(rule.Targets)}
+		for _, name := range rule.Failover {
+			if name != names[0] {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	names := make([]string, 0, len(r.acquirers))
+	for _, acquirer := range r.acquirers {
+		names = append(names, acquirer.Name)
+	}
+	return names
+}
+
+// split picks one of the targets at random, in proportion to their weights.
+func (r *AcquirerRouter) split(targets []Target) string {
+	total := 0
+	for _, target := range targets {
+		total += target.Weight
+	}
+	r.mu.Lock()
+	n := r.rand.Intn(total)
+	r.mu.Unlock()
+	for _, target := range targets {
+		if n < target.Weight {
+			return target.Acquirer
+		}
+		n -= target.Weight
+	}
+	return targets[len(targets)-1].Acquirer
+}
+
+// acquirerFor returns the acquirer named in the CallInfo, which made the payment being changed.
+func (r *AcquirerRouter) acquirerFor(ctx context.Context) (Banker, error) {
+	info := CallInfoFrom(ctx)
+	if info == nil {
+		return nil, &Error{Kind: ErrInvalidRequest, Err: fmt.Errorf("no acquirer given for the payment")}
+	}
+	acquirer, ok := r.byName[info.Acquirer]
+	if !ok {
+		return nil, &Error{Kind: ErrInvalidRequest, Err: fmt.Errorf("unknown acquirer %q", info.Acquirer)}
+	}
+	return acquirer.Banker, nil
+}
+
+// matches reports whether the payment meets every condition of the rule.
+func (rule Rule) matches(cd data.CardData, merchantId string) bool {
+	return matchesAny(rule.Brands, cd.Brand) &&
+		matchesAny(rule.Currencies, cd.Amount.Currency) &&
+		matchesAny(rule.Merchants, merchantId) &&
+		cd.Amount.MinorUnits >= rule.MinAmount &&
+		(rule.MaxAmount == 0 || cd.Amount.MinorUnits <= rule.MaxAmount)
+}
+
+// matchesAny reports whether value is one of values, or values is empty.
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,498 @@
+// Package banksim simulates an acquiring bank, serving the API that bank.HTTPBank talks to. It is
+// meant for developing and testing the gateway locally: magic card numbers and amounts trigger
+// specific outcomes, and latency and failures can be injected at random.
+package banksim
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"payment-gateway/bank"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reasons given by the simulator for declining a request.
+const (
+	ReasonInsufficientFunds = "insufficient-funds"
+	ReasonStolenCard        = "stolen-card"
+	ReasonDoNotHonour       = "do-not-honour"
+	ReasonInvalidState      = "invalid-state"     // The payment cannot be captured, voided or refunded in its current state
+	ReasonAmountTooLarge    = "amount-too-large"  // More was asked for than is left to capture or refund
+	ReasonUnknownPayment    = "unknown-payment"   // The payment was never made with the simulator
+	ReasonCurrencyMismatch  = "currency-mismatch" // The currency differs from the payment's
+)
+
+// Outcomes the simulator can give a new payment.
+const (
+	outcomeApprove           = "approve"
+	outcomeInsufficientFunds = "insufficient-funds"
+	outcomeStolenCard        = "stolen-card"
+	outcomeDoNotHonour       = "do-not-honour"
+	outcomeTimeout           = "timeout"         // Approve, but never answer, so the caller gives up waiting without knowing
+	outcomeServerError       = "server-error"    // Answer with a 500, leaving the outcome unknown
+	outcomeUnavailable       = "unavailable"     // Answer with a 503
+	outcomeSlow              = "slow"            // Approve, but only after the SlowLatency
+	outcomePending           = "pending"         // Answer "Pending", approving the payment after the PendingLatency
+	outcomePendingDecline    = "pending-decline" // Answer "Pending", declining the payment after the PendingLatency
+)
+
+// magicCards are the card numbers that trigger a specific outcome, whatever the amount.
+var magicCards = map[string]string{
+	"4000000000009953": outcomeInsufficientFunds,
+	"4000000000009979": outcomeStolenCard,
+	"4000000000000002": outcomeDoNotHonour,
+	"4000000000000119": outcomeTimeout,
+	"4000000000000127": outcomeServerError,
+	"4000000000000143": outcomeUnavailable,
+	"4000000000000135": outcomeSlow,
+	"4000000000000150": outcomePending,
+	"4000000000000168": outcomePendingDecline,
+}
+
+// magicAmounts are the exact amounts in minor units that trigger a specific outcome for any
+// other card, e.g. 1000.51 GBP is declined for insufficient funds. They sit just above 1000 in
+// two decimal currencies, which everyday prices rarely land on, so realistic amounts are approved.
+var magicAmounts = map[int64]string{
+	100051: outcomeInsufficientFunds,
+	100043: outcomeStolenCard,
+	100005: outcomeDoNotHonour,
+	100098: outcomeTimeout,
+	100099: outcomeServerError,
+	100096: outcomeUnavailable,
+	100097: outcomeSlow,
+	100095: outcomePending,
+	100094: outcomePendingDecline,
+}
+
+// maxHold is the longest a request asking for a timeout is held open for.
+const maxHold = 2 * time.Minute
+
+// Config controls how the simulator behaves beyond the magic card numbers and amounts.
+type Config struct {
+	Secret          []byte        // Secret that requests must be signed with, requests are not checked when empty
+	Latency         time.Duration // Delay added to every response
+	SlowLatency     time.Duration // Delay added to slow responses
+	UnavailableRate float64       // Fraction of requests, between 0 and 1, answered with a 503 at random
+	ErrorRate       float64       // Fraction of requests, between 0 and 1, answered with a 500 at random
+	PendingLatency  time.Duration // How long the simulator takes to decide on a payment it answered as pending
+	NotificationURL string        // Where the decisions on pending payments are sent, they are only found by asking when empty
+}
+
+// Simulator is an http.Handler serving the simulated acquiring bank's API.
+type Simulator struct {
+	config     Config
+	payments   map[uuid.UUID]*payment // Every payment the simulator has approved
+	references map[string]uuid.UUID   // The id of each payment made with an idempotency key, by the key
+	answers    map[string]response    // The answer to each request made with an idempotency key, by key
+	rand       *rand.Rand             // Source of the random failures
+	mu         sync.Mutex             // Mutex to protect concurrent access to payments and rand
+}
+
+// payment is the simulator's record of a payment it approved, or has yet to decide on.
+type payment struct {
+	currency   string
+	status     string    // "Pending" until decideAt, then "Success" or "Failure"
+	authorised int64     // Amount reserved, in minor units
+	captured   int64     // Amount taken, in minor units
+	refunded   int64     // Amount given back, in minor units
+	voided     bool      // Whether the reserved amount was released
+	capture    bool      // Whether the payment is captured when it is approved
+	decline    bool      // Whether a pending payment is declined rather than approved
+	decideAt   time.Time // When a pending payment is decided on
+}
+
+// request is the body of a request to the simulator.
+type request struct {
+	CardNumber string `json:"card-number"`
+	ExpiryDate string `json:"expiry-date"`
+	Cvv        string `json:"cvv"`
+	Amount     int64  `json:"amount"`
+	Currency   string `json:"currency"`
+	Capture    *bool  `json:"capture"`
+	Initiator  string `json:"initiator"`
+}
+
+// response is the body of a response from the simulator.
+type response struct {
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"` // Why the request was declined
+}
+
+// New creates a Simulator with the given config.
+func New(config Config) *Simulator {
+	return &Simulator{
+		config:     config,
+		payments:   make(map[uuid.UUID]*payment),
+		references: make(map[string]uuid.UUID),
+		answers:    make(map[string]response),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// ServeHTTP handles a request to the simulated bank's API.
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(s.config.Secret) > 0 && !bank.VerifySignature(s.config.Secret, r.Header.Get(bank.TimestampHeader), r.Header.Get(bank.SignatureHeader), r.Method, r.URL.Path, body, bank.MaxSignatureAge) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodGet {
+		s.status(w, r)
+		return
+	}
+	var req request
+	if err := json.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !sleep(r, s.config.Latency) {
+		return
+	}
+	if status := s.randomFailure(); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	// A repeated request is given its original answer, rather than being acted on again
+	var key string
+	if reference := r.Header.Get(bank.IdempotencyHeader); reference != "" {
+		key = r.URL.Path + " " + reference
+	}
+	if resp, ok := s.answer(key); ok {
+		writeJSON(w, resp)
+		return
+	}
+
+	// Route the request, which is either /payments or /payments/{id}/{action}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "payments":
+		s.createPayment(w, r, key, req)
+	case len(parts) == 3 && parts[0] == "payments":
+		id, err := uuid.Parse(parts[1])
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		var resp response
+		switch parts[2] {
+		case "capture":
+			resp = s.capture(id, req)
+		case "void":
+			resp = s.void(id)
+		case "refunds":
+			resp = s.refund(id, req)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s.remember(key, resp)
+		writeJSON(w, resp)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// createPayment handles a new payment, which is approved unless its card number or amount is magic.
+func (s *Simulator) createPayment(w http.ResponseWriter, r *http.Request, key string, req request) {
+	if req.CardNumber == "" || req.Amount <= 0 || req.Currency == "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	// The cardholder is not there to give the CVV of a payment the merchant started
+	switch req.Initiator {
+	case "", "customer":
+	case "merchant":
+		if req.Cvv != "" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	outcome, ok := magicCards[req.CardNumber]
+	if !ok {
+		outcome, ok = magicAmounts[req.Amount]
+	}
+	if !ok {
+		outcome = outcomeApprove
+	}
+
+	id := uuid.New()
+	switch outcome {
+	case outcomeInsufficientFunds, outcomeStolenCard, outcomeDoNotHonour:
+		resp := response{ID: id.String(), Status: "Failure", Reason: outcome}
+		s.remember(key, resp)
+		writeJSON(w, resp)
+		return
+	case outcomeTimeout:
+		// Take the payment, but hold the request open until the caller gives up on it, so it can
+		// only learn the outcome by asking for the payment by reference
+		p := &payment{status: "Success", currency: req.Currency, authorised: req.Amount, capture: req.Capture == nil || *req.Capture}
+		if p.capture {
+			p.captured = req.Amount
+		}
+		s.add(id, r.Header.Get(bank.IdempotencyHeader), p)
+		sleep(r, maxHold)
+		return
+	case outcomeServerError:
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	case outcomeUnavailable:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	case outcomeSlow:
+		if !sleep(r, s.config.SlowLatency) {
+			return
+		}
+	}
+
+	p := &payment{status: "Success", currency: req.Currency, authorised: req.Amount, capture: req.Capture == nil || *req.Capture}
+	if outcome == outcomePending || outcome == outcomePendingDecline {
+		// Decide on the payment later, telling the gateway if it is listening
+		p.status = "Pending"
+		p.decline = outcome == outcomePendingDecline
+		p.decideAt = time.Now().Add(s.config.PendingLatency)
+		if s.config.NotificationURL != "" {
+			go s.notify(id, r.Header.Get(bank.IdempotencyHeader))
+		}
+	} else if p.capture {
+		p.captured = req.Amount
+	}
+	resp := response{ID: id.String(), Status: p.status}
+	s.add(id, r.Header.Get(bank.IdempotencyHeader), p)
+	s.remember(key, resp)
+	writeJSON(w, resp)
+}
+
+// add records a new payment, along with the reference it was made with, if any.
+func (s *Simulator) add(id uuid.UUID, reference string, p *payment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payments[id] = p
+	if reference != "" {
+		s.references[reference] = id
+	}
+}
+
+// status answers a request for the status of a payment, at GET /payments/{id}, or at
+// GET /references/{reference} for a payment by the reference it was made with.
+func (s *Simulator) status(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || (parts[0] != "payments" && parts[0] != "references") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.mu.Lock()
+	id := s.references[parts[1]] // The zero id of an unknown reference is never a payment
+	s.mu.Unlock()
+	if parts[0] == "payments" {
+		var err error
+		if id, err = uuid.Parse(parts[1]); err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	s.mu.Lock()
+	p, ok := s.payments[id]
+	var status string
+	if ok {
+		status = s.decide(p)
+	}
+	s.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, response{ID: id.String(), Status: status})
+}
+
+// notify sends the decision on a pending payment to the NotificationURL once it is made. The
+// reference is the one the gateway sent the payment with, so it can find the payment.
+func (s *Simulator) notify(id uuid.UUID, reference string) {
+	time.Sleep(s.config.PendingLatency)
+	s.mu.Lock()
+	status := s.decide(s.payments[id])
+	s.mu.Unlock()
+
+	body, err := json.Marshal(bank.Notification{Reference: reference, ID: id.String(), Status: status})
+	if err != nil {
+		log.Printf("Could not encode notification for payment %s: %v\n", id, err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, s.config.NotificationURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Could not send notification for payment %s: %v\n", id, err)
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(bank.TimestampHeader, timestamp)
+	req.Header.Set(bank.SignatureHeader, bank.Sign(s.config.Secret, timestamp, http.MethodPost, req.URL.Path, body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Could not send notification for payment %s: %v\n", id, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Notification for payment %s was answered %s\n", id, resp.Status)
+	}
+}
+
+// decide makes the decision on a pending payment once it is due, returning the payment's status.
+// It must be called with the mutex held.
+func (s *Simulator) decide(p *payment) string {
+	if p.status == "Pending" && !time.Now().Before(p.decideAt) {
+		if p.decline {
+			p.status = "Failure"
+		} else {
+			p.status = "Success"
+			if p.capture {
+				p.captured = p.authorised
+			}
+		}
+	}
+	return p.status
+}
+
+// capture takes some, or all, of an authorised payment.
+func (s *Simulator) capture(id uuid.UUID, req request) response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.payments[id]
+	switch {
+	case !ok:
+		return response{Status: "Failure", Reason: ReasonUnknownPayment}
+	case s.decide(p) != "Success":
+		return response{Status: "Failure", Reason: ReasonInvalidState}
+	case p.captured > 0 || p.voided:
+		return response{Status: "Failure", Reason: ReasonInvalidState}
+	case req.Currency != p.currency:
+		return response{Status: "Failure", Reason: ReasonCurrencyMismatch}
+	case req.Amount <= 0 || req.Amount > p.authorised:
+		return response{Status: "Failure", Reason: ReasonAmountTooLarge}
+	}
+	p.captured = req.Amount
+	return response{Status: "Success"}
+}
+
+// void releases an authorised payment.
+func (s *Simulator) void(id uuid.UUID) response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.payments[id]
+	switch {
+	case !ok:
+		return response{Status: "Failure", Reason: ReasonUnknownPayment}
+	case s.decide(p) != "Success":
+		return response{Status: "Failure", Reason: ReasonInvalidState}
+	case p.captured > 0 || p.voided:
+		return response{Status: "Failure", Reason: ReasonInvalidState}
+	}
+	p.voided = true
+	return response{Status: "Success"}
+}
+
+// refund gives back some, or all, of a captured payment.
+func (s *Simulator) refund(id uuid.UUID, req request) response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.payments[id]
+	switch {
+	case !ok:
+		return response{Status: "Failure", Reason: ReasonUnknownPayment}
+	case s.decide(p) != "Success":
+		return response{Status: "Failure", Reason: ReasonInvalidState}
+	case p.captured == 0:
+		return response{Status: "Failure", Reason: ReasonInvalidState}
+	case req.Currency != p.currency:
+		return response{Status: "Failure", Reason: ReasonCurrencyMismatch}
+	case req.Amount <= 0 || p.refunded+req.Amount > p.captured:
+		return response{Status: "Failure", Reason: ReasonAmountTooLarge}
+	}
+	p.refunded += req.Amount
+	return response{ID: uuid.New().String(), Status: "Success"}
+}
+
+// answer returns the answer already given to the request with the idempotency key, if any.
+func (s *Simulator) answer(key string) (response, bool) {
+	if key == "" {
+		return response{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp, ok := s.answers[key]
+	return resp, ok
+}
+
+// remember records the answer given to the request with the idempotency key.
+func (s *Simulator) remember(key string, resp response) {
+	if key == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.answers[key] = resp
+}
+
+// randomFailure returns the status of a failure injected at random, or 0 if the request should
+// be handled normally.
+func (s *Simulator) randomFailure() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	roll := s.rand.Float64()
+	switch {
+	case roll < s.config.UnavailableRate:
+		return http.StatusServiceUnavailable
+	case roll < s.config.UnavailableRate+s.config.ErrorRate:
+		return http.StatusInternalServerError
+	}
+	return 0
+}
+
+// sleep waits for d, returning false if the caller gave up first.
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// readBody reads the body of the request, which is limited to 1MB.
+func readBody(r *http.Request) ([]byte, error) {
+	return io.ReadAll(io.LimitReader(r.Body, 1<<20))
+}
+
+// writeJSON writes the response as JSON.
+func writeJSON(w http.ResponseWriter, resp response) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
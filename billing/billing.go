@@ -0,0 +1,399 @@
+// Package billing charges merchants' customers on a schedule. Merchants create plans, which
+// set how much is charged and how often, and subscribe their customers to them with a saved
+// card. The Billing's Run charges every subscription as it falls due, retrying declined charges
+// for a while before the subscription is cancelled, and changing a subscription's plan part way
+// through a period carries the difference for the rest of the period over to the next charge.
+package billing
+
+import (
+	"errors"
+	"math/big"
+	"payment-gateway/money"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Errors returned by Billing.
+var (
+	ErrPlanNotFound          = errors.New("plan not found")
+	ErrSubscriptionNotFound  = errors.New("subscription not found")
+	ErrInvalidInterval       = errors.New("invalid plan interval")
+	ErrInvalidAmount         = errors.New("invalid plan amount")
+	ErrIncompatiblePlan      = errors.New("plans can only be changed for one with the same currency and interval")
+	ErrSubscriptionCancelled = errors.New("subscription has been cancelled")
+	ErrSubscriptionCharging  = errors.New("subscription is being charged")
+	ErrPaymentMethodNotGiven = errors.New("payment method must be given")
+)
+
+// Interval is a custom type representing the unit of time a plan charges for.
+type Interval string
+
+// The intervals a plan can charge for.
+const (
+	Day   Interval = "day"
+	Week  Interval = "week"
+	Month Interval = "month"
+	Year  Interval = "year"
+)
+
+// Status is a custom type representing where a subscription is in its lifecycle.
+type Status string
+
+// The statuses a subscription can have.
+const (
+	StatusActive    Status = "active"    // Paid up, and charged again at the end of each period
+	StatusPastDue   Status = "past-due"  // The last charge failed, and is being retried
+	StatusCancelled Status = "cancelled" // No longer charged, either by request or after every retry failed
+)
+
+// ChargeStatus is a custom type representing the outcome of a charge.
+type ChargeStatus string
+
+// The outcomes a charge can have.
+const (
+	ChargePaid    ChargeStatus = "paid"    // The period was paid for, by a payment or by the subscription's credit
+	ChargePending ChargeStatus = "pending" // The payment is being made, or the bank has yet to decide on it
+	ChargeFailed  ChargeStatus = "failed"  // The payment was declined, or could not be made
+)
+
+// Plan is what a merchant charges their customers for a subscription.
+type Plan struct {
+	ID            string      // The gateway's identifier for the plan
+	MerchantID    string      // The merchant the plan belongs to, who alone can see it
+	Name          string      // The plan's name, as given by the merchant
+	Amount        money.Money // How much is charged each period
+	Interval      Interval    // The unit of time a period is counted in
+	IntervalCount int         // How many intervals make up a period, e.g. 3 months for a quarterly plan
+	CreatedAt     time.Time   // When the plan was created
+}
+
+// periodEnd returns when the given number of the plan's periods, counted from the anchor, end.
+// Months are counted by the calendar, and a period that would end on a day the month does not
+// have ends on the month's last day instead, so a plan started on the 31st is charged on the 30th
+// in June but still on the 31st in July.
+func (p Plan) periodEnd(anchor time.Time, periods int) time.Time {
+	n := periods * p.IntervalCount
+	switch p.Interval {
+	case Day:
+		return anchor.AddDate(0, 0, n)
+	case Week:
+		return anchor.AddDate(0, 0, 7*n)
+	case Year:
+		return addMonths(anchor, 12*n)
+	default:
+		return addMonths(anchor, n)
+	}
+}
+
+// Subscription charges a customer's saved card for a plan at the start of every period. A
+// subscription's first period starts when it is created, and every period after it starts when
+// the one before ends.
+type Subscription struct {
+	ID                 string      // The gateway's identifier for the subscription
+	MerchantID         string      // The merchant the subscription belongs to, who alone can see it
+	CustomerID         string      // The customer being charged
+	PaymentMethodID    string      // The customer's saved card that is charged
+	PlanID             string      // The plan being charged for
+	Status             Status      // Where the subscription is in its lifecycle
+	Anchor             time.Time   // When the subscription started, from which its periods are counted
+	Periods            int         // How many periods have been paid for
+	CurrentPeriodStart time.Time   // When the last period paid for started, the same as its end until the first is paid
+	CurrentPeriodEnd   time.Time   // When the last period paid for ends
+	NextChargeAt       time.Time   // When the subscription is next charged, zero once it is cancelled
+	Balance            money.Money // Added to the next charge, from changes of plan part way through a period, negative for a credit
+	FailedAttempts     int         // How many times in a row charging for the next period has failed
+	CancelAtPeriodEnd  bool        // Whether the subscription is cancelled, rather than charged, when the current period ends
+	CancelledAt        time.Time   // When the subscription was cancelled, zero while it is not
+	Charges            []Charge    // Every charge made for the subscription, oldest first
+	CreatedAt          time.Time   // When the subscription was created
+	UpdatedAt          time.Time   // When the subscription last changed
+}
+
+// Charge is an attempt to pay for one of a subscription's periods.
+type Charge struct {
+	PaymentID   string       // The payment made for the charge, empty if it was paid from the credit or no payment was made
+	Amount      money.Money  // How much was charged, including any balance carried over
+	Status      ChargeStatus // The outcome of the charge
+	Error       string       // Why the charge failed, empty if it was paid
+	PeriodStart time.Time    // When the period charged for starts
+	PeriodEnd   time.Time    // When the period charged for ends
+	CreatedAt   time.Time    // When the charge was made
+}
+
+// Billing creates and changes the plans and subscriptions of merchants, kept in a Store, and
+// charges the subscriptions as they fall due. Plans and subscriptions of other merchants are
+// reported as not found, the same as ones that do not exist.
+type Billing struct {
+	Store                        // Embedding Store to keep the plans and subscriptions
+	Charger     Charger          // Makes the payments subscriptions are charged with
+	Clock       func() time.Time // Source of the current time, replaceable in tests
+	RetryDelays []time.Duration  // The wait before each retry of a failed charge, the subscription is cancelled when they run out
+
+	wake     chan struct{}       // Signalled when a subscription falls due straight away, so Run charges it
+	charging map[string]struct{} // Subscriptions being charged, so that none is charged twice at once
+	mu       sync.Mutex          // Serialises changes, and protects charging
+}
+
+// New creates Billing keeping its plans and subscriptions in store, and charging them with
+// charger. Failed charges are retried after 1, 3 and 7 days, after which the subscription is
+// cancelled.
+func New(store Store, charger Charger) *Billing {
+	return &Billing{
+		Store:       store,
+		Charger:     charger,
+		Clock:       time.Now,
+		RetryDelays: []time.Duration{24 * time.Hour, 3 * 24 * time.Hour, 7 * 24 * time.Hour},
+		wake:        make(chan struct{}, 1),
+		charging:    make(map[string]struct{}),
+	}
+}
+
+// CreatePlan adds a new plan for the merchant, charging the amount every intervalCount intervals.
+func (b *Billing) CreatePlan(merchantId, name string, amount money.Money, interval Interval, intervalCount int) (Plan, error) {
+	switch interval {
+	case Day, Week, Month, Year:
+	default:
+		return Plan{}, ErrInvalidInterval
+	}
+	if intervalCount < 1 {
+		return Plan{}, ErrInvalidInterval
+	}
+	if amount.MinorUnits <= 0 {
+		return Plan{}, ErrInvalidAmount
+	}
+	plan := Plan{
+		ID:            uuid.New().String(),
+		MerchantID:    merchantId,
+		Name:          name,
+		Amount:        amount,
+		Interval:      interval,
+		IntervalCount: intervalCount,
+		CreatedAt:     b.Clock().UTC(),
+	}
+	if err := b.Store.AddPlan(plan); err != nil {
+		return Plan{}, err
+	}
+	return plan, nil
+}
+
+// Plan returns the merchant's plan with the given id.
+func (b *Billing) Plan(merchantId, planId string) (Plan, error) {
+	ok, plan, err := b.Store.RetrievePlan(planId)
+	if err != nil {
+		return Plan{}, err
+	}
+	if !ok || plan.MerchantID != merchantId {
+		return Plan{}, ErrPlanNotFound
+	}
+	return plan, nil
+}
+
+// Plans returns the merchant's plans, oldest first.
+func (b *Billing) Plans(merchantId string) ([]Plan, error) {
+	return b.Store.ListPlans(merchantId)
+}
+
+// Subscribe subscribes the merchant's customer to one of the merchant's plans. The first period
+// falls due straight away, so Run charges the saved card for it as soon as it is woken. The
+// caller checks the customer and their saved card belong to the merchant.
+func (b *Billing) Subscribe(merchantId, customerId, paymentMethodId, planId string) (Subscription, error) {
+	plan, err := b.Plan(merchantId, planId)
+	if err != nil {
+		return Subscription{}, err
+	}
+	if paymentMethodId == "" {
+		return Subscription{}, ErrPaymentMethodNotGiven
+	}
+	now := b.Clock().UTC()
+	subscription := Subscription{
+		ID:                 uuid.New().String(),
+		MerchantID:         merchantId,
+		CustomerID:         customerId,
+		PaymentMethodID:    paymentMethodId,
+		PlanID:             plan.ID,
+		Status:             StatusActive,
+		Anchor:             now,
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   now,
+		NextChargeAt:       now,
+		Balance:            money.Money{Currency: plan.Amount.Currency},
+		Charges:            []Charge{},
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	}
+	if err := b.Store.AddSubscription(subscription); err != nil {
+		return Subscription{}, err
+	}
+	b.signal()
+	return subscription, nil
+}
+
+// Subscription returns the merchant's subscription with the given id.
+func (b *Billing) Subscription(merchantId, subscriptionId string) (Subscription, error) {
+	ok, subscription, err := b.Store.RetrieveSubscription(subscriptionId)
+	if err != nil {
+		return Subscription{}, err
+	}
+	if !ok || subscription.MerchantID != merchantId {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+	return subscription, nil
+}
+
+// Subscriptions returns the merchant's subscriptions, oldest first.
+func (b *Billing) Subscriptions(merchantId string) ([]Subscription, error) {
+	return b.Store.ListSubscriptions(merchantId)
+}
+
+// Update moves the merchant's subscription to another of the merchant's plans, and charges
+// another of the customer's saved cards for it, either of which can be left empty to keep the
+// current one. The new plan must have the same currency and interval as the current one, and the
+// difference between them for what is left of the period already paid for is added to the
+// subscription's balance, to be charged, or credited, with the next charge. A subscription that
+// is past due is charged with the new card straight away, rather than waiting for the next retry.
+// The caller checks the saved card belongs to the customer.
+func (b *Billing) Update(merchantId, subscriptionId, planId, paymentMethodId string) (Subscription, error) {
+	var plan Plan
+	if planId != "" {
+		var err error
+		if plan, err = b.Plan(merchantId, planId); err != nil {
+			return Subscription{}, err
+		}
+	}
+	subscription, err := b.change(merchantId, subscriptionId, func(subscription *Subscription) error {
+		if plan.ID != "" && plan.ID != subscription.PlanID {
+			if err := b.changePlan(subscription, plan); err != nil {
+				return err
+			}
+		}
+		if paymentMethodId != "" && paymentMethodId != subscription.PaymentMethodID {
+			subscription.PaymentMethodID = paymentMethodId
+			if subscription.Status == StatusPastDue {
+				subscription.NextChargeAt = b.Clock().UTC()
+			}
+		}
+		return nil
+	})
+	if err == nil && subscription.Status == StatusPastDue {
+		b.signal()
+	}
+	return subscription, err
+}
+
+// changePlan moves the subscription to the plan, prorating the difference between the plans for
+// what is left of the period already paid for.
+func (b *Billing) changePlan(subscription *Subscription, plan Plan) error {
+	ok, current, err := b.Store.RetrievePlan(subscription.PlanID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrPlanNotFound
+	}
+	if current.Amount.Currency != plan.Amount.Currency || current.Interval != plan.Interval || current.IntervalCount != plan.IntervalCount {
+		return ErrIncompatiblePlan
+	}
+	// Only the part of the period that has been paid for, and not yet used, is prorated
+	now := b.Clock()
+	if subscription.Periods > 0 && now.Before(subscription.CurrentPeriodEnd) {
+		subscription.Balance.MinorUnits += prorate(plan.Amount.MinorUnits-current.Amount.MinorUnits,
+			subscription.CurrentPeriodEnd.Sub(now), subscription.CurrentPeriodEnd.Sub(subscription.CurrentPeriodStart))
+	}
+	subscription.PlanID = plan.ID
+	return nil
+}
+
+// Cancel stops the merchant's subscription being charged, either straight away or once the
+// period already paid for ends. The period already paid for is not refunded either way.
+func (b *Billing) Cancel(merchantId, subscriptionId string, atPeriodEnd bool) (Subscription, error) {
+	return b.change(merchantId, subscriptionId, func(subscription *Subscription) error {
+		// A subscription with nothing paid for, or whose charge is being retried, has no period
+		// left to wait for
+		if atPeriodEnd && subscription.Status == StatusActive && subscription.Periods > 0 {
+			subscription.CancelAtPeriodEnd = true
+			return nil
+		}
+		subscription.cancel(b.Clock().UTC())
+		return nil
+	})
+}
+
+// change applies fn to the merchant's subscription, unless it has been cancelled, and stores the result.
+func (b *Billing) change(merchantId, subscriptionId string, fn func(subscription *Subscription) error) (Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subscription, err := b.Subscription(merchantId, subscriptionId)
+	if err != nil {
+		return Subscription{}, err
+	}
+	if subscription.Status == StatusCancelled {
+		return Subscription{}, ErrSubscriptionCancelled
+	}
+	// A change part way through a charge could be overwritten by its outcome, or change what it
+	// should have charged
+	if _, ok := b.charging[subscriptionId]; ok {
+		return Subscription{}, ErrSubscriptionCharging
+	}
+	if _, ok := subscription.pendingCharge(); ok {
+		return Subscription{}, ErrSubscriptionCharging
+	}
+	if err := fn(&subscription); err != nil {
+		return Subscription{}, err
+	}
+	subscription.UpdatedAt = b.Clock().UTC()
+	if err := b.Store.UpdateSubscription(subscription); err != nil {
+		return Subscription{}, err
+	}
+	return subscription, nil
+}
+
+// pendingCharge returns the subscription's last charge if it has yet to be settled, along with
+// whether there is one. Nothing is charged for the next period until it is.
+func (s Subscription) pendingCharge() (Charge, bool) {
+	if len(s.Charges) == 0 || s.Charges[len(s.Charges)-1].Status != ChargePending {
+		return Charge{}, false
+	}
+	return s.Charges[len(s.Charges)-1], true
+}
+
+// cancel marks the subscription as cancelled at the given time, so it is never charged again.
+func (s *Subscription) cancel(at time.Time) {
+	s.Status = StatusCancelled
+	s.CancelledAt = at
+	s.NextChargeAt = time.Time{}
+	s.CancelAtPeriodEnd = false
+}
+
+// prorate returns the share of the amount for the remaining part of a period of the given
+// length, rounded to the nearest minor unit with halves rounded away from zero. It is worked
+// out exactly, as the amount multiplied by the remaining nanoseconds overflows an int64.
+func prorate(amount int64, remaining, length time.Duration) int64 {
+	if length <= 0 || remaining <= 0 {
+		return 0
+	}
+	if remaining > length {
+		remaining = length
+	}
+	numerator := new(big.Int).Mul(big.NewInt(amount), big.NewInt(int64(remaining)))
+	numerator.Mul(numerator, big.NewInt(2))
+	denominator := big.NewInt(2 * int64(length))
+	if amount < 0 {
+		numerator.Sub(numerator, big.NewInt(int64(length)))
+	} else {
+		numerator.Add(numerator, big.NewInt(int64(length)))
+	}
+	return numerator.Quo(numerator, denominator).Int64()
+}
+
+// addMonths adds n calendar months to t, keeping its day of the month unless the month has fewer
+// days, when the month's last day is used instead.
+func addMonths(t time.Time, n int) time.Time {
+	year, month, day := t.Date()
+	first := time.Date(year, month+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
@@ -0,0 +1,203 @@
+package billing
+
+import (
+	"context"
+	"log"
+	"payment-gateway/money"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Charger makes the payments subscriptions are charged with.
+type Charger interface {
+	// ChargeSavedCard charges the merchant's customer's saved card, without the customer there,
+	// with a payment of the given id, and returns whether it was paid or is pending. Charging
+	// again with the same id makes no new payment, but returns the outcome of the one already
+	// made. A payment the bank declines, or that could not be made, returns ChargeFailed along
+	// with an error, while one whose outcome is unknown, such as when the bank's answer was lost,
+	// returns ChargePending, with any error, so it is never made again under another id.
+	ChargeSavedCard(ctx context.Context, paymentId, merchantId, customerId, paymentMethodId string, amount money.Money) (ChargeStatus, error)
+}
+
+// ChargeDue charges every subscription that is due, returning how many periods were paid for.
+// A subscription that cannot be charged is logged and left due, to be charged next time, while
+// the others are charged.
+func (b *Billing) ChargeDue(ctx context.Context) (int, error) {
+	due, err := b.Store.DueSubscriptions(b.Clock())
+	if err != nil {
+		return 0, err
+	}
+	paid := 0
+	for _, subscription := range due {
+		if err := ctx.Err(); err != nil {
+			return paid, err
+		}
+		ok, err := b.chargeDue(ctx, subscription.ID)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Could not charge subscription %s with an error of: %v\n", subscription.ID, err)
+			}
+			continue
+		}
+		if ok {
+			paid++
+		}
+	}
+	return paid, nil
+}
+
+// Run charges subscriptions as they are created, and as they fall due, checking for due
+// subscriptions at the given interval until the context is done.
+func (b *Billing) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := b.ChargeDue(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Could not charge subscriptions with an error of: %v\n", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-b.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Wake has Run charge the due subscriptions straight away, such as one whose pending charge the
+// bank has now decided on, rather than at its next check.
+func (b *Billing) Wake() {
+	b.signal()
+}
+
+// chargeDue charges the subscription for its next period if it is still due once it has been
+// claimed, as it may have been charged or changed since it was found to be due, and reports
+// whether the period was paid for. A subscription that is due to be cancelled at the end of its
+// period is cancelled instead. The charge is recorded as pending before the card is charged, and
+// a charge left pending, whether the bank has yet to decide on it or its outcome was never
+// recorded, is settled with the outcome of its payment rather than made again, so a period is
+// never charged twice. A failed charge is retried after the next of the RetryDelays, and once
+// they run out the subscription is cancelled.
+func (b *Billing) chargeDue(ctx context.Context, subscriptionId string) (bool, error) {
+	ok, subscription, err := b.claim(subscriptionId)
+	if err != nil || !ok {
+		return false, err
+	}
+	defer b.release(subscriptionId)
+
+	now := b.Clock().UTC()
+	charge, pending := subscription.pendingCharge()
+	credit := int64(0)
+	if !pending {
+		if subscription.CancelAtPeriodEnd {
+			subscription.cancel(subscription.CurrentPeriodEnd)
+			subscription.UpdatedAt = now
+			return false, b.Store.UpdateSubscription(subscription)
+		}
+		ok, plan, err := b.Store.RetrievePlan(subscription.PlanID)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, ErrPlanNotFound
+		}
+
+		// The balance carried over from changes of plan is charged, or credited, along with the period
+		amount := money.Money{MinorUnits: plan.Amount.MinorUnits + subscription.Balance.MinorUnits, Currency: plan.Amount.Currency}
+		charge = Charge{
+			Amount:      money.Money{Currency: amount.Currency},
+			Status:      ChargePending,
+			PeriodStart: subscription.CurrentPeriodEnd,
+			PeriodEnd:   plan.periodEnd(subscription.Anchor, subscription.Periods+1),
+			CreatedAt:   now,
+		}
+		if amount.MinorUnits > 0 {
+			charge.Amount = amount
+			// The charge, and the id its payment is made with, are recorded before the card is
+			// charged, so a charge whose outcome is lost to a failed write, a crash or the gateway
+			// stopping is settled next time rather than made again
+			charge.PaymentID = uuid.New().String()
+			subscription.Charges = append(subscription.Charges, charge)
+			subscription.UpdatedAt = now
+			if err := b.Store.UpdateSubscription(subscription); err != nil {
+				return false, err
+			}
+		} else {
+			// A credit larger than the period is kept for the periods after it
+			credit = amount.MinorUnits
+			subscription.Charges = append(subscription.Charges, charge)
+		}
+	}
+
+	status, chargeErr := ChargePaid, error(nil)
+	if charge.PaymentID != "" {
+		status, chargeErr = b.Charger.ChargeSavedCard(ctx, charge.PaymentID, subscription.MerchantID, subscription.CustomerID, subscription.PaymentMethodID, charge.Amount)
+		// A charge cut short because the gateway is stopping, or that the bank has yet to decide
+		// on, is left pending, to be settled next time
+		if chargeErr != nil && ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if status == ChargePending {
+			return false, chargeErr
+		}
+	}
+
+	charge.Status = status
+	if chargeErr != nil {
+		charge.Status = ChargeFailed
+		charge.Error = chargeErr.Error()
+		subscription.FailedAttempts++
+		if subscription.FailedAttempts > len(b.RetryDelays) {
+			subscription.cancel(now)
+		} else {
+			subscription.Status = StatusPastDue
+			subscription.NextChargeAt = now.Add(b.RetryDelays[subscription.FailedAttempts-1])
+		}
+	} else {
+		subscription.Status = StatusActive
+		subscription.FailedAttempts = 0
+		subscription.Periods++
+		subscription.CurrentPeriodStart = charge.PeriodStart
+		subscription.CurrentPeriodEnd = charge.PeriodEnd
+		subscription.NextChargeAt = charge.PeriodEnd
+		subscription.Balance.MinorUnits = credit
+	}
+	subscription.Charges[len(subscription.Charges)-1] = charge
+	subscription.UpdatedAt = now
+	if err := b.Store.UpdateSubscription(subscription); err != nil {
+		return false, err
+	}
+	return charge.Status == ChargePaid, nil
+}
+
+// claim marks the subscription as being charged, if it is still due, returning it along with
+// whether it was claimed. Changes to the subscription are refused until it is released.
+func (b *Billing) claim(subscriptionId string) (bool, Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.charging[subscriptionId]; ok {
+		return false, Subscription{}, nil
+	}
+	ok, subscription, err := b.Store.RetrieveSubscription(subscriptionId)
+	if err != nil || !ok || subscription.Status == StatusCancelled || subscription.NextChargeAt.After(b.Clock()) {
+		return false, Subscription{}, err
+	}
+	b.charging[subscriptionId] = struct{}{}
+	return true, subscription, nil
+}
+
+// release marks the subscription as no longer being charged.
+func (b *Billing) release(subscriptionId string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.charging, subscriptionId)
+}
+
+// signal wakes Run to charge a subscription that has fallen due, unless it has already been woken.
+func (b *Billing) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
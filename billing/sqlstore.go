@@ -0,0 +1,298 @@
+package billing
+
+import (
+	"database/sql"
+	"errors"
+	"payment-gateway/data"
+	"payment-gateway/money"
+	"time"
+)
+
+// SQLStore is a Store backed by a relational database, alongside the payments of a data.SQLStore.
+// Its tables are created by the data package's migrations.
+type SQLStore struct {
+	db *sql.DB // Handle to the database, which is safe for concurrent use
+}
+
+// selectPlans is the query shared by every read of plans.
+const selectPlans = `SELECT plan_id, merchant_id, name, amount_minor, currency, interval_unit, interval_count, created_at FROM plans`
+
+// selectSubscriptions is the query shared by every read of subscriptions.
+const selectSubscriptions = `SELECT subscription_id, merchant_id, customer_id, payment_method_id, plan_id, status, anchor, periods, current_period_start, current_period_end,
+		next_charge_at, balance_minor, currency, failed_attempts, cancel_at_period_end, cancelled_at, created_at, updated_at
+	FROM subscriptions`
+
+// NewSQLStore creates a SQLStore using the given database, applying any outstanding schema
+// migrations before returning.
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	if err := data.Migrate(db); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// AddPlan adds a new plan.
+func (s *SQLStore) AddPlan(plan Plan) error {
+	_, err := s.db.Exec(`INSERT INTO plans (plan_id, merchant_id, name, amount_minor, currency, interval_unit, interval_count, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		plan.ID, plan.MerchantID, plan.Name, plan.Amount.MinorUnits, plan.Amount.Currency, string(plan.Interval), plan.IntervalCount, timeString(plan.CreatedAt))
+	return err
+}
+
+// RetrievePlan returns the plan with the given id, and whether it was found.
+func (s *SQLStore) RetrievePlan(planId string) (bool, Plan, error) {
+	plan, err := scanPlan(s.db.QueryRow(selectPlans+` WHERE plan_id = ?`, planId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, Plan{}, nil
+	}
+	if err != nil {
+		return false, Plan{}, err
+	}
+	return true, plan, nil
+}
+
+// ListPlans returns the merchant's plans, oldest first.
+func (s *SQLStore) ListPlans(merchantId string) ([]Plan, error) {
+	rows, err := s.db.Query(selectPlans+` WHERE merchant_id = ? ORDER BY created_at, plan_id`, merchantId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	plans := []Plan{}
+	for rows.Next() {
+		plan, err := scanPlan(rows)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+	return plans, rows.Err()
+}
+
+// AddSubscription adds a new subscription along with its charges.
+func (s *SQLStore) AddSubscription(subscription Subscription) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO subscriptions (subscription_id, merchant_id, customer_id, payment_method_id, plan_id, status, anchor, periods, current_period_start, current_period_end,
+				next_charge_at, balance_minor, currency, failed_attempts, cancel_at_period_end, cancelled_at, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			subscription.ID, subscription.MerchantID, subscription.CustomerID, subscription.PaymentMethodID, subscription.PlanID, string(subscription.Status),
+			timeString(subscription.Anchor), subscription.Periods, timeString(subscription.CurrentPeriodStart), timeString(subscription.CurrentPeriodEnd),
+			nanos(subscription.NextChargeAt), subscription.Balance.MinorUnits, subscription.Balance.Currency, subscription.FailedAttempts, subscription.CancelAtPeriodEnd,
+			timeString(subscription.CancelledAt), timeString(subscription.CreatedAt), timeString(subscription.UpdatedAt))
+		if err != nil {
+			return err
+		}
+		return writeCharges(tx, subscription)
+	})
+}
+
+// RetrieveSubscription returns the subscription with the given id, and whether it was found.
+func (s *SQLStore) RetrieveSubscription(subscriptionId string) (bool, Subscription, error) {
+	subscriptions, err := s.readSubscriptions(`WHERE subscription_id = ?`, subscriptionId)
+	if err != nil {
+		return false, Subscription{}, err
+	}
+	if len(subscriptions) == 0 {
+		return false, Subscription{}, nil
+	}
+	return true, subscriptions[0], nil
+}
+
+// UpdateSubscription replaces an existing subscription, adding any new charges.
+func (s *SQLStore) UpdateSubscription(subscription Subscription) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec(`UPDATE subscriptions SET merchant_id = ?, customer_id = ?, payment_method_id = ?, plan_id = ?, status = ?, anchor = ?, periods = ?,
+				current_period_start = ?, current_period_end = ?, next_charge_at = ?, balance_minor = ?, currency = ?, failed_attempts = ?, cancel_at_period_end = ?,
+				cancelled_at = ?, created_at = ?, updated_at = ?
+			WHERE subscription_id = ?`,
+			subscription.MerchantID, subscription.CustomerID, subscription.PaymentMethodID, subscription.PlanID, string(subscription.Status),
+			timeString(subscription.Anchor), subscription.Periods, timeString(subscription.CurrentPeriodStart), timeString(subscription.CurrentPeriodEnd),
+			nanos(subscription.NextChargeAt), subscription.Balance.MinorUnits, subscription.Balance.Currency, subscription.FailedAttempts, subscription.CancelAtPeriodEnd,
+			timeString(subscription.CancelledAt), timeString(subscription.CreatedAt), timeString(subscription.UpdatedAt), subscription.ID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrSubscriptionNotFound
+		}
+		return writeCharges(tx, subscription)
+	})
+}
+
+// ListSubscriptions returns the merchant's subscriptions, oldest first.
+func (s *SQLStore) ListSubscriptions(merchantId string) ([]Subscription, error) {
+	return s.readSubscriptions(`WHERE merchant_id = ?`, merchantId)
+}
+
+// DueSubscriptions returns the subscriptions that are not cancelled and whose next charge is due
+// by now, oldest first.
+func (s *SQLStore) DueSubscriptions(now time.Time) ([]Subscription, error) {
+	return s.readSubscriptions(`WHERE status IN (?, ?) AND next_charge_at <= ?`, string(StatusActive), string(StatusPastDue), now.UnixNano())
+}
+
+// readSubscriptions returns the subscriptions matching the where clause, oldest first, along
+// with their charges.
+func (s *SQLStore) readSubscriptions(where string, args ...interface{}) ([]Subscription, error) {
+	rows, err := s.db.Query(selectSubscriptions+` `+where+` ORDER BY created_at, subscription_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	subscriptions := []Subscription{}
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	charges, err := s.readCharges(`WHERE subscription_id IN (SELECT subscription_id FROM subscriptions `+where+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range subscriptions {
+		for _, charge := range charges[subscriptions[i].ID] {
+			// Charges are always in the currency of their subscription
+			charge.Amount.Currency = subscriptions[i].Balance.Currency
+			subscriptions[i].Charges = append(subscriptions[i].Charges, charge)
+		}
+	}
+	return subscriptions, nil
+}
+
+// inTx runs fn inside a transaction, committing if it succeeds and rolling back otherwise.
+func (s *SQLStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// readCharges returns the charges matching the where clause, grouped by subscription and in the
+// order they were made. The currency of their amounts is left for the caller to fill in.
+func (s *SQLStore) readCharges(where string, args ...interface{}) (map[string][]Charge, error) {
+	rows, err := s.db.Query(`SELECT subscription_id, payment_id, amount_minor, status, error, period_start, period_end, created_at FROM subscription_charges `+where+` ORDER BY subscription_id, seq`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	charges := make(map[string][]Charge)
+	for rows.Next() {
+		var charge Charge
+		var subscriptionId, status, periodStart, periodEnd, createdAt string
+		if err := rows.Scan(&subscriptionId, &charge.PaymentID, &charge.Amount.MinorUnits, &status, &charge.Error, &periodStart, &periodEnd, &createdAt); err != nil {
+			return nil, err
+		}
+		charge.Status = ChargeStatus(status)
+		if err := parseTimes([]string{periodStart, periodEnd, createdAt}, &charge.PeriodStart, &charge.PeriodEnd, &charge.CreatedAt); err != nil {
+			return nil, err
+		}
+		charges[subscriptionId] = append(charges[subscriptionId], charge)
+	}
+	return charges, rows.Err()
+}
+
+// writeCharges stores the charges of the subscription that are not stored yet. Only the last
+// charge stored can have changed since, as it is settled once its payment's outcome is known,
+// so it is rewritten along with the new ones, at the end.
+func writeCharges(tx *sql.Tx, subscription Subscription) error {
+	var stored int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM subscription_charges WHERE subscription_id = ?`, subscription.ID).Scan(&stored); err != nil {
+		return err
+	}
+	if stored > 0 && stored <= len(subscription.Charges) {
+		charge := subscription.Charges[stored-1]
+		_, err := tx.Exec(`UPDATE subscription_charges SET payment_id = ?, amount_minor = ?, status = ?, error = ? WHERE subscription_id = ? AND seq = ?`,
+			charge.PaymentID, charge.Amount.MinorUnits, string(charge.Status), charge.Error, subscription.ID, stored-1)
+		if err != nil {
+			return err
+		}
+	}
+	for i := stored; i < len(subscription.Charges); i++ {
+		charge := subscription.Charges[i]
+		_, err := tx.Exec(`INSERT INTO subscription_charges (subscription_id, seq, payment_id, amount_minor, status, error, period_start, period_end, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			subscription.ID, i, charge.PaymentID, charge.Amount.MinorUnits, string(charge.Status), charge.Error,
+			timeString(charge.PeriodStart), timeString(charge.PeriodEnd), timeString(charge.CreatedAt))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanPlan reads a row produced by selectPlans into a Plan.
+func scanPlan(row scanner) (Plan, error) {
+	var plan Plan
+	var interval, createdAt string
+	if err := row.Scan(&plan.ID, &plan.MerchantID, &plan.Name, &plan.Amount.MinorUnits, &plan.Amount.Currency, &interval, &plan.IntervalCount, &createdAt); err != nil {
+		return plan, err
+	}
+	plan.Interval = Interval(interval)
+	var err error
+	plan.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+	return plan, err
+}
+
+// scanSubscription reads a row produced by selectSubscriptions into a Subscription, without its charges.
+func scanSubscription(row scanner) (Subscription, error) {
+	subscription := Subscription{Charges: []Charge{}}
+	var status, anchor, periodStart, periodEnd, cancelledAt, createdAt, updatedAt string
+	var nextChargeAt int64
+	var balance money.Money
+	if err := row.Scan(&subscription.ID, &subscription.MerchantID, &subscription.CustomerID, &subscription.PaymentMethodID, &subscription.PlanID, &status,
+		&anchor, &subscription.Periods, &periodStart, &periodEnd, &nextChargeAt, &balance.MinorUnits, &balance.Currency,
+		&subscription.FailedAttempts, &subscription.CancelAtPeriodEnd, &cancelledAt, &createdAt, &updatedAt); err != nil {
+		return subscription, err
+	}
+	subscription.Status = Status(status)
+	subscription.Balance = balance
+	if nextChargeAt != 0 {
+		subscription.NextChargeAt = time.Unix(0, nextChargeAt).UTC()
+	}
+	err := parseTimes([]string{anchor, periodStart, periodEnd, cancelledAt, createdAt, updatedAt},
+		&subscription.Anchor, &subscription.CurrentPeriodStart, &subscription.CurrentPeriodEnd, &subscription.CancelledAt, &subscription.CreatedAt, &subscription.UpdatedAt)
+	return subscription, err
+}
+
+// parseTimes parses each of the stored times into the time at the same position.
+func parseTimes(values []string, times ...*time.Time) error {
+	for i, value := range values {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return err
+		}
+		*times[i] = t
+	}
+	return nil
+}
+
+// timeString formats a time for storage.
+func timeString(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// nanos returns the time as nanoseconds since the Unix epoch, which due subscriptions are found
+// by, or zero for the zero time.
+func nanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
@@ -0,0 +1,204 @@
+package billing
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"payment-gateway/data"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store is the interface that defines the contract for where plans and subscriptions are kept.
+type Store interface {
+	AddPlan(plan Plan) error
+	RetrievePlan(planId string) (bool, Plan, error)
+	ListPlans(merchantId string) ([]Plan, error)
+	AddSubscription(subscription Subscription) error
+	RetrieveSubscription(subscriptionId string) (bool, Subscription, error)
+	UpdateSubscription(subscription Subscription) error
+	ListSubscriptions(merchantId string) ([]Subscription, error)
+	DueSubscriptions(now time.Time) ([]Subscription, error)
+}
+
+// MemoryStore is a Store held in memory. When it has a path, every change is also written to a
+// JSON snapshot at the path, which is read back when the store is opened again.
+type MemoryStore struct {
+	Plans         map[string]Plan         // A map that associates the plan id with its plan
+	Subscriptions map[string]Subscription // A map that associates the subscription id with its subscription
+
+	path string     // Where the snapshot is written, empty to keep the store in memory only
+	mu   sync.Mutex // Mutex to protect concurrent access to the store
+}
+
+// NewMemoryStore creates an empty MemoryStore that is only held in memory.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{Plans: make(map[string]Plan), Subscriptions: make(map[string]Subscription)}
+}
+
+// NewFileStore opens the MemoryStore snapshotted at path, creating an empty one if there is
+// no snapshot yet.
+func NewFileStore(path string) (*MemoryStore, error) {
+	s := NewMemoryStore()
+	file, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(file, s); err != nil {
+			return nil, err
+		}
+	}
+	s.path = path
+	return s, nil
+}
+
+// AddPlan adds a new plan.
+func (s *MemoryStore) AddPlan(plan Plan) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Plans[plan.ID] = plan
+	if err := s.save(); err != nil {
+		delete(s.Plans, plan.ID)
+		return err
+	}
+	return nil
+}
+
+// RetrievePlan returns the plan with the given id, and whether it was found.
+func (s *MemoryStore) RetrievePlan(planId string) (bool, Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	plan, ok := s.Plans[planId]
+	return ok, plan, nil
+}
+
+// ListPlans returns the merchant's plans, oldest first.
+func (s *MemoryStore) ListPlans(merchantId string) ([]Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	plans := []Plan{}
+	for _, plan := range s.Plans {
+		if plan.MerchantID == merchantId {
+			plans = append(plans, plan)
+		}
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		if !plans[i].CreatedAt.Equal(plans[j].CreatedAt) {
+			return plans[i].CreatedAt.Before(plans[j].CreatedAt)
+		}
+		return plans[i].ID < plans[j].ID
+	})
+	return plans, nil
+}
+
+// AddSubscription adds a new subscription.
+func (s *MemoryStore) AddSubscription(subscription Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Subscriptions[subscription.ID] = subscription.clone()
+	if err := s.save(); err != nil {
+		delete(s.Subscriptions, subscription.ID)
+		return err
+	}
+	return nil
+}
+
+// RetrieveSubscription returns the subscription with the given id, and whether it was found.
+func (s *MemoryStore) RetrieveSubscription(subscriptionId string) (bool, Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscription, ok := s.Subscriptions[subscriptionId]
+	return ok, subscription.clone(), nil
+}
+
+// UpdateSubscription replaces an existing subscription.
+func (s *MemoryStore) UpdateSubscription(subscription Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.Subscriptions[subscription.ID]
+	if !ok {
+		return ErrSubscriptionNotFound
+	}
+	s.Subscriptions[subscription.ID] = subscription.clone()
+	if err := s.save(); err != nil {
+		s.Subscriptions[subscription.ID] = previous
+		return err
+	}
+	return nil
+}
+
+// ListSubscriptions returns the merchant's subscriptions, oldest first.
+func (s *MemoryStore) ListSubscriptions(merchantId string) ([]Subscription, error) {
+	return s.subscriptions(func(subscription Subscription) bool {
+		return subscription.MerchantID == merchantId
+	}), nil
+}
+
+// DueSubscriptions returns the subscriptions that are not cancelled and whose next charge is due
+// by now, oldest first.
+func (s *MemoryStore) DueSubscriptions(now time.Time) ([]Subscription, error) {
+	return s.subscriptions(func(subscription Subscription) bool {
+		return subscription.Status != StatusCancelled && !subscription.NextChargeAt.After(now)
+	}), nil
+}
+
+// subscriptions returns the subscriptions that match, oldest first.
+func (s *MemoryStore) subscriptions(match func(subscription Subscription) bool) []Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscriptions := []Subscription{}
+	for _, subscription := range s.Subscriptions {
+		if match(subscription) {
+			subscriptions = append(subscriptions, subscription.clone())
+		}
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if !subscriptions[i].CreatedAt.Equal(subscriptions[j].CreatedAt) {
+			return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+		}
+		return subscriptions[i].ID < subscriptions[j].ID
+	})
+	return subscriptions
+}
+
+// clone returns a copy of the subscription that shares no memory with the original, so that
+// copies handed out by a store can be modified without affecting the stored subscription.
+func (s Subscription) clone() Subscription {
+	s.Charges = append([]Charge{}, s.Charges...)
+	return s
+}
+
+// save writes the store to its snapshot, if it has one, by way of a temporary file renamed into
+// place. It must be called with the mutex held.
+func (s *MemoryStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	snapshot, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	return data.SyncDir(filepath.Dir(s.path))
+}
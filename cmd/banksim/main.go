@@ -0,0 +1,49 @@
+// Command banksim runs a simulated acquiring bank for the gateway to send payments to locally.
+//
+// Start it, then point the gateway at it with the same signing secret:
+//
+//	BANK_SIGNING_SECRET=secret go run ./cmd/banksim -addr :8081
+//	BANK_URL=http://localhost:8081 BANK_SIGNING_SECRET=secret go run .
+//
+// See the README for the card numbers and amounts that trigger each outcome.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"payment-gateway/banksim"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", ":8081", "address to listen on")
+	latency := flag.Duration("latency", 0, "delay added to every response")
+	slowLatency := flag.Duration("slow-latency", 3*time.Second, "delay added to responses for the slow card and amount")
+	unavailableRate := flag.Float64("unavailable-rate", 0, "fraction of requests, between 0 and 1, answered with a 503 at random")
+	errorRate := flag.Float64("error-rate", 0, "fraction of requests, between 0 and 1, answered with a 500 at random")
+	pendingLatency := flag.Duration("pending-latency", 10*time.Second, "how long the decision on a pending payment takes")
+	notifyURL := flag.String("notify-url", "", "URL the decisions on pending payments are sent to, e.g. http://localhost:8080/bank/notifications")
+	flag.Parse()
+
+	// Requests are only checked against a signature when a secret is set
+	secret := os.Getenv("BANK_SIGNING_SECRET")
+	if secret == "" {
+		log.Println("BANK_SIGNING_SECRET is not set, request signatures will not be checked")
+	}
+
+	simulator := banksim.New(banksim.Config{
+		Secret:          []byte(secret),
+		Latency:         *latency,
+		SlowLatency:     *slowLatency,
+		UnavailableRate: *unavailableRate,
+		ErrorRate:       *errorRate,
+		PendingLatency:  *pendingLatency,
+		NotificationURL: *notifyURL,
+	})
+	log.Printf("Simulated bank listening on %s\n", *addr)
+	if err := http.ListenAndServe(*addr, simulator); err != nil {
+		log.Fatalf("Could not run simulated bank with an error of: %v\n", err)
+	}
+}
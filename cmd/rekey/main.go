@@ -0,0 +1,82 @@
+// Command rekey re-encrypts every tokenised card in the vault under the primary key of the
+// keyring, so older keys can be retired. It reads the same PAYMENT_STORE, PAYMENT_STORE_PATH and
+// VAULT_KEYRING envars as the gateway.
+//
+// Only the sql store can be rotated without downtime. Add the new key to the start of the keyring
+// file, keeping the old ones after it, and restart the gateway so new cards are encrypted under
+// it. Then run rekey, and once it reports every card rotated remove the old keys from the keyring:
+//
+//	PAYMENT_STORE=sql PAYMENT_STORE_PATH=payments.db VAULT_KEYRING=keyring.json go run ./cmd/rekey
+//
+// Cards are rotated one at a time, and the gateway can decrypt each of them throughout, so it
+// keeps serving payments while rekey runs.
+//
+// The file store is only read when the gateway starts, so a running gateway's next write would
+// put back the cards as they were. Rotating it needs downtime: rekey refuses to run against the
+// file store unless given -offline, which must only be done once the gateway has been stopped.
+// Start the gateway again once rekey has finished.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"payment-gateway/data"
+	"payment-gateway/vault"
+
+	_ "modernc.org/sqlite" // Pure Go SQLite driver used by the sql payment store
+)
+
+func main() {
+	offline := flag.Bool("offline", false, "rotate the file store, which must only be done with the gateway stopped")
+	flag.Parse()
+
+	path := os.Getenv("VAULT_KEYRING")
+	if path == "" {
+		log.Fatalln("VAULT_KEYRING must be set to the keyring to rotate cards to the primary key of")
+	}
+	keys, err := vault.LoadKeyring(path)
+	if err != nil {
+		log.Fatalf("Could not read VAULT_KEYRING with an error of: %v\n", err)
+	}
+
+	var store vault.Store
+	switch backend := os.Getenv("PAYMENT_STORE"); backend {
+	case "file":
+		if !*offline {
+			log.Fatalln("The file store cannot be rotated while the gateway is running. Stop the gateway, then run rekey again with -offline")
+		}
+		store, err = vault.NewFileStore(filepath.Join(envOrDefault("PAYMENT_STORE_PATH", "payment-data"), "vault.json"))
+	case "sql":
+		var db *sql.DB
+		// Wait on the gateway's writes rather than fail, as both use the database at once
+		db, err = sql.Open("sqlite", data.SQLiteDSN(envOrDefault("PAYMENT_STORE_PATH", "payments.db")))
+		if err != nil {
+			break
+		}
+		defer db.Close()
+		db.SetMaxOpenConns(1)
+		store, err = vault.NewSQLStore(db)
+	default:
+		log.Fatalf("PAYMENT_STORE must be file or sql, as cards in the memory store are lost when the gateway stops\n")
+	}
+	if err != nil {
+		log.Fatalf("Could not open the card vault with an error of: %v\n", err)
+	}
+
+	rotated, err := vault.New(store, keys).Rotate()
+	if err != nil {
+		log.Fatalf("Rotated %d cards before failing with an error of: %v\n", rotated, err)
+	}
+	log.Printf("Rotated %d cards to key %s\n", rotated, keys.Primary().ID)
+}
+
+// Function to read an envar, falling back to a default when it is not set
+func envOrDefault(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,182 @@
+// Package customers keeps merchants' customers, and the cards they have saved so they can be
+// paid with again without the card being given in full. Saved cards are held, encrypted, by the
+// vault, and customers only refer to them by token.
+package customers
+
+import (
+	"errors"
+	"net/mail"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Errors returned by Customers.
+var (
+	ErrCustomerNotFound      = errors.New("customer not found")
+	ErrPaymentMethodNotFound = errors.New("payment method not found")
+	ErrInvalidEmail          = errors.New("invalid email address")
+)
+
+// Customer is one of a merchant's customers, who can save cards to pay with later.
+type Customer struct {
+	ID             string          // The gateway's identifier for the customer
+	MerchantID     string          // The merchant the customer belongs to, who alone can see them
+	Name           string          // The customer's name, as given by the merchant
+	Email          string          // The customer's email address, empty if not given
+	PaymentMethods []PaymentMethod // The cards the customer has saved, oldest first
+	CreatedAt      time.Time       // When the customer was created
+	UpdatedAt      time.Time       // When the customer, or their saved cards, last changed
+}
+
+// PaymentMethod is a card saved by a customer. Its details are held by the vault under its token.
+type PaymentMethod struct {
+	ID        string    // The gateway's identifier for the payment method
+	CardToken string    // The vault token of the card
+	CreatedAt time.Time // When the card was saved
+}
+
+// Customers creates and changes the customers of merchants, kept in a Store. Customers of other
+// merchants are reported as not found, the same as customers that do not exist.
+type Customers struct {
+	Store                  // Embedding Store to keep the customers
+	Clock func() time.Time // Source of the current time, replaceable in tests
+
+	mu sync.Mutex // Serialises changes, so that concurrent changes to a customer are not lost
+}
+
+// New creates Customers keeping the customers in store.
+func New(store Store) *Customers {
+	return &Customers{Store: store, Clock: time.Now}
+}
+
+// Create adds a new customer for the merchant.
+func (c *Customers) Create(merchantId, name, email string) (Customer, error) {
+	if !validEmail(email) {
+		return Customer{}, ErrInvalidEmail
+	}
+	now := c.Clock().UTC()
+	customer := Customer{
+		ID:             uuid.New().String(),
+		MerchantID:     merchantId,
+		Name:           name,
+		Email:          email,
+		PaymentMethods: []PaymentMethod{},
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	if err := c.Store.AddCustomer(customer); err != nil {
+		return Customer{}, err
+	}
+	return customer, nil
+}
+
+// Customer returns the merchant's customer with the given id.
+func (c *Customers) Customer(merchantId, customerId string) (Customer, error) {
+	ok, customer, err := c.Store.RetrieveCustomer(customerId)
+	if err != nil {
+		return Customer{}, err
+	}
+	if !ok || customer.MerchantID != merchantId {
+		return Customer{}, ErrCustomerNotFound
+	}
+	return customer, nil
+}
+
+// List returns the merchant's customers, oldest first.
+func (c *Customers) List(merchantId string) ([]Customer, error) {
+	return c.Store.ListCustomers(merchantId)
+}
+
+// Update replaces the name and email address of the merchant's customer.
+func (c *Customers) Update(merchantId, customerId, name, email string) (Customer, error) {
+	if !validEmail(email) {
+		return Customer{}, ErrInvalidEmail
+	}
+	return c.change(merchantId, customerId, func(customer *Customer) error {
+		customer.Name = name
+		customer.Email = email
+		return nil
+	})
+}
+
+// Delete removes the merchant's customer along with their saved cards. The cards stay in the
+// vault, as payments already made with them refer to them by token.
+func (c *Customers) Delete(merchantId, customerId string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.Customer(merchantId, customerId); err != nil {
+		return err
+	}
+	return c.Store.DeleteCustomer(customerId)
+}
+
+// AddPaymentMethod saves the card with the given vault token for the merchant's customer. The
+// caller checks the token belongs to the merchant.
+func (c *Customers) AddPaymentMethod(merchantId, customerId, cardToken string) (PaymentMethod, error) {
+	method := PaymentMethod{ID: uuid.New().String(), CardToken: cardToken, CreatedAt: c.Clock().UTC()}
+	_, err := c.change(merchantId, customerId, func(customer *Customer) error {
+		customer.PaymentMethods = append(customer.PaymentMethods, method)
+		return nil
+	})
+	if err != nil {
+		return PaymentMethod{}, err
+	}
+	return method, nil
+}
+
+// PaymentMethod returns the saved card of the merchant's customer with the given id.
+func (c *Customers) PaymentMethod(merchantId, customerId, paymentMethodId string) (PaymentMethod, error) {
+	customer, err := c.Customer(merchantId, customerId)
+	if err != nil {
+		return PaymentMethod{}, err
+	}
+	for _, method := range customer.PaymentMethods {
+		if method.ID == paymentMethodId {
+			return method, nil
+		}
+	}
+	return PaymentMethod{}, ErrPaymentMethodNotFound
+}
+
+// RemovePaymentMethod removes a saved card from the merchant's customer.
+func (c *Customers) RemovePaymentMethod(merchantId, customerId, paymentMethodId string) error {
+	_, err := c.change(merchantId, customerId, func(customer *Customer) error {
+		for i, method := range customer.PaymentMethods {
+			if method.ID == paymentMethodId {
+				customer.PaymentMethods = append(customer.PaymentMethods[:i:i], customer.PaymentMethods[i+1:]...)
+				return nil
+			}
+		}
+		return ErrPaymentMethodNotFound
+	})
+	return err
+}
+
+// change applies fn to the merchant's customer and stores the result.
+func (c *Customers) change(merchantId, customerId string, fn func(customer *Customer) error) (Customer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	customer, err := c.Customer(merchantId, customerId)
+	if err != nil {
+		return Customer{}, err
+	}
+	if err := fn(&customer); err != nil {
+		return Customer{}, err
+	}
+	customer.UpdatedAt = c.Clock().UTC()
+	if err := c.Store.UpdateCustomer(customer); err != nil {
+		return Customer{}, err
+	}
+	return customer, nil
+}
+
+// validEmail reports whether email is a bare email address, or empty.
+func validEmail(email string) bool {
+	if email == "" {
+		return true
+	}
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
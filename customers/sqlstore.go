@@ -0,0 +1,197 @@
+package customers
+
+import (
+	"database/sql"
+	"errors"
+	"payment-gateway/data"
+	"time"
+)
+
+// SQLStore is a Store backed by a relational database, alongside the payments of a data.SQLStore.
+// Its tables are created by the data package's migrations.
+type SQLStore struct {
+	db *sql.DB // Handle to the database, which is safe for concurrent use
+}
+
+// selectCustomers is the query shared by every read of customers.
+const selectCustomers = `SELECT customer_id, merchant_id, name, email, created_at, updated_at FROM customers`
+
+// NewSQLStore creates a SQLStore using the given database, applying any outstanding schema
+// migrations before returning.
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	if err := data.Migrate(db); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// AddCustomer adds a new customer along with their saved cards.
+func (s *SQLStore) AddCustomer(customer Customer) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO customers (customer_id, merchant_id, name, email, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			customer.ID, customer.MerchantID, customer.Name, customer.Email, timeString(customer.CreatedAt), timeString(customer.UpdatedAt))
+		if err != nil {
+			return err
+		}
+		return writePaymentMethods(tx, customer)
+	})
+}
+
+// RetrieveCustomer returns the customer with the given id, and whether it was found.
+func (s *SQLStore) RetrieveCustomer(customerId string) (bool, Customer, error) {
+	customer, err := scanCustomer(s.db.QueryRow(selectCustomers+` WHERE customer_id = ?`, customerId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, Customer{}, nil
+	}
+	if err != nil {
+		return false, Customer{}, err
+	}
+	methods, err := s.readPaymentMethods(`WHERE customer_id = ?`, customerId)
+	if err != nil {
+		return false, Customer{}, err
+	}
+	customer.PaymentMethods = append(customer.PaymentMethods, methods[customer.ID]...)
+	return true, customer, nil
+}
+
+// UpdateCustomer replaces the details and saved cards of an existing customer.
+func (s *SQLStore) UpdateCustomer(customer Customer) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec(`UPDATE customers SET merchant_id = ?, name = ?, email = ?, created_at = ?, updated_at = ? WHERE customer_id = ?`,
+			customer.MerchantID, customer.Name, customer.Email, timeString(customer.CreatedAt), timeString(customer.UpdatedAt), customer.ID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrCustomerNotFound
+		}
+		return writePaymentMethods(tx, customer)
+	})
+}
+
+// ListCustomers returns the merchant's customers, oldest first.
+func (s *SQLStore) ListCustomers(merchantId string) ([]Customer, error) {
+	rows, err := s.db.Query(selectCustomers+` WHERE merchant_id = ? ORDER BY created_at, customer_id`, merchantId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	customers := []Customer{}
+	for rows.Next() {
+		customer, err := scanCustomer(rows)
+		if err != nil {
+			return nil, err
+		}
+		customers = append(customers, customer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	methods, err := s.readPaymentMethods(`WHERE customer_id IN (SELECT customer_id FROM customers WHERE merchant_id = ?)`, merchantId)
+	if err != nil {
+		return nil, err
+	}
+	for i := range customers {
+		customers[i].PaymentMethods = append(customers[i].PaymentMethods, methods[customers[i].ID]...)
+	}
+	return customers, nil
+}
+
+// DeleteCustomer removes the customer with the given id, along with their saved cards.
+func (s *SQLStore) DeleteCustomer(customerId string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM customer_payment_methods WHERE customer_id = ?`, customerId); err != nil {
+			return err
+		}
+		result, err := tx.Exec(`DELETE FROM customers WHERE customer_id = ?`, customerId)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrCustomerNotFound
+		}
+		return nil
+	})
+}
+
+// inTx runs fn inside a transaction, committing if it succeeds and rolling back otherwise.
+func (s *SQLStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// readPaymentMethods returns the saved cards matching the where clause, grouped by customer and
+// in the order they were saved.
+func (s *SQLStore) readPaymentMethods(where string, args ...interface{}) (map[string][]PaymentMethod, error) {
+	rows, err := s.db.Query(`SELECT customer_id, payment_method_id, card_token, created_at FROM customer_payment_methods `+where+` ORDER BY customer_id, seq`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	methods := make(map[string][]PaymentMethod)
+	for rows.Next() {
+		var method PaymentMethod
+		var customerId, createdAt string
+		if err := rows.Scan(&customerId, &method.ID, &method.CardToken, &createdAt); err != nil {
+			return nil, err
+		}
+		if method.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+			return nil, err
+		}
+		methods[customerId] = append(methods[customerId], method)
+	}
+	return methods, rows.Err()
+}
+
+// writePaymentMethods replaces the stored saved cards of the customer with their current ones.
+func writePaymentMethods(tx *sql.Tx, customer Customer) error {
+	if _, err := tx.Exec(`DELETE FROM customer_payment_methods WHERE customer_id = ?`, customer.ID); err != nil {
+		return err
+	}
+	for i, method := range customer.PaymentMethods {
+		_, err := tx.Exec(`INSERT INTO customer_payment_methods (payment_method_id, customer_id, seq, card_token, created_at) VALUES (?, ?, ?, ?, ?)`,
+			method.ID, customer.ID, i, method.CardToken, timeString(method.CreatedAt))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanCustomer reads a row produced by selectCustomers into a Customer, without their saved cards.
+func scanCustomer(row scanner) (Customer, error) {
+	customer := Customer{PaymentMethods: []PaymentMethod{}}
+	var createdAt, updatedAt string
+	if err := row.Scan(&customer.ID, &customer.MerchantID, &customer.Name, &customer.Email, &createdAt, &updatedAt); err != nil {
+		return customer, err
+	}
+	var err error
+	if customer.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return customer, err
+	}
+	customer.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt)
+	return customer, err
+}
+
+// timeString formats a time for storage.
+func timeString(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
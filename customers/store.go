@@ -0,0 +1,161 @@
+package customers
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"payment-gateway/data"
+	"sort"
+	"sync"
+)
+
+// Store is the interface that defines the contract for where customers are kept.
+type Store interface {
+	AddCustomer(customer Customer) error
+	RetrieveCustomer(customerId string) (bool, Customer, error)
+	UpdateCustomer(customer Customer) error
+	ListCustomers(merchantId string) ([]Customer, error)
+	DeleteCustomer(customerId string) error
+}
+
+// MemoryStore is a Store held in memory. When it has a path, every change is also written to a
+// JSON snapshot at the path, which is read back when the store is opened again.
+type MemoryStore struct {
+	Customers map[string]Customer // A map that associates the customer id with its customer
+
+	path string     // Where the snapshot is written, empty to keep the store in memory only
+	mu   sync.Mutex // Mutex to protect concurrent access to the store
+}
+
+// NewMemoryStore creates an empty MemoryStore that is only held in memory.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{Customers: make(map[string]Customer)}
+}
+
+// NewFileStore opens the MemoryStore snapshotted at path, creating an empty one if there is
+// no snapshot yet.
+func NewFileStore(path string) (*MemoryStore, error) {
+	s := NewMemoryStore()
+	file, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(file, s); err != nil {
+			return nil, err
+		}
+	}
+	s.path = path
+	return s, nil
+}
+
+// AddCustomer adds a new customer.
+func (s *MemoryStore) AddCustomer(customer Customer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Customers[customer.ID] = customer.clone()
+	if err := s.save(); err != nil {
+		delete(s.Customers, customer.ID)
+		return err
+	}
+	return nil
+}
+
+// RetrieveCustomer returns the customer with the given id, and whether it was found.
+func (s *MemoryStore) RetrieveCustomer(customerId string) (bool, Customer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	customer, ok := s.Customers[customerId]
+	return ok, customer.clone(), nil
+}
+
+// UpdateCustomer replaces an existing customer.
+func (s *MemoryStore) UpdateCustomer(customer Customer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.Customers[customer.ID]
+	if !ok {
+		return ErrCustomerNotFound
+	}
+	s.Customers[customer.ID] = customer.clone()
+	if err := s.save(); err != nil {
+		s.Customers[customer.ID] = previous
+		return err
+	}
+	return nil
+}
+
+// ListCustomers returns the merchant's customers, oldest first.
+func (s *MemoryStore) ListCustomers(merchantId string) ([]Customer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	customers := []Customer{}
+	for _, customer := range s.Customers {
+		if customer.MerchantID == merchantId {
+			customers = append(customers, customer.clone())
+		}
+	}
+	sort.Slice(customers, func(i, j int) bool {
+		if !customers[i].CreatedAt.Equal(customers[j].CreatedAt) {
+			return customers[i].CreatedAt.Before(customers[j].CreatedAt)
+		}
+		return customers[i].ID < customers[j].ID
+	})
+	return customers, nil
+}
+
+// DeleteCustomer removes the customer with the given id.
+func (s *MemoryStore) DeleteCustomer(customerId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.Customers[customerId]
+	if !ok {
+		return ErrCustomerNotFound
+	}
+	delete(s.Customers, customerId)
+	if err := s.save(); err != nil {
+		s.Customers[customerId] = previous
+		return err
+	}
+	return nil
+}
+
+// clone returns a copy of the customer that shares no memory with the original, so that copies
+// handed out by a store can be modified without affecting the stored customer.
+func (c Customer) clone() Customer {
+	c.PaymentMethods = append([]PaymentMethod{}, c.PaymentMethods...)
+	return c
+}
+
+// save writes the store to its snapshot, if it has one, by way of a temporary file renamed into
+// place. It must be called with the mutex held.
+func (s *MemoryStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	snapshot, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	return data.SyncDir(filepath.Dir(s.path))
+}
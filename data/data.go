@@ -1,23 +1,104 @@
 package data
 
 import (
+	"errors"
+	"payment-gateway/money"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrPaymentNotFound is returned by a PaymentStore when the requested payment does not exist.
+var ErrPaymentNotFound = errors.New("payment not found")
+
+// ErrPaymentExists is returned by a PaymentStore when adding a payment whose ID is already stored.
+var ErrPaymentExists = errors.New("payment already exists")
+
+// PaymentStore is the interface that defines the contract for a payment data store.
+// The in-memory GatewayData is one implementation, durable backends can be swapped in
+// behind the PaymentGatewayService without any changes to the handlers.
+type PaymentStore interface {
+	AddPayment(payment Payment) error
+	RetrievePayment(paymentId PaymentID) (bool, Payment, error)
+	UpdatePayment(payment Payment) error
+	ListPayments() ([]Payment, error)
+	QueryPayments(query PaymentQuery) ([]Payment, error)
+	PendingPayments() ([]Payment, error)
+	DeletePayment(paymentId PaymentID) error
+}
+
 // GatewayData holds the payment data, which is held in an in-memory map,
 // As well as a mutex lock to protect the PyamentData map, as it is shared.
 // This can be expanded to contain other meta data about the system/payments.
 type GatewayData struct {
-	PaymentData map[PaymentID]Payment // A map that associates PaymentID with Payment.
-	mu          sync.Mutex            // Mutex to protect concurrent access to PaymentData
+	PaymentData map[PaymentID]Payment   // A map that associates PaymentID with Payment.
+	byMerchant  map[string][]paymentKey // Each merchant's payments in the order they were created, see QueryPayments
+	pending     map[PaymentID]struct{}  // The IDs of the payments in the pending state, see PendingPayments
+	mu          sync.Mutex              // Mutex to protect concurrent access to PaymentData
 }
 
 // Payment represents a payment transaction.
 type Payment struct {
-	BankTransactionData // Embedding BankTransactionData to inherit its fields.
-	CardData            // Embedding CardData to inherit its fields.
+	PaymentID           PaymentID         // The gateway's identifier for the payment.
+	MerchantID          string            // The merchant that owns the payment.
+	State               PaymentState      // Where the payment is in its lifecycle.
+	CreatedAt           time.Time         // When the payment was recorded, which payments are listed in the order of.
+	History             []StateTransition // Every state the payment has been through, oldest first.
+	CapturedAmount      money.Money       // How much of the authorised amount has been taken.
+	AuthorisationExpiry time.Time         // When the authorisation lapses if the payment is not captured.
+	Refunds             []Refund          // Every refund asked of the bank, oldest first, including declined ones.
+	BankAttempts        int               // How many times the bank was called to make the payment, including retries.
+	Acquirer            string            // The acquiring bank the payment was made with, empty when only one is used.
+	AutoCapture         bool              // Whether the payment is captured as soon as the bank approves it.
+	Initiator           Initiator         // Who started the payment, the cardholder or the merchant.
+	CustomerID          string            // The customer whose saved card the payment was made with, empty for any other card.
+	BankTransactionData                   // Embedding BankTransactionData to inherit its fields.
+	StoredCard                            // Embedding StoredCard to inherit its fields, the full card data is never stored.
+}
+
+// clone returns a copy of the payment that shares no memory with the original, so that copies
+// handed out by a store can be modified without affecting the stored payment.
+func (p Payment) clone() Payment {
+	p.History = append([]StateTransition(nil), p.History...)
+	p.Refunds = append([]Refund(nil), p.Refunds...)
+	return p
+}
+
+// creationTime returns when the payment was recorded. Payments stored before the time was
+// recorded were created at their first state transition, if they have one.
+func (p Payment) creationTime() time.Time {
+	if p.CreatedAt.IsZero() && len(p.History) > 0 {
+		return p.History[0].At
+	}
+	return p.CreatedAt
+}
+
+// RefundedAmount returns how much of the captured amount has been given back by successful refunds.
+func (p Payment) RefundedAmount() money.Money {
+	refunded := money.Money{Currency: p.Amount.Currency}
+	for _, refund := range p.Refunds {
+		if refund.Status == "Success" {
+			refunded.MinorUnits += refund.Amount.MinorUnits
+		}
+	}
+	return refunded
+}
+
+// RefundableAmount returns how much of the captured amount can still be refunded.
+func (p Payment) RefundableAmount() money.Money {
+	return money.Money{MinorUnits: p.CapturedAmount.MinorUnits - p.RefundedAmount().MinorUnits, Currency: p.Amount.Currency}
+}
+
+// Refund represents money given back to the card holder from a captured payment.
+type Refund struct {
+	RefundID     RefundID          // The gateway's identifier for the refund.
+	BankRefundID BankPaymentID     // The bank's reference for the refund.
+	Status       BankPaymentStatus // The bank's answer to the refund.
+	Amount       money.Money       // How much was refunded.
+	CreatedAt    time.Time         // When the refund was made.
+	BankAttempts int               // How many times the bank was called to make the refund, including retries.
 }
 
 // BankTransactionData represents data related to a bank transaction.
@@ -26,62 +107,185 @@ type BankTransactionData struct {
 	BankPaymentStatus // Embedding BankPaymentStatus to inherit its fields.
 }
 
-// CardData represents data related to the payment card.
+// CardData represents data related to the payment card, as given by the merchant. It is only
+// held for as long as it takes to send the payment to the bank, and is never stored, as it
+// holds the full card number and the CVV.
 type CardData struct {
 	CardNumber string
 	ExpiryDate string
-	Amount     float64
-	Currency   string
+	Amount     money.Money // The amount and currency of the payment, held in minor units
 	Cvv        string
+	Brand      string    // The card scheme detected from the card number, e.g. Visa
+	Token      string    // The vault token of the card, given instead of the card number for a tokenised card
+	Initiator  Initiator // Who started the payment, which the bank is told
+	CustomerID string    // The customer whose saved card is paid with, if any
+}
+
+// Initiator is a custom type representing who started a payment. Card schemes treat payments the
+// cardholder is not there for differently, so the bank is told which each payment is.
+type Initiator string
+
+// The parties that can start a payment.
+const (
+	CustomerInitiated Initiator = "customer" // The cardholder is there to make the payment, e.g. at checkout
+	MerchantInitiated Initiator = "merchant" // The merchant charges a card the cardholder saved with them, e.g. for a subscription
+)
+
+// StoredCard represents the card data that is kept with a payment. It has no room for the CVV,
+// which must never be stored once the payment is sent to the bank, nor for the full card number
+// or expiry date, so none can be stored by mistake. The card number and expiry date are held,
+// encrypted, by the vault under the token.
+type StoredCard struct {
+	CardToken    string      // The vault token the card number can be looked up with when it is sent to the bank
+	CardLastFour string      // The last four digits of the card number
+	Amount       money.Money // The amount and currency of the payment, held in minor units
+	Brand        string      // The card scheme detected from the card number, e.g. Visa
+}
+
+// MaskedCardNumber returns the card number with all but its last four digits hidden.
+func (c StoredCard) MaskedCardNumber() string {
+	return "****" + c.CardLastFour
 }
 
 // PaymentID is a custom type representing a unique identifier for a payment.
 type PaymentID uuid.UUID
 
+// RefundID is a custom type representing a unique identifier for a refund.
+type RefundID uuid.UUID
+
 // BankPaymentID is a custom type representing a unique identifier for a bank payment transaction.
 type BankPaymentID uuid.UUID
 
 // BankPaymentStatus is a custom type representing the status of a bank payment transaction.
 type BankPaymentStatus string
 
-func (g *GatewayData) AddPayment(bstatus BankPaymentStatus, bpid BankPaymentID, paymentId PaymentID, cd CardData) {
+// NewGatewayData creates a new in-memory PaymentStore with an initialised PaymentData map.
+func NewGatewayData() *GatewayData {
+	g := new(GatewayData)
+	g.PaymentData = make(map[PaymentID]Payment)
+	g.byMerchant = make(map[string][]paymentKey)
+	g.pending = make(map[PaymentID]struct{})
+	return g
+}
+
+// AddPayment stores a new payment, keyed by its PaymentID.
+func (g *GatewayData) AddPayment(payment Payment) error {
 	// Lock the mutex to protect concurrent access to PaymentData
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	// Create a new BankTransactionData with the received bank payment status and ID
-	var btd BankTransactionData
-	btd.BankPaymentStatus = bstatus
-	btd.BankPaymentID = bpid
+	if _, ok := g.PaymentData[payment.PaymentID]; ok {
+		return ErrPaymentExists
+	}
+	// Add the payment to the PaymentData map with the generated payment ID
+	g.put(payment)
+	return nil
+}
 
-	// Create a new Payment with the card data and bank transaction data
-	var payment Payment
-	payment.CardData = cd
-	payment.BankTransactionData = btd
+// RetrievePayment returns the stored payment for the given ID, and whether it was found.
+func (g *GatewayData) RetrievePayment(paymentId PaymentID) (bool, Payment, error) {
+	// Lock the mutex to protect concurrent access to PaymentData
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	payment, ok := g.PaymentData[paymentId]
+	return ok, payment.clone(), nil
+}
 
-	// Add the payment to the PaymentData map with the generated payment ID
-	g.PaymentData[paymentId] = payment
+// UpdatePayment replaces an existing payment with the provided one.
+func (g *GatewayData) UpdatePayment(payment Payment) error {
+	// Lock the mutex to protect concurrent access to PaymentData
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.PaymentData[payment.PaymentID]; !ok {
+		return ErrPaymentNotFound
+	}
+	g.put(payment)
+	return nil
+}
+
+// ListPayments returns every stored payment. The order of the returned payments is not defined.
+func (g *GatewayData) ListPayments() ([]Payment, error) {
+	// Lock the mutex to protect concurrent access to PaymentData
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	payments := make([]Payment, 0, len(g.PaymentData))
+	for _, payment := range g.PaymentData {
+		payments = append(payments, payment.clone())
+	}
+	return payments, nil
+}
+
+// PendingPayments returns every payment in the pending state, oldest first.
+func (g *GatewayData) PendingPayments() ([]Payment, error) {
+	// Lock the mutex to protect concurrent access to PaymentData
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	payments := make([]Payment, 0, len(g.pending))
+	for paymentId := range g.pending {
+		payments = append(payments, g.PaymentData[paymentId].clone())
+	}
+	sort.Slice(payments, func(i, j int) bool { return keyOf(payments[i]).less(keyOf(payments[j])) })
+	return payments, nil
 }
 
-func (g *GatewayData) RetrievePayment(paymentId PaymentID) (bool, BankPaymentStatus, CardData) {
+// DeletePayment removes the payment with the given ID from the store.
+func (g *GatewayData) DeletePayment(paymentId PaymentID) error {
 	// Lock the mutex to protect concurrent access to PaymentData
 	g.mu.Lock()
 	defer g.mu.Unlock()
-	var maskedCardData CardData
-	var bankPaymentStatus BankPaymentStatus
-	if payment, ok := g.PaymentData[paymentId]; ok {
-		// If found, return true, masked card number and data, and bank payment status
-		maskedCardData.Amount = payment.Amount
-		maskedCardData.CardNumber = MaskCardNumber(payment.CardData)
-		maskedCardData.Currency = payment.Currency
-		maskedCardData.ExpiryDate = payment.ExpiryDate
-		bankPaymentStatus = payment.BankPaymentStatus
-		return true, bankPaymentStatus, maskedCardData
+	if _, ok := g.PaymentData[paymentId]; !ok {
+		return ErrPaymentNotFound
+	}
+	g.remove(paymentId)
+	return nil
+}
+
+// put stores the payment, replacing any payment with the same ID, and keeps the merchant's
+// index of payments up to date. The caller must hold the lock.
+func (g *GatewayData) put(payment Payment) {
+	payment = payment.clone()
+	payment.CreatedAt = payment.creationTime()
+	if payment.State == StatePending {
+		g.pending[payment.PaymentID] = struct{}{}
+	} else {
+		delete(g.pending, payment.PaymentID)
+	}
+	if old, ok := g.PaymentData[payment.PaymentID]; ok {
+		if old.MerchantID == payment.MerchantID && old.CreatedAt.Equal(payment.CreatedAt) {
+			g.PaymentData[payment.PaymentID] = payment
+			return
+		}
+		g.unindex(old)
 	}
-	// If payment not found, return false and empty strings for masked card number and bank payment status
-	return false, bankPaymentStatus, maskedCardData
+	g.PaymentData[payment.PaymentID] = payment
+	g.byMerchant[payment.MerchantID] = insertKey(g.byMerchant[payment.MerchantID], keyOf(payment))
 }
 
-// MaskCardNumber masks the card number, keeping only the last four digits visible.
-func MaskCardNumber(cd CardData) string {
-	return "****" + cd.CardNumber[len(cd.CardNumber)-4:]
+// remove deletes the payment, if it is stored, from the map and from its merchant's index.
+// The caller must hold the lock.
+func (g *GatewayData) remove(paymentId PaymentID) {
+	payment, ok := g.PaymentData[paymentId]
+	if !ok {
+		return
+	}
+	delete(g.PaymentData, paymentId)
+	delete(g.pending, paymentId)
+	g.unindex(payment)
+}
+
+// unindex removes the payment from its merchant's index. The caller must hold the lock.
+func (g *GatewayData) unindex(payment Payment) {
+	keys := removeKey(g.byMerchant[payment.MerchantID], keyOf(payment))
+	if len(keys) == 0 {
+		delete(g.byMerchant, payment.MerchantID)
+		return
+	}
+	g.byMerchant[payment.MerchantID] = keys
+}
+
+// lastFour returns the last four digits of a card number.
+func lastFour(cardNumber string) string {
+	if len(cardNumber) < 4 {
+		return cardNumber
+	}
+	return cardNumber[len(cardNumber)-4:]
 }
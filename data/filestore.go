@@ -0,0 +1,370 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	logFileName      = "payments.log"      // Append-only log of every change since the last snapshot
+	snapshotFileName = "payments.snapshot" // Compacted copy of every payment at the time of the last compaction
+)
+
+// Operations that can be recorded in the log.
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// logRecord is a single entry of the append-only log and of the snapshot.
+type logRecord struct {
+	Op      string  `json:"op"`
+	Payment Payment `json:"payment"`
+
+	legacy bool // Whether the record was written with the full card data, see legacyRecord
+}
+
+// legacyRecord is the card data records were written with before the full card number and the
+// CVV stopped being stored, and later the expiry date. Such records are still read, keeping the
+// last four digits of the card number, and are rewritten without them when the store is opened.
+type legacyRecord struct {
+	Payment struct {
+		CardNumber string
+		Cvv        string
+	} `json:"payment"`
+}
+
+// FileStore is a durable PaymentStore that appends every change as a checksummed record
+// to a log on local disk. The log is replayed into an in-memory GatewayData on startup,
+// which then serves all reads, and is periodically compacted into a snapshot so it does
+// not grow without bound.
+type FileStore struct {
+	*GatewayData // Embedding GatewayData to serve reads from the replayed in-memory copy
+
+	dir    string     // Directory holding the log and snapshot files
+	log    *os.File   // Open handle to the append-only log
+	legacy bool       // Whether any record replayed was written with the full card data
+	broken error      // Why writes are refused, set when a failed write could not be cut off the log
+	mu     sync.Mutex // Mutex to serialise writes to the log
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewFileStore opens, or creates, a FileStore in the given directory and replays any existing
+// snapshot and log into memory. If compactInterval is greater than zero the log is compacted
+// into a snapshot in the background at that interval until Close is called.
+func NewFileStore(dir string, compactInterval time.Duration) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	f := &FileStore{GatewayData: NewGatewayData(), dir: dir}
+
+	// Rebuild the in-memory state, starting with the snapshot and then any changes made after it
+	if _, err := f.replay(filepath.Join(dir, snapshotFileName), false); err != nil {
+		return nil, fmt.Errorf("replaying snapshot: %w", err)
+	}
+	validLength, err := f.replay(filepath.Join(dir, logFileName), true)
+	if err != nil {
+		return nil, fmt.Errorf("replaying log: %w", err)
+	}
+
+	f.log, err = os.OpenFile(filepath.Join(dir, logFileName), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// A crash part way through a write leaves a torn record at the end of the log, which is
+	// cut off here so new records are appended after the last complete one
+	if err := f.log.Truncate(validLength); err != nil {
+		f.log.Close()
+		return nil, err
+	}
+	if _, err := f.log.Seek(validLength, io.SeekStart); err != nil {
+		f.log.Close()
+		return nil, err
+	}
+	// Records holding the full card data are rewritten straight away, so it is not kept on disk
+	if f.legacy {
+		if err := f.Compact(); err != nil {
+			f.log.Close()
+			return nil, fmt.Errorf("removing card data: %w", err)
+		}
+	}
+
+	if compactInterval > 0 {
+		f.stop = make(chan struct{})
+		f.done = make(chan struct{})
+		go f.compactPeriodically(compactInterval)
+	}
+	return f, nil
+}
+
+// AddPayment appends the new payment to the log before making it visible to readers.
+func (f *FileStore) AddPayment(payment Payment) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ok, _, _ := f.GatewayData.RetrievePayment(payment.PaymentID); ok {
+		return ErrPaymentExists
+	}
+	if err := f.append(logRecord{Op: opPut, Payment: payment}); err != nil {
+		return err
+	}
+	return f.GatewayData.AddPayment(payment)
+}
+
+// UpdatePayment appends the updated payment to the log before making it visible to readers.
+func (f *FileStore) UpdatePayment(payment Payment) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ok, _, _ := f.GatewayData.RetrievePayment(payment.PaymentID); !ok {
+		return ErrPaymentNotFound
+	}
+	if err := f.append(logRecord{Op: opPut, Payment: payment}); err != nil {
+		return err
+	}
+	return f.GatewayData.UpdatePayment(payment)
+}
+
+// DeletePayment appends a deletion to the log before removing the payment from memory.
+func (f *FileStore) DeletePayment(paymentId PaymentID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ok, _, _ := f.GatewayData.RetrievePayment(paymentId); !ok {
+		return ErrPaymentNotFound
+	}
+	if err := f.append(logRecord{Op: opDelete, Payment: Payment{PaymentID: paymentId}}); err != nil {
+		return err
+	}
+	return f.GatewayData.DeletePayment(paymentId)
+}
+
+// Compact writes every payment to a new snapshot and empties the log. The snapshot is written
+// to a temporary file and renamed into place, so a crash never leaves a partial snapshot behind.
+func (f *FileStore) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	payments, err := f.GatewayData.ListPayments()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(f.dir, snapshotFileName+".tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, payment := range payments {
+		line, err := encodeRecord(logRecord{Op: opPut, Payment: payment})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := w.Write(line); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(f.dir, snapshotFileName)); err != nil {
+		return err
+	}
+	// The rename is only durable once the directory holding it is synced too
+	if err := SyncDir(f.dir); err != nil {
+		return err
+	}
+
+	// Everything in the log is now part of the snapshot. If we crash before the truncate the
+	// log is simply replayed over the snapshot again, which is safe as records are idempotent
+	if err := f.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	// The log no longer holds whatever was left of a failed write, so writes can carry on
+	f.broken = nil
+	return nil
+}
+
+// Close stops background compaction and closes the log.
+func (f *FileStore) Close() error {
+	if f.stop != nil {
+		close(f.stop)
+		<-f.done
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.log.Close()
+}
+
+// compactPeriodically compacts the log at the given interval until the store is closed.
+func (f *FileStore) compactPeriodically(interval time.Duration) {
+	defer close(f.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// A failed compaction leaves the log intact, so it is safe to try again next tick
+			_ = f.Compact()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// append writes a record to the end of the log and syncs it to disk. A write or sync that fails
+// has any part of the record written cut off the log again, as replay only tolerates a torn
+// record at the very end. If even that fails every write is refused until the log is compacted.
+func (f *FileStore) append(record logRecord) error {
+	if f.broken != nil {
+		return f.broken
+	}
+	line, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	offset, err := f.log.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = f.log.Write(line)
+	if err == nil {
+		err = f.log.Sync()
+	}
+	if err == nil {
+		return nil
+	}
+	if truncErr := f.log.Truncate(offset); truncErr != nil {
+		f.broken = fmt.Errorf("log left with a partial record: %w", truncErr)
+	} else if _, seekErr := f.log.Seek(offset, io.SeekStart); seekErr != nil {
+		f.broken = fmt.Errorf("log left with a partial record: %w", seekErr)
+	}
+	return err
+}
+
+// SyncDir syncs the directory to disk, so that files created in it, or renamed into it, survive
+// a crash.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// replay applies every record in the file at path to the in-memory store and returns the
+// length of the valid prefix of the file. When tolerateTornTail is true a damaged final record
+// is treated as an interrupted write and ignored, otherwise any damage is reported as an error.
+func (f *FileStore) replay(path string, tolerateTornTail bool) (int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var validLength int64
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return validLength, nil
+		}
+		if err != nil && err != io.EOF {
+			return validLength, err
+		}
+
+		record, decodeErr := decodeRecord(line)
+		if decodeErr != nil {
+			// Only the very last record can be torn, damage anywhere else is corruption
+			if tolerateTornTail && isAtEOF(r) {
+				return validLength, nil
+			}
+			return validLength, fmt.Errorf("record at offset %d: %w", validLength, decodeErr)
+		}
+
+		f.legacy = f.legacy || record.legacy
+		switch record.Op {
+		case opPut:
+			f.GatewayData.put(record.Payment)
+		case opDelete:
+			f.GatewayData.remove(record.Payment.PaymentID)
+		default:
+			return validLength, fmt.Errorf("record at offset %d: unknown op %q", validLength, record.Op)
+		}
+		validLength += int64(len(line))
+	}
+}
+
+// isAtEOF reports whether there is nothing left to read.
+func isAtEOF(r *bufio.Reader) bool {
+	_, err := r.Peek(1)
+	return err == io.EOF
+}
+
+// encodeRecord frames a record as a single line made up of the CRC-32 checksum of the
+// JSON encoded record, a space, the JSON itself and a trailing newline.
+func encodeRecord(record logRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(payload), payload)), nil
+}
+
+// decodeRecord parses and verifies a line written by encodeRecord.
+func decodeRecord(line []byte) (logRecord, error) {
+	var record logRecord
+	if len(line) < 10 || line[len(line)-1] != '\n' || line[8] != ' ' {
+		return record, errors.New("malformed record")
+	}
+	var checksum uint32
+	if _, err := fmt.Sscanf(string(line[:8]), "%08x", &checksum); err != nil {
+		return record, errors.New("malformed checksum")
+	}
+	payload := bytes.TrimSuffix(line[9:], []byte("\n"))
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return record, errors.New("checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, err
+	}
+	if bytes.Contains(payload, []byte(`"CardNumber"`)) || bytes.Contains(payload, []byte(`"Cvv"`)) || bytes.Contains(payload, []byte(`"ExpiryDate"`)) {
+		var legacy legacyRecord
+		if err := json.Unmarshal(payload, &legacy); err != nil {
+			return record, err
+		}
+		if legacy.Payment.CardNumber != "" {
+			record.Payment.CardLastFour = lastFour(legacy.Payment.CardNumber)
+		}
+		record.legacy = true
+	}
+	return record, nil
+}
@@ -0,0 +1,267 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// sqlMigrations holds every schema change for the SQLStore in the order they are applied.
+// Migrations are forward-only: once released a migration must never be edited or removed,
+// any further change to the schema is made by appending a new migration to the end.
+var sqlMigrations = []string{
+	// 1: Payments, with their bank transaction and card data held in their own tables
+	`CREATE TABLE payments (
+		payment_id TEXT PRIMARY KEY
+	);
+	CREATE TABLE bank_transactions (
+		payment_id          TEXT PRIMARY KEY REFERENCES payments(payment_id) ON DELETE CASCADE,
+		bank_payment_id     TEXT NOT NULL,
+		bank_payment_status TEXT NOT NULL
+	);
+	CREATE TABLE card_data (
+		payment_id  TEXT PRIMARY KEY REFERENCES payments(payment_id) ON DELETE CASCADE,
+		card_number TEXT NOT NULL,
+		expiry_date TEXT NOT NULL,
+		amount      REAL NOT NULL,
+		currency    TEXT NOT NULL,
+		cvv         TEXT NOT NULL
+	);`,
+	// 2: Amounts are held as an integer number of minor units rather than a floating point value
+	`ALTER TABLE card_data ADD COLUMN amount_minor INTEGER NOT NULL DEFAULT 0;
+	UPDATE card_data SET amount_minor = CAST(ROUND(amount * 100) AS INTEGER);
+	ALTER TABLE card_data DROP COLUMN amount;`,
+	// 3: Currency codes are normalised, and amounts rescaled to the ISO 4217 exponent of their
+	// currency, as migration 2 assumed every currency had two decimal places
+	`UPDATE card_data SET currency = UPPER(TRIM(currency));
+	UPDATE card_data SET amount_minor = amount_minor / 100
+		WHERE currency IN ('BIF', 'CLP', 'DJF', 'GNF', 'ISK', 'JPY', 'KMF', 'KRW', 'PYG', 'RWF', 'UGX', 'UYI', 'VND', 'VUV', 'XAF', 'XOF', 'XPF');
+	UPDATE card_data SET amount_minor = amount_minor * 10
+		WHERE currency IN ('BHD', 'IQD', 'JOD', 'KWD', 'LYD', 'OMR', 'TND');
+	UPDATE card_data SET amount_minor = amount_minor * 100
+		WHERE currency IN ('CLF', 'UYW');`,
+	// 4: The card scheme detected from the card number. Existing payments are left without one
+	`ALTER TABLE card_data ADD COLUMN brand TEXT NOT NULL DEFAULT '';`,
+	// 5: The merchant that owns each payment. Existing payments belong to no merchant
+	`ALTER TABLE payments ADD COLUMN merchant_id TEXT NOT NULL DEFAULT '';`,
+	// 6: The lifecycle state of each payment, and the history of its state transitions. The state
+	// of existing payments is worked out from the bank's answer, they have no recorded history
+	`ALTER TABLE payments ADD COLUMN state TEXT NOT NULL DEFAULT '';
+	UPDATE payments SET state = CASE
+		(SELECT bank_payment_status FROM bank_transactions b WHERE b.payment_id = payments.payment_id)
+		WHEN 'Success' THEN 'captured'
+		WHEN 'Failure' THEN 'declined'
+		ELSE 'failed' END;
+	CREATE TABLE payment_state_history (
+		payment_id TEXT NOT NULL REFERENCES payments(payment_id) ON DELETE CASCADE,
+		seq        INTEGER NOT NULL,
+		from_state TEXT NOT NULL,
+		to_state   TEXT NOT NULL,
+		at         TEXT NOT NULL,
+		PRIMARY KEY (payment_id, seq)
+	);`,
+	// 7: How much of each payment has been captured, and when an uncaptured authorisation expires.
+	// Every existing captured payment was taken in full by a one-shot payment
+	`ALTER TABLE payments ADD COLUMN captured_minor INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE payments ADD COLUMN authorisation_expiry TEXT NOT NULL DEFAULT '';
+	UPDATE payments SET captured_minor =
+		(SELECT amount_minor FROM card_data c WHERE c.payment_id = payments.payment_id)
+		WHERE state = 'captured';`,
+	// 8: The refunds made against each payment, in the order they were made
+	`CREATE TABLE refunds (
+		refund_id      TEXT PRIMARY KEY,
+		payment_id     TEXT NOT NULL REFERENCES payments(payment_id) ON DELETE CASCADE,
+		seq            INTEGER NOT NULL,
+		bank_refund_id TEXT NOT NULL,
+		status         TEXT NOT NULL,
+		amount_minor   INTEGER NOT NULL,
+		created_at     TEXT NOT NULL
+	);
+	CREATE INDEX refunds_payment_id ON refunds (payment_id, seq);`,
+	// 9: How many times the bank was called for each payment and refund. Everything made before
+	// calls were retried was made with a single call
+	`ALTER TABLE payments ADD COLUMN bank_attempts INTEGER NOT NULL DEFAULT 1;
+	ALTER TABLE refunds ADD COLUMN bank_attempts INTEGER NOT NULL DEFAULT 1;`,
+	// 10: The acquiring bank each payment was made with. Everything made before payments were
+	// routed between acquirers was made with the only one
+	`ALTER TABLE payments ADD COLUMN acquirer TEXT NOT NULL DEFAULT '';`,
+	// 11: Whether each payment is captured as soon as the bank approves it, which is needed when
+	// the bank decides on a payment after answering it as pending. Every payment made before
+	// then was decided straight away, so the default is never acted on
+	`ALTER TABLE payments ADD COLUMN auto_capture INTEGER NOT NULL DEFAULT 1;`,
+	// 12: Merchants' webhook endpoints, and the queue of payment events being delivered to them,
+	// which are kept by the webhooks package. Times when deliveries are next due are held as
+	// Unix nanoseconds, so the queue can be ordered and compared on them
+	`CREATE TABLE webhook_endpoints (
+		endpoint_id TEXT PRIMARY KEY,
+		merchant_id TEXT NOT NULL,
+		url         TEXT NOT NULL,
+		secret      TEXT NOT NULL,
+		created_at  TEXT NOT NULL
+	);
+	CREATE INDEX webhook_endpoints_merchant_id ON webhook_endpoints (merchant_id);
+	CREATE TABLE webhook_deliveries (
+		delivery_id  TEXT PRIMARY KEY,
+		merchant_id  TEXT NOT NULL,
+		endpoint_id  TEXT NOT NULL,
+		url          TEXT NOT NULL,
+		event_id     TEXT NOT NULL,
+		event_type   TEXT NOT NULL,
+		payload      BLOB NOT NULL,
+		status       TEXT NOT NULL,
+		attempts     INTEGER NOT NULL,
+		next_attempt INTEGER NOT NULL,
+		last_error   TEXT NOT NULL,
+		created_at   TEXT NOT NULL
+	);
+	CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, next_attempt);
+	CREATE INDEX webhook_deliveries_merchant_id ON webhook_deliveries (merchant_id, status);`,
+	// 13: The CVV and the full card number are no longer stored, only the last four digits of the
+	// card number. Secure delete overwrites the dropped values on disk, rather than leaving them
+	// in free pages of the database file
+	`PRAGMA secure_delete = ON;
+	ALTER TABLE card_data ADD COLUMN card_last_four TEXT NOT NULL DEFAULT '';
+	UPDATE card_data SET card_last_four = SUBSTR(card_number, -4);
+	ALTER TABLE card_data DROP COLUMN card_number;
+	ALTER TABLE card_data DROP COLUMN cvv;`,
+	// 14: Cards tokenised by the vault package, with their card numbers encrypted, and the token of
+	// the card each payment was made with. Payments made before cards were tokenised have none
+	`CREATE TABLE vault_cards (
+		token       TEXT PRIMARY KEY,
+		merchant_id TEXT NOT NULL,
+		last_four   TEXT NOT NULL,
+		expiry_date TEXT NOT NULL,
+		brand       TEXT NOT NULL,
+		created_at  TEXT NOT NULL,
+		key_id      TEXT NOT NULL,
+		wrapped_key BLOB NOT NULL,
+		ciphertext  BLOB NOT NULL
+	);
+	ALTER TABLE card_data ADD COLUMN card_token TEXT NOT NULL DEFAULT '';`,
+	// 15: The expiry dates of tokenised cards are encrypted along with their card numbers, in a new
+	// format, while cards already tokenised keep theirs in the clear until they are rotated. Payments
+	// no longer keep the expiry date of their card, which the vault holds under the card's token
+	`PRAGMA secure_delete = ON;
+	ALTER TABLE vault_cards ADD COLUMN format INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE card_data DROP COLUMN expiry_date;`,
+	// 16: Merchants' customers and the cards they have saved, which are kept by the customers
+	// package, and who started each payment along with the customer whose saved card it was
+	// made with. Every payment made before then was started by the cardholder
+	`CREATE TABLE customers (
+		customer_id TEXT PRIMARY KEY,
+		merchant_id TEXT NOT NULL,
+		name        TEXT NOT NULL,
+		email       TEXT NOT NULL,
+		created_at  TEXT NOT NULL,
+		updated_at  TEXT NOT NULL
+	);
+	CREATE INDEX customers_merchant_id ON customers (merchant_id, created_at);
+	CREATE TABLE customer_payment_methods (
+		payment_method_id TEXT PRIMARY KEY,
+		customer_id       TEXT NOT NULL,
+		seq               INTEGER NOT NULL,
+		card_token        TEXT NOT NULL,
+		created_at        TEXT NOT NULL
+	);
+	CREATE INDEX customer_payment_methods_customer_id ON customer_payment_methods (customer_id, seq);
+	ALTER TABLE payments ADD COLUMN customer_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE payments ADD COLUMN initiator TEXT NOT NULL DEFAULT 'customer';`,
+	// 17: Merchants' plans and the subscriptions of their customers to them, along with every
+	// charge made for each subscription, which are kept by the billing package
+	`CREATE TABLE plans (
+		plan_id        TEXT PRIMARY KEY,
+		merchant_id    TEXT NOT NULL,
+		name           TEXT NOT NULL,
+		amount_minor   INTEGER NOT NULL,
+		currency       TEXT NOT NULL,
+		interval_unit  TEXT NOT NULL,
+		interval_count INTEGER NOT NULL,
+		created_at     TEXT NOT NULL
+	);
+	CREATE INDEX plans_merchant_id ON plans (merchant_id, created_at);
+	CREATE TABLE subscriptions (
+		subscription_id      TEXT PRIMARY KEY,
+		merchant_id          TEXT NOT NULL,
+		customer_id          TEXT NOT NULL,
+		payment_method_id    TEXT NOT NULL,
+		plan_id              TEXT NOT NULL,
+		status               TEXT NOT NULL,
+		anchor               TEXT NOT NULL,
+		periods              INTEGER NOT NULL,
+		current_period_start TEXT NOT NULL,
+		current_period_end   TEXT NOT NULL,
+		next_charge_at       INTEGER NOT NULL,
+		balance_minor        INTEGER NOT NULL,
+		currency             TEXT NOT NULL,
+		failed_attempts      INTEGER NOT NULL,
+		cancel_at_period_end INTEGER NOT NULL,
+		cancelled_at         TEXT NOT NULL,
+		created_at           TEXT NOT NULL,
+		updated_at           TEXT NOT NULL
+	);
+	CREATE INDEX subscriptions_merchant_id ON subscriptions (merchant_id, created_at);
+	CREATE INDEX subscriptions_due ON subscriptions (status, next_charge_at);
+	CREATE TABLE subscription_charges (
+		subscription_id TEXT NOT NULL,
+		seq             INTEGER NOT NULL,
+		payment_id      TEXT NOT NULL,
+		amount_minor    INTEGER NOT NULL,
+		status          TEXT NOT NULL,
+		error           TEXT NOT NULL,
+		period_start    TEXT NOT NULL,
+		period_end      TEXT NOT NULL,
+		created_at      TEXT NOT NULL,
+		PRIMARY KEY (subscription_id, seq)
+	);`,
+	// 18: When each payment was created, in nanoseconds since the Unix epoch so it sorts and can be
+	// compared in range, indexed by merchant for listing a merchant's payments. Existing payments
+	// were created at their first state transition, which is read to the millisecond
+	`ALTER TABLE payments ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+	UPDATE payments SET created_at = COALESCE((
+		SELECT CAST(strftime('%s', h.at) AS INTEGER) * 1000000000 + CAST(ROUND(strftime('%f', h.at) * 1000) AS INTEGER) % 1000 * 1000000
+		FROM payment_state_history h WHERE h.payment_id = payments.payment_id AND h.seq = 0), 0);
+	CREATE INDEX payments_merchant_created ON payments (merchant_id, created_at, payment_id);`,
+	// 19: Payments indexed by state, so the payments waiting on the bank are found without reading the rest
+	`CREATE INDEX payments_state ON payments (state, created_at);`,
+}
+
+// Migrate brings the schema of db up to date by applying, in order, every migration that has
+// not been applied yet. Each migration runs in its own transaction along with the bookkeeping
+// row recording it, so a failed migration leaves the schema at the previous version.
+func Migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	// A database migrated by a newer release cannot be safely used by this one
+	if version > len(sqlMigrations) {
+		return fmt.Errorf("database schema version %d is newer than the latest known version %d", version, len(sqlMigrations))
+	}
+
+	for i := version; i < len(sqlMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("applying migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, i+1, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
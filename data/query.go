@@ -0,0 +1,154 @@
+package data
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+// PaymentQuery selects a merchant's payments, in the order they were created, a page at a time.
+// Every filter that is set must match for a payment to be selected.
+type PaymentQuery struct {
+	MerchantID   string         // The merchant whose payments are selected, payments of other merchants never are
+	States       []PaymentState // Only payments in one of these states, or in any state when empty
+	Currency     string         // Only payments in this currency, when set
+	MinAmount    *int64         // Only payments of at least this many minor units, when set
+	MaxAmount    *int64         // Only payments of at most this many minor units, when set
+	CreatedFrom  time.Time      // Only payments created at or after this time, when set
+	CreatedTo    time.Time      // Only payments created before this time, when set
+	CardLastFour string         // Only payments made with a card ending in these four digits, when set
+	Brand        string         // Only payments made with a card of this scheme, e.g. Visa, when set
+	Oldest       bool           // Whether the oldest payments come first, rather than the newest
+	After        *PaymentCursor // Only payments after this position in the order, for the pages after the first
+	Limit        int            // The most payments selected, or every matching payment when zero
+}
+
+// PaymentCursor is a position in the order payments are listed in. Payments are ordered by
+// when they were created, and payments created at the same time by their ID, so the order is
+// stable and a page always starts where the last one ended, however many payments are added.
+type PaymentCursor struct {
+	CreatedAt time.Time // When the last payment of the page was created
+	PaymentID PaymentID // The ID of the last payment of the page
+}
+
+// CursorOf returns the position of the payment in the order payments are listed in.
+func CursorOf(payment Payment) PaymentCursor {
+	return PaymentCursor{CreatedAt: payment.CreatedAt, PaymentID: payment.PaymentID}
+}
+
+// Matches reports whether the payment passes every filter of the query, other than its
+// position, which is left to the store's index.
+func (q PaymentQuery) Matches(payment Payment) bool {
+	if payment.MerchantID != q.MerchantID {
+		return false
+	}
+	if len(q.States) > 0 && !containsState(q.States, payment.State) {
+		return false
+	}
+	if q.Currency != "" && payment.Amount.Currency != q.Currency {
+		return false
+	}
+	if q.MinAmount != nil && payment.Amount.MinorUnits < *q.MinAmount {
+		return false
+	}
+	if q.MaxAmount != nil && payment.Amount.MinorUnits > *q.MaxAmount {
+		return false
+	}
+	if q.CardLastFour != "" && payment.CardLastFour != q.CardLastFour {
+		return false
+	}
+	return q.Brand == "" || payment.Brand == q.Brand
+}
+
+// containsState reports whether the state is one of states.
+func containsState(states []PaymentState, state PaymentState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// paymentKey is the position of a payment in its merchant's index, see GatewayData.byMerchant.
+type paymentKey struct {
+	createdAt time.Time
+	id        PaymentID
+}
+
+// keyOf returns the index key of a stored payment.
+func keyOf(payment Payment) paymentKey {
+	return paymentKey{createdAt: payment.CreatedAt, id: payment.PaymentID}
+}
+
+// less reports whether k comes before other, ordering by creation time and then by ID.
+func (k paymentKey) less(other paymentKey) bool {
+	if !k.createdAt.Equal(other.createdAt) {
+		return k.createdAt.Before(other.createdAt)
+	}
+	return bytes.Compare(k.id[:], other.id[:]) < 0
+}
+
+// insertKey adds the key to the sorted keys, keeping them sorted.
+func insertKey(keys []paymentKey, key paymentKey) []paymentKey {
+	i := sort.Search(len(keys), func(i int) bool { return !keys[i].less(key) })
+	keys = append(keys, paymentKey{})
+	copy(keys[i+1:], keys[i:])
+	keys[i] = key
+	return keys
+}
+
+// removeKey removes the key from the sorted keys, if it is there.
+func removeKey(keys []paymentKey, key paymentKey) []paymentKey {
+	i := sort.Search(len(keys), func(i int) bool { return !keys[i].less(key) })
+	if i == len(keys) || keys[i] != key {
+		return keys
+	}
+	return append(keys[:i], keys[i+1:]...)
+}
+
+// QueryPayments returns the merchant's payments that match the query, in order. The merchant's
+// index is searched for the first and last payments in range, so only the merchant's payments
+// created in range, after the cursor, are looked at.
+func (g *GatewayData) QueryPayments(query PaymentQuery) ([]Payment, error) {
+	// Lock the mutex to protect concurrent access to PaymentData
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	keys := g.byMerchant[query.MerchantID]
+	// Narrow the index down to the payments created in range, from lo up to but not including hi
+	lo, hi := 0, len(keys)
+	if !query.CreatedFrom.IsZero() {
+		lo = sort.Search(len(keys), func(i int) bool { return !keys[i].createdAt.Before(query.CreatedFrom) })
+	}
+	if !query.CreatedTo.IsZero() {
+		hi = sort.Search(len(keys), func(i int) bool { return !keys[i].createdAt.Before(query.CreatedTo) })
+	}
+	if query.After != nil {
+		after := paymentKey{createdAt: query.After.CreatedAt, id: query.After.PaymentID}
+		if query.Oldest {
+			if i := sort.Search(len(keys), func(i int) bool { return after.less(keys[i]) }); i > lo {
+				lo = i
+			}
+		} else if i := sort.Search(len(keys), func(i int) bool { return !keys[i].less(after) }); i < hi {
+			hi = i
+		}
+	}
+
+	payments := []Payment{}
+	for n := 0; n < hi-lo; n++ {
+		i := lo + n
+		if !query.Oldest {
+			i = hi - 1 - n
+		}
+		payment := g.PaymentData[keys[i].id]
+		if !query.Matches(payment) {
+			continue
+		}
+		payments = append(payments, payment.clone())
+		if query.Limit > 0 && len(payments) == query.Limit {
+			break
+		}
+	}
+	return payments, nil
+}
@@ -0,0 +1,473 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SQLStore is a PaymentStore backed by a relational database. The database driver is chosen by
+// the caller when opening the *sql.DB, the queries are written to run on SQLite.
+type SQLStore struct {
+	db *sql.DB // Handle to the database, which is safe for concurrent use
+}
+
+// selectPayments is the query shared by every read, joining a payment to its bank and card data.
+const selectPayments = `SELECT p.payment_id, p.merchant_id, p.state, p.created_at, p.captured_minor, p.authorisation_expiry, p.bank_attempts, p.acquirer, p.auto_capture, p.initiator, p.customer_id, b.bank_payment_id, b.bank_payment_status,
+		c.card_token, c.card_last_four, c.amount_minor, c.currency, c.brand
+	FROM payments p
+	JOIN bank_transactions b ON b.payment_id = p.payment_id
+	JOIN card_data c ON c.payment_id = p.payment_id`
+
+// SQLiteDSN returns the name to open the SQLite database at path with, for the pure Go SQLite
+// driver. The gateway and cmd/rekey write to the database at the same time, so a writer waits up
+// to five seconds for the other's transaction rather than failing with SQLITE_BUSY, and takes the
+// write lock when its transaction begins, as a transaction that only tried to once it had read
+// could be refused without waiting.
+func SQLiteDSN(path string) string {
+	return path + "?_pragma=busy_timeout(5000)&_txlock=immediate"
+}
+
+// NewSQLStore creates a SQLStore using the given database, applying any outstanding schema
+// migrations before returning.
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// AddPayment inserts a new payment along with its state history, bank transaction and card data.
+func (s *SQLStore) AddPayment(payment Payment) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if ok, err := paymentExists(tx, payment.PaymentID); err != nil {
+			return err
+		} else if ok {
+			return ErrPaymentExists
+		}
+		if _, err := tx.Exec(`INSERT INTO payments (payment_id, merchant_id, state, created_at, captured_minor, authorisation_expiry, bank_attempts, acquirer, auto_capture, initiator, customer_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			idString(payment.PaymentID), payment.MerchantID, string(payment.State), nanos(payment.creationTime()), payment.CapturedAmount.MinorUnits, timeString(payment.AuthorisationExpiry), payment.BankAttempts, payment.Acquirer, payment.AutoCapture, string(payment.Initiator), payment.CustomerID); err != nil {
+			return err
+		}
+		if err := writeHistory(tx, payment); err != nil {
+			return err
+		}
+		if err := writeRefunds(tx, payment); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO bank_transactions (payment_id, bank_payment_id, bank_payment_status) VALUES (?, ?, ?)`,
+			idString(payment.PaymentID), uuid.UUID(payment.BankPaymentID).String(), string(payment.BankPaymentStatus))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO card_data (payment_id, card_token, card_last_four, amount_minor, currency, brand) VALUES (?, ?, ?, ?, ?, ?)`,
+			idString(payment.PaymentID), payment.CardToken, payment.CardLastFour, payment.Amount.MinorUnits, payment.Amount.Currency, payment.Brand)
+		return err
+	})
+}
+
+// RetrievePayment returns the stored payment for the given ID, and whether it was found.
+func (s *SQLStore) RetrievePayment(paymentId PaymentID) (bool, Payment, error) {
+	payment, err := scanPayment(s.db.QueryRow(selectPayments+` WHERE p.payment_id = ?`, idString(paymentId)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, Payment{}, nil
+	}
+	if err != nil {
+		return false, Payment{}, err
+	}
+	history, err := s.readHistory(`WHERE payment_id = ?`, idString(paymentId))
+	if err != nil {
+		return false, Payment{}, err
+	}
+	payment.History = history[payment.PaymentID]
+	refunds, err := s.readRefunds(`WHERE payment_id = ?`, idString(paymentId))
+	if err != nil {
+		return false, Payment{}, err
+	}
+	payment.Refunds = withCurrency(refunds[payment.PaymentID], payment.Amount.Currency)
+	return true, payment, nil
+}
+
+// UpdatePayment replaces the details, state history, bank transaction and card data of an existing payment.
+func (s *SQLStore) UpdatePayment(payment Payment) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if ok, err := paymentExists(tx, payment.PaymentID); err != nil {
+			return err
+		} else if !ok {
+			return ErrPaymentNotFound
+		}
+		if _, err := tx.Exec(`UPDATE payments SET merchant_id = ?, state = ?, created_at = ?, captured_minor = ?, authorisation_expiry = ?, bank_attempts = ?, acquirer = ?, auto_capture = ?, initiator = ?, customer_id = ? WHERE payment_id = ?`,
+			payment.MerchantID, string(payment.State), nanos(payment.creationTime()), payment.CapturedAmount.MinorUnits, timeString(payment.AuthorisationExpiry), payment.BankAttempts, payment.Acquirer, payment.AutoCapture, string(payment.Initiator), payment.CustomerID, idString(payment.PaymentID)); err != nil {
+			return err
+		}
+		if err := writeHistory(tx, payment); err != nil {
+			return err
+		}
+		if err := writeRefunds(tx, payment); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE bank_transactions SET bank_payment_id = ?, bank_payment_status = ? WHERE payment_id = ?`,
+			uuid.UUID(payment.BankPaymentID).String(), string(payment.BankPaymentStatus), idString(payment.PaymentID))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE card_data SET card_token = ?, card_last_four = ?, amount_minor = ?, currency = ?, brand = ? WHERE payment_id = ?`,
+			payment.CardToken, payment.CardLastFour, payment.Amount.MinorUnits, payment.Amount.Currency, payment.Brand, idString(payment.PaymentID))
+		return err
+	})
+}
+
+// ListPayments returns every stored payment, ordered by payment ID.
+func (s *SQLStore) ListPayments() ([]Payment, error) {
+	rows, err := s.db.Query(selectPayments + ` ORDER BY p.payment_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []Payment{}
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	history, err := s.readHistory(``)
+	if err != nil {
+		return nil, err
+	}
+	refunds, err := s.readRefunds(``)
+	if err != nil {
+		return nil, err
+	}
+	for i := range payments {
+		payments[i].History = history[payments[i].PaymentID]
+		payments[i].Refunds = withCurrency(refunds[payments[i].PaymentID], payments[i].Amount.Currency)
+	}
+	return payments, nil
+}
+
+// QueryPayments returns the merchant's payments that match the query, in order. The range of
+// creation times and the cursor are looked up in the payments_merchant_created index.
+func (s *SQLStore) QueryPayments(query PaymentQuery) ([]Payment, error) {
+	where := ` WHERE p.merchant_id = ?`
+	args := []interface{}{query.MerchantID}
+	if len(query.States) > 0 {
+		where += ` AND p.state IN (?` + strings.Repeat(`, ?`, len(query.States)-1) + `)`
+		for _, state := range query.States {
+			args = append(args, string(state))
+		}
+	}
+	if query.Currency != "" {
+		where += ` AND c.currency = ?`
+		args = append(args, query.Currency)
+	}
+	if query.MinAmount != nil {
+		where += ` AND c.amount_minor >= ?`
+		args = append(args, *query.MinAmount)
+	}
+	if query.MaxAmount != nil {
+		where += ` AND c.amount_minor <= ?`
+		args = append(args, *query.MaxAmount)
+	}
+	if !query.CreatedFrom.IsZero() {
+		where += ` AND p.created_at >= ?`
+		args = append(args, nanos(query.CreatedFrom))
+	}
+	if !query.CreatedTo.IsZero() {
+		where += ` AND p.created_at < ?`
+		args = append(args, nanos(query.CreatedTo))
+	}
+	if query.CardLastFour != "" {
+		where += ` AND c.card_last_four = ?`
+		args = append(args, query.CardLastFour)
+	}
+	if query.Brand != "" {
+		where += ` AND c.brand = ?`
+		args = append(args, query.Brand)
+	}
+	order := ` ORDER BY p.created_at DESC, p.payment_id DESC`
+	if query.Oldest {
+		order = ` ORDER BY p.created_at, p.payment_id`
+	}
+	if query.After != nil {
+		comparison := `<`
+		if query.Oldest {
+			comparison = `>`
+		}
+		where += ` AND (p.created_at ` + comparison + ` ? OR p.created_at = ? AND p.payment_id ` + comparison + ` ?)`
+		args = append(args, nanos(query.After.CreatedAt), nanos(query.After.CreatedAt), idString(query.After.PaymentID))
+	}
+	if query.Limit > 0 {
+		order += ` LIMIT ?`
+		args = append(args, query.Limit)
+	}
+
+	return s.readPayments(where+order, args...)
+}
+
+// PendingPayments returns every payment in the pending state, oldest first, which are looked up
+// in the payments_state index.
+func (s *SQLStore) PendingPayments() ([]Payment, error) {
+	return s.readPayments(` WHERE p.state = ? ORDER BY p.created_at, p.payment_id`, string(StatePending))
+}
+
+// readPayments returns the payments selected by the clause, which follows selectPayments, along
+// with the history and refunds of only those payments.
+func (s *SQLStore) readPayments(clause string, args ...interface{}) ([]Payment, error) {
+	rows, err := s.db.Query(selectPayments+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	payments := []Payment{}
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	// The rows are closed before the history and refunds are read, which need the connection
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(payments) == 0 {
+		return payments, nil
+	}
+
+	in := `WHERE payment_id IN (?` + strings.Repeat(`, ?`, len(payments)-1) + `)`
+	ids := make([]interface{}, 0, len(payments))
+	for _, payment := range payments {
+		ids = append(ids, idString(payment.PaymentID))
+	}
+	history, err := s.readHistory(in, ids...)
+	if err != nil {
+		return nil, err
+	}
+	refunds, err := s.readRefunds(in, ids...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range payments {
+		payments[i].History = history[payments[i].PaymentID]
+		payments[i].Refunds = withCurrency(refunds[payments[i].PaymentID], payments[i].Amount.Currency)
+	}
+	return payments, nil
+}
+
+// DeletePayment removes the payment with the given ID, along with its refunds, bank and card data.
+func (s *SQLStore) DeletePayment(paymentId PaymentID) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if ok, err := paymentExists(tx, paymentId); err != nil {
+			return err
+		} else if !ok {
+			return ErrPaymentNotFound
+		}
+		for _, table := range []string{"payment_state_history", "refunds", "card_data", "bank_transactions", "payments"} {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE payment_id = ?`, idString(paymentId)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// inTx runs fn inside a transaction, committing if it succeeds and rolling back otherwise.
+func (s *SQLStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// readHistory returns the state transitions matching the where clause, grouped by payment and
+// in the order they happened.
+func (s *SQLStore) readHistory(where string, args ...interface{}) (map[PaymentID][]StateTransition, error) {
+	rows, err := s.db.Query(`SELECT payment_id, from_state, to_state, at FROM payment_state_history `+where+` ORDER BY payment_id, seq`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make(map[PaymentID][]StateTransition)
+	for rows.Next() {
+		var paymentId, from, to, at string
+		if err := rows.Scan(&paymentId, &from, &to, &at); err != nil {
+			return nil, err
+		}
+		pid, err := uuid.Parse(paymentId)
+		if err != nil {
+			return nil, err
+		}
+		transitionTime, err := time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			return nil, err
+		}
+		history[PaymentID(pid)] = append(history[PaymentID(pid)], StateTransition{From: PaymentState(from), To: PaymentState(to), At: transitionTime})
+	}
+	return history, rows.Err()
+}
+
+// writeHistory replaces the stored state transitions of the payment with its current history.
+func writeHistory(tx *sql.Tx, payment Payment) error {
+	if _, err := tx.Exec(`DELETE FROM payment_state_history WHERE payment_id = ?`, idString(payment.PaymentID)); err != nil {
+		return err
+	}
+	for i, transition := range payment.History {
+		_, err := tx.Exec(`INSERT INTO payment_state_history (payment_id, seq, from_state, to_state, at) VALUES (?, ?, ?, ?, ?)`,
+			idString(payment.PaymentID), i, string(transition.From), string(transition.To), transition.At.UTC().Format(time.RFC3339Nano))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRefunds returns the refunds matching the where clause, grouped by payment and in the order
+// they were made. Refunds are always in the currency of their payment, which is left for the caller to fill in.
+func (s *SQLStore) readRefunds(where string, args ...interface{}) (map[PaymentID][]Refund, error) {
+	rows, err := s.db.Query(`SELECT payment_id, refund_id, bank_refund_id, status, amount_minor, created_at, bank_attempts FROM refunds `+where+` ORDER BY payment_id, seq`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := make(map[PaymentID][]Refund)
+	for rows.Next() {
+		var refund Refund
+		var paymentId, refundId, bankRefundId, status, createdAt string
+		if err := rows.Scan(&paymentId, &refundId, &bankRefundId, &status, &refund.Amount.MinorUnits, &createdAt, &refund.BankAttempts); err != nil {
+			return nil, err
+		}
+		pid, err := uuid.Parse(paymentId)
+		if err != nil {
+			return nil, err
+		}
+		rid, err := uuid.Parse(refundId)
+		if err != nil {
+			return nil, err
+		}
+		bid, err := uuid.Parse(bankRefundId)
+		if err != nil {
+			return nil, err
+		}
+		if refund.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+			return nil, err
+		}
+		refund.RefundID = RefundID(rid)
+		refund.BankRefundID = BankPaymentID(bid)
+		refund.Status = BankPaymentStatus(status)
+		refunds[PaymentID(pid)] = append(refunds[PaymentID(pid)], refund)
+	}
+	return refunds, rows.Err()
+}
+
+// withCurrency sets the currency of each refund, returning the refunds for convenience.
+func withCurrency(refunds []Refund, currency string) []Refund {
+	for i := range refunds {
+		refunds[i].Amount.Currency = currency
+	}
+	return refunds
+}
+
+// writeRefunds replaces the stored refunds of the payment with its current refunds.
+func writeRefunds(tx *sql.Tx, payment Payment) error {
+	if _, err := tx.Exec(`DELETE FROM refunds WHERE payment_id = ?`, idString(payment.PaymentID)); err != nil {
+		return err
+	}
+	for i, refund := range payment.Refunds {
+		_, err := tx.Exec(`INSERT INTO refunds (refund_id, payment_id, seq, bank_refund_id, status, amount_minor, created_at, bank_attempts) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			uuid.UUID(refund.RefundID).String(), idString(payment.PaymentID), i, uuid.UUID(refund.BankRefundID).String(),
+			string(refund.Status), refund.Amount.MinorUnits, timeString(refund.CreatedAt), refund.BankAttempts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paymentExists reports whether a payment with the given ID is stored.
+func paymentExists(tx *sql.Tx, paymentId PaymentID) (bool, error) {
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM payments WHERE payment_id = ?`, idString(paymentId)).Scan(&count)
+	return count > 0, err
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanPayment reads a row produced by selectPayments into a Payment.
+func scanPayment(row scanner) (Payment, error) {
+	var payment Payment
+	var paymentId, state, authorisationExpiry, initiator, bankPaymentId, bankPaymentStatus string
+	var createdAt int64
+	err := row.Scan(&paymentId, &payment.MerchantID, &state, &createdAt, &payment.CapturedAmount.MinorUnits, &authorisationExpiry, &payment.BankAttempts, &payment.Acquirer, &payment.AutoCapture, &initiator, &payment.CustomerID, &bankPaymentId, &bankPaymentStatus,
+		&payment.CardToken, &payment.CardLastFour, &payment.Amount.MinorUnits, &payment.Amount.Currency, &payment.Brand)
+	if err != nil {
+		return payment, err
+	}
+	pid, err := uuid.Parse(paymentId)
+	if err != nil {
+		return payment, err
+	}
+	bpid, err := uuid.Parse(bankPaymentId)
+	if err != nil {
+		return payment, err
+	}
+	if authorisationExpiry != "" {
+		if payment.AuthorisationExpiry, err = time.Parse(time.RFC3339Nano, authorisationExpiry); err != nil {
+			return payment, err
+		}
+	}
+	// Payments that were never given a creation time have none
+	if createdAt != 0 {
+		payment.CreatedAt = time.Unix(0, createdAt).UTC()
+	}
+	// The captured amount is always in the currency of the payment
+	payment.CapturedAmount.Currency = payment.Amount.Currency
+	payment.PaymentID = PaymentID(pid)
+	payment.State = PaymentState(state)
+	payment.Initiator = Initiator(initiator)
+	payment.BankPaymentID = BankPaymentID(bpid)
+	payment.BankPaymentStatus = BankPaymentStatus(bankPaymentStatus)
+	return payment, nil
+}
+
+// timeString formats a time for storage, with the zero time stored as an empty string.
+func timeString(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// nanos formats a time for storage as nanoseconds since the Unix epoch, which sorts and compares
+// in order, with the zero time stored as 0.
+func nanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// idString formats a PaymentID as the canonical UUID string used as the primary key.
+func idString(paymentId PaymentID) string {
+	return uuid.UUID(paymentId).String()
+}
@@ -0,0 +1,65 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrIllegalTransition is returned when a payment is moved to a state it cannot reach from its current one.
+var ErrIllegalTransition = errors.New("illegal payment state transition")
+
+// PaymentState is a custom type representing where a payment is in its lifecycle.
+type PaymentState string
+
+// The states a payment can be in.
+const (
+	StatePending           PaymentState = "pending"            // Created, and waiting on an answer from the bank
+	StateAuthorised        PaymentState = "authorised"         // The bank has reserved the funds
+	StateDeclined          PaymentState = "declined"           // The bank refused the payment
+	StateCaptured          PaymentState = "captured"           // The funds have been taken
+	StatePartiallyRefunded PaymentState = "partially-refunded" // Some of the captured funds have been given back
+	StateRefunded          PaymentState = "refunded"           // All of the captured funds have been given back
+	StateVoided            PaymentState = "voided"             // The authorisation was cancelled before capture
+	StateFailed            PaymentState = "failed"             // The payment could not be processed
+)
+
+// States holds every state a payment can be in, in the order of its lifecycle.
+var States = []PaymentState{StatePending, StateAuthorised, StateDeclined, StateCaptured, StatePartiallyRefunded, StateRefunded, StateVoided, StateFailed}
+
+// transitions is the table of legal moves between states. Declined, refunded, voided and failed
+// are final states, so have no moves out of them.
+var transitions = map[PaymentState][]PaymentState{
+	StatePending:           {StateAuthorised, StateDeclined, StateFailed},
+	StateAuthorised:        {StateCaptured, StateVoided},
+	StateCaptured:          {StatePartiallyRefunded, StateRefunded},
+	StatePartiallyRefunded: {StatePartiallyRefunded, StateRefunded},
+}
+
+// StateTransition records a payment moving from one state to another.
+type StateTransition struct {
+	From PaymentState // The state before the transition, empty for the payment's creation
+	To   PaymentState // The state after the transition
+	At   time.Time    // When the transition happened
+}
+
+// CanTransition reports whether a payment can move from one state to another.
+func CanTransition(from, to PaymentState) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the payment to a new state, recording the move in its history. A payment
+// without a state can only be moved to pending, which marks its creation.
+func (p *Payment) Transition(to PaymentState, at time.Time) error {
+	if p.State == "" && to != StatePending || p.State != "" && !CanTransition(p.State, to) {
+		return fmt.Errorf("%w: %q to %q", ErrIllegalTransition, p.State, to)
+	}
+	p.History = append(p.History, StateTransition{From: p.State, To: to, At: at})
+	p.State = to
+	return nil
+}
@@ -1,4 +1,5 @@
-// Code generated by swaggo/swag. DO NOT EDIT
+// Code generated by swaggo/swag. DO NOT EDIT.
+
 package docs
 
 import "github.com/swaggo/swag"
@@ -15,19 +16,194 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
-        "/findpayment/{uuid}": {
+        "/bank/notifications": {
+            "post": {
+                "description": "Called by an acquiring bank with its decision on a payment it answered as pending. The notification is signed with the secret shared with the bank, in the same way as requests to it, and a decision that was already recorded is accepted again",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Receive a decision on a pending payment",
+                "operationId": "bank-notification",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Unix time in seconds when the notification was signed",
+                        "name": "X-Bank-Timestamp",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Hex encoded HMAC-SHA256 of the notification",
+                        "name": "X-Bank-Signature",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "description": "Decision on the payment",
+                        "name": "notification",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/bank.Notification"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/customers": {
             "get": {
-                "description": "Get payment information by UUID",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "List the merchant's customers, oldest first, along with their saved cards",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Get payment information by UUID",
-                "operationId": "get-payment-by-uuid",
+                "summary": "List customers",
+                "operationId": "list-customers",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.CustomerResponse"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Create a customer, who can save cards to be paid with later by payment-method-id",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Create a customer",
+                "operationId": "create-customer",
                 "parameters": [
+                    {
+                        "description": "Customer Data",
+                        "name": "customerData",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.CustomerJsonRequest"
+                        }
+                    },
                     {
                         "type": "string",
-                        "description": "Payment UUID",
-                        "name": "uuid",
+                        "description": "Unique key for the customer, retries with the same key and body replay the original response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/api.CustomerResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/customers/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get one of the merchant's customers, along with their saved cards",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get a customer",
+                "operationId": "get-customer",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Customer ID",
+                        "name": "id",
                         "in": "path",
                         "required": true
                     }
@@ -36,7 +212,67 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/api.GetResponse"
+                            "$ref": "#/definitions/api.CustomerResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Replace the name and email of one of the merchant's customers, leaving their saved cards as they are",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Update a customer",
+                "operationId": "update-customer",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Customer ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Customer Data",
+                        "name": "customerData",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.CustomerJsonRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.CustomerResponse"
                         }
                     },
                     "400": {
@@ -45,42 +281,114 @@ const docTemplate = `{
                             "$ref": "#/definitions/api.ErrorResponse"
                         }
                     },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Delete one of the merchant's customers along with their saved cards. Payments already made with the cards are kept",
+                "summary": "Delete a customer",
+                "operationId": "delete-customer",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Customer ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
                     "404": {
                         "description": "Not Found",
                         "schema": {
                             "$ref": "#/definitions/api.ErrorResponse"
                         }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
                     }
                 }
             }
         },
-        "/pay": {
+        "/customers/{id}/payment-methods": {
             "post": {
-                "description": "Make a payment",
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Save a card for one of the merchant's customers, given either in full or by the card-token of a card tokenised with /tokens. The card is kept encrypted by the gateway, and can be paid with by giving the customer-id and payment-method-id to /pay",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Make a payment",
-                "operationId": "make-payment",
+                "summary": "Save a card for a customer",
+                "operationId": "create-payment-method",
                 "parameters": [
                     {
-                        "description": "Payment Data",
-                        "name": "paymentData",
+                        "type": "string",
+                        "description": "Customer ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Card Data",
+                        "name": "cardData",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/api.PostJsonRequest"
+                            "$ref": "#/definitions/api.PaymentMethodJsonRequest"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key for the saved card, retries with the same key and body replay the original response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "OK",
+                    "201": {
+                        "description": "Created",
                         "schema": {
-                            "$ref": "#/definitions/api.PostResponse"
+                            "$ref": "#/definitions/api.PaymentMethodResponse"
                         }
                     },
                     "400": {
@@ -88,74 +396,1955 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/api.ErrorResponse"
                         }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "api.ErrorResponse": {
-            "type": "object",
-            "properties": {
-                "error": {
-                    "type": "string"
-                }
-            }
         },
-        "api.GetResponse": {
-            "type": "object",
-            "properties": {
-                "amount": {
-                    "type": "number",
-                    "example": 100
-                },
+        "/customers/{id}/payment-methods/{paymentMethodId}": {
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Remove one of a customer's saved cards, so it can no longer be paid with by payment-method-id. Payments already made with it are kept",
+                "summary": "Remove a saved card",
+                "operationId": "delete-payment-method",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Customer ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Payment Method ID",
+                        "name": "paymentMethodId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/findpayment/{uuid}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get payment information by UUID",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get payment information by UUID",
+                "operationId": "get-payment-by-uuid",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Payment UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.GetResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/health": {
+            "get": {
+                "description": "Reports whether the gateway is up, and the state of the circuit breaker in front of each acquiring bank. The status is degraded while any breaker is not closed",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Health of the gateway",
+                "operationId": "health",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.HealthResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/pay": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Make a payment with either the card details, the card-token of a card tokenised with /tokens, or the payment-method-id of a card saved by the customer-id. Payments are initiated by the customer unless initiated-by is merchant, which charges a saved card without its CVV while the customer is not there. By default the payment is authorised and captured in one go, set capture to false to only authorise it and capture it later",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Make a payment",
+                "operationId": "make-payment",
+                "parameters": [
+                    {
+                        "description": "Payment Data",
+                        "name": "paymentData",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.PostJsonRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key for the payment, retries with the same key and body replay the original response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.PostResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "502": {
+                        "description": "Bad Gateway",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/payments": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "List the merchant's payments, newest first unless order is oldest, filtered by any of the query parameters. The list is paged: when there are more payments next-cursor is returned, which is given as cursor, along with the same filters and order, to list the next page",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List and search payments",
+                "operationId": "list-payments",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Only payments in these states, separated by commas, e.g. captured,refunded",
+                        "name": "status",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only payments in this currency",
+                        "name": "currency",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only payments of at least this amount, given along with currency",
+                        "name": "min-amount",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only payments of at most this amount, given along with currency",
+                        "name": "max-amount",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only payments created at or after this time, in RFC 3339 format",
+                        "name": "created-from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only payments created before this time, in RFC 3339 format",
+                        "name": "created-to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only payments made with a card ending in these four digits",
+                        "name": "last-four",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only payments made with a card of this scheme, e.g. Visa, in any case",
+                        "name": "brand",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "newest (default) or oldest first",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "The most payments listed, 20 by default and at most 100",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "The next-cursor of the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.PaymentListResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/payments/{uuid}/capture": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Capture the funds of a payment made with capture set to false. The amount can be less than the authorised amount, or left out to capture it in full",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Capture an authorised payment",
+                "operationId": "capture-payment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Payment UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Amount to capture",
+                        "name": "captureData",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/api.CaptureJsonRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key for the capture, retries with the same key and body replay the original response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.GetResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "402": {
+                        "description": "Payment Required",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "502": {
+                        "description": "Bad Gateway",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/payments/{uuid}/refunds": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Give back some, or all, of a captured payment. A payment can be refunded many times, as long as the refunds add up to no more than was captured. The amount can be left out to refund everything not already refunded",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Refund a payment",
+                "operationId": "refund-payment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Payment UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Amount to refund",
+                        "name": "refundData",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/api.RefundJsonRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key for the refund, retries with the same key and body replay the original response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/api.RefundResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "402": {
+                        "description": "Payment Required",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "502": {
+                        "description": "Bad Gateway",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/payments/{uuid}/void": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Cancel a payment made with capture set to false before it is captured, releasing the authorised funds",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Void an authorised payment",
+                "operationId": "void-payment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Payment UUID",
+                        "name": "uuid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key for the void, retries with the same key replay the original response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.GetResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "402": {
+                        "description": "Payment Required",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "502": {
+                        "description": "Bad Gateway",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "504": {
+                        "description": "Gateway Timeout",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/plans": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "List the merchant's plans, oldest first",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List plans",
+                "operationId": "list-plans",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.PlanResponse"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Create a plan, charging the amount every interval-count intervals to the customers subscribed to it",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Create a plan",
+                "operationId": "create-plan",
+                "parameters": [
+                    {
+                        "description": "Plan Data",
+                        "name": "planData",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.PlanJsonRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key for the plan, retries with the same key and body replay the original response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/api.PlanResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/plans/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get one of the merchant's plans",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get a plan",
+                "operationId": "get-plan",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Plan ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.PlanResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "List the merchant's subscriptions, oldest first, along with their charges",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List subscriptions",
+                "operationId": "list-subscriptions",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.SubscriptionResponse"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Subscribe one of the merchant's customers to a plan, charging the card they saved as payment-method-id for the first period straight away, and for every period after it as it starts. The card is charged by the merchant, without its CVV. A declined charge is retried after 1, 3 and 7 days, after which the subscription is cancelled",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Subscribe a customer to a plan",
+                "operationId": "create-subscription",
+                "parameters": [
+                    {
+                        "description": "Subscription Data",
+                        "name": "subscriptionData",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.SubscriptionJsonRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key for the subscription, retries with the same key and body replay the original response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/api.SubscriptionResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/{id}": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Get one of the merchant's subscriptions, along with its charges",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get a subscription",
+                "operationId": "get-subscription",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Subscription ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.SubscriptionResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Move a subscription to another plan with the same currency and interval, or charge another of the customer's saved cards for it, leaving out either to keep the current one. Moving to another plan part way through a period carries the difference between the plans, for the rest of the period, over to the next charge as the balance. A past-due subscription is charged with a new card straight away",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Update a subscription",
+                "operationId": "update-subscription",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Subscription ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Subscription Data",
+                        "name": "subscriptionData",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.SubscriptionUpdateJsonRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.SubscriptionResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/subscriptions/{id}/cancel": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Stop a subscription being charged, either straight away or, with at-period-end, once the period already paid for ends. The period already paid for is not refunded",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Cancel a subscription",
+                "operationId": "cancel-subscription",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Subscription ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Cancellation Data",
+                        "name": "cancelData",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/api.CancelSubscriptionJsonRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key for the cancellation, retries with the same key and body replay the original response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.SubscriptionResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/tokens": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Exchange a card number and expiry date for a token, which can be given to /pay as card-token in place of the card. The card number is kept encrypted by the gateway, and the token can only be used by the merchant that created it",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Tokenise a card",
+                "operationId": "create-card-token",
+                "parameters": [
+                    {
+                        "description": "Card Data",
+                        "name": "cardData",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.CardTokenJsonRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key for the token, retries with the same key and body replay the original response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/api.CardTokenResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/webhooks": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "List the merchant's webhooks, oldest first",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List webhooks",
+                "operationId": "list-webhooks",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.WebhookResponse"
+                            }
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Register a URL to be sent a signed JSON event every time one of the merchant's payments changes state. The secret the events are signed with is only returned here",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Register a webhook",
+                "operationId": "create-webhook",
+                "parameters": [
+                    {
+                        "description": "Webhook URL",
+                        "name": "webhookData",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.WebhookJsonRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key for the webhook, retries with the same key and body replay the original response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/api.WebhookResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/webhooks/deliveries": {
+            "get": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "List the merchant's webhook deliveries with the given status, oldest first. By default the failed deliveries are listed, which were given up on after being retried and can be redelivered",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "List webhook deliveries",
+                "operationId": "list-webhook-deliveries",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "pending, delivered or failed (default)",
+                        "name": "status",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/api.DeliveryResponse"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/webhooks/deliveries/{id}/redeliver": {
+            "post": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Send a failed delivery again straight away. The delivery is returned with the outcome, and stays failed if it fails again",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Redeliver a failed webhook delivery",
+                "operationId": "redeliver-webhook",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Delivery ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Unique key for the redelivery, retries with the same key replay the original response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/api.DeliveryResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/webhooks/{id}": {
+            "delete": {
+                "security": [
+                    {
+                        "ApiKeyAuth": []
+                    }
+                ],
+                "description": "Stop sending events to one of the merchant's webhooks. Events already queued for it fail",
+                "summary": "Remove a webhook",
+                "operationId": "delete-webhook",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Webhook ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "api.CancelSubscriptionJsonRequest": {
+            "type": "object",
+            "properties": {
+                "at-period-end": {
+                    "description": "Cancel once the period already paid for ends, rather than straight away",
+                    "type": "boolean",
+                    "example": true
+                }
+            }
+        },
+        "api.CaptureJsonRequest": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "description": "Left out to capture the full authorised amount",
+                    "type": "number",
+                    "example": 50
+                }
+            }
+        },
+        "api.CardTokenJsonRequest": {
+            "type": "object",
+            "required": [
+                "card-number",
+                "expiry-date"
+            ],
+            "properties": {
+                "card-number": {
+                    "type": "string",
+                    "example": "4032 0341 3083 5070"
+                },
+                "expiry-date": {
+                    "type": "string",
+                    "example": "11/26"
+                }
+            }
+        },
+        "api.CardTokenResponse": {
+            "type": "object",
+            "properties": {
+                "card-brand": {
+                    "type": "string",
+                    "example": "Visa"
+                },
+                "card-number-masked": {
+                    "type": "string",
+                    "example": "****5070"
+                },
+                "card-token": {
+                    "type": "string",
+                    "example": "tok_4f1c2b3a5d6e7f8091a2b3c4d5e6f708"
+                },
+                "expiry-date": {
+                    "type": "string",
+                    "example": "11/26"
+                }
+            }
+        },
+        "api.ChargeResponse": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "type": "number",
+                    "example": 9.99
+                },
+                "created-at": {
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                },
+                "error": {
+                    "description": "Why the charge failed",
+                    "type": "string"
+                },
+                "payment-id": {
+                    "description": "Left out when the period was paid from the balance",
+                    "type": "string",
+                    "example": "0e3f5a7c-9b1d-4e26-8f40-6c2a8e4b1d93"
+                },
+                "period-end": {
+                    "type": "string",
+                    "example": "2023-09-01T12:00:00Z"
+                },
+                "period-start": {
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                },
+                "status": {
+                    "type": "string",
+                    "enum": [
+                        "paid",
+                        "pending",
+                        "failed"
+                    ],
+                    "example": "paid"
+                }
+            }
+        },
+        "api.CustomerJsonRequest": {
+            "type": "object",
+            "properties": {
+                "email": {
+                    "description": "Optional, must be a bare email address when given",
+                    "type": "string",
+                    "example": "jane@example.com"
+                },
+                "name": {
+                    "type": "string",
+                    "example": "Jane Doe"
+                }
+            }
+        },
+        "api.CustomerResponse": {
+            "type": "object",
+            "properties": {
+                "created-at": {
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                },
+                "email": {
+                    "type": "string",
+                    "example": "jane@example.com"
+                },
+                "id": {
+                    "type": "string",
+                    "example": "5b0f1d8e-3c2a-4e7b-9f61-0a8d2c4e6b13"
+                },
+                "name": {
+                    "type": "string",
+                    "example": "Jane Doe"
+                },
+                "payment-methods": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/api.PaymentMethodResponse"
+                    }
+                },
+                "updated-at": {
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                }
+            }
+        },
+        "api.DeliveryResponse": {
+            "type": "object",
+            "properties": {
+                "attempts": {
+                    "type": "integer",
+                    "example": 8
+                },
+                "created-at": {
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                },
+                "event": {
+                    "type": "object"
+                },
+                "event-id": {
+                    "type": "string",
+                    "example": "5d4c3b2a-1f0e-4d9c-8b7a-6f5e4d3c2b1a"
+                },
+                "event-type": {
+                    "type": "string",
+                    "example": "payment.captured"
+                },
+                "id": {
+                    "type": "string",
+                    "example": "9a7c1e2d-4b5f-4c3a-8e6d-1f2a3b4c5d6e"
+                },
+                "last-error": {
+                    "type": "string",
+                    "example": "endpoint responded 500 Internal Server Error"
+                },
+                "next-attempt-at": {
+                    "type": "string",
+                    "example": "2023-08-01T12:30:00Z"
+                },
+                "status": {
+                    "type": "string",
+                    "example": "failed"
+                },
+                "url": {
+                    "type": "string",
+                    "example": "https://merchant.example.com/webhooks"
+                },
+                "webhook-id": {
+                    "type": "string",
+                    "example": "3b0b8a52-8f6e-4b2a-9d0c-3c5e7f1a2b4d"
+                }
+            }
+        },
+        "api.ErrorResponse": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "uuid": {
+                    "description": "Set when a payment was recorded before the error, so it can still be looked up",
+                    "type": "string"
+                }
+            }
+        },
+        "api.GetResponse": {
+            "type": "object",
+            "properties": {
+                "acquirer": {
+                    "type": "string",
+                    "example": "acquirer-a"
+                },
+                "amount": {
+                    "type": "number",
+                    "example": 100
+                },
+                "amount-captured": {
+                    "type": "number",
+                    "example": 100
+                },
+                "amount-refundable": {
+                    "type": "number",
+                    "example": 75
+                },
+                "authorisation-expires-at": {
+                    "type": "string",
+                    "example": "2023-08-08T12:00:00Z"
+                },
+                "bank-attempts": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "bank-payment-status": {
+                    "type": "string",
+                    "example": "Success"
+                },
+                "card-brand": {
+                    "type": "string",
+                    "example": "Visa"
+                },
+                "card-number-masked": {
+                    "type": "string",
+                    "example": "****5070"
+                },
+                "card-token": {
+                    "type": "string",
+                    "example": "tok_4f1c2b3a5d6e7f8091a2b3c4d5e6f708"
+                },
+                "currency": {
+                    "type": "string",
+                    "example": "GBP"
+                },
+                "customer-id": {
+                    "type": "string",
+                    "example": "5b0f1d8e-3c2a-4e7b-9f61-0a8d2c4e6b13"
+                },
+                "expiry-date": {
+                    "type": "string",
+                    "example": "11/26"
+                },
+                "history": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/api.StateTransitionResponse"
+                    }
+                },
+                "initiated-by": {
+                    "type": "string",
+                    "example": "customer"
+                },
+                "refunds": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/api.RefundResponse"
+                    }
+                },
+                "state": {
+                    "type": "string",
+                    "example": "captured"
+                }
+            }
+        },
+        "api.HealthResponse": {
+            "type": "object",
+            "properties": {
+                "acquirers": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/bank.Health"
+                    }
+                },
+                "status": {
+                    "type": "string",
+                    "example": "ok"
+                }
+            }
+        },
+        "api.PaymentListResponse": {
+            "type": "object",
+            "properties": {
+                "next-cursor": {
+                    "description": "Only returned when there are more payments",
+                    "type": "string",
+                    "example": "bjoxNjkxMDAwMDAwMDAwMDAwMDAwOjNmMmI..."
+                },
+                "payments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/api.PaymentSummaryResponse"
+                    }
+                }
+            }
+        },
+        "api.PaymentMethodJsonRequest": {
+            "type": "object",
+            "properties": {
+                "card-number": {
+                    "description": "Given along with expiry-date, or replaced by card-token",
+                    "type": "string",
+                    "example": "4032 0341 3083 5070"
+                },
+                "card-token": {
+                    "description": "The token of a card the merchant tokenised before, see POST /tokens",
+                    "type": "string"
+                },
+                "expiry-date": {
+                    "type": "string",
+                    "example": "11/26"
+                }
+            }
+        },
+        "api.PaymentMethodResponse": {
+            "type": "object",
+            "properties": {
+                "card-brand": {
+                    "type": "string",
+                    "example": "Visa"
+                },
+                "card-number-masked": {
+                    "type": "string",
+                    "example": "****5070"
+                },
+                "card-token": {
+                    "type": "string",
+                    "example": "tok_4f1c2b3a5d6e7f8091a2b3c4d5e6f708"
+                },
+                "created-at": {
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                },
+                "expiry-date": {
+                    "type": "string",
+                    "example": "11/26"
+                },
+                "id": {
+                    "type": "string",
+                    "example": "9a7c3e51-2d4b-4f68-8e1a-6b5c0d9f2e47"
+                }
+            }
+        },
+        "api.PaymentSummaryResponse": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "type": "number",
+                    "example": 100
+                },
+                "amount-captured": {
+                    "type": "number",
+                    "example": 100
+                },
+                "amount-refundable": {
+                    "type": "number",
+                    "example": 75
+                },
                 "bank-payment-status": {
                     "type": "string",
                     "example": "Success"
                 },
+                "card-brand": {
+                    "type": "string",
+                    "example": "Visa"
+                },
                 "card-number-masked": {
                     "type": "string",
                     "example": "****5070"
                 },
+                "created-at": {
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                },
                 "currency": {
                     "type": "string",
                     "example": "GBP"
                 },
-                "expiry-date": {
+                "customer-id": {
+                    "type": "string"
+                },
+                "initiated-by": {
                     "type": "string",
-                    "example": "11/26"
+                    "example": "customer"
+                },
+                "state": {
+                    "type": "string",
+                    "example": "captured"
+                },
+                "uuid": {
+                    "type": "string",
+                    "example": "8d3c1f0e-2b4a-4c5d-9e6f-7a8b9c0d1e2f"
                 }
             }
         },
-        "api.PostJsonRequest": {
+        "api.PlanJsonRequest": {
             "type": "object",
             "required": [
                 "amount",
-                "card-number",
                 "currency",
-                "cvv",
-                "expiry-date"
+                "interval"
+            ],
+            "properties": {
+                "amount": {
+                    "description": "Charged every period, kept as the literal decimal so it is never rounded",
+                    "type": "number",
+                    "example": 9.99
+                },
+                "currency": {
+                    "type": "string",
+                    "example": "GBP"
+                },
+                "interval": {
+                    "type": "string",
+                    "enum": [
+                        "day",
+                        "week",
+                        "month",
+                        "year"
+                    ],
+                    "example": "month"
+                },
+                "interval-count": {
+                    "description": "How many intervals make up a period, 1 when left out",
+                    "type": "integer",
+                    "example": 1
+                },
+                "name": {
+                    "type": "string",
+                    "example": "Premium"
+                }
+            }
+        },
+        "api.PlanResponse": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "type": "number",
+                    "example": 9.99
+                },
+                "created-at": {
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                },
+                "currency": {
+                    "type": "string",
+                    "example": "GBP"
+                },
+                "id": {
+                    "type": "string",
+                    "example": "2c6e8a14-7b3d-4f59-a0e2-1d9c5b7f3a68"
+                },
+                "interval": {
+                    "type": "string",
+                    "example": "month"
+                },
+                "interval-count": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "name": {
+                    "type": "string",
+                    "example": "Premium"
+                }
+            }
+        },
+        "api.PostJsonRequest": {
+            "type": "object",
+            "required": [
+                "amount",
+                "currency"
             ],
             "properties": {
                 "amount": {
+                    "description": "Kept as the literal decimal so it is never rounded",
                     "type": "number",
                     "example": 100
                 },
+                "capture": {
+                    "description": "Defaults to true, false only authorises the payment",
+                    "type": "boolean",
+                    "example": true
+                },
                 "card-number": {
+                    "description": "Given along with expiry-date and cvv, or replaced by card-token",
                     "type": "string",
                     "example": "4032 0341 3083 5070"
                 },
+                "card-token": {
+                    "description": "The token of a card the merchant tokenised before, see POST /tokens",
+                    "type": "string"
+                },
                 "currency": {
                     "type": "string",
                     "example": "GBP"
                 },
+                "customer-id": {
+                    "description": "Given along with payment-method-id to pay with a card the customer saved",
+                    "type": "string"
+                },
                 "cvv": {
+                    "description": "Optional with card-token or payment-method-id, and left out when initiated-by is merchant",
                     "type": "string",
                     "example": "975"
                 },
                 "expiry-date": {
                     "type": "string",
                     "example": "11/26"
+                },
+                "initiated-by": {
+                    "description": "Defaults to customer, merchant charges a saved card while the customer is not there",
+                    "type": "string",
+                    "enum": [
+                        "customer",
+                        "merchant"
+                    ],
+                    "example": "customer"
+                },
+                "payment-method-id": {
+                    "description": "One of the customer's saved cards, see POST /customers/{id}/payment-methods",
+                    "type": "string"
                 }
             }
         },
@@ -166,6 +2355,277 @@ const docTemplate = `{
                     "type": "string"
                 }
             }
+        },
+        "api.RefundJsonRequest": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "description": "Left out to refund everything not already refunded",
+                    "type": "number",
+                    "example": 25
+                }
+            }
+        },
+        "api.RefundResponse": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "type": "number",
+                    "example": 25
+                },
+                "bank-attempts": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "bank-refund-id": {
+                    "type": "string",
+                    "example": "0d9e3a8e-5b7f-4a3b-9a43-1c2d3e4f5a6b"
+                },
+                "created-at": {
+                    "type": "string",
+                    "example": "2023-08-02T12:00:00Z"
+                },
+                "currency": {
+                    "type": "string",
+                    "example": "GBP"
+                },
+                "id": {
+                    "type": "string",
+                    "example": "6f1c5fa4-7a44-4c41-9d5e-2b7c0c1e8d3a"
+                },
+                "status": {
+                    "type": "string",
+                    "example": "Success"
+                }
+            }
+        },
+        "api.StateTransitionResponse": {
+            "type": "object",
+            "properties": {
+                "at": {
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                },
+                "from": {
+                    "type": "string",
+                    "example": "authorised"
+                },
+                "to": {
+                    "type": "string",
+                    "example": "captured"
+                }
+            }
+        },
+        "api.SubscriptionJsonRequest": {
+            "type": "object",
+            "properties": {
+                "customer-id": {
+                    "type": "string",
+                    "example": "5b0f1d8e-3c2a-4e7b-9f61-0a8d2c4e6b13"
+                },
+                "payment-method-id": {
+                    "description": "The customer's saved card that is charged",
+                    "type": "string",
+                    "example": "9a7c3e51-2d4b-4f68-8e1a-6b5c0d9f2e47"
+                },
+                "plan-id": {
+                    "type": "string",
+                    "example": "2c6e8a14-7b3d-4f59-a0e2-1d9c5b7f3a68"
+                }
+            }
+        },
+        "api.SubscriptionResponse": {
+            "type": "object",
+            "properties": {
+                "balance": {
+                    "description": "Added to the next charge, negative for a credit",
+                    "type": "number",
+                    "example": 0
+                },
+                "cancel-at-period-end": {
+                    "type": "boolean",
+                    "example": false
+                },
+                "cancelled-at": {
+                    "type": "string",
+                    "example": "2023-09-01T12:00:00Z"
+                },
+                "charges": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/api.ChargeResponse"
+                    }
+                },
+                "created-at": {
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                },
+                "currency": {
+                    "type": "string",
+                    "example": "GBP"
+                },
+                "current-period-end": {
+                    "description": "The end of the last period paid for, the same as its start until the first is paid",
+                    "type": "string",
+                    "example": "2023-09-01T12:00:00Z"
+                },
+                "current-period-start": {
+                    "description": "The start of the last period paid for",
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                },
+                "customer-id": {
+                    "type": "string",
+                    "example": "5b0f1d8e-3c2a-4e7b-9f61-0a8d2c4e6b13"
+                },
+                "failed-attempts": {
+                    "description": "How many times in a row the next period has failed to be charged",
+                    "type": "integer",
+                    "example": 0
+                },
+                "id": {
+                    "type": "string",
+                    "example": "7d4b2f91-5e3a-4c68-b1d7-3a9e6c2f8b45"
+                },
+                "next-charge-at": {
+                    "type": "string",
+                    "example": "2023-09-01T12:00:00Z"
+                },
+                "payment-method-id": {
+                    "type": "string",
+                    "example": "9a7c3e51-2d4b-4f68-8e1a-6b5c0d9f2e47"
+                },
+                "plan-id": {
+                    "type": "string",
+                    "example": "2c6e8a14-7b3d-4f59-a0e2-1d9c5b7f3a68"
+                },
+                "status": {
+                    "type": "string",
+                    "enum": [
+                        "active",
+                        "past-due",
+                        "cancelled"
+                    ],
+                    "example": "active"
+                },
+                "updated-at": {
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                }
+            }
+        },
+        "api.SubscriptionUpdateJsonRequest": {
+            "type": "object",
+            "properties": {
+                "payment-method-id": {
+                    "description": "Left out to keep charging the current card",
+                    "type": "string",
+                    "example": "9a7c3e51-2d4b-4f68-8e1a-6b5c0d9f2e47"
+                },
+                "plan-id": {
+                    "description": "Left out to keep the current plan",
+                    "type": "string",
+                    "example": "2c6e8a14-7b3d-4f59-a0e2-1d9c5b7f3a68"
+                }
+            }
+        },
+        "api.WebhookJsonRequest": {
+            "type": "object",
+            "required": [
+                "url"
+            ],
+            "properties": {
+                "url": {
+                    "type": "string",
+                    "example": "https://merchant.example.com/webhooks"
+                }
+            }
+        },
+        "api.WebhookResponse": {
+            "type": "object",
+            "properties": {
+                "created-at": {
+                    "type": "string",
+                    "example": "2023-08-01T12:00:00Z"
+                },
+                "id": {
+                    "type": "string",
+                    "example": "3b0b8a52-8f6e-4b2a-9d0c-3c5e7f1a2b4d"
+                },
+                "secret": {
+                    "description": "Only returned when the webhook is registered",
+                    "type": "string",
+                    "example": "whsec_5f2b..."
+                },
+                "url": {
+                    "type": "string",
+                    "example": "https://merchant.example.com/webhooks"
+                }
+            }
+        },
+        "bank.BreakerState": {
+            "type": "string",
+            "enum": [
+                "closed",
+                "open",
+                "half-open"
+            ],
+            "x-enum-comments": {
+                "BreakerClosed": "Calls are sent to the bank",
+                "BreakerHalfOpen": "A trial call is sent to the bank to see if it has recovered",
+                "BreakerOpen": "Calls fail fast without reaching the bank"
+            },
+            "x-enum-varnames": [
+                "BreakerClosed",
+                "BreakerOpen",
+                "BreakerHalfOpen"
+            ]
+        },
+        "bank.Health": {
+            "type": "object",
+            "properties": {
+                "acquirer": {
+                    "description": "The name of the acquiring bank",
+                    "type": "string"
+                },
+                "consecutive-failures": {
+                    "description": "Failed calls since the last successful one",
+                    "type": "integer"
+                },
+                "state": {
+                    "description": "The state of the circuit breaker in front of it",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/bank.BreakerState"
+                        }
+                    ]
+                }
+            }
+        },
+        "bank.Notification": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "description": "The bank's id for the payment",
+                    "type": "string"
+                },
+                "reference": {
+                    "description": "The CallInfo reference the payment was sent with, the gateway's id for it",
+                    "type": "string"
+                },
+                "status": {
+                    "description": "The bank's decision, \"Success\" or \"Failure\"",
+                    "type": "string"
+                }
+            }
+        }
+    },
+    "securityDefinitions": {
+        "ApiKeyAuth": {
+            "description": "Merchant API key, sent as \"Bearer \u003capi key\u003e\"",
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
         }
     }
 }`
@@ -180,6 +2640,8 @@ var SwaggerInfo = &swag.Spec{
 	Description:      "This is a simple Payment Gateway API for the ProcessOut take-home technical assessment.",
 	InfoInstanceName: "swagger",
 	SwaggerTemplate:  docTemplate,
+	LeftDelim:        "{{",
+	RightDelim:       "}}",
 }
 
 func init() {
@@ -0,0 +1,66 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"payment-gateway/data"
+	"payment-gateway/money"
+	"syscall"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFileStoreFailedWrite checks that a record only partly written to the log, as when the disk
+// fills up, is cut off again, so the records after it are not stranded behind a torn one.
+func TestFileStoreFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := data.NewFileStore(dir, 0)
+	require.NoError(t, err)
+	newPayment := func() data.Payment {
+		return data.Payment{
+			PaymentID:  data.PaymentID(uuid.New()),
+			MerchantID: testMerchantID,
+			State:      data.StateCaptured,
+			StoredCard: data.StoredCard{CardLastFour: "1009", Amount: money.Money{MinorUnits: 10000, Currency: "GBP"}, Brand: "Visa"},
+		}
+	}
+	first, lost, last := newPayment(), newPayment(), newPayment()
+	require.NoError(t, store.AddPayment(first))
+
+	// Limit the size of files the process can write to just past the end of the log, so the
+	// next record is only partly written
+	info, err := os.Stat(filepath.Join(dir, "payments.log"))
+	require.NoError(t, err)
+	var limit syscall.Rlimit
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit))
+	small := limit
+	small.Cur = uint64(info.Size()) + 16
+	require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_FSIZE, &small))
+	err = store.AddPayment(lost)
+	require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit))
+	require.Error(t, err)
+	truncated, err := os.Stat(filepath.Join(dir, "payments.log"))
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), truncated.Size())
+
+	// The next record is appended after the last complete one, so the log still replays
+	require.NoError(t, store.AddPayment(last))
+	require.NoError(t, store.Close())
+	store, err = data.NewFileStore(dir, 0)
+	require.NoError(t, err)
+	defer store.Close()
+	for _, payment := range []data.Payment{first, last} {
+		ok, _, err := store.RetrievePayment(payment.PaymentID)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+	ok, _, err := store.RetrievePayment(lost.PaymentID)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
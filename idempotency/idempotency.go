@@ -0,0 +1,119 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrKeyReused is returned when an idempotency key is reused for a request that is not
+// identical to the one the key was first used for.
+var ErrKeyReused = errors.New("idempotency key reused with a different request")
+
+// Response is a stored response, which is replayed for retries of the original request.
+type Response struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// entry tracks a single idempotency key, from the first request using it through to its response.
+type entry struct {
+	requestHash []byte        // Hash of the request the key was first used for
+	done        chan struct{} // Closed once the first request has finished, successfully or not
+	response    *Response     // The stored response, nil if the first request was abandoned
+	expires     time.Time     // When the key can be forgotten
+}
+
+// Store remembers the response to each request made with an idempotency key, so that retries of
+// the request get the same response instead of repeating its side effects.
+type Store struct {
+	entries   map[string]*entry // A map that associates an idempotency key with its entry
+	ttl       time.Duration     // How long a key is remembered for
+	lastSweep time.Time         // When expired keys were last removed
+	mu        sync.Mutex        // Mutex to protect concurrent access to entries
+}
+
+// NewStore creates an empty Store which remembers keys for the given duration.
+func NewStore(ttl time.Duration) *Store {
+	return &Store{entries: make(map[string]*entry), ttl: ttl}
+}
+
+// Begin claims the key for the request with the given hash. If the key is new, Begin returns
+// true and the caller must process the request and then call either Complete or Abandon. If
+// the key has already been used for an identical request, Begin waits for that request to
+// finish and returns its response for the caller to replay. ErrKeyReused is returned if the
+// key was used for a different request.
+func (s *Store) Begin(ctx context.Context, key string, requestHash []byte) (bool, *Response, error) {
+	for {
+		s.mu.Lock()
+		s.removeExpired()
+		e, ok := s.entries[key]
+		if !ok {
+			// The key is new, so this request is the one that gets to process it
+			s.entries[key] = &entry{requestHash: requestHash, done: make(chan struct{}), expires: time.Now().Add(s.ttl)}
+			s.mu.Unlock()
+			return true, nil, nil
+		}
+		s.mu.Unlock()
+
+		if !bytes.Equal(e.requestHash, requestHash) {
+			return false, nil, ErrKeyReused
+		}
+
+		// Wait for the request already using the key to finish
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return false, nil, ctx.Err()
+		}
+		if e.response != nil {
+			return false, e.response, nil
+		}
+		// The request was abandoned and its key released, so try to claim the key again
+	}
+}
+
+// Complete stores the response to the request that claimed the key, to be replayed for retries.
+// A key that is no longer in flight, having expired, is left as it is.
+func (s *Store) Complete(key string, response Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && e.response == nil {
+		e.response = &response
+		close(e.done)
+	}
+}
+
+// Abandon releases the key without storing a response, so that a retry processes the request again.
+func (s *Store) Abandon(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && e.response == nil {
+		delete(s.entries, key)
+		close(e.done)
+	}
+}
+
+// removeExpired forgets every key that is past its expiry. A key still in flight by then belongs
+// to a request that can no longer be running, so it is released as if abandoned, rather than
+// leaving retries waiting on it forever. To keep Begin cheap the keys are swept at most once a
+// minute. The mutex must be held by the caller.
+func (s *Store) removeExpired() {
+	now := time.Now()
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, e := range s.entries {
+		if !now.After(e.expires) {
+			continue
+		}
+		delete(s.entries, key)
+		if e.response == nil {
+			close(e.done)
+		}
+	}
+}
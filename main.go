@@ -1,15 +1,33 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"payment-gateway/api"
 	"payment-gateway/bank"
+	"payment-gateway/billing"
+	"payment-gateway/customers"
+	"payment-gateway/data"
 	_ "payment-gateway/docs" // Needed for serving generated swagger docs
+	"payment-gateway/idempotency"
+	"payment-gateway/merchants"
 	"payment-gateway/payments"
+	"payment-gateway/vault"
+	"payment-gateway/webhooks"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"                 // Gin framework
 	swaggerFiles "github.com/swaggo/files"     // Swagger embed files
 	ginSwagger "github.com/swaggo/gin-swagger" // Gin-swagger middleware
+	_ "modernc.org/sqlite"                     // Pure Go SQLite driver used by the sql payment store
 )
 
 // Note: Tagging above the main fucntion and handlers are for autogeneration of Swagger documents
@@ -19,19 +37,82 @@ import (
 // @version 1.0
 // @host localhost:8080
 // @BasePath /
+// @securityDefinitions.apikey ApiKeyAuth
+// @in header
+// @name Authorization
+// @description Merchant API key, sent as "Bearer <api key>"
 func main() {
 	// Create a new instance of PaymentGatewayService
 	payments := payments.NewPaymentGatewayService()
 
-	// Assign the Bank implementation to the PaymentGatewayService
-	payments.Banker = new(bank.Bank)
+	// Assign the configured Bank implementation to the PaymentGatewayService
+	banker, secrets, err := newBanker()
+	if err != nil {
+		log.Fatalf("Could not set up the bank with an error of: %v\n", err)
+	}
+	payments.Banker = banker
+	payments.BankSecrets = secrets
+
+	// Assign the configured PaymentStore to the PaymentGatewayService
+	storage, err := newStores()
+	if err != nil {
+		log.Fatalf("Could not open payment store with an error of: %v\n", err)
+	}
+	payments.PaymentStore = storage.payments
+	payments.Webhooks = webhooks.NewDispatcher(storage.webhooks)
+	// Webhooks are only sent to the public internet, unless endpoints on this machine or its
+	// network are allowed for local testing
+	allowPrivate, err := strconv.ParseBool(envOrDefault("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "false"))
+	if err != nil {
+		log.Fatalf("Invalid WEBHOOK_ALLOW_PRIVATE_NETWORKS %q\n", os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS"))
+	}
+	payments.Webhooks.AllowPrivateNetworks = allowPrivate
+
+	// Card numbers are kept in the vault, encrypted under the configured keys
+	keys, err := newVaultKeyring(storage.durable)
+	if err != nil {
+		log.Fatalf("Could not set up the card vault with an error of: %v\n", err)
+	}
+	payments.Vault = vault.New(storage.vault, keys)
+	payments.Customers = customers.New(storage.customers)
+	payments.Billing = billing.New(storage.billing, payments)
+
+	// Register the merchants that are allowed to use the gateway
+	if err := registerMerchants(payments.Merchants); err != nil {
+		log.Fatalf("Could not register merchants with an error of: %v\n", err)
+	}
+
+	// Ask the bank about payments it answered as pending and has not sent a decision on since
+	checkInterval, err := time.ParseDuration(envOrDefault("BANK_PENDING_CHECK_INTERVAL", "1m"))
+	if err != nil || checkInterval <= 0 {
+		log.Fatalf("Invalid BANK_PENDING_CHECK_INTERVAL %q\n", os.Getenv("BANK_PENDING_CHECK_INTERVAL"))
+	}
+	checkAfter, err := time.ParseDuration(envOrDefault("BANK_PENDING_CHECK_AFTER", "5m"))
+	if err != nil {
+		log.Fatalf("Invalid BANK_PENDING_CHECK_AFTER: %v\n", err)
+	}
+	go payments.WatchPendingPayments(context.Background(), checkInterval, checkAfter)
+
+	// Send the queued webhook deliveries as they are made, and retry the ones that failed when due
+	retryInterval, err := time.ParseDuration(envOrDefault("WEBHOOK_RETRY_INTERVAL", "10s"))
+	if err != nil || retryInterval <= 0 {
+		log.Fatalf("Invalid WEBHOOK_RETRY_INTERVAL %q\n", os.Getenv("WEBHOOK_RETRY_INTERVAL"))
+	}
+	go payments.Webhooks.Run(context.Background(), retryInterval)
+
+	// Charge subscriptions as they are created, and as their periods start or their failed charges are retried
+	chargeInterval, err := time.ParseDuration(envOrDefault("SUBSCRIPTION_CHARGE_INTERVAL", "1m"))
+	if err != nil || chargeInterval <= 0 {
+		log.Fatalf("Invalid SUBSCRIPTION_CHARGE_INTERVAL %q\n", os.Getenv("SUBSCRIPTION_CHARGE_INTERVAL"))
+	}
+	go payments.Billing.Run(context.Background(), chargeInterval)
 
 	// Set up the router
 	r := setupRouter(payments)
 	// Serve Swagger UI at /swagger
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 	// Start the server on port 8080. This can be modified to read from an envar/config file/etc
-	err := r.Run(":8080")
+	err = r.Run(":8080")
 	if err != nil {
 		log.Fatalf("Could not run server with an error of: %v\n", err)
 	}
@@ -42,15 +123,381 @@ func setupRouter(p *payments.PaymentGatewayService) *gin.Engine {
 	// Create a new Gin router with default middleware
 	router := gin.Default()
 
+	// Responses to requests made with an Idempotency-Key are remembered for a day
+	idempotencyKeys := idempotency.NewStore(24 * time.Hour)
+
+	// The health check is open to load balancers and monitoring, so needs no API key
+	router.GET("/health", func(c *gin.Context) {
+		// Handle GET requests for the health of the gateway
+		api.HandleHealth(c, p)
+	})
+
+	// Notifications from the acquiring banks are signed with the secret shared with each bank, in
+	// place of an API key
+	router.POST("/bank/notifications", func(c *gin.Context) {
+		// Handle POST requests with a bank's decision on a pending payment
+		api.HandleBankNotification(c, p)
+	})
+
+	// Every payment route requires a merchant API key
+	authorised := router.Group("/", api.Authenticate(p.Merchants))
+
 	// Define routes and their corresponding handler functions
-	router.GET("/findpayment/:uuid", func(c *gin.Context) {
+	authorised.GET("/findpayment/:uuid", func(c *gin.Context) {
 		// Handle GET requests for finding a payment
 		api.HandleGetPayment(c, p)
 	})
-	router.POST("/pay", func(c *gin.Context) {
+	authorised.GET("/payments", func(c *gin.Context) {
+		// Handle GET requests for listing and searching payments
+		api.HandleListPayments(c, p)
+	})
+	authorised.POST("/pay", api.Idempotency(idempotencyKeys), func(c *gin.Context) {
 		// Handle POST requests for making a payment
 		api.HandlePostPayment(c, p)
 	})
+	authorised.POST("/payments/:uuid/capture", api.Idempotency(idempotencyKeys), func(c *gin.Context) {
+		// Handle POST requests for capturing an authorised payment
+		api.HandleCapturePayment(c, p)
+	})
+	authorised.POST("/payments/:uuid/void", api.Idempotency(idempotencyKeys), func(c *gin.Context) {
+		// Handle POST requests for voiding an authorised payment
+		api.HandleVoidPayment(c, p)
+	})
+	authorised.POST("/payments/:uuid/refunds", api.Idempotency(idempotencyKeys), func(c *gin.Context) {
+		// Handle POST requests for refunding a captured payment
+		api.HandleRefundPayment(c, p)
+	})
+	authorised.POST("/tokens", api.Idempotency(idempotencyKeys), func(c *gin.Context) {
+		// Handle POST requests for tokenising a card
+		api.HandleCreateCardToken(c, p)
+	})
+	authorised.POST("/customers", api.Idempotency(idempotencyKeys), func(c *gin.Context) {
+		// Handle POST requests for creating a customer
+		api.HandleCreateCustomer(c, p)
+	})
+	authorised.GET("/customers", func(c *gin.Context) {
+		// Handle GET requests for listing customers
+		api.HandleListCustomers(c, p)
+	})
+	authorised.GET("/customers/:id", func(c *gin.Context) {
+		// Handle GET requests for finding a customer
+		api.HandleGetCustomer(c, p)
+	})
+	authorised.PUT("/customers/:id", func(c *gin.Context) {
+		// Handle PUT requests for updating a customer
+		api.HandleUpdateCustomer(c, p)
+	})
+	authorised.DELETE("/customers/:id", func(c *gin.Context) {
+		// Handle DELETE requests for deleting a customer
+		api.HandleDeleteCustomer(c, p)
+	})
+	authorised.POST("/customers/:id/payment-methods", api.Idempotency(idempotencyKeys), func(c *gin.Context) {
+		// Handle POST requests for saving a card for a customer
+		api.HandleCreatePaymentMethod(c, p)
+	})
+	authorised.DELETE("/customers/:id/payment-methods/:paymentMethodId", func(c *gin.Context) {
+		// Handle DELETE requests for removing a customer's saved card
+		api.HandleDeletePaymentMethod(c, p)
+	})
+	authorised.POST("/plans", api.Idempotency(idempotencyKeys), func(c *gin.Context) {
+		// Handle POST requests for creating a plan
+		api.HandleCreatePlan(c, p)
+	})
+	authorised.GET("/plans", func(c *gin.Context) {
+		// Handle GET requests for listing plans
+		api.HandleListPlans(c, p)
+	})
+	authorised.GET("/plans/:id", func(c *gin.Context) {
+		// Handle GET requests for finding a plan
+		api.HandleGetPlan(c, p)
+	})
+	authorised.POST("/subscriptions", api.Idempotency(idempotencyKeys), func(c *gin.Context) {
+		// Handle POST requests for subscribing a customer to a plan
+		api.HandleCreateSubscription(c, p)
+	})
+	authorised.GET("/subscriptions", func(c *gin.Context) {
+		// Handle GET requests for listing subscriptions
+		api.HandleListSubscriptions(c, p)
+	})
+	authorised.GET("/subscriptions/:id", func(c *gin.Context) {
+		// Handle GET requests for finding a subscription
+		api.HandleGetSubscription(c, p)
+	})
+	authorised.PUT("/subscriptions/:id", func(c *gin.Context) {
+		// Handle PUT requests for changing a subscription's plan or card
+		api.HandleUpdateSubscription(c, p)
+	})
+	authorised.POST("/subscriptions/:id/cancel", api.Idempotency(idempotencyKeys), func(c *gin.Context) {
+		// Handle POST requests for cancelling a subscription
+		api.HandleCancelSubscription(c, p)
+	})
+	authorised.POST("/webhooks", api.Idempotency(idempotencyKeys), func(c *gin.Context) {
+		// Handle POST requests for registering a webhook
+		api.HandleCreateWebhook(c, p)
+	})
+	authorised.GET("/webhooks", func(c *gin.Context) {
+		// Handle GET requests for listing webhooks
+		api.HandleListWebhooks(c, p)
+	})
+	authorised.DELETE("/webhooks/:id", func(c *gin.Context) {
+		// Handle DELETE requests for removing a webhook
+		api.HandleDeleteWebhook(c, p)
+	})
+	authorised.GET("/webhooks/deliveries", func(c *gin.Context) {
+		// Handle GET requests for listing webhook deliveries
+		api.HandleListWebhookDeliveries(c, p)
+	})
+	authorised.POST("/webhooks/deliveries/:id/redeliver", api.Idempotency(idempotencyKeys), func(c *gin.Context) {
+		// Handle POST requests for redelivering a failed webhook delivery
+		api.HandleRedeliverWebhook(c, p)
+	})
 	// Return the configured router
 	return router
 }
+
+// stores are the stores the gateway keeps its data in, all on the same backend.
+type stores struct {
+	payments  data.PaymentStore // The payments themselves
+	webhooks  webhooks.Store    // The webhooks and their deliveries
+	vault     vault.Store       // The tokenised cards, with their card numbers encrypted
+	customers customers.Store   // The merchants' customers and their saved cards
+	billing   billing.Store     // The merchants' plans and subscriptions
+	durable   bool              // Whether the data outlives the process
+}
+
+// Function to create the stores selected by the PAYMENT_STORE envar. Payments are kept in memory
+// by default, "file" keeps them in an append-only log in the PAYMENT_STORE_PATH directory and
+// "sql" keeps them in the SQLite database at PAYMENT_STORE_PATH. The webhooks and their
+// deliveries, the card vault, the customers and the subscriptions are kept alongside the payments.
+func newStores() (stores, error) {
+	switch backend := os.Getenv("PAYMENT_STORE"); backend {
+	case "", "memory":
+		return stores{payments: data.NewGatewayData(), webhooks: webhooks.NewMemoryStore(), vault: vault.NewMemoryStore(), customers: customers.NewMemoryStore(), billing: billing.NewMemoryStore()}, nil
+	case "file":
+		dir := envOrDefault("PAYMENT_STORE_PATH", "payment-data")
+		store, err := data.NewFileStore(dir, time.Hour)
+		if err != nil {
+			return stores{}, err
+		}
+		webhookStore, err := webhooks.NewFileStore(filepath.Join(dir, "webhooks.json"))
+		if err != nil {
+			return stores{}, err
+		}
+		vaultStore, err := vault.NewFileStore(filepath.Join(dir, "vault.json"))
+		if err != nil {
+			return stores{}, err
+		}
+		customerStore, err := customers.NewFileStore(filepath.Join(dir, "customers.json"))
+		if err != nil {
+			return stores{}, err
+		}
+		billingStore, err := billing.NewFileStore(filepath.Join(dir, "billing.json"))
+		if err != nil {
+			return stores{}, err
+		}
+		return stores{payments: store, webhooks: webhookStore, vault: vaultStore, customers: customerStore, billing: billingStore, durable: true}, nil
+	case "sql":
+		db, err := sql.Open("sqlite", data.SQLiteDSN(envOrDefault("PAYMENT_STORE_PATH", "payments.db")))
+		if err != nil {
+			return stores{}, err
+		}
+		// SQLite only allows a single writer, so share one connection rather than contend for locks
+		db.SetMaxOpenConns(1)
+		store, err := data.NewSQLStore(db)
+		if err != nil {
+			return stores{}, err
+		}
+		webhookStore, err := webhooks.NewSQLStore(db)
+		if err != nil {
+			return stores{}, err
+		}
+		vaultStore, err := vault.NewSQLStore(db)
+		if err != nil {
+			return stores{}, err
+		}
+		customerStore, err := customers.NewSQLStore(db)
+		if err != nil {
+			return stores{}, err
+		}
+		billingStore, err := billing.NewSQLStore(db)
+		if err != nil {
+			return stores{}, err
+		}
+		return stores{payments: store, webhooks: webhookStore, vault: vaultStore, customers: customerStore, billing: billingStore, durable: true}, nil
+	default:
+		return stores{}, fmt.Errorf("unknown payment store %q", backend)
+	}
+}
+
+// Function to read the key-encryption keys of the card vault. VAULT_KEYRING names a keyring file
+// holding several keys, see vault.LoadKeyring, so keys can be rotated, while VAULT_KEK is a single
+// key of 32 bytes encoded as hex. A key is generated when neither is set and the stores are held in
+// memory, as the cards are lost when the server stops anyway, but a durable store needs the same
+// keys every time.
+func newVaultKeyring(durable bool) (*vault.Keyring, error) {
+	path, encoded := os.Getenv("VAULT_KEYRING"), os.Getenv("VAULT_KEK")
+	switch {
+	case path != "" && encoded != "":
+		return nil, fmt.Errorf("only one of VAULT_KEYRING and VAULT_KEK can be set")
+	case path != "":
+		keys, err := vault.LoadKeyring(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading VAULT_KEYRING: %w", err)
+		}
+		return keys, nil
+	case encoded != "":
+		secret, err := hex.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VAULT_KEK: %w", err)
+		}
+		key, err := vault.NewKey(secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VAULT_KEK: %w", err)
+		}
+		return vault.NewKeyring(key), nil
+	case durable:
+		return nil, fmt.Errorf("VAULT_KEYRING or VAULT_KEK must be set when PAYMENT_STORE is")
+	}
+	log.Println("No VAULT_KEYRING or VAULT_KEK configured, tokenised cards will only be usable until the server stops")
+	key, err := vault.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return vault.NewKeyring(key), nil
+}
+
+// Function to create the Banker payments are sent to. If BANK_URL is set payments are sent to the
+// acquiring bank's API at that URL, signed with the BANK_SIGNING_SECRET and given up on after
+// BANK_TIMEOUT, and calls that fail without reaching the bank are made up to BANK_MAX_ATTEMPTS
+// times. After BANK_BREAKER_THRESHOLD failed calls in a row calls fail fast for the
+// BANK_BREAKER_COOLDOWN. If BANK_ROUTING is set it names a JSON file of several acquirers and
+// the rules routing payments between them, each acquirer sharing those settings. Otherwise a
+// stand-in bank that approves every payment is used. The secret of each acquirer is returned
+// by name, to verify its notifications.
+func newBanker() (bank.Banker, map[string][]byte, error) {
+	routing := os.Getenv("BANK_ROUTING")
+	baseURL := os.Getenv("BANK_URL")
+	if routing == "" && baseURL == "" {
+		return new(bank.Bank), nil, nil
+	}
+	settings, err := readBankSettings()
+	if err != nil {
+		return nil, nil, err
+	}
+	if routing == "" {
+		secret := os.Getenv("BANK_SIGNING_SECRET")
+		if secret == "" {
+			return nil, nil, fmt.Errorf("BANK_SIGNING_SECRET must be set when BANK_URL is")
+		}
+		// Payments are not routed to a lone acquirer by name, so they record none
+		return settings.newAcquirer("acquirer", baseURL, secret), map[string][]byte{"": []byte(secret)}, nil
+	}
+
+	// Several acquirers are configured in a JSON file, along with the rules routing payments between them
+	file, err := os.ReadFile(routing)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading BANK_ROUTING: %w", err)
+	}
+	var config routingConfig
+	if err := json.Unmarshal(file, &config); err != nil {
+		return nil, nil, fmt.Errorf("invalid BANK_ROUTING: %w", err)
+	}
+	acquirers := make([]bank.Acquirer, 0, len(config.Acquirers))
+	secrets := make(map[string][]byte)
+	for _, acquirer := range config.Acquirers {
+		secret := os.Getenv(acquirer.SecretEnv)
+		if acquirer.SecretEnv == "" || secret == "" {
+			return nil, nil, fmt.Errorf("the signing secret of acquirer %q must be set in the envar named by its secret-env", acquirer.Name)
+		}
+		acquirers = append(acquirers, bank.Acquirer{Name: acquirer.Name, Banker: settings.newAcquirer(acquirer.Name, acquirer.URL, secret)})
+		secrets[acquirer.Name] = []byte(secret)
+	}
+	router, err := bank.NewAcquirerRouter(acquirers, config.Rules)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid BANK_ROUTING: %w", err)
+	}
+	return router, secrets, nil
+}
+
+// routingConfig is the layout of the BANK_ROUTING file.
+type routingConfig struct {
+	Acquirers []struct {
+		Name      string `json:"name"`
+		URL       string `json:"url"`
+		SecretEnv string `json:"secret-env"` // The envar holding the acquirer's signing secret, so it is kept out of the file
+	} `json:"acquirers"`
+	Rules []bank.Rule `json:"rules"`
+}
+
+// bankSettings are the settings shared by every acquirer, read from envars.
+type bankSettings struct {
+	timeout          time.Duration
+	maxAttempts      int
+	failureThreshold int
+	coolDown         time.Duration
+}
+
+// Function to read the settings shared by every acquirer
+func readBankSettings() (bankSettings, error) {
+	var settings bankSettings
+	var err error
+	settings.timeout, err = time.ParseDuration(envOrDefault("BANK_TIMEOUT", "5s"))
+	if err != nil {
+		return settings, fmt.Errorf("invalid BANK_TIMEOUT: %w", err)
+	}
+	settings.maxAttempts, err = strconv.Atoi(envOrDefault("BANK_MAX_ATTEMPTS", "3"))
+	if err != nil || settings.maxAttempts < 1 {
+		return settings, fmt.Errorf("invalid BANK_MAX_ATTEMPTS %q", os.Getenv("BANK_MAX_ATTEMPTS"))
+	}
+	settings.failureThreshold, err = strconv.Atoi(envOrDefault("BANK_BREAKER_THRESHOLD", "5"))
+	if err != nil || settings.failureThreshold < 1 {
+		return settings, fmt.Errorf("invalid BANK_BREAKER_THRESHOLD %q", os.Getenv("BANK_BREAKER_THRESHOLD"))
+	}
+	settings.coolDown, err = time.ParseDuration(envOrDefault("BANK_BREAKER_COOLDOWN", "30s"))
+	if err != nil {
+		return settings, fmt.Errorf("invalid BANK_BREAKER_COOLDOWN: %w", err)
+	}
+	return settings, nil
+}
+
+// newAcquirer creates the Banker for an acquirer's HTTP API. Calls that failed without reaching
+// the bank are retried, backing off from 100ms up to 2s, and once the bank keeps failing calls
+// are failed fast by the circuit breaker.
+func (s bankSettings) newAcquirer(name, baseURL, secret string) bank.Banker {
+	retrying := bank.NewRetryingBank(bank.NewHTTPBank(baseURL, []byte(secret), s.timeout), s.maxAttempts, 100*time.Millisecond, 2*time.Second)
+	return bank.NewCircuitBreaker(name, retrying, s.failureThreshold, s.coolDown)
+}
+
+// Function to register the merchants in the MERCHANT_API_KEYS envar, a comma separated list of
+// merchant-id:api-key pairs. If no merchants are configured a single merchant is registered with
+// a newly generated key, which is logged so the server can be tried out locally.
+func registerMerchants(registry *merchants.Registry) error {
+	config := os.Getenv("MERCHANT_API_KEYS")
+	if config == "" {
+		apiKey, err := merchants.GenerateAPIKey()
+		if err != nil {
+			return err
+		}
+		log.Printf("No merchants configured, registered merchant \"default\" with API key %s\n", apiKey)
+		return registry.Register(merchants.Merchant{ID: "default", Name: "default"}, apiKey)
+	}
+	for _, pair := range strings.Split(config, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid merchant %q, expected merchant-id:api-key", pair)
+		}
+		id, apiKey := parts[0], parts[1]
+		if err := registry.Register(merchants.Merchant{ID: id, Name: id}, apiKey); err != nil {
+			return fmt.Errorf("registering merchant %q: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// Function to read an envar, falling back to a default when it is not set
+func envOrDefault(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
@@ -2,36 +2,225 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"payment-gateway/api"
 	"payment-gateway/bank"
+	"payment-gateway/banksim"
+	"payment-gateway/billing"
+	"payment-gateway/customers"
 	"payment-gateway/data"
+	"payment-gateway/merchants"
 	"payment-gateway/mocks"
+	"payment-gateway/money"
 	"payment-gateway/payments"
+	"payment-gateway/vault"
+	"payment-gateway/webhooks"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
 )
 
+// The merchant every test router is set up with, and its API key
+const (
+	testMerchantID = "merchant-1"
+	testAPIKey     = "sk_test_merchant_1"
+)
+
+// requirePaymentResponse checks a GET /findpayment response body against the expected JSON, which
+// leaves out the state history and the randomly generated card token, that the payment was made
+// with a token, and that the history moved through the expected states in order.
+func requirePaymentResponse(t *testing.T, expected string, wantStates []data.PaymentState, body string) {
+	var resp map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	delete(resp, "history")
+	require.IsType(t, "", resp["card-token"])
+	assert.True(t, strings.HasPrefix(resp["card-token"].(string), "tok_"))
+	delete(resp, "card-token")
+	actual, err := json.Marshal(resp)
+	require.NoError(t, err)
+	require.JSONEq(t, expected, string(actual))
+
+	var getResp api.GetResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &getResp))
+	require.Len(t, getResp.History, len(wantStates))
+	from := ""
+	for i, transition := range getResp.History {
+		assert.Equal(t, from, transition.From)
+		assert.Equal(t, string(wantStates[i]), transition.To)
+		assert.False(t, transition.At.IsZero())
+		from = transition.To
+	}
+}
+
+// storeBackend selects the PaymentStore the tests run against, e.g. go test ./... -args -store=sql
+var storeBackend = flag.String("store", "memory", "payment store to run the tests against: memory, file or sql")
+
+// newTestPaymentGatewayService creates a PaymentGatewayService backed by the store selected with -store,
+// with the test merchant registered.
+func newTestPaymentGatewayService(t *testing.T) *payments.PaymentGatewayService {
+	p := payments.NewPaymentGatewayService()
+	p.PaymentStore = newTestPaymentStore(t, *storeBackend)
+	p.Webhooks = webhooks.NewDispatcher(newTestWebhookStore(t, *storeBackend))
+	// The tests' webhook receivers are on the loopback address
+	p.Webhooks.AllowPrivateNetworks = true
+	kek, err := vault.GenerateKey()
+	require.NoError(t, err)
+	p.Vault = vault.New(newTestVaultStore(t, *storeBackend), vault.NewKeyring(kek))
+	p.Customers = customers.New(newTestCustomerStore(t, *storeBackend))
+	p.Billing = billing.New(newTestBillingStore(t, *storeBackend), p)
+	require.NoError(t, p.Merchants.Register(merchants.Merchant{ID: testMerchantID, Name: "Test Merchant"}, testAPIKey))
+	return p
+}
+
+// newTestPaymentStore creates an empty PaymentStore of the given backend, which is cleaned up with the test.
+func newTestPaymentStore(t *testing.T, backend string) data.PaymentStore {
+	switch backend {
+	case "memory":
+		return data.NewGatewayData()
+	case "file":
+		store, err := data.NewFileStore(t.TempDir(), 0)
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		return store
+	case "sql":
+		db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "payments.db"))
+		require.NoError(t, err)
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { db.Close() })
+		store, err := data.NewSQLStore(db)
+		require.NoError(t, err)
+		return store
+	}
+	t.Fatalf("unknown payment store %q", backend)
+	return nil
+}
+
+// newTestWebhookStore creates an empty webhooks Store of the given backend, which is cleaned up with the test.
+func newTestWebhookStore(t *testing.T, backend string) webhooks.Store {
+	switch backend {
+	case "memory":
+		return webhooks.NewMemoryStore()
+	case "file":
+		store, err := webhooks.NewFileStore(filepath.Join(t.TempDir(), "webhooks.json"))
+		require.NoError(t, err)
+		return store
+	case "sql":
+		db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "webhooks.db"))
+		require.NoError(t, err)
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { db.Close() })
+		store, err := webhooks.NewSQLStore(db)
+		require.NoError(t, err)
+		return store
+	}
+	t.Fatalf("unknown webhook store %q", backend)
+	return nil
+}
+
+// newTestVaultStore creates an empty vault Store of the given backend, which is cleaned up with the test.
+func newTestVaultStore(t *testing.T, backend string) vault.Store {
+	switch backend {
+	case "memory":
+		return vault.NewMemoryStore()
+	case "file":
+		store, err := vault.NewFileStore(filepath.Join(t.TempDir(), "vault.json"))
+		require.NoError(t, err)
+		return store
+	case "sql":
+		db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "vault.db"))
+		require.NoError(t, err)
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { db.Close() })
+		store, err := vault.NewSQLStore(db)
+		require.NoError(t, err)
+		return store
+	}
+	t.Fatalf("unknown vault store %q", backend)
+	return nil
+}
+
+// newTestCustomerStore creates an empty customers Store of the given backend, which is cleaned up with the test.
+func newTestCustomerStore(t *testing.T, backend string) customers.Store {
+	switch backend {
+	case "memory":
+		return customers.NewMemoryStore()
+	case "file":
+		store, err := customers.NewFileStore(filepath.Join(t.TempDir(), "customers.json"))
+		require.NoError(t, err)
+		return store
+	case "sql":
+		db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "customers.db"))
+		require.NoError(t, err)
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { db.Close() })
+		store, err := customers.NewSQLStore(db)
+		require.NoError(t, err)
+		return store
+	}
+	t.Fatalf("unknown customer store %q", backend)
+	return nil
+}
+
+// newTestBillingStore creates an empty billing.Store of the given backend, which is cleaned up with the test.
+func newTestBillingStore(t *testing.T, backend string) billing.Store {
+	switch backend {
+	case "memory":
+		return billing.NewMemoryStore()
+	case "file":
+		store, err := billing.NewFileStore(filepath.Join(t.TempDir(), "billing.json"))
+		require.NoError(t, err)
+		return store
+	case "sql":
+		db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "billing.db"))
+		require.NoError(t, err)
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { db.Close() })
+		store, err := billing.NewSQLStore(db)
+		require.NoError(t, err)
+		return store
+	}
+	t.Fatalf("unknown billing store %q", backend)
+	return nil
+}
+
 // TestHandlePostPayment tests the payment creation endpoint with valid payment data.
 func TestHandlePostPayment(t *testing.T) {
 	// Create a new PaymentGatewayService and set up the router.
-	p := payments.NewPaymentGatewayService()
+	p := newTestPaymentGatewayService(t)
 	p.Banker = new(bank.Bank)
 	router := setupRouter(p)
 
 	// Create valid payment data in the request body.
 	var cd api.PostJsonRequest
 	cd.CardNumber = "4658585018481009"
-	cd.Amount = 100.00
+	cd.Amount = "100.00"
 	cd.Currency = "GBP"
-	cd.ExpiryDate = "11/24"
+	cd.ExpiryDate = "11/30"
 	cd.Cvv = "555"
 
 	// Marshal the payment data to JSON.
@@ -41,6 +230,7 @@ func TestHandlePostPayment(t *testing.T) {
 	// Create a new HTTP request for the POST endpoint and record the response.
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
 	router.ServeHTTP(w, req)
 
 	// Assert that the response status code is 200 (OK).
@@ -58,7 +248,7 @@ func TestHandlePostPayment(t *testing.T) {
 // and simulates concurrent requests.
 func TestHandlePostPaymentConcurrent(t *testing.T) {
 	// Create a new PaymentGatewayService and set up the router.
-	p := payments.NewPaymentGatewayService()
+	p := newTestPaymentGatewayService(t)
 	p.Banker = new(bank.Bank)
 	router := setupRouter(p)
 
@@ -73,9 +263,9 @@ func TestHandlePostPaymentConcurrent(t *testing.T) {
 		// Create valid payment data in the request body.
 		var cd api.PostJsonRequest
 		cd.CardNumber = "4658585018481009"
-		cd.Amount = 100.00
+		cd.Amount = "100.00"
 		cd.Currency = "GBP"
-		cd.ExpiryDate = "11/24"
+		cd.ExpiryDate = "11/30"
 		cd.Cvv = "555"
 
 		// Marshal the payment data to JSON.
@@ -85,6 +275,7 @@ func TestHandlePostPaymentConcurrent(t *testing.T) {
 		// Create a new HTTP request for the POST endpoint and record the response.
 		w := httptest.NewRecorder()
 		req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
 
 		// Concurrently send the request using a goroutine.
 		go func() {
@@ -98,7 +289,7 @@ func TestHandlePostPaymentConcurrent(t *testing.T) {
 }
 
 func TestHandlePostPaymentWithIncorrectBody(t *testing.T) {
-	p := payments.NewPaymentGatewayService()
+	p := newTestPaymentGatewayService(t)
 	p.Banker = new(bank.Bank)
 	router := setupRouter(p)
 
@@ -114,6 +305,7 @@ func TestHandlePostPaymentWithIncorrectBody(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
 
 	router.ServeHTTP(w, req)
 
@@ -128,16 +320,16 @@ func TestHandlePostPaymentWithIncorrectBody(t *testing.T) {
 }
 
 func TestHandlePostPaymentWithInvalidCardNo(t *testing.T) {
-	p := payments.NewPaymentGatewayService()
+	p := newTestPaymentGatewayService(t)
 	p.Banker = new(bank.Bank)
 
 	router := setupRouter(p)
 
 	var cd api.PostJsonRequest
 	cd.CardNumber = "4658585018481009123"
-	cd.Amount = 100.00
+	cd.Amount = "100.00"
 	cd.Currency = "GBP"
-	cd.ExpiryDate = "11/24"
+	cd.ExpiryDate = "11/30"
 	cd.Cvv = "555"
 
 	jsonData, err := json.Marshal(cd)
@@ -148,6 +340,7 @@ func TestHandlePostPaymentWithInvalidCardNo(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 400, w.Code)
@@ -161,16 +354,16 @@ func TestHandlePostPaymentWithInvalidCardNo(t *testing.T) {
 }
 
 func TestHandlePostPaymentWithInvalidAmount(t *testing.T) {
-	p := payments.NewPaymentGatewayService()
+	p := newTestPaymentGatewayService(t)
 	p.Banker = new(bank.Bank)
 
 	router := setupRouter(p)
 
 	var cd api.PostJsonRequest
 	cd.CardNumber = "4658585018481009"
-	cd.Amount = -100.00
+	cd.Amount = "-100.00"
 	cd.Currency = "GBP"
-	cd.ExpiryDate = "11/24"
+	cd.ExpiryDate = "11/30"
 	cd.Cvv = "555"
 
 	jsonData, err := json.Marshal(cd)
@@ -181,6 +374,7 @@ func TestHandlePostPaymentWithInvalidAmount(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
 
 	router.ServeHTTP(w, req)
 
@@ -195,14 +389,14 @@ func TestHandlePostPaymentWithInvalidAmount(t *testing.T) {
 }
 
 func TestHandlePostPaymentWithInvalidExpiry(t *testing.T) {
-	p := payments.NewPaymentGatewayService()
+	p := newTestPaymentGatewayService(t)
 	p.Banker = new(bank.Bank)
 
 	router := setupRouter(p)
 
 	var cd api.PostJsonRequest
 	cd.CardNumber = "4658585018481009"
-	cd.Amount = 100.00
+	cd.Amount = "100.00"
 	cd.Currency = "GBP"
 	cd.ExpiryDate = "11/09"
 	cd.Cvv = "555"
@@ -215,6 +409,7 @@ func TestHandlePostPaymentWithInvalidExpiry(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
 
 	router.ServeHTTP(w, req)
 
@@ -229,16 +424,16 @@ func TestHandlePostPaymentWithInvalidExpiry(t *testing.T) {
 }
 
 func TestHandlePostPaymentWithInvalidCvv(t *testing.T) {
-	p := payments.NewPaymentGatewayService()
+	p := newTestPaymentGatewayService(t)
 	p.Banker = new(bank.Bank)
 
 	router := setupRouter(p)
 
 	var cd api.PostJsonRequest
 	cd.CardNumber = "4658585018481009"
-	cd.Amount = 100.00
+	cd.Amount = "100.00"
 	cd.Currency = "GBP"
-	cd.ExpiryDate = "11/24"
+	cd.ExpiryDate = "11/30"
 	cd.Cvv = "55555"
 
 	jsonData, err := json.Marshal(cd)
@@ -249,6 +444,7 @@ func TestHandlePostPaymentWithInvalidCvv(t *testing.T) {
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
 
 	router.ServeHTTP(w, req)
 
@@ -263,44 +459,47 @@ func TestHandlePostPaymentWithInvalidCvv(t *testing.T) {
 }
 
 func TestHandleGetPayment(t *testing.T) {
-	p := payments.NewPaymentGatewayService()
+	p := newTestPaymentGatewayService(t)
 	p.Banker = new(bank.Bank)
 
 	var cd data.CardData
 	cd.CardNumber = "4658585018481009"
-	cd.Amount = 100.00
-	cd.Currency = "GBP"
+	cd.Amount = money.Money{MinorUnits: 10000, Currency: "GBP"}
 	cd.ExpiryDate = "11/22"
 	cd.Cvv = "555"
 
 	// Adding the payment to the in memory data store.
-	pId := p.MakePayment(cd)
+	pId, err := p.MakePayment(context.Background(), testMerchantID, cd)
+	require.NoError(t, err)
 	router := setupRouter(p)
 
 	w := httptest.NewRecorder()
 	uuidValue := uuid.UUID(pId)
 	strPaymentID := uuidValue.String()
 	req, _ := http.NewRequest("GET", "/findpayment/"+strPaymentID, nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 200, w.Code)
 
 	var resp api.GetResponse
-	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
 	if err != nil {
 		t.Fatalf("ERROR : %v\n", err)
 	}
-	require.JSONEq(t, `{"amount":100, "bank-payment-status":"Success", "card-number-masked":"****1009", "currency":"GBP", "expiry-date":"11/22"}`, w.Body.String())
+	requirePaymentResponse(t, `{"state":"captured", "amount":100, "amount-captured":100, "amount-refundable":100, "refunds":[], "bank-attempts":1, "bank-payment-status":"Success", "card-number-masked":"****1009", "card-brand":"Visa", "currency":"GBP", "expiry-date":"11/22", "initiated-by":"customer"}`,
+		[]data.PaymentState{data.StatePending, data.StateAuthorised, data.StateCaptured}, w.Body.String())
 }
 
 func TestHandleGetPaymentWithInvalidPaymentId(t *testing.T) {
-	p := payments.NewPaymentGatewayService()
+	p := newTestPaymentGatewayService(t)
 	p.Banker = new(bank.Bank)
 
 	router := setupRouter(p)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/findpayment/InvalidID", nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
 
 	router.ServeHTTP(w, req)
 
@@ -315,12 +514,13 @@ func TestHandleGetPaymentWithInvalidPaymentId(t *testing.T) {
 }
 
 func TestHandleGetPaymentForNonExistantPayment(t *testing.T) {
-	p := payments.NewPaymentGatewayService()
+	p := newTestPaymentGatewayService(t)
 	p.Banker = new(bank.Bank)
 	router := setupRouter(p)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/findpayment/f2a5dd12-dad1-487c-ad60-d9f79a8aa6c6", nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 404, w.Code)
@@ -334,20 +534,20 @@ func TestHandleGetPaymentForNonExistantPayment(t *testing.T) {
 }
 
 func TestHandleGetPaymentWithFailedBankPayment(t *testing.T) {
-	p := payments.NewPaymentGatewayService()
+	p := newTestPaymentGatewayService(t)
 	// Using the bank mock allows us to mock out different responses from the bank
 	// In this case, we make a payment to the bank and receive an unsuccessful payment
 	p.Banker = new(mocks.BankMock)
 
 	var cd data.CardData
 	cd.CardNumber = "4658585018481009"
-	cd.Amount = 100.00
-	cd.Currency = "GBP"
+	cd.Amount = money.Money{MinorUnits: 10000, Currency: "GBP"}
 	cd.ExpiryDate = "11/22"
 	cd.Cvv = "555"
 
 	// Adding the payment to the in memory data store.
-	pId := p.MakePayment(cd)
+	pId, err := p.MakePayment(context.Background(), testMerchantID, cd)
+	require.NoError(t, err)
 
 	router := setupRouter(p)
 
@@ -355,15 +555,3147 @@ func TestHandleGetPaymentWithFailedBankPayment(t *testing.T) {
 	uuidValue := uuid.UUID(pId)
 	strPaymentID := uuidValue.String()
 	req, _ := http.NewRequest("GET", "/findpayment/"+strPaymentID, nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
 
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 200, w.Code)
 
 	var resp api.GetResponse
-	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
 	if err != nil {
 		t.Fatalf("ERROR : %v\n", err)
 	}
-	require.JSONEq(t, `{"amount":100, "bank-payment-status":"Failure", "card-number-masked":"****1009", "currency":"GBP", "expiry-date":"11/22"}`, w.Body.String())
+	requirePaymentResponse(t, `{"state":"declined", "amount":100, "amount-captured":0, "amount-refundable":0, "refunds":[], "bank-attempts":1, "bank-payment-status":"Failure", "card-number-masked":"****1009", "card-brand":"Visa", "currency":"GBP", "expiry-date":"11/22", "initiated-by":"customer"}`,
+		[]data.PaymentState{data.StatePending, data.StateDeclined}, w.Body.String())
+}
+
+func TestPaymentStoreBackends(t *testing.T) {
+	for _, backend := range []string{"memory", "file", "sql"} {
+		t.Run(backend, func(t *testing.T) {
+			p := payments.NewPaymentGatewayService()
+			p.Banker = new(bank.Bank)
+			// Any PaymentStore implementation can back the service
+			store := newTestPaymentStore(t, backend)
+			p.PaymentStore = store
+
+			var cd data.CardData
+			cd.CardNumber = "4658585018481009"
+			cd.Amount = money.Money{MinorUnits: 10000, Currency: "GBP"}
+			cd.ExpiryDate = "11/30"
+			cd.Cvv = "555"
+
+			pId, err := p.MakePayment(context.Background(), testMerchantID, cd)
+			require.NoError(t, err)
+
+			// The payment should have been written to the swapped in store
+			ok, payment, err := store.RetrievePayment(pId)
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, data.BankPaymentStatus("Success"), payment.BankPaymentStatus)
+			// The card brand is detected when the payment is made, and only the token and the
+			// last four digits of the card number are kept, the expiry date being in the vault
+			assert.True(t, strings.HasPrefix(payment.CardToken, "tok_"))
+			assert.Equal(t, data.StoredCard{CardToken: payment.CardToken, CardLastFour: "1009", Amount: cd.Amount, Brand: "Visa"}, payment.StoredCard)
+			assert.ErrorIs(t, store.AddPayment(payment), data.ErrPaymentExists)
+
+			assert.Equal(t, data.StateCaptured, payment.State)
+			assert.Equal(t, cd.Amount, payment.CapturedAmount)
+			require.Len(t, payment.History, 3)
+
+			payment.BankPaymentStatus = "Failure"
+			require.NoError(t, payment.Transition(data.StateRefunded, time.Now()))
+			require.NoError(t, store.UpdatePayment(payment))
+
+			stored, err := store.ListPayments()
+			require.NoError(t, err)
+			require.Len(t, stored, 1)
+			assert.Equal(t, data.BankPaymentStatus("Failure"), stored[0].BankPaymentStatus)
+			assert.Equal(t, data.StateRefunded, stored[0].State)
+			require.Len(t, stored[0].History, 4)
+			assert.True(t, payment.History[3].At.Equal(stored[0].History[3].At))
+
+			require.NoError(t, store.DeletePayment(pId))
+			assert.ErrorIs(t, store.DeletePayment(pId), data.ErrPaymentNotFound)
+
+			ok, _, err = p.GetPayment(testMerchantID, pId)
+			require.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := data.NewFileStore(dir, 0)
+	require.NoError(t, err)
+
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	p.PaymentStore = store
+
+	var cd data.CardData
+	cd.CardNumber = "4658585018481009"
+	cd.Amount = money.Money{MinorUnits: 10000, Currency: "GBP"}
+	cd.ExpiryDate = "11/30"
+	cd.Cvv = "555"
+
+	compactedId, err := p.MakePayment(context.Background(), testMerchantID, cd)
+	require.NoError(t, err)
+	require.NoError(t, store.Compact())
+	loggedId, err := p.MakePayment(context.Background(), testMerchantID, cd)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	// Simulate a crash part way through writing a record to the end of the log
+	f, err := os.OpenFile(filepath.Join(dir, "payments.log"), os.O_APPEND|os.O_WRONLY, 0o600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`0badc0de {"op":"put","pay`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Reopening the store replays both the snapshot and the log
+	store, err = data.NewFileStore(dir, 0)
+	require.NoError(t, err)
+	defer store.Close()
+	p.PaymentStore = store
+
+	for _, pId := range []data.PaymentID{compactedId, loggedId} {
+		ok, payment, err := p.GetPayment(testMerchantID, pId)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, "****1009", payment.MaskedCardNumber())
+		assert.Equal(t, data.BankPaymentStatus("Success"), payment.BankPaymentStatus)
+	}
+
+	// New payments are appended after the torn record was discarded
+	_, err = p.MakePayment(context.Background(), testMerchantID, cd)
+	require.NoError(t, err)
+	stored, err := store.ListPayments()
+	require.NoError(t, err)
+	assert.Len(t, stored, 3)
+}
+
+func TestSQLStoreMigrations(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "payments.db"))
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	// Migrations are only applied once, so reopening an up to date database is a no-op
+	_, err = data.NewSQLStore(db)
+	require.NoError(t, err)
+	_, err = data.NewSQLStore(db)
+	require.NoError(t, err)
+
+	var applied int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied))
+	var latest int
+	require.NoError(t, db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&latest))
+	assert.Equal(t, latest, applied)
+
+	// A database migrated by a newer release is refused rather than downgraded
+	_, err = db.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, '')`, latest+1)
+	require.NoError(t, err)
+	_, err = data.NewSQLStore(db)
+	assert.Error(t, err)
+}
+
+// TestCardDataNeverStored checks that no record kept by any of the stores holds the full card
+// number or the CVV, which must never be stored once a payment has been sent to the bank.
+func TestCardDataNeverStored(t *testing.T) {
+	const cardNumber, cvv, expiryDate = "4658585018481009", "555", "11/30"
+
+	// The stored payment has nowhere to keep them
+	var fields func(typ reflect.Type)
+	fields = func(typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			assert.NotContains(t, []string{"CardNumber", "Cvv", "CardData"}, field.Name)
+			if field.Type.Kind() == reflect.Struct {
+				fields(field.Type)
+			}
+		}
+	}
+	fields(reflect.TypeOf(data.Payment{}))
+
+	for _, backend := range []string{"memory", "file", "sql"} {
+		t.Run(backend, func(t *testing.T) {
+			// Open the stores so that their raw records can be read afterwards, the vault being
+			// kept alongside the payments
+			var store data.PaymentStore
+			var vaultStore vault.Store
+			var records func() []string
+			switch backend {
+			case "memory":
+				memory := data.NewGatewayData()
+				memoryVault := vault.NewMemoryStore()
+				store, vaultStore = memory, memoryVault
+				records = func() []string {
+					stored, err := memory.ListPayments()
+					require.NoError(t, err)
+					raw, err := json.Marshal(stored)
+					require.NoError(t, err)
+					cards, err := json.Marshal(memoryVault)
+					require.NoError(t, err)
+					return append(jsonValues(t, raw), jsonValues(t, cards)...)
+				}
+			case "file":
+				dir := t.TempDir()
+				file, err := data.NewFileStore(dir, 0)
+				require.NoError(t, err)
+				t.Cleanup(func() { file.Close() })
+				store = file
+				vaultStore, err = vault.NewFileStore(filepath.Join(dir, "vault.json"))
+				require.NoError(t, err)
+				records = func() []string {
+					cards, err := os.ReadFile(filepath.Join(dir, "vault.json"))
+					require.NoError(t, err)
+					values := append([]string{string(cards)}, jsonValues(t, cards)...)
+					for _, name := range []string{"payments.log", "payments.snapshot"} {
+						raw, err := os.ReadFile(filepath.Join(dir, name))
+						require.NoError(t, err)
+						values = append(values, string(raw))
+						for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+							if line != "" {
+								values = append(values, jsonValues(t, []byte(line[9:]))...)
+							}
+						}
+					}
+					return values
+				}
+			case "sql":
+				db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "payments.db"))
+				require.NoError(t, err)
+				db.SetMaxOpenConns(1)
+				t.Cleanup(func() { db.Close() })
+				store, err = data.NewSQLStore(db)
+				require.NoError(t, err)
+				vaultStore, err = vault.NewSQLStore(db)
+				require.NoError(t, err)
+				records = func() []string { return sqlValues(t, db) }
+			}
+
+			// Make payments that go through every change a payment can be stored with
+			p := newTestPaymentGatewayService(t)
+			p.Banker = new(bank.Bank)
+			p.PaymentStore = store
+			kek, err := vault.GenerateKey()
+			require.NoError(t, err)
+			p.Vault = vault.New(vaultStore, vault.NewKeyring(kek))
+			router := setupRouter(p)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+			require.Equal(t, 200, w.Code)
+			if file, ok := store.(*data.FileStore); ok {
+				require.NoError(t, file.Compact())
+			}
+			id := authorisePayment(t, router, "50.00")
+			require.Equal(t, 200, postPaymentAction(router, "/payments/"+id+"/capture", "").Code)
+			require.Equal(t, 201, postPaymentAction(router, "/payments/"+id+"/refunds", `{"amount": "10.00"}`).Code)
+			p.Banker = new(mocks.BankMock)
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+			require.Equal(t, 200, w.Code)
+
+			values := records()
+			require.NotEmpty(t, values)
+			for _, value := range values {
+				assert.NotContains(t, value, cardNumber)
+				assert.NotEqual(t, cvv, value)
+				assert.NotContains(t, value, expiryDate)
+			}
+			assert.Contains(t, values, "1009")
+		})
+	}
+}
+
+// jsonValues returns every string and number held in a JSON document, as strings.
+func jsonValues(t *testing.T, raw []byte) []string {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var document interface{}
+	require.NoError(t, decoder.Decode(&document))
+	values := []string{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, value := range v {
+				values = append(values, key)
+				walk(value)
+			}
+		case []interface{}:
+			for _, value := range v {
+				walk(value)
+			}
+		case string:
+			values = append(values, v)
+		case json.Number:
+			values = append(values, v.String())
+		}
+	}
+	walk(document)
+	return values
+}
+
+// sqlValues returns the name of every column of every table in the database, and every value
+// held in them, as strings.
+func sqlValues(t *testing.T, db *sql.DB) []string {
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table'`)
+	require.NoError(t, err)
+	tables := []string{}
+	for rows.Next() {
+		var table string
+		require.NoError(t, rows.Scan(&table))
+		tables = append(tables, table)
+	}
+	require.NoError(t, rows.Err())
+	rows.Close()
+
+	values := []string{}
+	for _, table := range tables {
+		rows, err := db.Query(`SELECT * FROM ` + table)
+		require.NoError(t, err)
+		columns, err := rows.Columns()
+		require.NoError(t, err)
+		values = append(values, columns...)
+		for rows.Next() {
+			row := make([]interface{}, len(columns))
+			pointers := make([]interface{}, len(columns))
+			for i := range row {
+				pointers[i] = &row[i]
+			}
+			require.NoError(t, rows.Scan(pointers...))
+			for _, value := range row {
+				if raw, ok := value.([]byte); ok {
+					value = string(raw)
+				}
+				values = append(values, fmt.Sprint(value))
+			}
+		}
+		require.NoError(t, rows.Err())
+		rows.Close()
+	}
+	return values
+}
+
+// TestLegacyCardDataRemoved checks that payments stored with the full card data, before it
+// stopped being stored, are kept with only the last four digits of the card number, and that
+// payments stored with the expiry date of their card are kept without it.
+func TestLegacyCardDataRemoved(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		// Payments in the log as they were written when the card data was stored in full, and
+		// when the expiry date was still stored alongside the card's token
+		dir := t.TempDir()
+		log := ""
+		for _, payment := range []map[string]interface{}{
+			{"CardNumber": "4658585018481009", "ExpiryDate": "11/30", "Cvv": "555"},
+			{"CardToken": "tok_legacy", "CardLastFour": "4242", "ExpiryDate": "12/31"},
+		} {
+			payment["PaymentID"] = data.PaymentID(uuid.New())
+			payment["MerchantID"] = testMerchantID
+			payment["State"] = "captured"
+			payment["Amount"] = money.Money{MinorUnits: 10000, Currency: "GBP"}
+			payment["Brand"] = "Visa"
+			payload, err := json.Marshal(map[string]interface{}{"op": "put", "payment": payment})
+			require.NoError(t, err)
+			log += fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(payload), payload)
+		}
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "payments.log"), []byte(log), 0o600))
+
+		store, err := data.NewFileStore(dir, 0)
+		require.NoError(t, err)
+		defer store.Close()
+		stored, err := store.ListPayments()
+		require.NoError(t, err)
+		require.Len(t, stored, 2)
+		lastFours := []string{stored[0].CardLastFour, stored[1].CardLastFour}
+		assert.ElementsMatch(t, []string{"1009", "4242"}, lastFours)
+		assert.Equal(t, data.StateCaptured, stored[0].State)
+
+		// The records are rewritten without the card data as soon as the store is opened
+		for _, name := range []string{"payments.log", "payments.snapshot"} {
+			raw, err := os.ReadFile(filepath.Join(dir, name))
+			require.NoError(t, err)
+			assert.NotContains(t, string(raw), "4658585018481009")
+			assert.NotContains(t, string(raw), "Cvv")
+			assert.NotContains(t, string(raw), "11/30")
+			assert.NotContains(t, string(raw), "12/31")
+		}
+	})
+
+	t.Run("sql", func(t *testing.T) {
+		db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "payments.db"))
+		require.NoError(t, err)
+		db.SetMaxOpenConns(1)
+		defer db.Close()
+		_, err = data.NewSQLStore(db)
+		require.NoError(t, err)
+
+		// Put the schema back as it was before migration 13 stopped storing the full card data,
+		// and migration 15 the expiry date, holding a payment with the full card data
+		paymentId := uuid.New().String()
+		for _, statement := range []string{
+			`DELETE FROM schema_migrations WHERE version >= 13`,
+			`DROP TABLE vault_cards`,
+			`DROP TABLE customers`,
+			`DROP TABLE customer_payment_methods`,
+			`DROP TABLE plans`,
+			`DROP TABLE subscriptions`,
+			`DROP TABLE subscription_charges`,
+			`DROP INDEX payments_state`,
+			`DROP INDEX payments_merchant_created`,
+			`ALTER TABLE payments DROP COLUMN created_at`,
+			`ALTER TABLE payments DROP COLUMN customer_id`,
+			`ALTER TABLE payments DROP COLUMN initiator`,
+			`ALTER TABLE card_data DROP COLUMN card_token`,
+			`ALTER TABLE card_data DROP COLUMN card_last_four`,
+			`ALTER TABLE card_data ADD COLUMN card_number TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE card_data ADD COLUMN cvv TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE card_data ADD COLUMN expiry_date TEXT NOT NULL DEFAULT ''`,
+			`INSERT INTO payments (payment_id, merchant_id, state) VALUES ('` + paymentId + `', '` + testMerchantID + `', 'captured')`,
+			`INSERT INTO bank_transactions (payment_id, bank_payment_id, bank_payment_status) VALUES ('` + paymentId + `', '` + uuid.New().String() + `', 'Success')`,
+			`INSERT INTO card_data (payment_id, card_number, expiry_date, amount_minor, currency, cvv, brand) VALUES ('` + paymentId + `', '4658585018481009', '11/30', 10000, 'GBP', '555', 'Visa')`,
+		} {
+			_, err := db.Exec(statement)
+			require.NoError(t, err)
+		}
+
+		store, err := data.NewSQLStore(db)
+		require.NoError(t, err)
+		stored, err := store.ListPayments()
+		require.NoError(t, err)
+		require.Len(t, stored, 1)
+		assert.Equal(t, "1009", stored[0].CardLastFour)
+		for _, value := range sqlValues(t, db) {
+			assert.NotContains(t, value, "4658585018481009")
+			assert.NotEqual(t, "555", value)
+			assert.NotEqual(t, "11/30", value)
+		}
+	})
+}
+
+// TestLegacyPaymentCreationTime checks that payments stored before their creation time was kept
+// are given the time of their first state transition, so they are listed in the right order.
+func TestLegacyPaymentCreationTime(t *testing.T) {
+	createdAt := time.Date(2023, 8, 1, 12, 0, 0, 123456789, time.UTC)
+	payment := data.Payment{
+		PaymentID:  data.PaymentID(uuid.New()),
+		MerchantID: testMerchantID,
+		State:      data.StateCaptured,
+		History:    []data.StateTransition{{To: data.StatePending, At: createdAt}, {From: data.StatePending, To: data.StateCaptured, At: createdAt.Add(time.Second)}},
+		StoredCard: data.StoredCard{CardLastFour: "1009", Amount: money.Money{MinorUnits: 10000, Currency: "GBP"}, Brand: "Visa"},
+	}
+
+	t.Run("file", func(t *testing.T) {
+		dir := t.TempDir()
+		payload, err := json.Marshal(map[string]interface{}{"op": "put", "payment": payment})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "payments.log"), []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(payload), payload)), 0o600))
+
+		store, err := data.NewFileStore(dir, 0)
+		require.NoError(t, err)
+		defer store.Close()
+		listed, err := store.QueryPayments(data.PaymentQuery{MerchantID: testMerchantID, CreatedFrom: createdAt})
+		require.NoError(t, err)
+		require.Len(t, listed, 1)
+		assert.True(t, createdAt.Equal(listed[0].CreatedAt))
+	})
+
+	t.Run("sql", func(t *testing.T) {
+		db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "payments.db"))
+		require.NoError(t, err)
+		db.SetMaxOpenConns(1)
+		defer db.Close()
+		store, err := data.NewSQLStore(db)
+		require.NoError(t, err)
+		require.NoError(t, store.AddPayment(payment))
+
+		// Put the schema back as it was before migration 18 added the creation time, which migration 19 indexes
+		for _, statement := range []string{
+			`DELETE FROM schema_migrations WHERE version >= 18`,
+			`DROP INDEX payments_state`,
+			`DROP INDEX payments_merchant_created`,
+			`ALTER TABLE payments DROP COLUMN created_at`,
+		} {
+			_, err := db.Exec(statement)
+			require.NoError(t, err)
+		}
+
+		// The first state transition is read to the millisecond
+		store, err = data.NewSQLStore(db)
+		require.NoError(t, err)
+		listed, err := store.QueryPayments(data.PaymentQuery{MerchantID: testMerchantID, CreatedFrom: createdAt.Truncate(time.Millisecond)})
+		require.NoError(t, err)
+		require.Len(t, listed, 1)
+		assert.True(t, createdAt.Truncate(time.Millisecond).Equal(listed[0].CreatedAt))
+	})
+}
+
+func TestHandlePostPaymentAmountPrecision(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	router := setupRouter(p)
+
+	tests := []struct {
+		amount     string
+		wantCode   int
+		wantMinors int64
+	}{
+		{amount: `100.00`, wantCode: 200, wantMinors: 10000},
+		{amount: `"10.50"`, wantCode: 200, wantMinors: 1050},
+		{amount: `0.1`, wantCode: 200, wantMinors: 10},
+		{amount: `10.500`, wantCode: 200, wantMinors: 1050},
+		// Amounts with more decimal places than the currency uses are rejected, not rounded
+		{amount: `10.005`, wantCode: 400},
+		{amount: `"10.001"`, wantCode: 400},
+		{amount: `1e2`, wantCode: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.amount, func(t *testing.T) {
+			body := `{"card-number":"4658585018481009","expiry-date":"11/30","cvv":"555","currency":"GBP","amount":` + tt.amount + `}`
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/pay", bytes.NewBufferString(body))
+			req.Header.Set("Authorization", "Bearer "+testAPIKey)
+			router.ServeHTTP(w, req)
+			require.Equal(t, tt.wantCode, w.Code, w.Body.String())
+			if tt.wantCode != 200 {
+				require.JSONEq(t, `{"error":"Invalid payment amount"}`, w.Body.String())
+				return
+			}
+
+			var resp api.PostResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(resp.Uuid))
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, money.Money{MinorUnits: tt.wantMinors, Currency: "GBP"}, payment.Amount)
+		})
+	}
+}
+
+func TestHandlePostPaymentCurrency(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	router := setupRouter(p)
+
+	tests := []struct {
+		currency  string
+		amount    string
+		wantError string
+		wantMoney money.Money
+	}{
+		{currency: "GBP", amount: "10.50", wantMoney: money.Money{MinorUnits: 1050, Currency: "GBP"}},
+		// Currency codes are normalised before use
+		{currency: " gbp ", amount: "10.50", wantMoney: money.Money{MinorUnits: 1050, Currency: "GBP"}},
+		// The number of decimal places allowed depends on the currency
+		{currency: "JPY", amount: "1050", wantMoney: money.Money{MinorUnits: 1050, Currency: "JPY"}},
+		{currency: "JPY", amount: "10.5", wantError: "Invalid payment amount"},
+		{currency: "KWD", amount: "10.505", wantMoney: money.Money{MinorUnits: 10505, Currency: "KWD"}},
+		{currency: "KWD", amount: "10.5055", wantError: "Invalid payment amount"},
+		{currency: "GBP", amount: "10.505", wantError: "Invalid payment amount"},
+		// Unknown and withdrawn currencies are rejected
+		{currency: "XYZ", amount: "10.50", wantError: "Invalid currency"},
+		{currency: "DEM", amount: "10.50", wantError: "Invalid currency"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.currency+" "+tt.amount, func(t *testing.T) {
+			var cd api.PostJsonRequest
+			cd.CardNumber = "4658585018481009"
+			cd.Amount = json.Number(tt.amount)
+			cd.Currency = tt.currency
+			cd.ExpiryDate = "11/30"
+			cd.Cvv = "555"
+			jsonData, err := json.Marshal(cd)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+			req.Header.Set("Authorization", "Bearer "+testAPIKey)
+			router.ServeHTTP(w, req)
+			if tt.wantError != "" {
+				assert.Equal(t, 400, w.Code)
+				require.JSONEq(t, `{"error":"`+tt.wantError+`"}`, w.Body.String())
+				return
+			}
+			require.Equal(t, 200, w.Code, w.Body.String())
+
+			var resp api.PostResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(resp.Uuid))
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, tt.wantMoney, payment.Amount)
+
+			// The amount is returned with the number of decimal places used by the currency
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/findpayment/"+resp.Uuid.String(), nil)
+			req.Header.Set("Authorization", "Bearer "+testAPIKey)
+			router.ServeHTTP(w, req)
+			assert.Contains(t, w.Body.String(), `"amount": `+tt.wantMoney.String()+`,`)
+		})
+	}
+}
+
+func TestHandlePostPaymentCardBrand(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	router := setupRouter(p)
+
+	tests := []struct {
+		cardNumber string
+		cvv        string
+		wantBrand  string
+		wantError  string
+	}{
+		{cardNumber: "4111111111111111", cvv: "123", wantBrand: "Visa"},
+		{cardNumber: "5555555555554444", cvv: "123", wantBrand: "Mastercard"},
+		{cardNumber: "2223003122003222", cvv: "123", wantBrand: "Mastercard"},
+		{cardNumber: "378282246310005", cvv: "1234", wantBrand: "American Express"},
+		{cardNumber: "6011111111111117", cvv: "123", wantBrand: "Discover"},
+		{cardNumber: "3530111333300000", cvv: "123", wantBrand: "JCB"},
+		{cardNumber: "6200000000000005", cvv: "123", wantBrand: "UnionPay"},
+		// The more specific Discover range wins over the UnionPay range it sits in
+		{cardNumber: "6221260000000000", cvv: "123", wantBrand: "Discover"},
+		{cardNumber: "6759649826438453", cvv: "123", wantBrand: "Maestro"},
+		{cardNumber: "675964982643844", cvv: "123", wantBrand: "Maestro"},
+		// The CVV length depends on the scheme
+		{cardNumber: "378282246310005", cvv: "123", wantError: "Invalid CVV"},
+		{cardNumber: "4111111111111111", cvv: "1234", wantError: "Invalid CVV"},
+		// The card number length depends on the scheme
+		{cardNumber: "555555555555442", cvv: "123", wantError: "Invalid card number"},
+		{cardNumber: "9999999999999995", cvv: "123", wantError: "Unsupported card brand"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cardNumber, func(t *testing.T) {
+			var cd api.PostJsonRequest
+			cd.CardNumber = tt.cardNumber
+			cd.Amount = "100.00"
+			cd.Currency = "GBP"
+			cd.ExpiryDate = "11/30"
+			cd.Cvv = tt.cvv
+			jsonData, err := json.Marshal(cd)
+			require.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+			req.Header.Set("Authorization", "Bearer "+testAPIKey)
+			router.ServeHTTP(w, req)
+			if tt.wantError != "" {
+				assert.Equal(t, 400, w.Code)
+				require.JSONEq(t, `{"error":"`+tt.wantError+`"}`, w.Body.String())
+				return
+			}
+			require.Equal(t, 200, w.Code, w.Body.String())
+
+			var resp api.PostResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+			// The detected brand is stored with the payment and returned when it is fetched
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/findpayment/"+resp.Uuid.String(), nil)
+			req.Header.Set("Authorization", "Bearer "+testAPIKey)
+			router.ServeHTTP(w, req)
+			require.Equal(t, 200, w.Code)
+			var getResp api.GetResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &getResp))
+			assert.Equal(t, tt.wantBrand, getResp.CardBrand)
+		})
+	}
+}
+
+// newPaymentRequest builds a POST /pay request for a valid payment of the given amount.
+func newPaymentRequest(t *testing.T, amount string) *http.Request {
+	var cd api.PostJsonRequest
+	cd.CardNumber = "4658585018481009"
+	cd.Amount = json.Number(amount)
+	cd.Currency = "GBP"
+	cd.ExpiryDate = "11/30"
+	cd.Cvv = "555"
+	jsonData, err := json.Marshal(cd)
+	require.NoError(t, err)
+	req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	return req
+}
+
+func TestHandlePostPaymentIdempotencyKey(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	bankMock := new(mocks.CountingBankMock)
+	p.Banker = bankMock
+	router := setupRouter(p)
+
+	// The first request with the key is processed as normal
+	w := httptest.NewRecorder()
+	req := newPaymentRequest(t, "100.00")
+	req.Header.Set("Idempotency-Key", "order-1")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	first := w.Body.String()
+
+	// A retry with the same key and body replays the original response without paying again
+	w = httptest.NewRecorder()
+	req = newPaymentRequest(t, "100.00")
+	req.Header.Set("Idempotency-Key", "order-1")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, first, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&bankMock.Calls))
+
+	// Reusing the key for a different payment is a conflict
+	w = httptest.NewRecorder()
+	req = newPaymentRequest(t, "200.00")
+	req.Header.Set("Idempotency-Key", "order-1")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 409, w.Code)
+	require.JSONEq(t, `{"error":"Idempotency-Key has already been used for a different request"}`, w.Body.String())
+
+	// A different key, or no key at all, is a new payment
+	w = httptest.NewRecorder()
+	req = newPaymentRequest(t, "100.00")
+	req.Header.Set("Idempotency-Key", "order-2")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	assert.NotEqual(t, first, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&bankMock.Calls))
+
+	stored, err := p.ListPayments()
+	require.NoError(t, err)
+	assert.Len(t, stored, 3)
+}
+
+func TestHandlePostPaymentIdempotencyKeyConcurrent(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	// Hold the payment at the bank so the duplicates arrive while it is in flight
+	bankMock := &mocks.CountingBankMock{Release: make(chan struct{})}
+	p.Banker = bankMock
+	router := setupRouter(p)
+
+	numConcurrentRequests := 10
+	recorders := make([]*httptest.ResponseRecorder, numConcurrentRequests)
+	var wg sync.WaitGroup
+	wg.Add(numConcurrentRequests)
+	for i := 0; i < numConcurrentRequests; i++ {
+		w := httptest.NewRecorder()
+		recorders[i] = w
+		req := newPaymentRequest(t, "100.00")
+		req.Header.Set("Idempotency-Key", "order-1")
+		go func() {
+			defer wg.Done()
+			router.ServeHTTP(w, req)
+		}()
+	}
+
+	// Let the payment complete once the first request has reached the bank
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&bankMock.Calls) == 1 }, time.Second, time.Millisecond)
+	close(bankMock.Release)
+	wg.Wait()
+
+	// Every request gets the response of the single payment that was made
+	assert.Equal(t, int32(1), atomic.LoadInt32(&bankMock.Calls))
+	for _, w := range recorders {
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, recorders[0].Body.String(), w.Body.String())
+	}
+}
+
+func TestIdempotencyKeyAfterPanic(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(panickingBank)
+	router := setupRouter(p)
+
+	// A handler that panics is answered with a 500 by the recovery middleware, and releases its key
+	w := httptest.NewRecorder()
+	req := newPaymentRequest(t, "100.00")
+	req.Header.Set("Idempotency-Key", "order-1")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 500, w.Code)
+
+	// So a retry with the key is processed again rather than waiting on the first request forever
+	bankMock := new(mocks.CountingBankMock)
+	p.Banker = bankMock
+	w = httptest.NewRecorder()
+	req = newPaymentRequest(t, "100.00")
+	req.Header.Set("Idempotency-Key", "order-1")
+	ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+	defer cancel()
+	router.ServeHTTP(w, req.WithContext(ctx))
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&bankMock.Calls))
+}
+
+// panickingBank is a bank.Banker that panics on every payment.
+type panickingBank struct {
+	bank.Banker
+}
+
+// MakePaymentToBank panics.
+func (b *panickingBank) MakePaymentToBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	panic("bank exploded")
+}
+
+func TestIdempotencyKeyBodyTooLarge(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	bankMock := new(mocks.CountingBankMock)
+	p.Banker = bankMock
+	router := setupRouter(p)
+
+	// A body too large to be hashed is refused before it is read in full
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/pay", bytes.NewReader(make([]byte, 2<<20)))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	req.Header.Set("Idempotency-Key", "order-1")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 413, w.Code)
+	assert.JSONEq(t, `{"error":"Request body is too large"}`, w.Body.String())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&bankMock.Calls))
+}
+
+// TestIdempotencyKeyAfterBankError checks that a retry of a payment the bank gave no answer to
+// replays the response rather than paying again, as the bank may have taken the first payment,
+// while a payment the bank is known not to have acted on can be retried.
+func TestIdempotencyKeyAfterBankError(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	// The bank never answers, so the call is given up on once the timeout passes
+	bankMock := &mocks.CountingBankMock{Release: make(chan struct{})}
+	defer close(bankMock.Release)
+	p.Banker = bankMock
+	p.BankTimeout = 10 * time.Millisecond
+	router := setupRouter(p)
+
+	w := httptest.NewRecorder()
+	req := newPaymentRequest(t, "100.00")
+	req.Header.Set("Idempotency-Key", "order-1")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 504, w.Code)
+	first := w.Body.String()
+
+	w = httptest.NewRecorder()
+	req = newPaymentRequest(t, "100.00")
+	req.Header.Set("Idempotency-Key", "order-1")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 504, w.Code)
+	assert.Equal(t, first, w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&bankMock.Calls))
+	stored, err := p.ListPayments()
+	require.NoError(t, err)
+	assert.Len(t, stored, 1)
+
+	// A bank that refused the payment did nothing, so it is sent again
+	p.Banker = &mocks.ErrorBankMock{Err: bank.ErrUnavailable}
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		req = newPaymentRequest(t, "100.00")
+		req.Header.Set("Idempotency-Key", "order-2")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 503, w.Code)
+		assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+	}
+	stored, err = p.ListPayments()
+	require.NoError(t, err)
+	assert.Len(t, stored, 3)
+}
+
+func TestMerchantAuthentication(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	require.NoError(t, p.Merchants.Register(merchants.Merchant{ID: "merchant-2", Name: "Other Merchant"}, "sk_test_merchant_2"))
+	router := setupRouter(p)
+
+	// Requests without a valid API key are rejected
+	for _, header := range []string{"", "Bearer ", "Bearer sk_unknown", testAPIKey} {
+		w := httptest.NewRecorder()
+		req := newPaymentRequest(t, "100.00")
+		req.Header.Set("Authorization", header)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 401, w.Code)
+		require.JSONEq(t, `{"error":"Invalid API key"}`, w.Body.String())
+	}
+
+	// The payment is stamped with the merchant that made it
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+	require.Equal(t, 200, w.Code)
+	var resp api.PostResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	ok, payment, err := p.RetrievePayment(data.PaymentID(resp.Uuid))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, testMerchantID, payment.MerchantID)
+
+	// The owning merchant can fetch the payment
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/findpayment/"+resp.Uuid.String(), nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// Any other merchant is told it does not exist
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/findpayment/"+resp.Uuid.String(), nil)
+	req.Header.Set("Authorization", "Bearer sk_test_merchant_2")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+	require.JSONEq(t, `{"error":"payment not found"}`, w.Body.String())
+
+	// Idempotency keys are scoped to the merchant, so the same key is a new payment for another merchant
+	w = httptest.NewRecorder()
+	req = newPaymentRequest(t, "100.00")
+	req.Header.Set("Idempotency-Key", "order-1")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	first := w.Body.String()
+	w = httptest.NewRecorder()
+	req = newPaymentRequest(t, "100.00")
+	req.Header.Set("Authorization", "Bearer sk_test_merchant_2")
+	req.Header.Set("Idempotency-Key", "order-1")
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	assert.NotEqual(t, first, w.Body.String())
+}
+
+func TestPaymentStateTransitions(t *testing.T) {
+	at := time.Now()
+	var payment data.Payment
+
+	// A new payment can only start out pending
+	assert.ErrorIs(t, payment.Transition(data.StateCaptured, at), data.ErrIllegalTransition)
+	require.NoError(t, payment.Transition(data.StatePending, at))
+	assert.ErrorIs(t, payment.Transition(data.StatePending, at), data.ErrIllegalTransition)
+
+	// Funds cannot be captured or refunded before they are authorised
+	assert.ErrorIs(t, payment.Transition(data.StateCaptured, at), data.ErrIllegalTransition)
+	assert.ErrorIs(t, payment.Transition(data.StateRefunded, at), data.ErrIllegalTransition)
+	require.NoError(t, payment.Transition(data.StateAuthorised, at))
+
+	// A captured payment can no longer be voided, only refunded
+	require.NoError(t, payment.Transition(data.StateCaptured, at))
+	assert.ErrorIs(t, payment.Transition(data.StateVoided, at), data.ErrIllegalTransition)
+	require.NoError(t, payment.Transition(data.StatePartiallyRefunded, at))
+	require.NoError(t, payment.Transition(data.StatePartiallyRefunded, at))
+	require.NoError(t, payment.Transition(data.StateRefunded, at))
+
+	// Refunded is a final state
+	for _, state := range []data.PaymentState{data.StatePending, data.StateAuthorised, data.StateCaptured, data.StatePartiallyRefunded, data.StateFailed} {
+		assert.ErrorIs(t, payment.Transition(state, at), data.ErrIllegalTransition)
+	}
+
+	// Rejected transitions leave the payment and its history untouched
+	assert.Equal(t, data.StateRefunded, payment.State)
+	want := []data.PaymentState{data.StatePending, data.StateAuthorised, data.StateCaptured, data.StatePartiallyRefunded, data.StatePartiallyRefunded, data.StateRefunded}
+	require.Len(t, payment.History, len(want))
+	for i, transition := range payment.History {
+		assert.Equal(t, want[i], transition.To)
+	}
+}
+
+// authorisePayment makes a payment through the router that is only authorised, returning its UUID.
+func authorisePayment(t *testing.T, router http.Handler, amount string) string {
+	capture := false
+	jsonData, err := json.Marshal(api.PostJsonRequest{
+		CardNumber: "4658585018481009",
+		ExpiryDate: "11/30",
+		Amount:     json.Number(amount),
+		Currency:   "GBP",
+		Cvv:        "555",
+		Capture:    &capture,
+	})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp api.PostResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Uuid.String()
+}
+
+// postPaymentAction sends a POST to one of the /payments/{uuid} actions with the given body.
+func postPaymentAction(router http.Handler, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthoriseAndCapturePayment(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	router := setupRouter(p)
+
+	// A payment made with capture set to false is only authorised
+	id := authorisePayment(t, router, "100.00")
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/findpayment/"+id, nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp api.GetResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "authorised", resp.State)
+	assert.Equal(t, json.Number("0.00"), resp.AmountCaptured)
+	require.NotNil(t, resp.AuthorisedUntil)
+	assert.True(t, resp.AuthorisedUntil.After(time.Now()))
+
+	// More than was authorised can never be captured
+	w = postPaymentAction(router, "/payments/"+id+"/capture", `{"amount":"100.01"}`)
+	assert.Equal(t, 400, w.Code)
+	w = postPaymentAction(router, "/payments/"+id+"/capture", `{"amount":"0"}`)
+	assert.Equal(t, 400, w.Code)
+
+	// A partial capture releases the rest of the authorisation
+	w = postPaymentAction(router, "/payments/"+id+"/capture", `{"amount":"60.00"}`)
+	require.Equal(t, 200, w.Code)
+	requirePaymentResponse(t, `{"state":"captured", "amount":100, "amount-captured":60, "amount-refundable":60, "refunds":[], "bank-attempts":1, "bank-payment-status":"Success", "card-number-masked":"****1009", "card-brand":"Visa", "currency":"GBP", "expiry-date":"11/30", "initiated-by":"customer"}`,
+		[]data.PaymentState{data.StatePending, data.StateAuthorised, data.StateCaptured}, w.Body.String())
+
+	// A payment can only be captured once, and can no longer be voided
+	w = postPaymentAction(router, "/payments/"+id+"/capture", ``)
+	assert.Equal(t, 409, w.Code)
+	w = postPaymentAction(router, "/payments/"+id+"/void", ``)
+	assert.Equal(t, 409, w.Code)
+
+	// Without an amount the payment is captured in full
+	id = authorisePayment(t, router, "25.50")
+	w = postPaymentAction(router, "/payments/"+id+"/capture", ``)
+	require.Equal(t, 200, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, json.Number("25.50"), resp.AmountCaptured)
+
+	// Payments taken in one go cannot be captured again
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newPaymentRequest(t, "10.00"))
+	require.Equal(t, 200, w.Code)
+	var postResp api.PostResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &postResp))
+	w = postPaymentAction(router, "/payments/"+postResp.Uuid.String()+"/capture", ``)
+	assert.Equal(t, 409, w.Code)
+
+	// Unknown payments are not found
+	w = postPaymentAction(router, "/payments/"+uuid.New().String()+"/capture", ``)
+	assert.Equal(t, 404, w.Code)
+	w = postPaymentAction(router, "/payments/not-a-uuid/void", ``)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestVoidPayment(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	require.NoError(t, p.Merchants.Register(merchants.Merchant{ID: "merchant-2", Name: "Other Merchant"}, "sk_test_merchant_2"))
+	router := setupRouter(p)
+
+	id := authorisePayment(t, router, "100.00")
+
+	// Other merchants cannot void, or even see, the payment
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/payments/"+id+"/void", nil)
+	req.Header.Set("Authorization", "Bearer sk_test_merchant_2")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+
+	w = postPaymentAction(router, "/payments/"+id+"/void", ``)
+	require.Equal(t, 200, w.Code)
+	requirePaymentResponse(t, `{"state":"voided", "amount":100, "amount-captured":0, "amount-refundable":0, "refunds":[], "bank-attempts":1, "bank-payment-status":"Success", "card-number-masked":"****1009", "card-brand":"Visa", "currency":"GBP", "expiry-date":"11/30", "initiated-by":"customer"}`,
+		[]data.PaymentState{data.StatePending, data.StateAuthorised, data.StateVoided}, w.Body.String())
+
+	// A voided payment can no longer be captured
+	w = postPaymentAction(router, "/payments/"+id+"/capture", ``)
+	assert.Equal(t, 409, w.Code)
+}
+
+func TestCaptureExpiredAuthorisation(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	// Authorisations lapse as soon as they are made
+	p.AuthorisationExpiry = -time.Second
+	router := setupRouter(p)
+
+	id := authorisePayment(t, router, "100.00")
+	w := postPaymentAction(router, "/payments/"+id+"/capture", ``)
+	assert.Equal(t, 409, w.Code)
+	assert.JSONEq(t, `{"error":"Payment authorisation has expired"}`, w.Body.String())
+
+	// The authorisation can still be voided to release it straight away
+	w = postPaymentAction(router, "/payments/"+id+"/void", ``)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestCaptureDeclinedByBank(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	router := setupRouter(p)
+	id := authorisePayment(t, router, "100.00")
+
+	// The bank refuses to capture the funds, which leaves the payment authorised
+	p.Banker = new(mocks.BankMock)
+	w := postPaymentAction(router, "/payments/"+id+"/capture", ``)
+	assert.Equal(t, 402, w.Code)
+	ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(uuid.MustParse(id)))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, data.StateAuthorised, payment.State)
+}
+
+func TestRefundPayment(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	router := setupRouter(p)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+	require.Equal(t, 200, w.Code)
+	var postResp api.PostResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &postResp))
+	id := postResp.Uuid.String()
+
+	// Partial refunds can be made until they add up to the captured amount
+	w = postPaymentAction(router, "/payments/"+id+"/refunds", `{"amount":"30.00"}`)
+	require.Equal(t, 201, w.Code)
+	var first api.RefundResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &first))
+	assert.Equal(t, "Success", first.Status)
+	assert.Equal(t, json.Number("30.00"), first.Amount)
+	assert.NotEmpty(t, first.BankRefundID)
+
+	w = postPaymentAction(router, "/payments/"+id+"/refunds", `{"amount":"70.01"}`)
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"error":"Amount exceeds the refundable amount"}`, w.Body.String())
+	w = postPaymentAction(router, "/payments/"+id+"/refunds", `{"amount":"-1"}`)
+	assert.Equal(t, 400, w.Code)
+
+	w = postPaymentAction(router, "/payments/"+id+"/refunds", `{"amount":"20.00"}`)
+	require.Equal(t, 201, w.Code)
+
+	// The payment shows each refund and what is left to refund
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/findpayment/"+id, nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp api.GetResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "partially-refunded", resp.State)
+	assert.Equal(t, json.Number("50.00"), resp.AmountRefundable)
+	require.Len(t, resp.Refunds, 2)
+	assert.Equal(t, first, resp.Refunds[0])
+	assert.NotEqual(t, resp.Refunds[0].RefundID, resp.Refunds[1].RefundID)
+
+	// Without an amount the rest of the payment is refunded, after which nothing more can be
+	w = postPaymentAction(router, "/payments/"+id+"/refunds", ``)
+	require.Equal(t, 201, w.Code)
+	var last api.RefundResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &last))
+	assert.Equal(t, json.Number("50.00"), last.Amount)
+	w = postPaymentAction(router, "/payments/"+id+"/refunds", `{"amount":"0.01"}`)
+	assert.Equal(t, 409, w.Code)
+
+	ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(postResp.Uuid))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, data.StateRefunded, payment.State)
+	assert.Equal(t, int64(0), payment.RefundableAmount().MinorUnits)
+	require.Len(t, payment.History, 6)
+}
+
+func TestRefundPaymentRules(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	router := setupRouter(p)
+
+	// Only the captured part of an authorisation can be refunded
+	id := authorisePayment(t, router, "100.00")
+	w := postPaymentAction(router, "/payments/"+id+"/refunds", ``)
+	assert.Equal(t, 409, w.Code)
+	w = postPaymentAction(router, "/payments/"+id+"/capture", `{"amount":"40.00"}`)
+	require.Equal(t, 200, w.Code)
+	w = postPaymentAction(router, "/payments/"+id+"/refunds", `{"amount":"40.01"}`)
+	assert.Equal(t, 400, w.Code)
+
+	// A declined refund is recorded, but does not count against the refundable amount
+	p.Banker = new(mocks.BankMock)
+	w = postPaymentAction(router, "/payments/"+id+"/refunds", `{"amount":"10.00"}`)
+	assert.Equal(t, 402, w.Code)
+	ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(uuid.MustParse(id)))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, data.StateCaptured, payment.State)
+	require.Len(t, payment.Refunds, 1)
+	assert.Equal(t, data.BankPaymentStatus("Failure"), payment.Refunds[0].Status)
+	assert.Equal(t, int64(4000), payment.RefundableAmount().MinorUnits)
+
+	w = postPaymentAction(router, "/payments/"+uuid.New().String()+"/refunds", ``)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestBankErrors(t *testing.T) {
+	tests := []struct {
+		err       error
+		wantCode  int
+		wantState data.PaymentState
+	}{
+		{err: fmt.Errorf("%w: connection reset", bank.ErrNetwork), wantCode: 502, wantState: data.StatePending},
+		{err: bank.ErrUnavailable, wantCode: 503, wantState: data.StateFailed},
+		{err: bank.ErrTimeout, wantCode: 504, wantState: data.StatePending},
+		{err: bank.ErrInvalidRequest, wantCode: 400, wantState: data.StateFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			p := newTestPaymentGatewayService(t)
+			p.Banker = new(bank.Bank)
+			router := setupRouter(p)
+			authorisedId := authorisePayment(t, router, "100.00")
+
+			// A bank that gives no answer is not a decline. The payment has failed if the bank
+			// turned it away, and is left pending if the bank may have taken it
+			p.Banker = &mocks.ErrorBankMock{Err: tt.err}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+			require.Equal(t, tt.wantCode, w.Code)
+			var resp api.ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(uuid.MustParse(resp.Uuid)))
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, tt.wantState, payment.State)
+
+			// Operations on existing payments leave them as they were
+			w = postPaymentAction(router, "/payments/"+authorisedId+"/capture", ``)
+			assert.Equal(t, tt.wantCode, w.Code)
+			ok, payment, err = p.GetPayment(testMerchantID, data.PaymentID(uuid.MustParse(authorisedId)))
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, data.StateAuthorised, payment.State)
+		})
+	}
+}
+
+func TestBankTimeout(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	// The bank never answers, so the call is given up on once the timeout passes
+	bankMock := &mocks.CountingBankMock{Release: make(chan struct{})}
+	defer close(bankMock.Release)
+	p.Banker = bankMock
+	p.BankTimeout = 10 * time.Millisecond
+	router := setupRouter(p)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+	assert.Equal(t, 504, w.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&bankMock.Calls))
+}
+
+// testBankSecret is the secret shared with the stand-in acquiring banks the tests run against
+var testBankSecret = []byte("test-bank-secret")
+
+// newTestBankServer starts a stand-in acquiring bank that checks every request is signed, and
+// answers with handler. It is shut down with the test.
+func newTestBankServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if !bank.VerifySignature(testBankSecret, r.Header.Get(bank.TimestampHeader), r.Header.Get(bank.SignatureHeader), r.Method, r.URL.Path, body, time.Minute) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPBank(t *testing.T) {
+	bankPaymentId := uuid.New()
+	var paths []string
+	var mu sync.Mutex
+	server := newTestBankServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		var req map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		switch r.URL.Path {
+		case "/v1/payments":
+			// Amounts are sent in minor units
+			assert.Equal(t, map[string]interface{}{"card-number": "4658585018481009", "expiry-date": "11/30", "cvv": "555", "amount": float64(10000), "currency": "GBP", "capture": false, "initiator": "customer"}, req)
+			fmt.Fprintf(w, `{"id":%q,"status":"Success"}`, bankPaymentId)
+		case "/v1/payments/" + bankPaymentId.String() + "/capture":
+			assert.Equal(t, map[string]interface{}{"amount": float64(6000), "currency": "GBP"}, req)
+			fmt.Fprint(w, `{"status":"Success"}`)
+		case "/v1/payments/" + bankPaymentId.String() + "/refunds":
+			fmt.Fprintf(w, `{"id":%q,"status":"Success"}`, uuid.New())
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	p := newTestPaymentGatewayService(t)
+	p.Banker = bank.NewHTTPBank(server.URL+"/v1/", testBankSecret, time.Second)
+	router := setupRouter(p)
+
+	id := authorisePayment(t, router, "100.00")
+	w := postPaymentAction(router, "/payments/"+id+"/capture", `{"amount":"60.00"}`)
+	require.Equal(t, 200, w.Code)
+	w = postPaymentAction(router, "/payments/"+id+"/refunds", `{"amount":"10.00"}`)
+	require.Equal(t, 201, w.Code)
+
+	ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(uuid.MustParse(id)))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, data.BankPaymentID(bankPaymentId), payment.BankPaymentID)
+	assert.Equal(t, data.StatePartiallyRefunded, payment.State)
+	assert.Len(t, paths, 3)
+
+	// Requests signed with the wrong secret are turned away by the bank
+	p.Banker = bank.NewHTTPBank(server.URL+"/v1", []byte("wrong-secret"), time.Second)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+	assert.Equal(t, 502, w.Code)
+}
+
+func TestHTTPBankResponses(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		wantCode  int
+		wantState data.PaymentState
+	}{
+		{name: "declined", handler: func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"id":%q,"status":"Failure"}`, uuid.New())
+		}, wantCode: 200, wantState: data.StateDeclined},
+		{name: "invalid request", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}, wantCode: 400, wantState: data.StateFailed},
+		{name: "unavailable", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}, wantCode: 503, wantState: data.StateFailed},
+		{name: "server error", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}, wantCode: 502, wantState: data.StatePending},
+		{name: "malformed response", handler: func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"id":"not-a-uuid","status":"Success"}`)
+		}, wantCode: 502, wantState: data.StatePending},
+		{name: "slow response", handler: func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		}, wantCode: 504, wantState: data.StatePending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestBankServer(t, tt.handler)
+			p := newTestPaymentGatewayService(t)
+			p.Banker = bank.NewHTTPBank(server.URL, testBankSecret, 50*time.Millisecond)
+			router := setupRouter(p)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+			require.Equal(t, tt.wantCode, w.Code)
+			var resp struct{ Uuid uuid.UUID }
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(resp.Uuid))
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, tt.wantState, payment.State)
+		})
+	}
+
+	// A bank that cannot be reached at all is a network failure
+	server := newTestBankServer(t, nil)
+	server.Close()
+	p := newTestPaymentGatewayService(t)
+	p.Banker = bank.NewHTTPBank(server.URL, testBankSecret, time.Second)
+	w := httptest.NewRecorder()
+	setupRouter(p).ServeHTTP(w, newPaymentRequest(t, "100.00"))
+	assert.Equal(t, 502, w.Code)
+}
+
+func TestBankSimulator(t *testing.T) {
+	server := httptest.NewServer(banksim.New(banksim.Config{Secret: testBankSecret, SlowLatency: 100 * time.Millisecond}))
+	t.Cleanup(server.Close)
+	p := newTestPaymentGatewayService(t)
+	p.Banker = bank.NewHTTPBank(server.URL, testBankSecret, 500*time.Millisecond)
+	router := setupRouter(p)
+
+	tests := []struct {
+		name       string
+		cardNumber string
+		amount     string
+		wantCode   int
+		wantState  data.PaymentState
+	}{
+		{name: "approved", cardNumber: "4658585018481009", amount: "100.00", wantCode: 200, wantState: data.StateCaptured},
+		{name: "insufficient funds card", cardNumber: "4000000000009953", amount: "100.00", wantCode: 200, wantState: data.StateDeclined},
+		{name: "stolen card", cardNumber: "4000000000009979", amount: "100.00", wantCode: 200, wantState: data.StateDeclined},
+		{name: "do not honour card", cardNumber: "4000000000000002", amount: "100.00", wantCode: 200, wantState: data.StateDeclined},
+		{name: "timeout card", cardNumber: "4000000000000119", amount: "100.00", wantCode: 504, wantState: data.StatePending},
+		{name: "server error card", cardNumber: "4000000000000127", amount: "100.00", wantCode: 502, wantState: data.StatePending},
+		{name: "unavailable card", cardNumber: "4000000000000143", amount: "100.00", wantCode: 503, wantState: data.StateFailed},
+		{name: "slow card", cardNumber: "4000000000000135", amount: "100.00", wantCode: 200, wantState: data.StateCaptured},
+		{name: "insufficient funds amount", cardNumber: "4658585018481009", amount: "1000.51", wantCode: 200, wantState: data.StateDeclined},
+		{name: "server error amount", cardNumber: "4658585018481009", amount: "1000.99", wantCode: 502, wantState: data.StatePending},
+		{name: "everyday price ending in a magic amount", cardNumber: "4658585018481009", amount: "9.99", wantCode: 200, wantState: data.StateCaptured},
+		{name: "everyday price ending in a pending amount", cardNumber: "4658585018481009", amount: "4.95", wantCode: 200, wantState: data.StateCaptured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jsonData, err := json.Marshal(api.PostJsonRequest{CardNumber: tt.cardNumber, ExpiryDate: "11/30", Amount: json.Number(tt.amount), Currency: "GBP", Cvv: "555"})
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+			req.Header.Set("Authorization", "Bearer "+testAPIKey)
+			router.ServeHTTP(w, req)
+			require.Equal(t, tt.wantCode, w.Code)
+
+			var resp struct{ Uuid uuid.UUID }
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(resp.Uuid))
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, tt.wantState, payment.State)
+		})
+	}
+
+	// The simulator keeps track of what it approved, so captures and refunds follow its rules too
+	id := authorisePayment(t, router, "100.00")
+	w := postPaymentAction(router, "/payments/"+id+"/capture", `{"amount":"80.00"}`)
+	require.Equal(t, 200, w.Code)
+	w = postPaymentAction(router, "/payments/"+id+"/refunds", ``)
+	require.Equal(t, 201, w.Code)
+	var refund api.RefundResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refund))
+	assert.Equal(t, json.Number("80.00"), refund.Amount)
+}
+
+func TestLostBankAnswers(t *testing.T) {
+	server := httptest.NewServer(banksim.New(banksim.Config{Secret: testBankSecret}))
+	t.Cleanup(server.Close)
+	p := newTestPaymentGatewayService(t)
+	p.Banker = bank.NewHTTPBank(server.URL, testBankSecret, 100*time.Millisecond)
+	router := setupRouter(p)
+	pay := func(cardNumber string, wantCode int) data.PaymentID {
+		jsonData, err := json.Marshal(api.PostJsonRequest{CardNumber: cardNumber, ExpiryDate: "11/30", Amount: "100.00", Currency: "GBP", Cvv: "555"})
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		router.ServeHTTP(w, req)
+		require.Equal(t, wantCode, w.Code)
+		var resp struct{ Uuid uuid.UUID }
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return data.PaymentID(resp.Uuid)
+	}
+	stateOf := func(id data.PaymentID) data.PaymentState {
+		ok, payment, err := p.GetPayment(testMerchantID, id)
+		require.NoError(t, err)
+		require.True(t, ok)
+		return payment.State
+	}
+
+	// The bank approves the timed out payment and never hears of the one it answered with a 500,
+	// but the gateway cannot tell either way, so both are left pending
+	timedOut := pay("4000000000000119", 504)
+	serverError := pay("4000000000000127", 502)
+	assert.Equal(t, data.StatePending, stateOf(timedOut))
+	assert.Equal(t, data.StatePending, stateOf(serverError))
+
+	// Checking on them later asks the bank by reference, which settles both
+	decided, err := p.CheckPendingPayments(context.Background(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, decided)
+	assert.Equal(t, data.StateCaptured, stateOf(timedOut))
+	assert.Equal(t, data.StateFailed, stateOf(serverError))
+	ok, payment, err := p.GetPayment(testMerchantID, timedOut)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.NotEqual(t, data.BankPaymentID(uuid.Nil), payment.BankPaymentID)
+
+	// The captured payment can be refunded with the bank like any other
+	w := postPaymentAction(router, "/payments/"+uuid.UUID(timedOut).String()+"/refunds", ``)
+	assert.Equal(t, 201, w.Code)
+}
+
+func TestBankSimulatorRandomFailures(t *testing.T) {
+	// Every request fails when the failure rate is one
+	server := httptest.NewServer(banksim.New(banksim.Config{UnavailableRate: 1}))
+	t.Cleanup(server.Close)
+	p := newTestPaymentGatewayService(t)
+	p.Banker = bank.NewHTTPBank(server.URL, testBankSecret, time.Second)
+
+	w := httptest.NewRecorder()
+	setupRouter(p).ServeHTTP(w, newPaymentRequest(t, "100.00"))
+	assert.Equal(t, 503, w.Code)
+}
+
+func TestRetryingBank(t *testing.T) {
+	// The bank is unavailable for the first two attempts at each operation
+	var mu sync.Mutex
+	attempts := make(map[string][]string)
+	server := newTestBankServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.URL.Path] = append(attempts[r.URL.Path], r.Header.Get(bank.IdempotencyHeader))
+		n := len(attempts[r.URL.Path])
+		mu.Unlock()
+		if n <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"id":%q,"status":"Success"}`, uuid.New())
+	})
+	p := newTestPaymentGatewayService(t)
+	p.Banker = bank.NewRetryingBank(bank.NewHTTPBank(server.URL, testBankSecret, time.Second), 5, time.Millisecond, 5*time.Millisecond)
+	router := setupRouter(p)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+	require.Equal(t, 200, w.Code)
+	var postResp api.PostResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &postResp))
+
+	// Every attempt carried the payment's id as its idempotency reference
+	require.Len(t, attempts["/payments"], 3)
+	for _, reference := range attempts["/payments"] {
+		assert.Equal(t, postResp.Uuid.String(), reference)
+	}
+	ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(postResp.Uuid))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, data.StateCaptured, payment.State)
+	assert.Equal(t, 3, payment.BankAttempts)
+
+	// Refunds are retried in the same way, under the refund's own id
+	w = postPaymentAction(router, "/payments/"+postResp.Uuid.String()+"/refunds", ``)
+	require.Equal(t, 201, w.Code)
+	var refund api.RefundResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refund))
+	assert.Equal(t, 3, refund.BankAttempts)
+	for path, references := range attempts {
+		if strings.HasSuffix(path, "/refunds") {
+			assert.Equal(t, []string{refund.RefundID, refund.RefundID, refund.RefundID}, references)
+		}
+	}
+}
+
+func TestRetryingBankOnlyRetriesSafeFailures(t *testing.T) {
+	tests := []struct {
+		name         string
+		handler      http.HandlerFunc
+		closed       bool
+		wantCode     int
+		wantAttempts int
+	}{
+		// The bank may have acted on the payment before failing, so it is not tried again
+		{name: "server error", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}, wantCode: 502, wantAttempts: 1},
+		{name: "timeout waiting for answer", handler: func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}, wantCode: 504, wantAttempts: 1},
+		// Nothing was sent, so every attempt is used up
+		{name: "unavailable", handler: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}, wantCode: 503, wantAttempts: 3},
+		{name: "connection refused", closed: true, wantCode: 502, wantAttempts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			server := newTestBankServer(t, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				tt.handler(w, r)
+			})
+			if tt.closed {
+				server.Close()
+			}
+			p := newTestPaymentGatewayService(t)
+			p.Banker = bank.NewRetryingBank(bank.NewHTTPBank(server.URL, testBankSecret, 50*time.Millisecond), 3, time.Millisecond, 5*time.Millisecond)
+
+			w := httptest.NewRecorder()
+			setupRouter(p).ServeHTTP(w, newPaymentRequest(t, "100.00"))
+			require.Equal(t, tt.wantCode, w.Code)
+			var resp struct{ Uuid uuid.UUID }
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(resp.Uuid))
+			require.NoError(t, err)
+			require.True(t, ok)
+			assert.Equal(t, tt.wantAttempts, payment.BankAttempts)
+			if !tt.closed {
+				assert.Equal(t, int32(tt.wantAttempts), atomic.LoadInt32(&calls))
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	// The stand-in bank answers with the status held in respondWith, or approves the payment
+	var respondWith, calls int32
+	server := newTestBankServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if status := atomic.LoadInt32(&respondWith); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		fmt.Fprintf(w, `{"id":%q,"status":"Success"}`, uuid.New())
+	})
+	now := time.Now()
+	breaker := bank.NewCircuitBreaker("test-acquirer", bank.NewHTTPBank(server.URL, testBankSecret, time.Second), 3, time.Minute)
+	breaker.Clock = func() time.Time { return now }
+	p := newTestPaymentGatewayService(t)
+	p.Banker = breaker
+	router := setupRouter(p)
+
+	pay := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+		return w
+	}
+	health := func() api.HealthResponse {
+		// The health check needs no API key
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/health", nil)
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+		var resp api.HealthResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	assert.Equal(t, api.HealthResponse{Status: "ok", Acquirers: []bank.Health{{Acquirer: "test-acquirer", State: bank.BreakerClosed}}}, health())
+
+	// Invalid requests are answers from a working bank, so never open the breaker
+	atomic.StoreInt32(&respondWith, http.StatusUnprocessableEntity)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 400, pay().Code)
+	}
+	assert.Equal(t, bank.BreakerClosed, health().Acquirers[0].State)
+
+	// The breaker opens once the bank has failed three calls in a row
+	atomic.StoreInt32(&respondWith, http.StatusInternalServerError)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 502, pay().Code)
+	}
+	assert.Equal(t, api.HealthResponse{Status: "degraded", Acquirers: []bank.Health{{Acquirer: "test-acquirer", State: bank.BreakerOpen, ConsecutiveFailures: 3}}}, health())
+
+	// While open, payments fail fast without reaching the bank
+	atomic.StoreInt32(&calls, 0)
+	w := pay()
+	assert.Equal(t, 503, w.Code)
+	var errResp api.ErrorResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &errResp))
+	assert.Equal(t, "Acquirer unavailable", errResp.Error)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+
+	// After the cool down a failed trial call opens the breaker again
+	now = now.Add(time.Minute)
+	assert.Equal(t, bank.BreakerHalfOpen, health().Acquirers[0].State)
+	assert.Equal(t, 502, pay().Code)
+	assert.Equal(t, 503, pay().Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// A trial call the caller gave up on says nothing about the bank, so leaves the breaker half-open
+	now = now.Add(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := breaker.MakePaymentToBank(ctx, data.CardData{CardNumber: "4658585018481009", ExpiryDate: "11/30", Amount: money.Money{MinorUnits: 10000, Currency: "GBP"}, Cvv: "555"})
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, api.HealthResponse{Status: "degraded", Acquirers: []bank.Health{{Acquirer: "test-acquirer", State: bank.BreakerHalfOpen, ConsecutiveFailures: 4}}}, health())
+
+	// A successful trial call closes it
+	now = now.Add(time.Minute)
+	atomic.StoreInt32(&respondWith, 0)
+	assert.Equal(t, 200, pay().Code)
+	assert.Equal(t, 200, pay().Code)
+	assert.Equal(t, api.HealthResponse{Status: "ok", Acquirers: []bank.Health{{Acquirer: "test-acquirer", State: bank.BreakerClosed}}}, health())
+}
+
+func TestAcquirerRouter(t *testing.T) {
+	// Each acquirer is a bank simulator, which only knows about the payments made with it, and
+	// the primary answers every request with a 503 while it is down
+	var primaryDown int32
+	primarySim := banksim.New(banksim.Config{Secret: testBankSecret})
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&primaryDown) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		primarySim.ServeHTTP(w, r)
+	}))
+	t.Cleanup(primary.Close)
+	secondary := httptest.NewServer(banksim.New(banksim.Config{Secret: testBankSecret}))
+	t.Cleanup(secondary.Close)
+
+	router, err := bank.NewAcquirerRouter([]bank.Acquirer{
+		{Name: "primary", Banker: bank.NewHTTPBank(primary.URL, testBankSecret, 500*time.Millisecond)},
+		{Name: "secondary", Banker: bank.NewHTTPBank(secondary.URL, testBankSecret, 500*time.Millisecond)},
+	}, []bank.Rule{
+		{Brands: []string{"Mastercard"}, Targets: []bank.Target{{Acquirer: "secondary", Weight: 1}}},
+		{Currencies: []string{"GBP"}, MinAmount: 100000, Targets: []bank.Target{{Acquirer: "secondary", Weight: 1}}},
+		{Currencies: []string{"EUR"}, Merchants: []string{testMerchantID}, Targets: []bank.Target{{Acquirer: "primary", Weight: 1}, {Acquirer: "secondary", Weight: 1}}},
+		{Targets: []bank.Target{{Acquirer: "primary", Weight: 1}}, Failover: []string{"secondary"}},
+	})
+	require.NoError(t, err)
+	p := newTestPaymentGatewayService(t)
+	p.Banker = router
+	r := setupRouter(p)
+
+	pay := func(cardNumber, amount, currency string) (int, data.Payment) {
+		jsonData, err := json.Marshal(api.PostJsonRequest{CardNumber: cardNumber, ExpiryDate: "11/30", Amount: json.Number(amount), Currency: currency, Cvv: "555"})
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		r.ServeHTTP(w, req)
+		var resp struct{ Uuid uuid.UUID }
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(resp.Uuid))
+		require.NoError(t, err)
+		require.True(t, ok)
+		return w.Code, payment
+	}
+
+	// Payments are routed by card brand and amount band, and anything else goes to the primary
+	tests := []struct {
+		name         string
+		cardNumber   string
+		amount       string
+		wantAcquirer string
+	}{
+		{name: "default", cardNumber: "4658585018481009", amount: "100.00", wantAcquirer: "primary"},
+		{name: "brand", cardNumber: "5555555555554444", amount: "100.00", wantAcquirer: "secondary"},
+		{name: "amount band", cardNumber: "4658585018481009", amount: "1000.00", wantAcquirer: "secondary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, payment := pay(tt.cardNumber, tt.amount, "GBP")
+			require.Equal(t, 200, code)
+			assert.Equal(t, data.StateCaptured, payment.State)
+			assert.Equal(t, tt.wantAcquirer, payment.Acquirer)
+		})
+	}
+
+	// The merchant's euro payments are split between both acquirers
+	used := map[string]int{}
+	for i := 0; i < 50; i++ {
+		code, payment := pay("4658585018481009", "10.00", "EUR")
+		require.Equal(t, 200, code)
+		used[payment.Acquirer]++
+	}
+	assert.Len(t, used, 2)
+
+	// The acquirer is stored on the payment, so its capture goes to the same bank, which is the
+	// only one that would approve it
+	id := authorisePayment(t, r, "1500.00")
+	w := postPaymentAction(r, "/payments/"+id+"/capture", ``)
+	require.Equal(t, 200, w.Code)
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/findpayment/"+id, nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	r.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var getResp api.GetResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &getResp))
+	assert.Equal(t, "secondary", getResp.Acquirer)
+
+	// While the primary is unavailable its payments fail over to the secondary
+	atomic.StoreInt32(&primaryDown, 1)
+	code, payment := pay("4658585018481009", "100.00", "GBP")
+	require.Equal(t, 200, code)
+	assert.Equal(t, data.StateCaptured, payment.State)
+	assert.Equal(t, "secondary", payment.Acquirer)
+
+	// A failure that may have reached the bank is never failed over, as the payment could be taken twice
+	atomic.StoreInt32(&primaryDown, 0)
+	code, payment = pay("4000000000000127", "100.00", "GBP")
+	assert.Equal(t, 502, code)
+	assert.Equal(t, data.StatePending, payment.State)
+	assert.Equal(t, "primary", payment.Acquirer)
+
+	// Rules can only name known acquirers
+	_, err = bank.NewAcquirerRouter([]bank.Acquirer{{Name: "primary", Banker: new(bank.Bank)}}, []bank.Rule{{Targets: []bank.Target{{Acquirer: "missing", Weight: 1}}}})
+	assert.Error(t, err)
+}
+
+// postBankNotification sends a notification to the gateway signed with the secret.
+func postBankNotification(router http.Handler, secret []byte, notification bank.Notification) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(notification)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/bank/notifications", bytes.NewBuffer(body))
+	req.Header.Set(bank.TimestampHeader, timestamp)
+	req.Header.Set(bank.SignatureHeader, bank.Sign(secret, timestamp, "POST", "/bank/notifications", body))
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestPendingPayments(t *testing.T) {
+	// The simulator decides on pending payments after 100ms, and sends its decision to the gateway
+	p := newTestPaymentGatewayService(t)
+	p.BankSecrets = map[string][]byte{"": testBankSecret}
+	router := setupRouter(p)
+	gateway := httptest.NewServer(router)
+	t.Cleanup(gateway.Close)
+	simulator := httptest.NewServer(banksim.New(banksim.Config{Secret: testBankSecret, PendingLatency: 100 * time.Millisecond, NotificationURL: gateway.URL + "/bank/notifications"}))
+	t.Cleanup(simulator.Close)
+	p.Banker = bank.NewHTTPBank(simulator.URL, testBankSecret, time.Second)
+
+	pay := func(cardNumber string) data.PaymentID {
+		jsonData, err := json.Marshal(api.PostJsonRequest{CardNumber: cardNumber, ExpiryDate: "11/30", Amount: "100.00", Currency: "GBP", Cvv: "555"})
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/pay", bytes.NewBuffer(jsonData))
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+		var resp api.PostResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return data.PaymentID(resp.Uuid)
+	}
+	stateOf := func(id data.PaymentID) data.PaymentState {
+		ok, payment, err := p.GetPayment(testMerchantID, id)
+		require.NoError(t, err)
+		require.True(t, ok)
+		return payment.State
+	}
+
+	// A pending payment stays pending until the bank's notification arrives
+	approved := pay("4000000000000150")
+	declined := pay("4000000000000168")
+	_, payment, err := p.GetPayment(testMerchantID, approved)
+	require.NoError(t, err)
+	assert.Equal(t, data.StatePending, payment.State)
+	assert.Equal(t, data.BankPaymentStatus("Pending"), payment.BankPaymentStatus)
+	require.Eventually(t, func() bool { return stateOf(approved) == data.StateCaptured }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return stateOf(declined) == data.StateDeclined }, 5*time.Second, 10*time.Millisecond)
+
+	// Repeated notifications are accepted, but those that contradict the decision or are not
+	// signed by the bank are not
+	_, payment, err = p.GetPayment(testMerchantID, approved)
+	require.NoError(t, err)
+	notification := bank.Notification{Reference: uuid.UUID(approved).String(), ID: uuid.UUID(payment.BankPaymentID).String(), Status: "Success"}
+	assert.Equal(t, 204, postBankNotification(router, testBankSecret, notification).Code)
+	assert.Equal(t, 401, postBankNotification(router, []byte("not-the-secret"), notification).Code)
+	notification.Status = "Failure"
+	assert.Equal(t, 409, postBankNotification(router, testBankSecret, notification).Code)
+	notification.ID = uuid.New().String()
+	assert.Equal(t, 404, postBankNotification(router, testBankSecret, notification).Code)
+	notification.Status = "Maybe"
+	assert.Equal(t, 400, postBankNotification(router, testBankSecret, notification).Code)
+
+	// Without notifications, payments pending for long enough are checked with the bank
+	quiet := httptest.NewServer(banksim.New(banksim.Config{Secret: testBankSecret, PendingLatency: 100 * time.Millisecond}))
+	t.Cleanup(quiet.Close)
+	p.Banker = bank.NewHTTPBank(quiet.URL, testBankSecret, time.Second)
+	polled := pay("4000000000000150")
+	decided, err := p.CheckPendingPayments(context.Background(), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 0, decided)
+	decided, err = p.CheckPendingPayments(context.Background(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, decided)
+	assert.Equal(t, data.StatePending, stateOf(polled))
+	// Only the payments still pending are read by the poller, the store finds them by state
+	pending, err := p.PendingPayments()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, polled, pending[0].PaymentID)
+	time.Sleep(150 * time.Millisecond)
+	decided, err = p.CheckPendingPayments(context.Background(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, decided)
+	assert.Equal(t, data.StateCaptured, stateOf(polled))
+	pending, err = p.PendingPayments()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+// webhookRequest sends a request to one of the webhook routes as the test merchant.
+func webhookRequest(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestWebhooks(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	now := time.Now()
+	p.Webhooks.Clock = func() time.Time { return now }
+	p.Webhooks.MaxAttempts = 2
+	router := setupRouter(p)
+
+	// The merchant's receiver records every event, and fails while failing is set
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	var mu sync.Mutex
+	var events []received
+	var failing int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		events = append(events, received{header: r.Header, body: body})
+		mu.Unlock()
+	}))
+	t.Cleanup(receiver.Close)
+	takeEvents := func() []received {
+		mu.Lock()
+		defer mu.Unlock()
+		taken := events
+		events = nil
+		return taken
+	}
+
+	// Registering a webhook returns its secret, which is not shown again
+	assert.Equal(t, 400, webhookRequest(router, "POST", "/webhooks", `{"url": "not a url"}`).Code)
+	w := webhookRequest(router, "POST", "/webhooks", `{"url": "`+receiver.URL+`"}`)
+	require.Equal(t, 201, w.Code)
+	var endpoint api.WebhookResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &endpoint))
+	assert.True(t, strings.HasPrefix(endpoint.Secret, "whsec_"))
+	w = webhookRequest(router, "GET", "/webhooks", "")
+	require.Equal(t, 200, w.Code)
+	var endpoints []api.WebhookResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &endpoints))
+	require.Len(t, endpoints, 1)
+	assert.Equal(t, endpoint.ID, endpoints[0].ID)
+	assert.Empty(t, endpoints[0].Secret)
+
+	// Every state the payment moves through is sent as a signed event
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+	require.Equal(t, 200, w.Code)
+	var payment api.PostResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &payment))
+	delivered, err := p.Webhooks.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, delivered)
+	types := []string{}
+	for _, r := range takeEvents() {
+		timestamp := r.header.Get(webhooks.TimestampHeader)
+		assert.Equal(t, webhooks.Sign([]byte(endpoint.Secret), timestamp, r.body), r.header.Get(webhooks.SignatureHeader))
+		var event webhooks.Event
+		require.NoError(t, json.Unmarshal(r.body, &event))
+		assert.Equal(t, event.ID, r.header.Get(webhooks.EventHeader))
+		assert.Equal(t, payment.Uuid.String(), event.Data.PaymentID)
+		assert.Equal(t, "****1009", event.Data.CardNumberMasked)
+		types = append(types, event.Type)
+	}
+	assert.ElementsMatch(t, []string{"payment.pending", "payment.authorised", "payment.captured"}, types)
+
+	// Deliveries the receiver fails are retried after a backoff, then given up on
+	atomic.StoreInt32(&failing, 1)
+	router.ServeHTTP(httptest.NewRecorder(), newPaymentRequest(t, "100.00"))
+	delivered, err = p.Webhooks.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+	w = webhookRequest(router, "GET", "/webhooks/deliveries?status=pending", "")
+	require.Equal(t, 200, w.Code)
+	var deliveries []api.DeliveryResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &deliveries))
+	require.Len(t, deliveries, 3)
+	require.NotNil(t, deliveries[0].NextAttemptAt)
+	assert.True(t, deliveries[0].NextAttemptAt.After(now))
+	delivered, err = p.Webhooks.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+	now = now.Add(p.Webhooks.BaseDelay)
+	_, err = p.Webhooks.DeliverDue(context.Background())
+	require.NoError(t, err)
+	w = webhookRequest(router, "GET", "/webhooks/deliveries", "")
+	require.Equal(t, 200, w.Code)
+	deliveries = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &deliveries))
+	require.Len(t, deliveries, 3)
+	assert.Equal(t, "failed", deliveries[0].Status)
+	assert.Equal(t, 2, deliveries[0].Attempts)
+	assert.Contains(t, deliveries[0].LastError, "500")
+	assert.Nil(t, deliveries[0].NextAttemptAt)
+	assert.Empty(t, takeEvents())
+
+	// Failed deliveries can be redelivered by hand, once they succeed
+	atomic.StoreInt32(&failing, 0)
+	w = webhookRequest(router, "POST", "/webhooks/deliveries/"+deliveries[0].ID+"/redeliver", "")
+	require.Equal(t, 200, w.Code)
+	var redelivered api.DeliveryResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &redelivered))
+	assert.Equal(t, "delivered", redelivered.Status)
+	assert.Equal(t, 3, redelivered.Attempts)
+	resent := takeEvents()
+	require.Len(t, resent, 1)
+	assert.Equal(t, deliveries[0].EventID, resent[0].header.Get(webhooks.EventHeader))
+	assert.Equal(t, 409, webhookRequest(router, "POST", "/webhooks/deliveries/"+deliveries[0].ID+"/redeliver", "").Code)
+	assert.Equal(t, 404, webhookRequest(router, "POST", "/webhooks/deliveries/"+uuid.New().String()+"/redeliver", "").Code)
+	assert.Equal(t, 400, webhookRequest(router, "GET", "/webhooks/deliveries?status=lost", "").Code)
+
+	// Removed webhooks are sent nothing more
+	assert.Equal(t, 204, webhookRequest(router, "DELETE", "/webhooks/"+endpoint.ID, "").Code)
+	assert.Equal(t, 404, webhookRequest(router, "DELETE", "/webhooks/"+endpoint.ID, "").Code)
+	router.ServeHTTP(httptest.NewRecorder(), newPaymentRequest(t, "100.00"))
+	delivered, err = p.Webhooks.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+}
+
+func TestWebhookPrivateAddresses(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	router := setupRouter(p)
+	var received int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+	}))
+	t.Cleanup(receiver.Close)
+
+	// The receiver is registered while private addresses are allowed, as if its host had resolved
+	// to a public address then and been repointed since
+	w := webhookRequest(router, "POST", "/webhooks", `{"url": "`+receiver.URL+`"}`)
+	require.Equal(t, 201, w.Code)
+	p.Webhooks.AllowPrivateNetworks = false
+
+	// Webhooks on the gateway's own machine or network are refused
+	for _, url := range []string{"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://[::1]/hook", "http://10.0.0.1/hook", "http://192.168.1.1/hook", "http://169.254.169.254/latest/meta-data", "http://0.0.0.0/hook", "http://[fe80::1]/hook"} {
+		w := webhookRequest(router, "POST", "/webhooks", `{"url": "`+url+`"}`)
+		assert.Equal(t, 400, w.Code, url)
+		assert.JSONEq(t, `{"error":"Invalid url, its host must only resolve to public addresses"}`, w.Body.String(), url)
+	}
+	w = webhookRequest(router, "POST", "/webhooks", `{"url": "https://93.184.216.34/hook"}`)
+	require.Equal(t, 201, w.Code)
+	var public api.WebhookResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &public))
+	require.Equal(t, 204, webhookRequest(router, "DELETE", "/webhooks/"+public.ID, "").Code)
+
+	// And events are never sent to a private address, whatever the host resolved to before
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+	require.Equal(t, 200, w.Code)
+	_, err := p.Webhooks.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&received))
+	w = webhookRequest(router, "GET", "/webhooks/deliveries?status=pending", "")
+	require.Equal(t, 200, w.Code)
+	var deliveries []api.DeliveryResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &deliveries))
+	refused := 0
+	for _, delivery := range deliveries {
+		if strings.Contains(delivery.LastError, webhooks.ErrPrivateURL.Error()) {
+			refused++
+		}
+	}
+	assert.Equal(t, 3, refused)
+}
+
+func TestWebhookSlowEndpoint(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	router := setupRouter(p)
+
+	// One receiver never answers until released, while the other answers straight away
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slow.Close)
+	var received int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+	}))
+	t.Cleanup(fast.Close)
+	require.Equal(t, 201, webhookRequest(router, "POST", "/webhooks", `{"url": "`+slow.URL+`"}`).Code)
+	require.Equal(t, 201, webhookRequest(router, "POST", "/webhooks", `{"url": "`+fast.URL+`"}`).Code)
+
+	// The fast receiver is sent every event while the slow one is still holding its first
+	router.ServeHTTP(httptest.NewRecorder(), newPaymentRequest(t, "100.00"))
+	done := make(chan int)
+	go func() {
+		delivered, err := p.Webhooks.DeliverDue(context.Background())
+		assert.NoError(t, err)
+		done <- delivered
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&received) == 3 }, 5*time.Second, time.Millisecond)
+	close(release)
+	assert.Equal(t, 6, <-done)
+}
+
+func TestCardTokens(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	recorder := new(mocks.RecordingBankMock)
+	p.Banker = recorder
+	require.NoError(t, p.Merchants.Register(merchants.Merchant{ID: "merchant-2", Name: "Other Merchant"}, "sk_test_merchant_2"))
+	router := setupRouter(p)
+
+	// Only valid cards are tokenised
+	for body, want := range map[string]string{
+		`{"card-number": "4658585018481008", "expiry-date": "11/30"}`: `{"error":"Invalid card number"}`,
+		`{"card-number": "4658585018481009", "expiry-date": "11/20"}`: `{"error":"Card has expired"}`,
+		`{"card-number": "4658585018481009"}`:                         `{"error":"Invalid json body"}`,
+	} {
+		w := postPaymentAction(router, "/tokens", body)
+		assert.Equal(t, 400, w.Code, body)
+		assert.JSONEq(t, want, w.Body.String(), body)
+	}
+
+	w := postPaymentAction(router, "/tokens", `{"card-number": "4658 5850 1848 1009", "expiry-date": "11/30"}`)
+	require.Equal(t, 201, w.Code)
+	var card api.CardTokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &card))
+	assert.True(t, strings.HasPrefix(card.CardToken, "tok_"))
+	assert.Equal(t, api.CardTokenResponse{CardToken: card.CardToken, MaskCardNumber: "****1009", CardBrand: "Visa", ExpiryDate: "11/30"}, card)
+
+	// Paying with the token sends the card number to the bank, while the payment only keeps the token
+	w = postPaymentAction(router, "/pay", `{"card-token": "`+card.CardToken+`", "amount": 100.00, "currency": "GBP", "cvv": "555"}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var resp api.PostResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, recorder.Cards, 1)
+	assert.Equal(t, data.CardData{CardNumber: "4658585018481009", ExpiryDate: "11/30", Amount: money.Money{MinorUnits: 10000, Currency: "GBP"}, Cvv: "555", Brand: "Visa", Token: card.CardToken, Initiator: data.CustomerInitiated}, recorder.Cards[0])
+	ok, payment, err := p.RetrievePayment(data.PaymentID(resp.Uuid))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, data.StoredCard{CardToken: card.CardToken, CardLastFour: "1009", Amount: money.Money{MinorUnits: 10000, Currency: "GBP"}, Brand: "Visa"}, payment.StoredCard)
+	req, _ := http.NewRequest("GET", "/findpayment/"+resp.Uuid.String(), nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"card-token": "`+card.CardToken+`"`)
+
+	// The CVV is optional with a token, but must still be valid when given
+	w = postPaymentAction(router, "/pay", `{"card-token": "`+card.CardToken+`", "amount": 100.00, "currency": "GBP"}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	require.Len(t, recorder.Cards, 2)
+	assert.Equal(t, "", recorder.Cards[1].Cvv)
+	w = postPaymentAction(router, "/pay", `{"card-token": "`+card.CardToken+`", "amount": 100.00, "currency": "GBP", "cvv": "5555"}`)
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"error":"Invalid CVV"}`, w.Body.String())
+
+	// A card paid with in full is tokenised, so it can be paid with by token afterwards
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newPaymentRequest(t, "100.00"))
+	require.Equal(t, 200, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	ok, payment, err = p.RetrievePayment(data.PaymentID(resp.Uuid))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.True(t, strings.HasPrefix(payment.CardToken, "tok_"))
+	assert.NotEqual(t, card.CardToken, payment.CardToken)
+	w = postPaymentAction(router, "/pay", `{"card-token": "`+payment.CardToken+`", "amount": 100.00, "currency": "GBP"}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	assert.Equal(t, "4658585018481009", recorder.Cards[len(recorder.Cards)-1].CardNumber)
+
+	// The card must be given in exactly one way, and only by a token of the merchant's own
+	calls := len(recorder.Cards)
+	for body, want := range map[string]string{
+		`{"card-token": "` + card.CardToken + `", "card-number": "4658585018481009", "expiry-date": "11/30", "amount": 100.00, "currency": "GBP", "cvv": "555"}`: `{"error":"Either card-number or card-token must be given"}`,
+		`{"amount": 100.00, "currency": "GBP", "cvv": "555"}`:                                                   `{"error":"Either card-number or card-token must be given"}`,
+		`{"card-token": "` + card.CardToken + `", "expiry-date": "11/30", "amount": 100.00, "currency": "GBP"}`: `{"error":"expiry-date cannot be given with card-token"}`,
+		`{"card-token": "tok_unknown", "amount": 100.00, "currency": "GBP"}`:                                    `{"error":"Invalid card token"}`,
+	} {
+		w := postPaymentAction(router, "/pay", body)
+		assert.Equal(t, 400, w.Code, body)
+		assert.JSONEq(t, want, w.Body.String(), body)
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/pay", bytes.NewBufferString(`{"card-token": "`+card.CardToken+`", "amount": 100.00, "currency": "GBP"}`))
+	req.Header.Set("Authorization", "Bearer sk_test_merchant_2")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"error":"Invalid card token"}`, w.Body.String())
+	assert.Len(t, recorder.Cards, calls)
+
+	// The card number can only be decrypted with the key it was encrypted under, and neither its
+	// ciphertext nor its wrapped data key can be tampered with
+	kek, err := vault.GenerateKey()
+	require.NoError(t, err)
+	cards := vault.New(vault.NewMemoryStore(), vault.NewKeyring(kek))
+	tokenised, err := cards.Tokenise(testMerchantID, "4658585018481009", "11/30", "Visa")
+	require.NoError(t, err)
+	cardNumber, err := cards.Detokenise(testMerchantID, tokenised.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "4658585018481009", cardNumber)
+	_, record, err := cards.RetrieveCard(tokenised.Token)
+	require.NoError(t, err)
+	assert.NotContains(t, string(record.Ciphertext), "4658585018481009")
+	otherKey, err := vault.GenerateKey()
+	require.NoError(t, err)
+	_, err = vault.New(cards.Store, vault.NewKeyring(otherKey)).Detokenise(testMerchantID, tokenised.Token)
+	assert.ErrorIs(t, err, vault.ErrUnknownKey)
+	for _, flip := range []func(r *vault.Record){
+		func(r *vault.Record) { r.Ciphertext = flipLastBit(r.Ciphertext) },
+		func(r *vault.Record) { r.WrappedKey = flipLastBit(r.WrappedKey) },
+	} {
+		tampered := record
+		flip(&tampered)
+		store := vault.NewMemoryStore()
+		require.NoError(t, store.AddCard(tampered))
+		_, err = vault.New(store, vault.NewKeyring(kek)).Detokenise(testMerchantID, tokenised.Token)
+		assert.Error(t, err)
+	}
+}
+
+// flipLastBit returns a copy of b with its last bit flipped.
+func flipLastBit(b []byte) []byte {
+	flipped := append([]byte(nil), b...)
+	flipped[len(flipped)-1] ^= 1
+	return flipped
+}
+
+func TestVaultKeyRotation(t *testing.T) {
+	oldKey, err := vault.GenerateKey()
+	require.NoError(t, err)
+	newKey, err := vault.GenerateKey()
+	require.NoError(t, err)
+
+	for _, backend := range []string{"memory", "file", "sql"} {
+		t.Run(backend, func(t *testing.T) {
+			store := newTestVaultStore(t, backend)
+
+			// A card tokenised under the old key, and one tokenised before expiry dates were
+			// encrypted, which kept its expiry date in the clear
+			tokenised, err := vault.New(store, vault.NewKeyring(oldKey)).Tokenise(testMerchantID, "4658585018481009", "11/30", "Visa")
+			require.NoError(t, err)
+			legacy := sealLegacyCard(t, oldKey, "tok_legacy", "5555555555554444", "12/31")
+			require.NoError(t, store.AddCard(legacy))
+
+			// Once the new key is primary new cards are encrypted under it, while the old cards
+			// can still be used
+			cards := vault.New(store, vault.NewKeyring(newKey, oldKey))
+			added, err := cards.Tokenise(testMerchantID, "4032034130835070", "10/29", "Visa")
+			require.NoError(t, err)
+			_, record, err := store.RetrieveCard(added.Token)
+			require.NoError(t, err)
+			assert.Equal(t, newKey.ID, record.KeyID)
+			for token, want := range map[string]string{tokenised.Token: "4658585018481009", legacy.Token: "5555555555554444"} {
+				cardNumber, err := cards.Detokenise(testMerchantID, token)
+				require.NoError(t, err)
+				assert.Equal(t, want, cardNumber)
+			}
+
+			// Rotating re-encrypts only the old cards, after which the old key is no longer needed
+			rotated, err := cards.Rotate()
+			require.NoError(t, err)
+			assert.Equal(t, 2, rotated)
+			rotated, err = cards.Rotate()
+			require.NoError(t, err)
+			assert.Equal(t, 0, rotated)
+			records, err := store.ListCards()
+			require.NoError(t, err)
+			require.Len(t, records, 3)
+			for _, record := range records {
+				assert.Equal(t, newKey.ID, record.KeyID)
+				assert.Equal(t, vault.FormatSealedCard, record.Format)
+				assert.Empty(t, record.ExpiryDate)
+			}
+			rotatedCards := vault.New(store, vault.NewKeyring(newKey))
+			for token, want := range map[string]vault.Card{
+				tokenised.Token: {LastFour: "1009", ExpiryDate: "11/30"},
+				legacy.Token:    {LastFour: "4444", ExpiryDate: "12/31"},
+				added.Token:     {LastFour: "5070", ExpiryDate: "10/29"},
+			} {
+				card, err := rotatedCards.Card(testMerchantID, token)
+				require.NoError(t, err)
+				assert.Equal(t, want.LastFour, card.LastFour)
+				assert.Equal(t, want.ExpiryDate, card.ExpiryDate)
+			}
+			cardNumber, err := rotatedCards.Detokenise(testMerchantID, legacy.Token)
+			require.NoError(t, err)
+			assert.Equal(t, "5555555555554444", cardNumber)
+			_, err = vault.New(store, vault.NewKeyring(oldKey)).Detokenise(testMerchantID, tokenised.Token)
+			assert.ErrorIs(t, err, vault.ErrUnknownKey)
+		})
+	}
+}
+
+// TestRekeyWhileGatewayRuns checks that the gateway keeps writing to the SQLite database while
+// cmd/rekey rotates the vault in it, waiting on the rekey's transactions rather than failing.
+func TestRekeyWhileGatewayRuns(t *testing.T) {
+	oldKey, err := vault.GenerateKey()
+	require.NoError(t, err)
+	newKey, err := vault.GenerateKey()
+	require.NoError(t, err)
+
+	// The gateway and the rekey command each open the database themselves
+	path := filepath.Join(t.TempDir(), "payments.db")
+	open := func() *sql.DB {
+		db, err := sql.Open("sqlite", data.SQLiteDSN(path))
+		require.NoError(t, err)
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	gatewayDB, rekeyDB := open(), open()
+	store, err := data.NewSQLStore(gatewayDB)
+	require.NoError(t, err)
+	gatewayVault, err := vault.NewSQLStore(gatewayDB)
+	require.NoError(t, err)
+	rekeyVault, err := vault.NewSQLStore(rekeyDB)
+	require.NoError(t, err)
+
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	p.PaymentStore = store
+	for i := 0; i < 20; i++ {
+		_, err := vault.New(gatewayVault, vault.NewKeyring(oldKey)).Tokenise(testMerchantID, "4658585018481009", "11/30", "Visa")
+		require.NoError(t, err)
+	}
+
+	var cd data.CardData
+	cd.CardNumber = "4658585018481009"
+	cd.Amount = money.Money{MinorUnits: 10000, Currency: "GBP"}
+	cd.ExpiryDate = "11/30"
+	cd.Cvv = "555"
+
+	// While the rekey holds a write transaction the gateway's writes wait for it to finish
+	tx, err := rekeyDB.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec(`UPDATE vault_cards SET brand = brand`)
+	require.NoError(t, err)
+	written := make(chan error, 1)
+	go func() {
+		_, err := p.MakePayment(context.Background(), testMerchantID, cd)
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("payment written while the rekey held the database, with an error of: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, tx.Commit())
+	require.NoError(t, <-written)
+
+	// Rotating every card runs alongside the gateway taking payments and saving cards
+	rotated := make(chan error, 1)
+	go func() {
+		_, err := vault.New(rekeyVault, vault.NewKeyring(newKey, oldKey)).Rotate()
+		rotated <- err
+	}()
+	for i := 0; i < 20; i++ {
+		_, err := p.MakePayment(context.Background(), testMerchantID, cd)
+		require.NoError(t, err)
+		_, err = vault.New(gatewayVault, vault.NewKeyring(newKey, oldKey)).Tokenise(testMerchantID, "4032034130835070", "10/29", "Visa")
+		require.NoError(t, err)
+	}
+	require.NoError(t, <-rotated)
+
+	payments, err := store.ListPayments()
+	require.NoError(t, err)
+	assert.Len(t, payments, 21)
+	records, err := gatewayVault.ListCards()
+	require.NoError(t, err)
+	require.Len(t, records, 40)
+	for _, record := range records {
+		assert.Equal(t, newKey.ID, record.KeyID)
+	}
+}
+
+// sealLegacyCard builds a vault record as cards were encrypted before their expiry dates were,
+// with only the card number encrypted under a data key wrapped by kek.
+func sealLegacyCard(t *testing.T, kek vault.Key, token, cardNumber, expiryDate string) vault.Record {
+	seal := func(key, plaintext []byte) []byte {
+		block, err := aes.NewCipher(key)
+		require.NoError(t, err)
+		aead, err := cipher.NewGCM(block)
+		require.NoError(t, err)
+		nonce := make([]byte, aead.NonceSize())
+		_, err = rand.Read(nonce)
+		require.NoError(t, err)
+		return aead.Seal(nonce, nonce, plaintext, []byte(token))
+	}
+	dataKey := make([]byte, vault.KeySize)
+	_, err := rand.Read(dataKey)
+	require.NoError(t, err)
+	return vault.Record{
+		Card:       vault.Card{Token: token, MerchantID: testMerchantID, LastFour: cardNumber[len(cardNumber)-4:], ExpiryDate: expiryDate, Brand: "Mastercard", CreatedAt: time.Now().UTC()},
+		Format:     vault.FormatCardNumber,
+		KeyID:      kek.ID,
+		WrappedKey: seal(kek.Secret, dataKey),
+		Ciphertext: seal(dataKey, []byte(cardNumber)),
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	newKey, err := vault.GenerateKey()
+	require.NoError(t, err)
+	oldKey, err := vault.GenerateKey()
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	// The first key on the keyring is the primary one, and every key can be looked up by id
+	path := filepath.Join(dir, "keyring.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"keys": ["`+hex.EncodeToString(newKey.Secret)+`", "`+hex.EncodeToString(oldKey.Secret)+`"]}`), 0o600))
+	keys, err := vault.LoadKeyring(path)
+	require.NoError(t, err)
+	assert.Equal(t, newKey, keys.Primary())
+	for _, key := range []vault.Key{newKey, oldKey} {
+		found, ok := keys.Key(key.ID)
+		assert.True(t, ok)
+		assert.Equal(t, key, found)
+	}
+	_, ok := keys.Key("unknown")
+	assert.False(t, ok)
+
+	for name, contents := range map[string]string{
+		"empty":     `{"keys": []}`,
+		"not hex":   `{"keys": ["not hex"]}`,
+		"too short": `{"keys": ["` + hex.EncodeToString(newKey.Secret[:16]) + `"]}`,
+		"malformed": `{"keys": `,
+	} {
+		path := filepath.Join(dir, name+".json")
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+		_, err := vault.LoadKeyring(path)
+		assert.Error(t, err, name)
+	}
+	_, err = vault.LoadKeyring(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestCustomers(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	recorder := new(mocks.RecordingBankMock)
+	p.Banker = recorder
+	require.NoError(t, p.Merchants.Register(merchants.Merchant{ID: "merchant-2", Name: "Other Merchant"}, "sk_test_merchant_2"))
+	router := setupRouter(p)
+	otherMerchant := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer sk_test_merchant_2")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := webhookRequest(router, "POST", "/customers", `{"name": "Jane Doe", "email": "jane@example.com"}`)
+	require.Equal(t, 201, w.Code, w.Body.String())
+	var customer api.CustomerResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &customer))
+	assert.Equal(t, "Jane Doe", customer.Name)
+	assert.Equal(t, "jane@example.com", customer.Email)
+	assert.Empty(t, customer.PaymentMethods)
+	w = webhookRequest(router, "POST", "/customers", `{"name": "Jane Doe", "email": "Jane <jane@example.com>"}`)
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"error":"Invalid email"}`, w.Body.String())
+
+	// Cards are saved either in full, when they are tokenised, or by the token of a card tokenised before
+	w = webhookRequest(router, "POST", "/customers/"+customer.ID+"/payment-methods", `{"card-number": "4658 5850 1848 1009", "expiry-date": "11/30"}`)
+	require.Equal(t, 201, w.Code, w.Body.String())
+	var saved api.PaymentMethodResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &saved))
+	assert.True(t, strings.HasPrefix(saved.CardToken, "tok_"))
+	assert.Equal(t, api.PaymentMethodResponse{ID: saved.ID, CardToken: saved.CardToken, MaskCardNumber: "****1009", CardBrand: "Visa", ExpiryDate: "11/30", CreatedAt: saved.CreatedAt}, saved)
+	w = postPaymentAction(router, "/tokens", `{"card-number": "5555555555554444", "expiry-date": "12/31"}`)
+	require.Equal(t, 201, w.Code)
+	var token api.CardTokenResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &token))
+	w = webhookRequest(router, "POST", "/customers/"+customer.ID+"/payment-methods", `{"card-token": "`+token.CardToken+`"}`)
+	require.Equal(t, 201, w.Code, w.Body.String())
+	var savedToken api.PaymentMethodResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &savedToken))
+	assert.Equal(t, token.CardToken, savedToken.CardToken)
+	assert.Equal(t, "Mastercard", savedToken.CardBrand)
+	for body, want := range map[string]string{
+		`{"card-number": "4658585018481008", "expiry-date": "11/30"}`:                  `{"error":"Invalid card number"}`,
+		`{"card-number": "4658585018481009", "card-token": "` + token.CardToken + `"}`: `{"error":"Either card-number or card-token must be given"}`,
+		`{"card-token": "tok_unknown"}`:                                                `{"error":"Invalid card token"}`,
+		`{"card-token": "` + token.CardToken + `", "expiry-date": "12/31"}`:            `{"error":"expiry-date cannot be given with card-token"}`,
+	} {
+		w := webhookRequest(router, "POST", "/customers/"+customer.ID+"/payment-methods", body)
+		assert.Equal(t, 400, w.Code, body)
+		assert.JSONEq(t, want, w.Body.String(), body)
+	}
+	w = webhookRequest(router, "POST", "/customers/unknown/payment-methods", `{"card-token": "`+token.CardToken+`"}`)
+	assert.Equal(t, 404, w.Code)
+	w = otherMerchant("POST", "/customers/"+customer.ID+"/payment-methods", `{"card-token": "`+token.CardToken+`"}`)
+	assert.Equal(t, 404, w.Code)
+
+	// Customers are only seen by their own merchant, with their saved cards oldest first
+	w = webhookRequest(router, "PUT", "/customers/"+customer.ID, `{"name": "Jane Smith"}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	w = webhookRequest(router, "GET", "/customers", ``)
+	require.Equal(t, 200, w.Code)
+	var list []api.CustomerResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, customer.ID, list[0].ID)
+	assert.Equal(t, "Jane Smith", list[0].Name)
+	assert.Empty(t, list[0].Email)
+	assert.Equal(t, []api.PaymentMethodResponse{saved, savedToken}, list[0].PaymentMethods)
+	assert.False(t, list[0].UpdatedAt.Before(list[0].CreatedAt))
+	w = otherMerchant("GET", "/customers", ``)
+	assert.JSONEq(t, `[]`, w.Body.String())
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		w = otherMerchant(method, "/customers/"+customer.ID, `{"name": "Mallory"}`)
+		assert.Equal(t, 404, w.Code, method)
+		assert.JSONEq(t, `{"error":"customer not found"}`, w.Body.String(), method)
+	}
+
+	// A saved card is paid with by the customer, giving its CVV, or by the merchant without it
+	w = postPaymentAction(router, "/pay", `{"customer-id": "`+customer.ID+`", "payment-method-id": "`+saved.ID+`", "amount": 100.00, "currency": "GBP", "cvv": "555"}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var resp api.PostResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, recorder.Cards, 1)
+	assert.Equal(t, data.CardData{CardNumber: "4658585018481009", ExpiryDate: "11/30", Amount: money.Money{MinorUnits: 10000, Currency: "GBP"}, Cvv: "555", Brand: "Visa", Token: saved.CardToken, Initiator: data.CustomerInitiated, CustomerID: customer.ID}, recorder.Cards[0])
+	w = webhookRequest(router, "GET", "/findpayment/"+resp.Uuid.String(), ``)
+	require.Equal(t, 200, w.Code)
+	var payment api.GetResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &payment))
+	assert.Equal(t, "customer", payment.InitiatedBy)
+	assert.Equal(t, customer.ID, payment.CustomerID)
+	assert.Equal(t, saved.CardToken, payment.CardToken)
+
+	w = postPaymentAction(router, "/pay", `{"customer-id": "`+customer.ID+`", "payment-method-id": "`+savedToken.ID+`", "amount": 25.00, "currency": "GBP", "initiated-by": "merchant"}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, recorder.Cards, 2)
+	assert.Equal(t, data.CardData{CardNumber: "5555555555554444", ExpiryDate: "12/31", Amount: money.Money{MinorUnits: 2500, Currency: "GBP"}, Brand: "Mastercard", Token: token.CardToken, Initiator: data.MerchantInitiated, CustomerID: customer.ID}, recorder.Cards[1])
+	ok, stored, err := p.RetrievePayment(data.PaymentID(resp.Uuid))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, data.MerchantInitiated, stored.Initiator)
+	assert.Equal(t, customer.ID, stored.CustomerID)
+
+	// The saved card must be given in full, in place of any other card, and a merchant can only
+	// start a payment with a saved card
+	for body, want := range map[string]string{
+		`{"customer-id": "` + customer.ID + `", "amount": 100.00, "currency": "GBP"}`:                                                                                    `{"error":"customer-id and payment-method-id must be given together"}`,
+		`{"customer-id": "` + customer.ID + `", "payment-method-id": "` + saved.ID + `", "card-token": "` + token.CardToken + `", "amount": 100.00, "currency": "GBP"}`:  `{"error":"card-number, card-token and expiry-date cannot be given with payment-method-id"}`,
+		`{"customer-id": "unknown", "payment-method-id": "` + saved.ID + `", "amount": 100.00, "currency": "GBP"}`:                                                       `{"error":"Invalid customer-id"}`,
+		`{"customer-id": "` + customer.ID + `", "payment-method-id": "unknown", "amount": 100.00, "currency": "GBP"}`:                                                    `{"error":"Invalid payment-method-id"}`,
+		`{"customer-id": "` + customer.ID + `", "payment-method-id": "` + saved.ID + `", "amount": 100.00, "currency": "GBP", "initiated-by": "merchant", "cvv": "555"}`: `{"error":"cvv cannot be given with a merchant-initiated payment"}`,
+		`{"customer-id": "` + customer.ID + `", "payment-method-id": "` + saved.ID + `", "amount": 100.00, "currency": "GBP", "initiated-by": "bank"}`:                   `{"error":"Invalid initiated-by"}`,
+		`{"card-number": "4658585018481009", "expiry-date": "11/30", "amount": 100.00, "currency": "GBP", "initiated-by": "merchant"}`:                                   `{"error":"Merchant-initiated payments must be made with a saved card"}`,
+	} {
+		w := postPaymentAction(router, "/pay", body)
+		assert.Equal(t, 400, w.Code, body)
+		assert.JSONEq(t, want, w.Body.String(), body)
+	}
+	w = otherMerchant("POST", "/pay", `{"customer-id": "`+customer.ID+`", "payment-method-id": "`+saved.ID+`", "amount": 100.00, "currency": "GBP"}`)
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"error":"Invalid customer-id"}`, w.Body.String())
+	assert.Len(t, recorder.Cards, 2)
+
+	// A removed card, or a deleted customer, can no longer be paid with, while the payments
+	// already made with them are kept
+	w = webhookRequest(router, "DELETE", "/customers/"+customer.ID+"/payment-methods/"+saved.ID, ``)
+	require.Equal(t, 204, w.Code)
+	w = webhookRequest(router, "DELETE", "/customers/"+customer.ID+"/payment-methods/"+saved.ID, ``)
+	assert.Equal(t, 404, w.Code)
+	assert.JSONEq(t, `{"error":"payment method not found"}`, w.Body.String())
+	w = postPaymentAction(router, "/pay", `{"customer-id": "`+customer.ID+`", "payment-method-id": "`+saved.ID+`", "amount": 100.00, "currency": "GBP"}`)
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"error":"Invalid payment-method-id"}`, w.Body.String())
+	w = webhookRequest(router, "DELETE", "/customers/"+customer.ID, ``)
+	require.Equal(t, 204, w.Code)
+	w = webhookRequest(router, "GET", "/customers/"+customer.ID, ``)
+	assert.Equal(t, 404, w.Code)
+	w = postPaymentAction(router, "/pay", `{"customer-id": "`+customer.ID+`", "payment-method-id": "`+savedToken.ID+`", "amount": 100.00, "currency": "GBP"}`)
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"error":"Invalid customer-id"}`, w.Body.String())
+	w = webhookRequest(router, "GET", "/findpayment/"+resp.Uuid.String(), ``)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestSubscriptions(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	recorder := new(mocks.RecordingBankMock)
+	p.Banker = recorder
+	require.NoError(t, p.Merchants.Register(merchants.Merchant{ID: "merchant-2", Name: "Other Merchant"}, "sk_test_merchant_2"))
+	// Start on the 31st, so the periods ending in shorter months are clamped to their last day
+	now := time.Date(2030, 1, 31, 9, 0, 0, 0, time.UTC)
+	p.Billing.Clock = func() time.Time { return now }
+	router := setupRouter(p)
+	ctx := context.Background()
+	subscription := func(id string) api.SubscriptionResponse {
+		w := webhookRequest(router, "GET", "/subscriptions/"+id, ``)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var resp api.SubscriptionResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	chargeDue := func(want int) {
+		paid, err := p.Billing.ChargeDue(ctx)
+		require.NoError(t, err)
+		require.Equal(t, want, paid)
+	}
+
+	// Plans charge an amount every few intervals
+	plans := make(map[string]api.PlanResponse)
+	for name, body := range map[string]string{
+		"basic":   `{"name": "Basic", "amount": 10.00, "currency": "gbp", "interval": "month"}`,
+		"premium": `{"name": "Premium", "amount": 25.00, "currency": "GBP", "interval": "month", "interval-count": 1}`,
+		"weekly":  `{"name": "Weekly", "amount": 5.00, "currency": "GBP", "interval": "week", "interval-count": 2}`,
+	} {
+		w := webhookRequest(router, "POST", "/plans", body)
+		require.Equal(t, 201, w.Code, w.Body.String())
+		var plan api.PlanResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &plan))
+		plans[name] = plan
+	}
+	assert.Equal(t, api.PlanResponse{ID: plans["basic"].ID, Name: "Basic", Amount: "10.00", Currency: "GBP", Interval: "month", IntervalCount: 1, CreatedAt: plans["basic"].CreatedAt}, plans["basic"])
+	assert.Equal(t, 2, plans["weekly"].IntervalCount)
+	for body, want := range map[string]string{
+		`{"name": "Daily", "amount": 1.00, "currency": "GBP", "interval": "fortnight"}`:                `{"error":"Invalid interval"}`,
+		`{"name": "Daily", "amount": 1.00, "currency": "GBP", "interval": "day", "interval-count": 0}`: `{"error":"Invalid interval"}`,
+		`{"name": "Daily", "amount": 0, "currency": "GBP", "interval": "day"}`:                         `{"error":"Invalid amount"}`,
+		`{"name": "Daily", "amount": 1.001, "currency": "GBP", "interval": "day"}`:                     `{"error":"Invalid amount"}`,
+		`{"name": "Daily", "amount": 1.00, "currency": "XYZ", "interval": "day"}`:                      `{"error":"Invalid currency"}`,
+	} {
+		w := webhookRequest(router, "POST", "/plans", body)
+		assert.Equal(t, 400, w.Code, body)
+		assert.JSONEq(t, want, w.Body.String(), body)
+	}
+	w := webhookRequest(router, "GET", "/plans", ``)
+	var list []api.PlanResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list, 3)
+	w = webhookRequest(router, "GET", "/plans/"+plans["basic"].ID, ``)
+	assert.Equal(t, 200, w.Code)
+
+	// A customer is subscribed with a saved card
+	w = webhookRequest(router, "POST", "/customers", `{"name": "Jane Doe"}`)
+	require.Equal(t, 201, w.Code)
+	var customer api.CustomerResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &customer))
+	saveCard := func(cardNumber string) api.PaymentMethodResponse {
+		w := webhookRequest(router, "POST", "/customers/"+customer.ID+"/payment-methods", `{"card-number": "`+cardNumber+`", "expiry-date": "11/30"}`)
+		require.Equal(t, 201, w.Code, w.Body.String())
+		var method api.PaymentMethodResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &method))
+		return method
+	}
+	card, otherCard := saveCard("4658585018481009"), saveCard("5555555555554444")
+	subscribe := func(plan string) api.SubscriptionResponse {
+		w := webhookRequest(router, "POST", "/subscriptions", `{"customer-id": "`+customer.ID+`", "payment-method-id": "`+card.ID+`", "plan-id": "`+plans[plan].ID+`"}`)
+		require.Equal(t, 201, w.Code, w.Body.String())
+		var resp api.SubscriptionResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	for body, want := range map[string]string{
+		`{"customer-id": "` + customer.ID + `", "plan-id": "` + plans["basic"].ID + `"}`:                                 `{"error":"customer-id, payment-method-id and plan-id must be given"}`,
+		`{"customer-id": "unknown", "payment-method-id": "` + card.ID + `", "plan-id": "` + plans["basic"].ID + `"}`:     `{"error":"Invalid customer-id"}`,
+		`{"customer-id": "` + customer.ID + `", "payment-method-id": "unknown", "plan-id": "` + plans["basic"].ID + `"}`: `{"error":"Invalid payment-method-id"}`,
+		`{"customer-id": "` + customer.ID + `", "payment-method-id": "` + card.ID + `", "plan-id": "unknown"}`:           `{"error":"Invalid plan-id"}`,
+	} {
+		w := webhookRequest(router, "POST", "/subscriptions", body)
+		assert.Equal(t, 400, w.Code, body)
+		assert.JSONEq(t, want, w.Body.String(), body)
+	}
+	created := subscribe("basic")
+	assert.Equal(t, "active", created.Status)
+	require.NotNil(t, created.NextChargeAt)
+	assert.True(t, now.Equal(*created.NextChargeAt))
+	assert.Empty(t, created.Charges)
+
+	// The first period is charged straight away, by the merchant without the CVV
+	chargeDue(1)
+	require.Len(t, recorder.Cards, 1)
+	assert.Equal(t, data.CardData{CardNumber: "4658585018481009", ExpiryDate: "11/30", Amount: money.Money{MinorUnits: 1000, Currency: "GBP"}, Brand: "Visa", Token: card.CardToken, Initiator: data.MerchantInitiated, CustomerID: customer.ID}, recorder.Cards[0])
+	sub := subscription(created.ID)
+	feb28 := time.Date(2030, 2, 28, 9, 0, 0, 0, time.UTC)
+	assert.True(t, now.Equal(sub.CurrentPeriodStart))
+	assert.True(t, feb28.Equal(sub.CurrentPeriodEnd), sub.CurrentPeriodEnd)
+	assert.True(t, feb28.Equal(*sub.NextChargeAt))
+	require.Len(t, sub.Charges, 1)
+	assert.Equal(t, "paid", sub.Charges[0].Status)
+	assert.Equal(t, json.Number("10.00"), sub.Charges[0].Amount)
+	w = webhookRequest(router, "GET", "/findpayment/"+sub.Charges[0].PaymentID, ``)
+	require.Equal(t, 200, w.Code)
+	var payment api.GetResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &payment))
+	assert.Equal(t, "merchant", payment.InitiatedBy)
+	assert.Equal(t, customer.ID, payment.CustomerID)
+	chargeDue(0)
+
+	// Upgrading half way through the period charges half the difference with the next period
+	now = time.Date(2030, 2, 14, 9, 0, 0, 0, time.UTC)
+	w = webhookRequest(router, "PUT", "/subscriptions/"+created.ID, `{"plan-id": "`+plans["weekly"].ID+`"}`)
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"error":"Plans can only be changed for one with the same currency and interval"}`, w.Body.String())
+	w = webhookRequest(router, "PUT", "/subscriptions/"+created.ID, `{"plan-id": "unknown"}`)
+	assert.Equal(t, 400, w.Code)
+	w = webhookRequest(router, "PUT", "/subscriptions/"+created.ID, `{"plan-id": "`+plans["premium"].ID+`"}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	sub = subscription(created.ID)
+	assert.Equal(t, plans["premium"].ID, sub.PlanID)
+	assert.Equal(t, json.Number("7.50"), sub.Balance)
+	chargeDue(0)
+	now = feb28
+	chargeDue(1)
+	require.Len(t, recorder.Cards, 2)
+	assert.Equal(t, int64(3250), recorder.Cards[1].Amount.MinorUnits)
+	sub = subscription(created.ID)
+	mar31 := time.Date(2030, 3, 31, 9, 0, 0, 0, time.UTC)
+	assert.True(t, mar31.Equal(sub.CurrentPeriodEnd), sub.CurrentPeriodEnd)
+	assert.Equal(t, json.Number("0.00"), sub.Balance)
+
+	// Downgrading credits the unused part of the period against the next one
+	now = time.Date(2030, 3, 16, 9, 0, 0, 0, time.UTC)
+	w = webhookRequest(router, "PUT", "/subscriptions/"+created.ID, `{"plan-id": "`+plans["basic"].ID+`"}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	assert.Equal(t, json.Number("-7.26"), subscription(created.ID).Balance)
+	now = mar31
+	chargeDue(1)
+	require.Len(t, recorder.Cards, 3)
+	assert.Equal(t, int64(274), recorder.Cards[2].Amount.MinorUnits)
+
+	// A declined charge is retried, and the subscription is past due until it is paid
+	apr30 := time.Date(2030, 4, 30, 9, 0, 0, 0, time.UTC)
+	now = apr30
+	p.Banker = new(mocks.BankMock)
+	chargeDue(0)
+	sub = subscription(created.ID)
+	assert.Equal(t, "past-due", sub.Status)
+	assert.Equal(t, 1, sub.FailedAttempts)
+	assert.True(t, apr30.AddDate(0, 0, 1).Equal(*sub.NextChargeAt))
+	assert.True(t, apr30.Equal(sub.CurrentPeriodEnd))
+	require.Len(t, sub.Charges, 4)
+	assert.Equal(t, "failed", sub.Charges[3].Status)
+	assert.Equal(t, payments.ErrDeclinedByBank.Error(), sub.Charges[3].Error)
+	assert.NotEmpty(t, sub.Charges[3].PaymentID)
+	now = apr30.AddDate(0, 0, 1)
+	chargeDue(0)
+	sub = subscription(created.ID)
+	assert.Equal(t, 2, sub.FailedAttempts)
+	assert.True(t, now.AddDate(0, 0, 3).Equal(*sub.NextChargeAt))
+
+	// Changing the card of a past due subscription charges it straight away
+	p.Banker = recorder
+	w = webhookRequest(router, "PUT", "/subscriptions/"+created.ID, `{"payment-method-id": "unknown"}`)
+	assert.Equal(t, 400, w.Code)
+	assert.JSONEq(t, `{"error":"Invalid payment-method-id"}`, w.Body.String())
+	w = webhookRequest(router, "PUT", "/subscriptions/"+created.ID, `{"payment-method-id": "`+otherCard.ID+`"}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	assert.True(t, now.Equal(*subscription(created.ID).NextChargeAt))
+	chargeDue(1)
+	require.Len(t, recorder.Cards, 4)
+	assert.Equal(t, "5555555555554444", recorder.Cards[3].CardNumber)
+	sub = subscription(created.ID)
+	assert.Equal(t, "active", sub.Status)
+	assert.Equal(t, 0, sub.FailedAttempts)
+	may31 := time.Date(2030, 5, 31, 9, 0, 0, 0, time.UTC)
+	assert.True(t, apr30.Equal(sub.CurrentPeriodStart))
+	assert.True(t, may31.Equal(sub.CurrentPeriodEnd))
+
+	// Only the merchant that owns a subscription can see it
+	w = otherMerchantRequest(router, "GET", "/subscriptions/"+created.ID, ``)
+	assert.Equal(t, 404, w.Code)
+	assert.JSONEq(t, `{"error":"subscription not found"}`, w.Body.String())
+	w = otherMerchantRequest(router, "GET", "/subscriptions", ``)
+	assert.JSONEq(t, `[]`, w.Body.String())
+	w = otherMerchantRequest(router, "GET", "/plans/"+plans["basic"].ID, ``)
+	assert.Equal(t, 404, w.Code)
+	w = otherMerchantRequest(router, "POST", "/subscriptions/"+created.ID+"/cancel", ``)
+	assert.Equal(t, 404, w.Code)
+
+	// Cancelling at the end of the period leaves it paid for, and nothing more is charged
+	w = webhookRequest(router, "POST", "/subscriptions/"+created.ID+"/cancel", `{"at-period-end": true}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	sub = subscription(created.ID)
+	assert.Equal(t, "active", sub.Status)
+	assert.True(t, sub.CancelAtPeriodEnd)
+	now = may31
+	chargeDue(0)
+	sub = subscription(created.ID)
+	assert.Equal(t, "cancelled", sub.Status)
+	require.NotNil(t, sub.CancelledAt)
+	assert.True(t, may31.Equal(*sub.CancelledAt))
+	assert.Nil(t, sub.NextChargeAt)
+	assert.Len(t, sub.Charges, 6)
+	w = webhookRequest(router, "PUT", "/subscriptions/"+created.ID, `{"plan-id": "`+plans["premium"].ID+`"}`)
+	assert.Equal(t, 409, w.Code)
+	assert.JSONEq(t, `{"error":"Subscription has been cancelled"}`, w.Body.String())
+	w = webhookRequest(router, "POST", "/subscriptions/"+created.ID+"/cancel", ``)
+	assert.Equal(t, 409, w.Code)
+
+	// A subscription whose charge keeps being declined is cancelled once the retries run out
+	p.Banker = new(mocks.BankMock)
+	declined := subscribe("weekly")
+	for _, wait := range []time.Duration{0, 24 * time.Hour, 3 * 24 * time.Hour, 7 * 24 * time.Hour} {
+		now = now.Add(wait)
+		chargeDue(0)
+	}
+	sub = subscription(declined.ID)
+	assert.Equal(t, "cancelled", sub.Status)
+	assert.Equal(t, 4, sub.FailedAttempts)
+	assert.Len(t, sub.Charges, 4)
+	assert.True(t, sub.Charges[0].PeriodStart.Equal(sub.Charges[3].PeriodStart))
+	now = now.AddDate(0, 1, 0)
+	chargeDue(0)
+	assert.Len(t, subscription(declined.ID).Charges, 4)
+
+	// Cancelling straight away stops even the first period being charged
+	p.Banker = recorder
+	cancelled := subscribe("basic")
+	w = webhookRequest(router, "POST", "/subscriptions/"+cancelled.ID+"/cancel", ``)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	chargeDue(0)
+	assert.Len(t, recorder.Cards, 4)
+	assert.Empty(t, subscription(cancelled.ID).Charges)
+	w = webhookRequest(router, "GET", "/subscriptions", ``)
+	var subscriptions []api.SubscriptionResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &subscriptions))
+	require.Len(t, subscriptions, 3)
+	assert.Equal(t, []string{created.ID, declined.ID, cancelled.ID}, []string{subscriptions[0].ID, subscriptions[1].ID, subscriptions[2].ID})
+}
+
+// newSubscriber creates a monthly plan charging 10.00, and a customer with a saved card for
+// each of the card numbers, returning the id of the plan, the customer and each saved card.
+func newSubscriber(t *testing.T, router http.Handler, cardNumbers ...string) (string, string, []string) {
+	w := webhookRequest(router, "POST", "/plans", `{"name": "Basic", "amount": 10.00, "currency": "GBP", "interval": "month"}`)
+	require.Equal(t, 201, w.Code, w.Body.String())
+	var plan api.PlanResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &plan))
+	w = webhookRequest(router, "POST", "/customers", `{"name": "Jane Doe"}`)
+	require.Equal(t, 201, w.Code, w.Body.String())
+	var customer api.CustomerResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &customer))
+	methods := []string{}
+	for _, cardNumber := range cardNumbers {
+		w := webhookRequest(router, "POST", "/customers/"+customer.ID+"/payment-methods", `{"card-number": "`+cardNumber+`", "expiry-date": "11/30"}`)
+		require.Equal(t, 201, w.Code, w.Body.String())
+		var method api.PaymentMethodResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &method))
+		methods = append(methods, method.ID)
+	}
+	return plan.ID, customer.ID, methods
+}
+
+func TestPendingSubscriptionCharges(t *testing.T) {
+	// The simulator decides on pending payments after 100ms, and sends its decision to the gateway
+	p := newTestPaymentGatewayService(t)
+	p.BankSecrets = map[string][]byte{"": testBankSecret}
+	router := setupRouter(p)
+	gateway := httptest.NewServer(router)
+	t.Cleanup(gateway.Close)
+	simulator := httptest.NewServer(banksim.New(banksim.Config{Secret: testBankSecret, PendingLatency: 100 * time.Millisecond, NotificationURL: gateway.URL + "/bank/notifications"}))
+	t.Cleanup(simulator.Close)
+	p.Banker = bank.NewHTTPBank(simulator.URL, testBankSecret, time.Second)
+	ctx := context.Background()
+
+	planId, customerId, methods := newSubscriber(t, router, "4000000000000150", "4000000000000168")
+	subscribe := func(methodId string) string {
+		subscription, err := p.Billing.Subscribe(testMerchantID, customerId, methodId, planId)
+		require.NoError(t, err)
+		return subscription.ID
+	}
+	approved, declined := subscribe(methods[0]), subscribe(methods[1])
+	subscription := func(id string) billing.Subscription {
+		subscription, err := p.Billing.Subscription(testMerchantID, id)
+		require.NoError(t, err)
+		return subscription
+	}
+
+	// A charge the bank leaves pending does not pay for the period, and is not made again while
+	// the bank decides on it
+	for i := 0; i < 2; i++ {
+		paid, err := p.Billing.ChargeDue(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, paid)
+	}
+	for _, id := range []string{approved, declined} {
+		sub := subscription(id)
+		assert.Equal(t, billing.StatusActive, sub.Status)
+		assert.Equal(t, 0, sub.Periods)
+		assert.True(t, sub.CurrentPeriodEnd.Equal(sub.CurrentPeriodStart))
+		require.Len(t, sub.Charges, 1)
+		assert.Equal(t, billing.ChargePending, sub.Charges[0].Status)
+		assert.NotEmpty(t, sub.Charges[0].PaymentID)
+	}
+	stored, err := p.PaymentStore.ListPayments()
+	require.NoError(t, err)
+	assert.Len(t, stored, 2)
+	w := webhookRequest(router, "POST", "/subscriptions/"+approved+"/cancel", ``)
+	assert.Equal(t, 409, w.Code)
+	assert.JSONEq(t, `{"error":"Subscription is being charged"}`, w.Body.String())
+
+	// The charges are settled once the bank's decisions arrive
+	require.Eventually(t, func() bool {
+		_, err := p.Billing.ChargeDue(ctx)
+		require.NoError(t, err)
+		return subscription(approved).Charges[0].Status != billing.ChargePending && subscription(declined).Charges[0].Status != billing.ChargePending
+	}, 5*time.Second, 10*time.Millisecond)
+	sub := subscription(approved)
+	assert.Equal(t, billing.StatusActive, sub.Status)
+	assert.Equal(t, 1, sub.Periods)
+	assert.True(t, sub.CurrentPeriodEnd.After(sub.CurrentPeriodStart))
+	require.Len(t, sub.Charges, 1)
+	assert.Equal(t, billing.ChargePaid, sub.Charges[0].Status)
+	sub = subscription(declined)
+	assert.Equal(t, billing.StatusPastDue, sub.Status)
+	assert.Equal(t, 0, sub.Periods)
+	assert.Equal(t, 1, sub.FailedAttempts)
+	require.Len(t, sub.Charges, 1)
+	assert.Equal(t, billing.ChargeFailed, sub.Charges[0].Status)
+	assert.Equal(t, payments.ErrDeclinedByBank.Error(), sub.Charges[0].Error)
+	stored, err = p.PaymentStore.ListPayments()
+	require.NoError(t, err)
+	assert.Len(t, stored, 2)
+}
+
+func TestSubscriptionChargeOutcomeLost(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	recorder := new(mocks.RecordingBankMock)
+	p.Banker = recorder
+	store := &failingBillingStore{Store: p.Billing.Store, failing: make(map[string]bool)}
+	p.Billing.Store = store
+	now := time.Date(2030, 1, 31, 9, 0, 0, 0, time.UTC)
+	p.Billing.Clock = func() time.Time { return now }
+	router := setupRouter(p)
+	ctx := context.Background()
+
+	planId, customerId, methods := newSubscriber(t, router, "4658585018481009")
+	lost, err := p.Billing.Subscribe(testMerchantID, customerId, methods[0], planId)
+	require.NoError(t, err)
+	now = now.Add(time.Second)
+	other, err := p.Billing.Subscribe(testMerchantID, customerId, methods[0], planId)
+	require.NoError(t, err)
+
+	// The outcome of the first charge cannot be recorded, which leaves the charge pending, while
+	// the subscriptions due after it are still charged
+	store.failing[lost.ID] = true
+	paid, err := p.Billing.ChargeDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, paid)
+	require.Len(t, recorder.Cards, 2)
+	sub, err := p.Billing.Subscription(testMerchantID, lost.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, sub.Periods)
+	require.Len(t, sub.Charges, 1)
+	assert.Equal(t, billing.ChargePending, sub.Charges[0].Status)
+	sub, err = p.Billing.Subscription(testMerchantID, other.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sub.Periods)
+
+	// The next run settles the charge with its payment, rather than charging the card again
+	store.failing[lost.ID] = false
+	paid, err = p.Billing.ChargeDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, paid)
+	assert.Len(t, recorder.Cards, 2)
+	sub, err = p.Billing.Subscription(testMerchantID, lost.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sub.Periods)
+	require.Len(t, sub.Charges, 1)
+	assert.Equal(t, billing.ChargePaid, sub.Charges[0].Status)
+	ok, payment, err := p.GetPayment(testMerchantID, data.PaymentID(uuid.MustParse(sub.Charges[0].PaymentID)))
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, data.StateCaptured, payment.State)
+}
+
+func TestSubscriptionChargeTimedOut(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	timeouts := new(mocks.TimeoutBankMock)
+	p.Banker = timeouts
+	router := setupRouter(p)
+	ctx := context.Background()
+
+	planId, customerId, methods := newSubscriber(t, router, "4658585018481009")
+	subscription, err := p.Billing.Subscribe(testMerchantID, customerId, methods[0], planId)
+	require.NoError(t, err)
+
+	// The bank takes the payment but its answer is lost, so the charge is left pending rather
+	// than failed, and the next runs neither retry it under another id nor start dunning
+	for i := 0; i < 2; i++ {
+		paid, err := p.Billing.ChargeDue(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, paid)
+	}
+	sub, err := p.Billing.Subscription(testMerchantID, subscription.ID)
+	require.NoError(t, err)
+	assert.Equal(t, billing.StatusActive, sub.Status)
+	assert.Equal(t, 0, sub.FailedAttempts)
+	require.Len(t, sub.Charges, 1)
+	assert.Equal(t, billing.ChargePending, sub.Charges[0].Status)
+
+	// Once the payment is found approved with the bank, the charge is paid, having charged the
+	// card only once
+	decided, err := p.CheckPendingPayments(ctx, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, decided)
+	paid, err := p.Billing.ChargeDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, paid)
+	sub, err = p.Billing.Subscription(testMerchantID, subscription.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sub.Periods)
+	require.Len(t, sub.Charges, 1)
+	assert.Equal(t, billing.ChargePaid, sub.Charges[0].Status)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&timeouts.Calls))
+	stored, err := p.PaymentStore.ListPayments()
+	require.NoError(t, err)
+	assert.Len(t, stored, 1)
+}
+
+// failingBillingStore is a billing.Store that fails to record the outcome of a charge for the
+// subscriptions that are failing, while still recording charges as pending.
+type failingBillingStore struct {
+	billing.Store
+	failing map[string]bool
+}
+
+// UpdateSubscription fails if the subscription is failing and its last charge has been settled.
+func (s *failingBillingStore) UpdateSubscription(subscription billing.Subscription) error {
+	if n := len(subscription.Charges); s.failing[subscription.ID] && n > 0 && subscription.Charges[n-1].Status != billing.ChargePending {
+		return errors.New("disk full")
+	}
+	return s.Store.UpdateSubscription(subscription)
+}
+
+// otherMerchantRequest makes a request to the router as a second merchant, which must be registered as merchant-2.
+func otherMerchantRequest(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer sk_test_merchant_2")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestListPayments(t *testing.T) {
+	p := newTestPaymentGatewayService(t)
+	p.Banker = new(bank.Bank)
+	require.NoError(t, p.Merchants.Register(merchants.Merchant{ID: "merchant-2", Name: "Other Merchant"}, "sk_test_merchant_2"))
+	router := setupRouter(p)
+	pay := func(cardNumber, amount, currency string, capture bool) string {
+		w := webhookRequest(router, "POST", "/pay", fmt.Sprintf(`{"card-number": "%s", "expiry-date": "11/30", "cvv": "555", "amount": %s, "currency": "%s", "capture": %t}`, cardNumber, amount, currency, capture))
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var resp api.PostResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Uuid.String()
+	}
+	list := func(query string) api.PaymentListResponse {
+		w := webhookRequest(router, "GET", "/payments"+query, ``)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var resp api.PaymentListResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	ids := func(payments []api.PaymentSummaryResponse) []string {
+		ids := make([]string, 0, len(payments))
+		for _, payment := range payments {
+			ids = append(ids, payment.Uuid)
+		}
+		return ids
+	}
+	// pages follows the cursors from the first page to the last, returning every payment listed
+	pages := func(query string) []string {
+		var listed []string
+		resp := list(query)
+		for {
+			assert.LessOrEqual(t, len(resp.Payments), 2)
+			listed = append(listed, ids(resp.Payments)...)
+			if resp.NextCursor == "" {
+				return listed
+			}
+			resp = list(query + "&cursor=" + resp.NextCursor)
+		}
+	}
+
+	visaGBP := pay("4658585018481009", "10.00", "GBP", true)
+	visaAuthorised := pay("4658585018481009", "25.00", "GBP", false)
+	mastercardGBP := pay("5555555555554444", "50.00", "GBP", true)
+	visaEUR := pay("4658585018481009", "30.00", "EUR", true)
+	mastercardAuthorised := pay("5555555555554444", "100.00", "GBP", false)
+	created := []string{visaGBP, visaAuthorised, mastercardGBP, visaEUR, mastercardAuthorised}
+	w := otherMerchantRequest(router, "POST", "/pay", `{"card-number": "4658585018481009", "expiry-date": "11/30", "cvv": "555", "amount": 10.00, "currency": "GBP"}`)
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	// Payments are listed newest first, and merchants only see their own
+	all := list("")
+	require.Len(t, all.Payments, 5)
+	assert.Empty(t, all.NextCursor)
+	assert.ElementsMatch(t, created, ids(all.Payments))
+	for i := 1; i < len(all.Payments); i++ {
+		assert.False(t, all.Payments[i].CreatedAt.After(all.Payments[i-1].CreatedAt))
+	}
+	newest := ids(all.Payments)
+	oldest := make([]string, len(newest))
+	for i, id := range newest {
+		oldest[len(newest)-1-i] = id
+	}
+	assert.Equal(t, oldest, ids(list("?order=oldest").Payments))
+	byID := make(map[string]api.PaymentSummaryResponse)
+	for _, payment := range all.Payments {
+		byID[payment.Uuid] = payment
+	}
+	assert.Equal(t, api.PaymentSummaryResponse{
+		Uuid: visaGBP, State: "captured", BankPaymentStatus: "Success", Amount: "10.00", AmountCaptured: "10.00", AmountRefundable: "10.00",
+		Currency: "GBP", MaskCardNumber: "****1009", CardBrand: "Visa", InitiatedBy: "customer", CreatedAt: byID[visaGBP].CreatedAt,
+	}, byID[visaGBP])
+	assert.False(t, byID[visaGBP].CreatedAt.IsZero())
+	w = otherMerchantRequest(router, "GET", "/payments", ``)
+	require.Equal(t, 200, w.Code)
+	var other api.PaymentListResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &other))
+	require.Len(t, other.Payments, 1)
+	assert.NotContains(t, created, other.Payments[0].Uuid)
+
+	// Paging through a page at a time lists every payment once, in either order
+	assert.Equal(t, newest, pages("?limit=2"))
+	assert.Equal(t, oldest, pages("?limit=2&order=oldest"))
+
+	// A page starts where the last one ended, however many payments were made since
+	first := list("?limit=2")
+	require.NotEmpty(t, first.NextCursor)
+	newer := pay("4658585018481009", "1.00", "GBP", true)
+	second := list("?limit=2&cursor=" + first.NextCursor)
+	assert.Equal(t, newest[2:4], ids(second.Payments))
+	assert.NotContains(t, ids(second.Payments), newer)
+	assert.Equal(t, newer, list("?limit=1").Payments[0].Uuid)
+
+	// Payments are filtered by every filter given
+	from := byID[mastercardGBP].CreatedAt.Format(time.RFC3339Nano)
+	for query, want := range map[string][]string{
+		"?status=authorised":                               {visaAuthorised, mastercardAuthorised},
+		"?status=captured,authorised":                      append(created, newer),
+		"?status=refunded":                                 {},
+		"?currency=eur":                                    {visaEUR},
+		"?currency=GBP&min-amount=25&max-amount=50.00":     {visaAuthorised, mastercardGBP},
+		"?currency=GBP&min-amount=50":                      {mastercardGBP, mastercardAuthorised},
+		"?last-four=4444":                                  {mastercardGBP, mastercardAuthorised},
+		"?brand=Mastercard&status=captured":                {mastercardGBP},
+		"?brand=mastercard&status=captured":                {mastercardGBP},
+		"?created-from=" + url.QueryEscape(from):           {mastercardGBP, visaEUR, mastercardAuthorised, newer},
+		"?created-to=" + url.QueryEscape(from):             {visaGBP, visaAuthorised},
+		"?created-to=2000-01-01T00:00:00Z":                 {},
+		"?brand=Visa&currency=GBP&status=captured&limit=1": {newer},
+	} {
+		assert.ElementsMatch(t, want, ids(list(query).Payments), query)
+	}
+	filtered := pages("?limit=2&brand=Visa&currency=GBP")
+	assert.Equal(t, []string{newer, visaAuthorised, visaGBP}, filtered)
+
+	for query, want := range map[string]string{
+		"?status=settled":                          `{"error":"Invalid status"}`,
+		"?currency=XYZ":                            `{"error":"Invalid currency"}`,
+		"?min-amount=10":                           `{"error":"currency must be given with min-amount and max-amount"}`,
+		"?currency=GBP&max-amount=10.001":          `{"error":"Invalid max-amount"}`,
+		"?created-from=yesterday":                  `{"error":"Invalid created-from"}`,
+		"?created-to=2023-08-01":                   `{"error":"Invalid created-to"}`,
+		"?last-four=12a4":                          `{"error":"Invalid last-four"}`,
+		"?brand=amex":                              `{"error":"Invalid brand"}`,
+		"?order=random":                            `{"error":"Invalid order"}`,
+		"?limit=0":                                 `{"error":"Invalid limit"}`,
+		"?limit=101":                               `{"error":"Invalid limit"}`,
+		"?cursor=not-a-cursor":                     `{"error":"Invalid cursor"}`,
+		"?order=oldest&cursor=" + first.NextCursor: `{"error":"Invalid cursor"}`,
+	} {
+		w := webhookRequest(router, "GET", "/payments"+query, ``)
+		assert.Equal(t, 400, w.Code, query)
+		assert.JSONEq(t, want, w.Body.String(), query)
+	}
 }
@@ -0,0 +1,70 @@
+package merchants
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// ErrKeyInUse is returned when registering an API key that already belongs to a merchant.
+var ErrKeyInUse = errors.New("api key already registered")
+
+// Merchant represents a merchant taking payments through the gateway.
+type Merchant struct {
+	ID   string // Unique identifier of the merchant, stamped on every payment they make
+	Name string // Display name of the merchant
+}
+
+// Registry holds the registered merchants and their API keys. Only a SHA-256 hash of each key
+// is kept, so the keys themselves cannot be recovered from the registry. Keys are long random
+// strings, which is what makes a fast unsalted hash suitable here rather than a password hash.
+type Registry struct {
+	keys map[string]Merchant // A map that associates the hex encoded hash of an API key with its merchant
+	mu   sync.RWMutex        // Mutex to protect concurrent access to keys
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{keys: make(map[string]Merchant)}
+}
+
+// Register adds an API key for the merchant. A merchant can have several keys, e.g. while
+// rotating from an old key to a new one.
+func (r *Registry) Register(merchant Merchant, apiKey string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hash := hashKey(apiKey)
+	if _, ok := r.keys[hash]; ok {
+		return ErrKeyInUse
+	}
+	r.keys[hash] = merchant
+	return nil
+}
+
+// Authenticate returns the merchant the API key belongs to, and whether the key is valid.
+func (r *Registry) Authenticate(apiKey string) (Merchant, bool) {
+	if apiKey == "" {
+		return Merchant{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	merchant, ok := r.keys[hashKey(apiKey)]
+	return merchant, ok
+}
+
+// GenerateAPIKey creates a new random API key.
+func GenerateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "sk_" + hex.EncodeToString(b), nil
+}
+
+// hashKey returns the hex encoded SHA-256 hash of an API key.
+func hashKey(apiKey string) string {
+	hash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(hash[:])
+}
@@ -1,8 +1,11 @@
 package mocks
 
 import (
+	"context"
 	"payment-gateway/bank"
 	"payment-gateway/data"
+	"payment-gateway/money"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 )
@@ -14,8 +17,151 @@ type BankMock struct {
 
 // MakePaymentToBank is the mocked version of the bank.Banker's MakePaymentToBank function.
 // This function simulates making a payment to the bank and returns a predefined failure status and payment ID.
-func (b *BankMock) MakePaymentToBank(cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID) {
+func (b *BankMock) MakePaymentToBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error) {
 	bankPaymentStatus := data.BankPaymentStatus("Failure")
 	bankPaymentId := data.BankPaymentID(uuid.New())
-	return bankPaymentStatus, bankPaymentId
+	return bankPaymentStatus, bankPaymentId, nil
+}
+
+// AuthorisePaymentWithBank is the mocked version of the bank.Banker's AuthorisePaymentWithBank function.
+// This function simulates authorising a payment with the bank and returns a predefined failure status and payment ID.
+func (b *BankMock) AuthorisePaymentWithBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	return data.BankPaymentStatus("Failure"), data.BankPaymentID(uuid.New()), nil
+}
+
+// CapturePaymentWithBank is the mocked version of the bank.Banker's CapturePaymentWithBank function.
+// This function simulates capturing a payment with the bank and returns a predefined failure status.
+func (b *BankMock) CapturePaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (data.BankPaymentStatus, error) {
+	return data.BankPaymentStatus("Failure"), nil
+}
+
+// VoidPaymentWithBank is the mocked version of the bank.Banker's VoidPaymentWithBank function.
+// This function simulates voiding a payment with the bank and returns a predefined failure status.
+func (b *BankMock) VoidPaymentWithBank(ctx context.Context, bpid data.BankPaymentID) (data.BankPaymentStatus, error) {
+	return data.BankPaymentStatus("Failure"), nil
+}
+
+// RefundPaymentWithBank is the mocked version of the bank.Banker's RefundPaymentWithBank function.
+// This function simulates refunding a payment with the bank and returns a predefined failure status and refund ID.
+func (b *BankMock) RefundPaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	return data.BankPaymentStatus("Failure"), data.BankPaymentID(uuid.New()), nil
+}
+
+// PaymentStatusFromBank is the mocked version of the bank.Banker's PaymentStatusFromBank function.
+// This function simulates asking the bank for the status of a payment and returns a predefined failure status.
+func (b *BankMock) PaymentStatusFromBank(ctx context.Context, bpid data.BankPaymentID) (data.BankPaymentStatus, error) {
+	return data.BankPaymentStatus("Failure"), nil
+}
+
+// PaymentStatusByReference is the mocked version of the bank.Banker's PaymentStatusByReference function.
+// This function simulates asking the bank for the status of a payment by its reference and returns a predefined failure status and payment ID.
+func (b *BankMock) PaymentStatusByReference(ctx context.Context, reference string) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	return data.BankPaymentStatus("Failure"), data.BankPaymentID(uuid.New()), nil
+}
+
+// CountingBankMock is a mock implementation of the bank.Banker interface that always succeeds
+// and counts the payments made to it. If Release is set, each payment is held until it is closed.
+type CountingBankMock struct {
+	bank.Banker               // Embedding the bank.Banker interface to satisfy the interface contract.
+	Calls       int32         // The number of payments made, updated atomically
+	Release     chan struct{} // When non-nil, payments block until this channel is closed
+}
+
+// MakePaymentToBank is the mocked version of the bank.Banker's MakePaymentToBank function.
+// This function counts the payment, waits for Release if set, and returns a success status and payment ID.
+// If the context finishes while waiting the bank gives no answer.
+func (b *CountingBankMock) MakePaymentToBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	atomic.AddInt32(&b.Calls, 1)
+	if b.Release != nil {
+		select {
+		case <-b.Release:
+		case <-ctx.Done():
+			return "", data.BankPaymentID{}, bank.ContextError(ctx.Err())
+		}
+	}
+	return data.BankPaymentStatus("Success"), data.BankPaymentID(uuid.New()), nil
+}
+
+// ErrorBankMock is a mock implementation of the bank.Banker interface for a bank that never
+// answers, every call fails with Err.
+type ErrorBankMock struct {
+	bank.Banker       // Embedding the bank.Banker interface to satisfy the interface contract.
+	Err         error // The error returned by every call
+}
+
+// MakePaymentToBank is the mocked version of the bank.Banker's MakePaymentToBank function.
+// This function simulates a payment the bank gave no answer to, returning Err.
+func (b *ErrorBankMock) MakePaymentToBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	return "", data.BankPaymentID{}, b.Err
+}
+
+// AuthorisePaymentWithBank is the mocked version of the bank.Banker's AuthorisePaymentWithBank function.
+// This function simulates an authorisation the bank gave no answer to, returning Err.
+func (b *ErrorBankMock) AuthorisePaymentWithBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	return "", data.BankPaymentID{}, b.Err
+}
+
+// CapturePaymentWithBank is the mocked version of the bank.Banker's CapturePaymentWithBank function.
+// This function simulates a capture the bank gave no answer to, returning Err.
+func (b *ErrorBankMock) CapturePaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (data.BankPaymentStatus, error) {
+	return "", b.Err
+}
+
+// VoidPaymentWithBank is the mocked version of the bank.Banker's VoidPaymentWithBank function.
+// This function simulates a void the bank gave no answer to, returning Err.
+func (b *ErrorBankMock) VoidPaymentWithBank(ctx context.Context, bpid data.BankPaymentID) (data.BankPaymentStatus, error) {
+	return "", b.Err
+}
+
+// RefundPaymentWithBank is the mocked version of the bank.Banker's RefundPaymentWithBank function.
+// This function simulates a refund the bank gave no answer to, returning Err.
+func (b *ErrorBankMock) RefundPaymentWithBank(ctx context.Context, bpid data.BankPaymentID, amount money.Money) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	return "", data.BankPaymentID{}, b.Err
+}
+
+// PaymentStatusFromBank is the mocked version of the bank.Banker's PaymentStatusFromBank function.
+// This function simulates a status check the bank gave no answer to, returning Err.
+func (b *ErrorBankMock) PaymentStatusFromBank(ctx context.Context, bpid data.BankPaymentID) (data.BankPaymentStatus, error) {
+	return "", b.Err
+}
+
+// PaymentStatusByReference is the mocked version of the bank.Banker's PaymentStatusByReference function.
+// This function simulates a status check the bank gave no answer to, returning Err.
+func (b *ErrorBankMock) PaymentStatusByReference(ctx context.Context, reference string) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	return "", data.BankPaymentID{}, b.Err
+}
+
+// TimeoutBankMock is a mock implementation of the bank.Banker interface for a bank that takes
+// every payment but never answers in time, so the payments are only found approved when asked
+// for by reference.
+type TimeoutBankMock struct {
+	bank.Banker       // Embedding the bank.Banker interface to satisfy the interface contract.
+	Calls       int32 // The number of payments made, updated atomically
+}
+
+// MakePaymentToBank is the mocked version of the bank.Banker's MakePaymentToBank function.
+// This function counts the payment and times out without answering.
+func (b *TimeoutBankMock) MakePaymentToBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	atomic.AddInt32(&b.Calls, 1)
+	return "", data.BankPaymentID{}, bank.ContextError(context.DeadlineExceeded)
+}
+
+// PaymentStatusByReference is the mocked version of the bank.Banker's PaymentStatusByReference function.
+// This function finds every payment approved.
+func (b *TimeoutBankMock) PaymentStatusByReference(ctx context.Context, reference string) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	return data.BankPaymentStatus("Success"), data.BankPaymentID(uuid.New()), nil
+}
+
+// RecordingBankMock is a mock implementation of the bank.Banker interface that always succeeds
+// and records the card data of every payment made to it.
+type RecordingBankMock struct {
+	bank.Banker                 // Embedding the bank.Banker interface to satisfy the interface contract.
+	Cards       []data.CardData // The card data sent with each payment, in the order they were made
+}
+
+// MakePaymentToBank is the mocked version of the bank.Banker's MakePaymentToBank function.
+// This function records the card data and returns a success status and payment ID.
+func (b *RecordingBankMock) MakePaymentToBank(ctx context.Context, cd data.CardData) (data.BankPaymentStatus, data.BankPaymentID, error) {
+	b.Cards = append(b.Cards, cd)
+	return data.BankPaymentStatus("Success"), data.BankPaymentID(uuid.New()), nil
 }
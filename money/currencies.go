@@ -0,0 +1,228 @@
+package money
+
+import "strings"
+
+// Currency describes an ISO 4217 currency.
+type Currency struct {
+	Code     string // The three letter alphabetic code, e.g. GBP
+	Numeric  string // The three digit numeric code, e.g. 826
+	Exponent int    // The number of digits after the decimal separator, e.g. 2 for pence
+	Active   bool   // Whether the currency is in use, withdrawn currencies are kept for reference only
+}
+
+// LookupCurrency returns the ISO 4217 currency with the given alphabetic code. The code must
+// already be normalised, see NormaliseCurrency.
+func LookupCurrency(code string) (Currency, bool) {
+	c, ok := currencies[code]
+	return c, ok
+}
+
+// NormaliseCurrency trims and upper-cases a currency code, returning the normalised code and
+// whether it is an active ISO 4217 currency that payments can be taken in.
+func NormaliseCurrency(code string) (string, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	c, ok := currencies[code]
+	if !ok || !c.Active {
+		return code, false
+	}
+	return code, true
+}
+
+// currencies is the ISO 4217 table, keyed by alphabetic code. Precious metals, testing and
+// other codes that have no minor unit are left out as payments can never be taken in them.
+var currencies = map[string]Currency{
+	"AED": {"AED", "784", 2, true},
+	"AFN": {"AFN", "971", 2, true},
+	"ALL": {"ALL", "008", 2, true},
+	"AMD": {"AMD", "051", 2, true},
+	"AOA": {"AOA", "973", 2, true},
+	"ARS": {"ARS", "032", 2, true},
+	"AUD": {"AUD", "036", 2, true},
+	"AWG": {"AWG", "533", 2, true},
+	"AZN": {"AZN", "944", 2, true},
+	"BAM": {"BAM", "977", 2, true},
+	"BBD": {"BBD", "052", 2, true},
+	"BDT": {"BDT", "050", 2, true},
+	"BGN": {"BGN", "975", 2, true},
+	"BHD": {"BHD", "048", 3, true},
+	"BIF": {"BIF", "108", 0, true},
+	"BMD": {"BMD", "060", 2, true},
+	"BND": {"BND", "096", 2, true},
+	"BOB": {"BOB", "068", 2, true},
+	"BOV": {"BOV", "984", 2, true},
+	"BRL": {"BRL", "986", 2, true},
+	"BSD": {"BSD", "044", 2, true},
+	"BTN": {"BTN", "064", 2, true},
+	"BWP": {"BWP", "072", 2, true},
+	"BYN": {"BYN", "933", 2, true},
+	"BZD": {"BZD", "084", 2, true},
+	"CAD": {"CAD", "124", 2, true},
+	"CDF": {"CDF", "976", 2, true},
+	"CHE": {"CHE", "947", 2, true},
+	"CHF": {"CHF", "756", 2, true},
+	"CHW": {"CHW", "948", 2, true},
+	"CLF": {"CLF", "990", 4, true},
+	"CLP": {"CLP", "152", 0, true},
+	"CNY": {"CNY", "156", 2, true},
+	"COP": {"COP", "170", 2, true},
+	"COU": {"COU", "970", 2, true},
+	"CRC": {"CRC", "188", 2, true},
+	"CUP": {"CUP", "192", 2, true},
+	"CVE": {"CVE", "132", 2, true},
+	"CZK": {"CZK", "203", 2, true},
+	"DJF": {"DJF", "262", 0, true},
+	"DKK": {"DKK", "208", 2, true},
+	"DOP": {"DOP", "214", 2, true},
+	"DZD": {"DZD", "012", 2, true},
+	"EGP": {"EGP", "818", 2, true},
+	"ERN": {"ERN", "232", 2, true},
+	"ETB": {"ETB", "230", 2, true},
+	"EUR": {"EUR", "978", 2, true},
+	"FJD": {"FJD", "242", 2, true},
+	"FKP": {"FKP", "238", 2, true},
+	"GBP": {"GBP", "826", 2, true},
+	"GEL": {"GEL", "981", 2, true},
+	"GHS": {"GHS", "936", 2, true},
+	"GIP": {"GIP", "292", 2, true},
+	"GMD": {"GMD", "270", 2, true},
+	"GNF": {"GNF", "324", 0, true},
+	"GTQ": {"GTQ", "320", 2, true},
+	"GYD": {"GYD", "328", 2, true},
+	"HKD": {"HKD", "344", 2, true},
+	"HNL": {"HNL", "340", 2, true},
+	"HTG": {"HTG", "332", 2, true},
+	"HUF": {"HUF", "348", 2, true},
+	"IDR": {"IDR", "360", 2, true},
+	"ILS": {"ILS", "376", 2, true},
+	"INR": {"INR", "356", 2, true},
+	"IQD": {"IQD", "368", 3, true},
+	"IRR": {"IRR", "364", 2, true},
+	"ISK": {"ISK", "352", 0, true},
+	"JMD": {"JMD", "388", 2, true},
+	"JOD": {"JOD", "400", 3, true},
+	"JPY": {"JPY", "392", 0, true},
+	"KES": {"KES", "404", 2, true},
+	"KGS": {"KGS", "417", 2, true},
+	"KHR": {"KHR", "116", 2, true},
+	"KMF": {"KMF", "174", 0, true},
+	"KPW": {"KPW", "408", 2, true},
+	"KRW": {"KRW", "410", 0, true},
+	"KWD": {"KWD", "414", 3, true},
+	"KYD": {"KYD", "136", 2, true},
+	"KZT": {"KZT", "398", 2, true},
+	"LAK": {"LAK", "418", 2, true},
+	"LBP": {"LBP", "422", 2, true},
+	"LKR": {"LKR", "144", 2, true},
+	"LRD": {"LRD", "430", 2, true},
+	"LSL": {"LSL", "426", 2, true},
+	"LYD": {"LYD", "434", 3, true},
+	"MAD": {"MAD", "504", 2, true},
+	"MDL": {"MDL", "498", 2, true},
+	"MGA": {"MGA", "969", 2, true},
+	"MKD": {"MKD", "807", 2, true},
+	"MMK": {"MMK", "104", 2, true},
+	"MNT": {"MNT", "496", 2, true},
+	"MOP": {"MOP", "446", 2, true},
+	"MRU": {"MRU", "929", 2, true},
+	"MUR": {"MUR", "480", 2, true},
+	"MVR": {"MVR", "462", 2, true},
+	"MWK": {"MWK", "454", 2, true},
+	"MXN": {"MXN", "484", 2, true},
+	"MXV": {"MXV", "979", 2, true},
+	"MYR": {"MYR", "458", 2, true},
+	"MZN": {"MZN", "943", 2, true},
+	"NAD": {"NAD", "516", 2, true},
+	"NGN": {"NGN", "566", 2, true},
+	"NIO": {"NIO", "558", 2, true},
+	"NOK": {"NOK", "578", 2, true},
+	"NPR": {"NPR", "524", 2, true},
+	"NZD": {"NZD", "554", 2, true},
+	"OMR": {"OMR", "512", 3, true},
+	"PAB": {"PAB", "590", 2, true},
+	"PEN": {"PEN", "604", 2, true},
+	"PGK": {"PGK", "598", 2, true},
+	"PHP": {"PHP", "608", 2, true},
+	"PKR": {"PKR", "586", 2, true},
+	"PLN": {"PLN", "985", 2, true},
+	"PYG": {"PYG", "600", 0, true},
+	"QAR": {"QAR", "634", 2, true},
+	"RON": {"RON", "946", 2, true},
+	"RSD": {"RSD", "941", 2, true},
+	"RUB": {"RUB", "643", 2, true},
+	"RWF": {"RWF", "646", 0, true},
+	"SAR": {"SAR", "682", 2, true},
+	"SBD": {"SBD", "090", 2, true},
+	"SCR": {"SCR", "690", 2, true},
+	"SDG": {"SDG", "938", 2, true},
+	"SEK": {"SEK", "752", 2, true},
+	"SGD": {"SGD", "702", 2, true},
+	"SHP": {"SHP", "654", 2, true},
+	"SLE": {"SLE", "925", 2, true},
+	"SOS": {"SOS", "706", 2, true},
+	"SRD": {"SRD", "968", 2, true},
+	"SSP": {"SSP", "728", 2, true},
+	"STN": {"STN", "930", 2, true},
+	"SVC": {"SVC", "222", 2, true},
+	"SYP": {"SYP", "760", 2, true},
+	"SZL": {"SZL", "748", 2, true},
+	"THB": {"THB", "764", 2, true},
+	"TJS": {"TJS", "972", 2, true},
+	"TMT": {"TMT", "934", 2, true},
+	"TND": {"TND", "788", 3, true},
+	"TOP": {"TOP", "776", 2, true},
+	"TRY": {"TRY", "949", 2, true},
+	"TTD": {"TTD", "780", 2, true},
+	"TWD": {"TWD", "901", 2, true},
+	"TZS": {"TZS", "834", 2, true},
+	"UAH": {"UAH", "980", 2, true},
+	"UGX": {"UGX", "800", 0, true},
+	"USD": {"USD", "840", 2, true},
+	"USN": {"USN", "997", 2, true},
+	"UYI": {"UYI", "940", 0, true},
+	"UYU": {"UYU", "858", 2, true},
+	"UYW": {"UYW", "927", 4, true},
+	"UZS": {"UZS", "860", 2, true},
+	"VED": {"VED", "926", 2, true},
+	"VES": {"VES", "928", 2, true},
+	"VND": {"VND", "704", 0, true},
+	"VUV": {"VUV", "548", 0, true},
+	"WST": {"WST", "882", 2, true},
+	"XAF": {"XAF", "950", 0, true},
+	"XCD": {"XCD", "951", 2, true},
+	"XCG": {"XCG", "532", 2, true},
+	"XOF": {"XOF", "952", 0, true},
+	"XPF": {"XPF", "953", 0, true},
+	"YER": {"YER", "886", 2, true},
+	"ZAR": {"ZAR", "710", 2, true},
+	"ZMW": {"ZMW", "967", 2, true},
+	"ZWG": {"ZWG", "924", 2, true},
+
+	// Withdrawn currencies, which are recognised but can no longer be used for payments
+	"ANG": {"ANG", "532", 2, false},
+	"ATS": {"ATS", "040", 2, false},
+	"BEF": {"BEF", "056", 0, false},
+	"CUC": {"CUC", "931", 2, false},
+	"CYP": {"CYP", "196", 2, false},
+	"DEM": {"DEM", "276", 2, false},
+	"EEK": {"EEK", "233", 2, false},
+	"ESP": {"ESP", "724", 0, false},
+	"FIM": {"FIM", "246", 2, false},
+	"FRF": {"FRF", "250", 2, false},
+	"GRD": {"GRD", "300", 0, false},
+	"HRK": {"HRK", "191", 2, false},
+	"IEP": {"IEP", "372", 2, false},
+	"ITL": {"ITL", "380", 0, false},
+	"LTL": {"LTL", "440", 2, false},
+	"LUF": {"LUF", "442", 0, false},
+	"LVL": {"LVL", "428", 2, false},
+	"MRO": {"MRO", "478", 2, false},
+	"MTL": {"MTL", "470", 2, false},
+	"NLG": {"NLG", "528", 2, false},
+	"PTE": {"PTE", "620", 0, false},
+	"SIT": {"SIT", "705", 2, false},
+	"SKK": {"SKK", "703", 2, false},
+	"SLL": {"SLL", "694", 2, false},
+	"STD": {"STD", "678", 2, false},
+	"VEF": {"VEF", "937", 2, false},
+	"ZWL": {"ZWL", "932", 2, false},
+}
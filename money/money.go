@@ -0,0 +1,102 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidAmount is returned when an amount is not a plain decimal number.
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// ErrTooPrecise is returned when an amount has more decimal places than its currency allows.
+var ErrTooPrecise = errors.New("amount has too many decimal places for its currency")
+
+// Money represents an exact amount of a currency, held as an integer number of the currency's
+// minor units (e.g. pence for GBP) so that it is never subject to floating point rounding.
+type Money struct {
+	MinorUnits int64  // The amount in minor units, e.g. 1050 for 10.50 GBP
+	Currency   string // The currency code of the amount, e.g. GBP
+}
+
+// Parse converts a decimal string such as "10.50" into Money of the given currency. The string
+// is parsed exactly, and amounts with more decimal places than the currency uses are rejected
+// rather than rounded.
+func Parse(amount string, currency string) (Money, error) {
+	m := Money{Currency: currency}
+	exponent := Exponent(currency)
+
+	// Split off the sign, as it applies to both the whole and fractional parts
+	negative := strings.HasPrefix(amount, "-")
+	unsigned := strings.TrimPrefix(amount, "-")
+
+	whole, fraction := unsigned, ""
+	if i := strings.IndexByte(unsigned, '.'); i >= 0 {
+		whole, fraction = unsigned[:i], unsigned[i+1:]
+		if fraction == "" {
+			return m, ErrInvalidAmount
+		}
+	}
+	if whole == "" || !isDigits(whole) || !isDigits(fraction) {
+		return m, ErrInvalidAmount
+	}
+
+	// Trailing zeros carry no value, so 10.500 is as precise as 10.50
+	fraction = strings.TrimRight(fraction, "0")
+	if len(fraction) > exponent {
+		return m, ErrTooPrecise
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	minorUnits, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return m, ErrInvalidAmount
+	}
+	if negative {
+		minorUnits = -minorUnits
+	}
+	m.MinorUnits = minorUnits
+	return m, nil
+}
+
+// String formats the amount as a decimal string with the number of decimal places used by its
+// currency, e.g. "10.50". The currency code is not included.
+func (m Money) String() string {
+	exponent := Exponent(m.Currency)
+	sign := ""
+	units := m.MinorUnits
+	if units < 0 {
+		sign = "-"
+	}
+	// Work with the magnitude as a uint64 so that the most negative int64 can be formatted
+	magnitude := uint64(units)
+	if units < 0 {
+		magnitude = uint64(-(units + 1)) + 1
+	}
+	if exponent == 0 {
+		return sign + strconv.FormatUint(magnitude, 10)
+	}
+	scale := uint64(math.Pow10(exponent))
+	return fmt.Sprintf("%s%d.%0*d", sign, magnitude/scale, exponent, magnitude%scale)
+}
+
+// Exponent returns the number of decimal places, i.e. the number of digits in the minor unit,
+// used by the given currency. Currencies missing from the ISO 4217 table are treated as having two.
+func Exponent(currency string) int {
+	if c, ok := LookupCurrency(currency); ok {
+		return c.Exponent
+	}
+	return 2
+}
+
+// isDigits reports whether s consists only of ASCII digits.
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,47 @@
+package payments
+
+import (
+	"payment-gateway/data"
+	"sync"
+)
+
+// paymentLocks hands out a mutex per payment, so that operations changing the same payment, such
+// as a capture and a void arriving together, run one at a time while other payments are unaffected.
+// The zero value is ready to use.
+type paymentLocks struct {
+	locks map[data.PaymentID]*paymentLock // A map that associates a payment with its lock, while it is in use
+	mu    sync.Mutex                      // Mutex to protect concurrent access to locks
+}
+
+// paymentLock is the mutex for a single payment, along with a count of the callers using it.
+type paymentLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks the given payment, and returns the function to unlock it again.
+func (l *paymentLocks) lock(paymentId data.PaymentID) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[data.PaymentID]*paymentLock)
+	}
+	pl, ok := l.locks[paymentId]
+	if !ok {
+		pl = new(paymentLock)
+		l.locks[paymentId] = pl
+	}
+	pl.users++
+	l.mu.Unlock()
+
+	pl.Lock()
+	return func() {
+		pl.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		// Forget the lock once nobody is using it, so the map only holds payments being changed
+		pl.users--
+		if pl.users == 0 {
+			delete(l.locks, paymentId)
+		}
+	}
+}
@@ -1,66 +1,719 @@
 package payments
 
 import (
+	"context"
+	"errors"
+	"log"
 	"payment-gateway/bank"
+	"payment-gateway/billing"
+	"payment-gateway/customers"
 	"payment-gateway/data"
+	"payment-gateway/merchants"
+	"payment-gateway/money"
 	"payment-gateway/validation"
+	"payment-gateway/vault"
+	"payment-gateway/webhooks"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// Errors returned by the PaymentGatewayService when an operation on a payment is not allowed.
+var (
+	ErrInvalidState         = errors.New("payment is not in a state that allows this operation")
+	ErrAuthorisationExpired = errors.New("payment authorisation has expired")
+	ErrInvalidAmount        = errors.New("invalid amount")
+	ErrAmountExceedsCapture = errors.New("amount exceeds the authorised amount")
+	ErrAmountExceedsRefund  = errors.New("amount exceeds the refundable amount")
+	ErrDeclinedByBank       = errors.New("the bank declined the operation")
+	ErrPaymentFailed        = errors.New("the payment failed")
+)
+
+// defaultAuthorisationExpiry is how long the bank holds authorised funds for, before they are released.
+const defaultAuthorisationExpiry = 7 * 24 * time.Hour
+
+// defaultBankTimeout is how long a call to the bank is waited on before giving up.
+const defaultBankTimeout = 10 * time.Second
+
 // PaymentGatewayService represents the payment gateway service that handles payment operations.
 type PaymentGatewayService struct {
-	data.GatewayData // Embedding GatewayData to inherit its fields and methods
-	bank.Banker      // Embedding Banker interface to use bank-related functionality
+	data.PaymentStore // Embedding PaymentStore interface so any storage backend can be plugged in
+	bank.Banker       // Embedding Banker interface to use bank-related functionality
+
+	Merchants           *merchants.Registry  // The merchants allowed to use the gateway, and their API keys
+	AuthorisationExpiry time.Duration        // How long an authorised payment can be captured for
+	BankTimeout         time.Duration        // How long each call to the bank is waited on, zero waits for as long as the caller's context allows
+	BankSecrets         map[string][]byte    // The secret shared with each acquirer by name, used to verify its notifications, a lone acquirer has no name
+	Webhooks            *webhooks.Dispatcher // Sends every change to a payment's state to the merchant's webhooks
+	Vault               *vault.Vault         // Holds the card numbers of payments, which are only referred to by token elsewhere
+	Customers           *customers.Customers // The merchants' customers, and the cards they have saved
+	Billing             *billing.Billing     // The merchants' plans, and the subscriptions that charge saved cards for them
+
+	locks paymentLocks // Serialises changes to each payment
 }
 
-// NewPaymentGatewayService creates a new instance of PaymentGatewayService and initializes the PaymentData map.
+// NewPaymentGatewayService creates a new instance of PaymentGatewayService backed by the in-memory store.
 func NewPaymentGatewayService() *PaymentGatewayService {
 	p := new(PaymentGatewayService)
-	// Payment data is our in-memory data store and can easily be ripped out
-	p.GatewayData.PaymentData = make(map[data.PaymentID]data.Payment)
+	// The in-memory store is the default, and can be swapped for any other PaymentStore
+	p.PaymentStore = data.NewGatewayData()
+	p.Merchants = merchants.NewRegistry()
+	p.AuthorisationExpiry = defaultAuthorisationExpiry
+	p.BankTimeout = defaultBankTimeout
+	p.Webhooks = webhooks.NewDispatcher(webhooks.NewMemoryStore())
+	// Cards tokenised with a generated key can only be used for as long as the service runs,
+	// which matches the in-memory store
+	kek, err := vault.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	p.Vault = vault.New(vault.NewMemoryStore(), vault.NewKeyring(kek))
+	p.Customers = customers.New(customers.NewMemoryStore())
+	p.Billing = billing.New(billing.NewMemoryStore(), p)
 	return p
 }
 
-// GetPayment retrieves payment information based on the provided payment ID.
-func (p *PaymentGatewayService) GetPayment(paymentId data.PaymentID) (bool, data.BankPaymentStatus, data.CardData) {
-	// Check if the paymentId exists in the PaymentData map
-	exists, bankPaymentStatus, maskedCardData := p.GatewayData.RetrievePayment(paymentId)
+// GetPayment retrieves payment information based on the provided payment ID. Merchants can only
+// see their own payments, so a payment belonging to another merchant is reported as not found.
+func (p *PaymentGatewayService) GetPayment(merchantId string, paymentId data.PaymentID) (bool, data.Payment, error) {
+	// Check if the paymentId exists in the payment store
+	exists, payment, err := p.PaymentStore.RetrievePayment(paymentId)
+	if err != nil || !exists || payment.MerchantID != merchantId {
+		return false, data.Payment{}, err
+	}
 
 	// return the details of the payment
-	return exists, bankPaymentStatus, maskedCardData
+	return true, payment, nil
+}
+
+// SearchPayments returns a page of the merchant's payments that match the query, in the order of
+// the query, along with the cursor of the next page, which is nil when there are no more. Merchants
+// can only see their own payments, so the query is always limited to the merchant's.
+func (p *PaymentGatewayService) SearchPayments(merchantId string, query data.PaymentQuery) ([]data.Payment, *data.PaymentCursor, error) {
+	query.MerchantID = merchantId
+	// One more payment than the page holds is asked for, to find out whether there is another page
+	limit := query.Limit
+	if limit > 0 {
+		query.Limit++
+	}
+	payments, err := p.PaymentStore.QueryPayments(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	if limit == 0 || len(payments) <= limit {
+		return payments, nil, nil
+	}
+	payments = payments[:limit]
+	next := data.CursorOf(payments[limit-1])
+	return payments, &next, nil
+}
+
+// MakePayment initiates a new payment transaction with the provided card data on behalf of the merchant.
+// The funds are authorised and captured by the bank in one go. If the bank gives no answer the
+// Banker's error is returned along with the payment's ID, and the payment is recorded as failed
+// if the bank is known not to have acted on it, or left pending if it may have. If the bank
+// answers that the payment is pending, or its answer was lost, it stays pending until the bank
+// decides on it, see CompletePendingPayment and CheckPendingPayments.
+func (p *PaymentGatewayService) MakePayment(ctx context.Context, merchantId string, cd data.CardData) (data.PaymentID, error) {
+	return p.createPayment(ctx, data.PaymentID(uuid.New()), merchantId, cd, true)
+}
+
+// AuthorisePayment initiates a new payment transaction that only reserves the funds with the bank.
+// The payment must then be captured with CapturePayment before its authorisation expires, or
+// released with VoidPayment.
+func (p *PaymentGatewayService) AuthorisePayment(ctx context.Context, merchantId string, cd data.CardData) (data.PaymentID, error) {
+	return p.createPayment(ctx, data.PaymentID(uuid.New()), merchantId, cd, false)
+}
+
+// CapturePayment takes the funds of an authorised payment. The amount is a decimal string in the
+// payment's currency, which can be less than the authorised amount, or empty to capture it all.
+// Any of the authorisation left uncaptured is released by the bank.
+func (p *PaymentGatewayService) CapturePayment(ctx context.Context, merchantId string, paymentId data.PaymentID, amount string) (data.Payment, error) {
+	unlock := p.locks.lock(paymentId)
+	defer unlock()
+
+	payment, err := p.ownedPayment(merchantId, paymentId)
+	if err != nil {
+		return data.Payment{}, err
+	}
+	if payment.State != data.StateAuthorised {
+		return data.Payment{}, ErrInvalidState
+	}
+	if time.Now().After(payment.AuthorisationExpiry) {
+		return data.Payment{}, ErrAuthorisationExpired
+	}
+
+	// Work out how much to capture, which can never be more than was authorised
+	captureAmount := payment.Amount
+	if amount != "" {
+		captureAmount, err = money.Parse(amount, payment.Amount.Currency)
+		if err != nil || !validation.ValidatePaymentAmount(captureAmount) {
+			return data.Payment{}, ErrInvalidAmount
+		}
+	}
+	if captureAmount.MinorUnits > payment.Amount.MinorUnits {
+		return data.Payment{}, ErrAmountExceedsCapture
+	}
+
+	ctx, _, cancel := p.bankContext(ctx, payment, idString(paymentId)+"/capture")
+	defer cancel()
+	bstatus, err := p.Banker.CapturePaymentWithBank(ctx, payment.BankPaymentID, captureAmount)
+	if err != nil {
+		return data.Payment{}, err
+	}
+	if bstatus != "Success" {
+		return data.Payment{}, ErrDeclinedByBank
+	}
+	payment.CapturedAmount = captureAmount
+	return p.transitionPayment(payment, data.StateCaptured)
+}
+
+// VoidPayment cancels an authorised payment before it is captured, releasing the reserved funds.
+func (p *PaymentGatewayService) VoidPayment(ctx context.Context, merchantId string, paymentId data.PaymentID) (data.Payment, error) {
+	unlock := p.locks.lock(paymentId)
+	defer unlock()
+
+	payment, err := p.ownedPayment(merchantId, paymentId)
+	if err != nil {
+		return data.Payment{}, err
+	}
+	if payment.State != data.StateAuthorised {
+		return data.Payment{}, ErrInvalidState
+	}
+
+	ctx, _, cancel := p.bankContext(ctx, payment, idString(paymentId)+"/void")
+	defer cancel()
+	bstatus, err := p.Banker.VoidPaymentWithBank(ctx, payment.BankPaymentID)
+	if err != nil {
+		return data.Payment{}, err
+	}
+	if bstatus != "Success" {
+		return data.Payment{}, ErrDeclinedByBank
+	}
+	return p.transitionPayment(payment, data.StateVoided)
+}
+
+// RefundPayment gives back some, or all, of a captured payment. The amount is a decimal string in
+// the payment's currency, or empty to refund everything not already refunded. A payment can be
+// refunded many times, as long as the refunds never add up to more than was captured. The refund
+// is recorded on the payment even when the bank declines it, in which case ErrDeclinedByBank is
+// returned alongside it. If the bank gives no answer nothing is recorded, and the Banker's error is returned.
+func (p *PaymentGatewayService) RefundPayment(ctx context.Context, merchantId string, paymentId data.PaymentID, amount string) (data.Refund, data.Payment, error) {
+	unlock := p.locks.lock(paymentId)
+	defer unlock()
+
+	payment, err := p.ownedPayment(merchantId, paymentId)
+	if err != nil {
+		return data.Refund{}, data.Payment{}, err
+	}
+	if payment.State != data.StateCaptured && payment.State != data.StatePartiallyRefunded {
+		return data.Refund{}, data.Payment{}, ErrInvalidState
+	}
+
+	// Work out how much to refund, which can never be more than is left of the captured amount
+	refundable := payment.RefundableAmount()
+	refundAmount := refundable
+	if amount != "" {
+		refundAmount, err = money.Parse(amount, payment.Amount.Currency)
+		if err != nil || !validation.ValidatePaymentAmount(refundAmount) {
+			return data.Refund{}, data.Payment{}, ErrInvalidAmount
+		}
+	}
+	if refundAmount.MinorUnits > refundable.MinorUnits {
+		return data.Refund{}, data.Payment{}, ErrAmountExceedsRefund
+	}
+
+	var refund data.Refund
+	refund.RefundID = data.RefundID(uuid.New())
+	refund.Amount = refundAmount
+	refund.CreatedAt = time.Now().UTC()
+	ctx, info, cancel := p.bankContext(ctx, payment, uuid.UUID(refund.RefundID).String())
+	defer cancel()
+	refund.Status, refund.BankRefundID, err = p.Banker.RefundPaymentWithBank(ctx, payment.BankPaymentID, refundAmount)
+	if err != nil {
+		return data.Refund{}, data.Payment{}, err
+	}
+	refund.BankAttempts = info.Attempts
+	payment.Refunds = append(payment.Refunds, refund)
+
+	// A declined refund is kept for the record, but leaves the payment as it was
+	if refund.Status != "Success" {
+		if err := p.PaymentStore.UpdatePayment(payment); err != nil {
+			return data.Refund{}, data.Payment{}, err
+		}
+		return refund, payment, ErrDeclinedByBank
+	}
+	state := data.StatePartiallyRefunded
+	if payment.RefundableAmount().MinorUnits == 0 {
+		state = data.StateRefunded
+	}
+	payment, err = p.transitionPayment(payment, state)
+	if err != nil {
+		return data.Refund{}, data.Payment{}, err
+	}
+	return refund, payment, nil
 }
 
-// MakePayment initiates a new payment transaction with the provided card data.
-func (p *PaymentGatewayService) MakePayment(cd data.CardData) data.PaymentID {
-	// Generate a payment id to record the payment
-	paymentId := data.PaymentID(uuid.New())
+// createPayment records a new payment with the given id and sends it to the bank, either to be
+// authorised and captured in one go, or only authorised. The card is given either by its number,
+// which is tokenised before anything is recorded, or by the token of a card the merchant tokenised
+// before. A payment that already has the id is left as it is, and data.ErrPaymentExists returned.
+func (p *PaymentGatewayService) createPayment(ctx context.Context, paymentId data.PaymentID, merchantId string, cd data.CardData, capture bool) (data.PaymentID, error) {
+	card, err := p.paymentCard(merchantId, cd)
+	if err != nil {
+		return paymentId, err
+	}
+
+	// Record the payment as pending before going to the bank, so there is a record of it
+	// even if we never hear back. Only the card's token and the details that are allowed to be
+	// kept are recorded, the card number and expiry date are held by the vault and the CVV
+	// passed to the bank
+	var payment data.Payment
+	payment.PaymentID = paymentId
+	payment.MerchantID = merchantId
+	payment.StoredCard = data.StoredCard{
+		CardToken:    card.Token,
+		CardLastFour: card.LastFour,
+		Amount:       cd.Amount,
+		Brand:        card.Brand,
+	}
+	payment.CapturedAmount = money.Money{Currency: cd.Amount.Currency}
+	payment.AutoCapture = capture
+	payment.Initiator = cd.Initiator
+	if payment.Initiator == "" {
+		payment.Initiator = data.CustomerInitiated
+	}
+	payment.CustomerID = cd.CustomerID
+	payment.CreatedAt = time.Now().UTC()
+	if err := payment.Transition(data.StatePending, payment.CreatedAt); err != nil {
+		return paymentId, err
+	}
+	// The payment is held locked while it is with the bank, so checking on pending payments
+	// never mistakes it for one whose answer was lost
+	unlock := p.locks.lock(paymentId)
+	defer unlock()
+	if err := p.PaymentStore.AddPayment(payment); err != nil {
+		return paymentId, err
+	}
+	p.publish(payment, 0)
 
 	// Use the embedded Banker interface to make a payment to the bank
 	// Note this also returns an UUID, which is our reference to the
 	// Payment for the bank
-	bstatus, bpid := p.Banker.MakePaymentToBank(cd)
+	// The payment id is sent as the reference, so the bank can spot any retries of the payment
+	ctx, info, cancel := p.bankContext(ctx, payment, idString(paymentId))
+	defer cancel()
+	var bstatus data.BankPaymentStatus
+	var bpid data.BankPaymentID
+	// The card number is only decrypted now, for as long as it takes to send it to the bank
+	bankCard := data.CardData{ExpiryDate: card.ExpiryDate, Amount: cd.Amount, Cvv: cd.Cvv, Brand: card.Brand, Token: card.Token, Initiator: payment.Initiator, CustomerID: cd.CustomerID}
+	var bankErr error
+	sent := false
+	bankCard.CardNumber, bankErr = p.Vault.Detokenise(merchantId, card.Token)
+	switch {
+	case bankErr != nil:
+		// A card number that cannot be decrypted is never sent, and the payment fails
+	case capture:
+		bstatus, bpid, bankErr = p.Banker.MakePaymentToBank(ctx, bankCard)
+		sent = true
+	default:
+		bstatus, bpid, bankErr = p.Banker.AuthorisePaymentWithBank(ctx, bankCard)
+		sent = true
+	}
+	payment.BankPaymentStatus = bstatus
+	payment.BankPaymentID = bpid
+	payment.BankAttempts = info.Attempts
+	payment.Acquirer = info.Acquirer
+
+	// Move the payment through the states that the bank's answer implies. A payment the bank is
+	// known not to have acted on has failed, while one whose answer was lost, such as to a
+	// timeout, may have been taken, so it stays pending until the bank is asked about it, see
+	// CheckPendingPayments
+	switch {
+	case bankErr == nil:
+		if err := p.settlePayment(&payment); err != nil {
+			return paymentId, err
+		}
+	case !sent || !outcomeUnknown(bankErr):
+		if err := payment.Transition(data.StateFailed, time.Now().UTC()); err != nil {
+			return paymentId, err
+		}
+	}
+	if err := p.PaymentStore.UpdatePayment(payment); err != nil {
+		return paymentId, err
+	}
+	p.publish(payment, 1)
+	// returns the payment id to the client, along with the reason the bank gave no answer
+	return paymentId, bankErr
+}
+
+// outcomeUnknown reports whether an error from the bank leaves it unknown whether the bank acted
+// on the call, as opposed to the bank turning it away or it never reaching the bank.
+func outcomeUnknown(err error) bool {
+	return !bank.Retryable(err) && !errors.Is(err, bank.ErrInvalidRequest)
+}
 
-	// Add the payment to the PaymentData
-	p.GatewayData.AddPayment(bstatus, bpid, paymentId, cd)
-	// returns the payment id to the client
-	return paymentId
+// paymentCard returns the vault's card for a new payment, tokenising the card number if the
+// payment was not made with a token. A token of another merchant returns vault.ErrTokenNotFound.
+func (p *PaymentGatewayService) paymentCard(merchantId string, cd data.CardData) (vault.Card, error) {
+	if cd.Token != "" {
+		return p.Vault.Card(merchantId, cd.Token)
+	}
+	var brand string
+	if b, ok := validation.DetectCardBrand(cd.CardNumber); ok {
+		brand = b.Name
+	}
+	return p.Vault.Tokenise(merchantId, cd.CardNumber, cd.ExpiryDate, brand)
+}
+
+// SavedCard returns the vault's card saved by the merchant's customer as the given payment method,
+// which can be paid with by its token. A customer or payment method that does not exist, or
+// belongs to another merchant, returns customers.ErrCustomerNotFound or
+// customers.ErrPaymentMethodNotFound.
+func (p *PaymentGatewayService) SavedCard(merchantId, customerId, paymentMethodId string) (vault.Card, error) {
+	method, err := p.Customers.PaymentMethod(merchantId, customerId, paymentMethodId)
+	if err != nil {
+		return vault.Card{}, err
+	}
+	return p.Vault.Card(merchantId, method.CardToken)
+}
+
+// ChargeSavedCard makes a payment, initiated by the merchant, with the card saved by the
+// merchant's customer as the given payment method, for a charge the customer agreed to when
+// they were not there, such as a subscription. The payment is made with the given id, and
+// charging again with the same id makes no new payment but returns the outcome of the one
+// already made, so a charge whose outcome was lost can safely be made again. It returns
+// billing.ChargePaid once the payment is captured and billing.ChargePending while the bank has
+// yet to decide on it, or while its outcome is unknown, such as when the bank's answer or the
+// payment itself could not be read. Otherwise the charge failed, and ErrDeclinedByBank is
+// returned if the bank declined it, the Banker's error if the bank turned it away, or
+// ErrPaymentFailed if the payment was made before and failed.
+func (p *PaymentGatewayService) ChargeSavedCard(ctx context.Context, paymentId, merchantId, customerId, paymentMethodId string, amount money.Money) (billing.ChargeStatus, error) {
+	id, err := uuid.Parse(paymentId)
+	if err != nil {
+		return billing.ChargeFailed, err
+	}
+	pId := data.PaymentID(id)
+	// A payment that cannot be read may have been made already, so the charge is left pending
+	// rather than failed and made again under another id
+	exists, payment, err := p.PaymentStore.RetrievePayment(pId)
+	if err != nil {
+		return billing.ChargePending, err
+	}
+	var chargeErr error
+	if !exists {
+		card, err := p.SavedCard(merchantId, customerId, paymentMethodId)
+		if err != nil {
+			return billing.ChargeFailed, err
+		}
+		cd := data.CardData{
+			ExpiryDate: card.ExpiryDate,
+			Amount:     amount,
+			Brand:      card.Brand,
+			Token:      card.Token,
+			Initiator:  data.MerchantInitiated,
+			CustomerID: customerId,
+		}
+		if ok, message := ValidatePayment(cd); !ok {
+			return billing.ChargeFailed, errors.New(message)
+		}
+		// A charge made with the same id at the same time finds the payment recorded, and waits
+		// for the next run to learn its outcome
+		if _, chargeErr = p.createPayment(ctx, pId, merchantId, cd, true); errors.Is(chargeErr, data.ErrPaymentExists) {
+			return billing.ChargePending, nil
+		}
+		if exists, payment, err = p.PaymentStore.RetrievePayment(pId); err != nil {
+			return billing.ChargePending, err
+		}
+		if !exists {
+			// The payment was refused before it was recorded
+			return billing.ChargeFailed, chargeErr
+		}
+	}
+	switch payment.State {
+	case data.StateCaptured, data.StatePartiallyRefunded, data.StateRefunded:
+		return billing.ChargePaid, nil
+	case data.StatePending:
+		return billing.ChargePending, nil
+	case data.StateDeclined:
+		return billing.ChargeFailed, ErrDeclinedByBank
+	}
+	if chargeErr == nil {
+		chargeErr = ErrPaymentFailed
+	}
+	return billing.ChargeFailed, chargeErr
+}
+
+// CompletePendingPayment records the decision of the named acquirer on a payment it answered as
+// pending, given in a notification from the bank. The notification must match the payment's
+// bank id, or the payment is reported as not found. A decision that was already recorded is
+// accepted again, so the bank can safely repeat its notifications, while one that contradicts
+// it returns ErrInvalidState.
+func (p *PaymentGatewayService) CompletePendingPayment(acquirer string, paymentId data.PaymentID, bpid data.BankPaymentID, status data.BankPaymentStatus) (data.Payment, error) {
+	unlock := p.locks.lock(paymentId)
+	defer unlock()
+
+	exists, payment, err := p.PaymentStore.RetrievePayment(paymentId)
+	if err != nil {
+		return data.Payment{}, err
+	}
+	if !exists || payment.Acquirer != acquirer || payment.BankPaymentID != bpid {
+		return data.Payment{}, data.ErrPaymentNotFound
+	}
+	return p.completePending(payment, status)
+}
+
+// CheckPendingPayments asks the bank for its decision on every payment that it answered as
+// pending more than olderThan ago, in case its notification never arrived, or whose answer was
+// lost, and records any decision it has made. It returns how many payments were decided, along with the last error
+// from the bank, after checking every payment.
+func (p *PaymentGatewayService) CheckPendingPayments(ctx context.Context, olderThan time.Duration) (int, error) {
+	payments, err := p.PaymentStore.PendingPayments()
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	decided := 0
+	var lastErr error
+	for _, payment := range payments {
+		if !awaitingBank(payment) || len(payment.History) == 0 || payment.History[len(payment.History)-1].At.After(cutoff) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return decided, err
+		}
+		ok, err := p.checkPendingPayment(ctx, payment.PaymentID)
+		if err != nil {
+			lastErr = err
+		} else if ok {
+			decided++
+		}
+	}
+	return decided, lastErr
+}
+
+// WatchPendingPayments checks the payments left pending with the bank at the given interval, see
+// CheckPendingPayments, until the context is done.
+func (p *PaymentGatewayService) WatchPendingPayments(ctx context.Context, interval, olderThan time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// A payment that could not be checked stays pending, so it is checked again next tick
+			if _, err := p.CheckPendingPayments(ctx, olderThan); err != nil {
+				log.Printf("Could not check pending payments with an error of: %v\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkPendingPayment asks the bank for its decision on a pending payment, recording it if
+// made, and reports whether it was. A payment whose answer was lost is looked up by the
+// reference it was sent with, and has failed if the bank never received it.
+func (p *PaymentGatewayService) checkPendingPayment(ctx context.Context, paymentId data.PaymentID) (bool, error) {
+	unlock := p.locks.lock(paymentId)
+	defer unlock()
+
+	// The decision may have been notified since the payments were listed
+	exists, payment, err := p.PaymentStore.RetrievePayment(paymentId)
+	if err != nil || !exists || !awaitingBank(payment) {
+		return false, err
+	}
+	ctx, _, cancel := p.bankContext(ctx, payment, idString(paymentId)+"/status")
+	defer cancel()
+	if payment.BankPaymentStatus == "" {
+		status, bpid, err := p.Banker.PaymentStatusByReference(ctx, idString(paymentId))
+		if errors.Is(err, bank.ErrNotFound) {
+			_, err = p.transitionPayment(payment, data.StateFailed)
+			return err == nil, err
+		}
+		if err != nil {
+			return false, err
+		}
+		// The bank's answer is recorded as if it had arrived in time, so that a payment it has
+		// yet to decide on is then checked, and notified, like any other pending payment
+		payment.BankPaymentID = bpid
+		payment.BankPaymentStatus = "Pending"
+		if status == "Pending" {
+			return false, p.PaymentStore.UpdatePayment(payment)
+		}
+		_, err = p.completePending(payment, status)
+		return err == nil, err
+	}
+	status, err := p.Banker.PaymentStatusFromBank(ctx, payment.BankPaymentID)
+	if err != nil || status == "Pending" {
+		return false, err
+	}
+	_, err = p.completePending(payment, status)
+	return err == nil, err
+}
+
+// awaitingBank reports whether the payment is pending the bank's decision, either because the
+// bank answered that it was pending or because its answer was lost.
+func awaitingBank(payment data.Payment) bool {
+	return payment.State == data.StatePending && (payment.BankPaymentStatus == "Pending" || payment.BankPaymentStatus == "")
+}
+
+// completePending records the bank's decision on a pending payment, which must be held locked.
+func (p *PaymentGatewayService) completePending(payment data.Payment, status data.BankPaymentStatus) (data.Payment, error) {
+	if payment.BankPaymentStatus != "Pending" {
+		if payment.BankPaymentStatus == status {
+			return payment, nil
+		}
+		return data.Payment{}, ErrInvalidState
+	}
+	if status == "Pending" {
+		return payment, nil
+	}
+	since := len(payment.History)
+	payment.BankPaymentStatus = status
+	if err := p.settlePayment(&payment); err != nil {
+		return data.Payment{}, err
+	}
+	if err := p.PaymentStore.UpdatePayment(payment); err != nil {
+		return data.Payment{}, err
+	}
+	p.publish(payment, since)
+	// The payment may be a subscription's charge, which is settled once the bank has decided on it
+	if payment.Initiator == data.MerchantInitiated && p.Billing != nil {
+		p.Billing.Wake()
+	}
+	return payment, nil
+}
+
+// settlePayment moves a pending payment through the states that the bank's answer implies,
+// recording what was captured or when the authorisation expires. A payment the bank has yet to
+// decide on stays pending.
+func (p *PaymentGatewayService) settlePayment(payment *data.Payment) error {
+	now := time.Now().UTC()
+	for _, state := range statesForBankStatus(payment.BankPaymentStatus, payment.AutoCapture) {
+		if err := payment.Transition(state, now); err != nil {
+			return err
+		}
+	}
+	switch payment.State {
+	case data.StateCaptured:
+		payment.CapturedAmount = payment.Amount
+	case data.StateAuthorised:
+		payment.AuthorisationExpiry = now.Add(p.AuthorisationExpiry)
+	}
+	return nil
+}
+
+// bankContext returns the context for a call to the bank about the payment, bounded by the
+// BankTimeout, and the CallInfo it carries. The reference identifies the operation to the bank,
+// and the CallInfo reports how many attempts were made, and with which acquirer, once the call returns.
+func (p *PaymentGatewayService) bankContext(ctx context.Context, payment data.Payment, reference string) (context.Context, *bank.CallInfo, context.CancelFunc) {
+	// A Banker that does not retry makes a single attempt, and changes to a payment go to the
+	// acquirer that made it
+	info := &bank.CallInfo{Reference: reference, MerchantID: payment.MerchantID, Acquirer: payment.Acquirer, Attempts: 1}
+	ctx = bank.WithCallInfo(ctx, info)
+	if p.BankTimeout <= 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, info, cancel
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.BankTimeout)
+	return ctx, info, cancel
+}
+
+// idString formats a PaymentID as its canonical UUID string.
+func idString(paymentId data.PaymentID) string {
+	return uuid.UUID(paymentId).String()
+}
+
+// ownedPayment fetches the payment, reporting it as not found if it belongs to another merchant.
+func (p *PaymentGatewayService) ownedPayment(merchantId string, paymentId data.PaymentID) (data.Payment, error) {
+	exists, payment, err := p.PaymentStore.RetrievePayment(paymentId)
+	if err != nil {
+		return data.Payment{}, err
+	}
+	if !exists || payment.MerchantID != merchantId {
+		return data.Payment{}, data.ErrPaymentNotFound
+	}
+	return payment, nil
+}
+
+// transitionPayment moves the payment to a new state, stores it and returns the result.
+func (p *PaymentGatewayService) transitionPayment(payment data.Payment, state data.PaymentState) (data.Payment, error) {
+	since := len(payment.History)
+	if err := payment.Transition(state, time.Now().UTC()); err != nil {
+		return data.Payment{}, err
+	}
+	if err := p.PaymentStore.UpdatePayment(payment); err != nil {
+		return data.Payment{}, err
+	}
+	p.publish(payment, since)
+	return payment, nil
+}
+
+// publish queues webhook events for the state transitions the payment has made after the
+// first since of its history, once the payment has been stored.
+func (p *PaymentGatewayService) publish(payment data.Payment, since int) {
+	if p.Webhooks == nil || since >= len(payment.History) {
+		return
+	}
+	p.Webhooks.PaymentChanged(payment, payment.History[since:])
+}
+
+// statesForBankStatus returns the states a pending payment moves through for the bank's answer.
+// A successful one-shot payment is both authorised and captured by the bank in one go.
+func statesForBankStatus(bstatus data.BankPaymentStatus, capture bool) []data.PaymentState {
+	switch bstatus {
+	case "Success":
+		if capture {
+			return []data.PaymentState{data.StateAuthorised, data.StateCaptured}
+		}
+		return []data.PaymentState{data.StateAuthorised}
+	case "Failure":
+		return []data.PaymentState{data.StateDeclined}
+	case "Pending":
+		return nil
+	default:
+		return []data.PaymentState{data.StateFailed}
+	}
 }
 
 // ValidatePayment validates the card data before processing the payment.
 func ValidatePayment(cd data.CardData) (bool, string) {
-	// Validate card number using Luhn's algorithm
-	if !validation.LuhnCheck(cd.CardNumber) {
-		return false, "Invalid card number"
+	// A tokenised card had its number checked when it was tokenised, and its expiry date and
+	// brand filled in from the vault. Its CVV is optional, as it is often not asked for again
+	var brand validation.CardBrand
+	if cd.Token == "" {
+		if ok, message := ValidateCard(cd.CardNumber, cd.ExpiryDate); !ok {
+			return false, message
+		}
+		brand, _ = validation.DetectCardBrand(cd.CardNumber)
+	} else {
+		if !validation.ValidateExpirationDate(cd.ExpiryDate) {
+			return false, "Card has expired"
+		}
+		brand, _ = validation.LookupCardBrand(cd.Brand)
 	}
-	// Validate expiration date of the card
-	if !validation.ValidateExpirationDate(cd.ExpiryDate) {
-		return false, "Card has expired"
+	// A payment the merchant starts is made with a card the cardholder saved, without them there
+	// to give its CVV
+	switch cd.Initiator {
+	case "", data.CustomerInitiated:
+	case data.MerchantInitiated:
+		if cd.Token == "" {
+			return false, "Merchant-initiated payments must be made with a saved card"
+		}
+		if cd.Cvv != "" {
+			return false, "cvv cannot be given with a merchant-initiated payment"
+		}
+	default:
+		return false, "Invalid initiated-by"
 	}
 	// Validate CVV number of the card
-	if !validation.ValidateCVV(cd.Cvv) {
+	if (cd.Token == "" || cd.Cvv != "") && !validation.ValidateCVV(cd.Cvv, brand) {
 		return false, "Invalid CVV"
 	}
+	// Validate the currency of the payment
+	if !validation.ValidateCurrency(cd.Amount.Currency) {
+		return false, "Invalid currency"
+	}
 	// Validate payment amount
 	if !validation.ValidatePaymentAmount(cd.Amount) {
 		return false, "Invalid payment amount"
@@ -68,3 +721,25 @@ func ValidatePayment(cd data.CardData) (bool, string) {
 	// If all validations pass, return true and an empty error message
 	return true, ""
 }
+
+// ValidateCard checks the card number and expiry date of a card, as given by the merchant,
+// and returns a message describing the first problem found.
+func ValidateCard(cardNumber, expiryDate string) (bool, string) {
+	// Validate card number using Luhn's algorithm
+	if !validation.LuhnCheck(cardNumber) {
+		return false, "Invalid card number"
+	}
+	// Identify the card scheme from the leading digits, and check the length against its rules
+	brand, ok := validation.DetectCardBrand(cardNumber)
+	if !ok {
+		return false, "Unsupported card brand"
+	}
+	if !validation.ValidateCardLength(cardNumber, brand) {
+		return false, "Invalid card number"
+	}
+	// Validate expiration date of the card
+	if !validation.ValidateExpirationDate(expiryDate) {
+		return false, "Card has expired"
+	}
+	return true, ""
+}
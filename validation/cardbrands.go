@@ -0,0 +1,110 @@
+package validation
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CardBrand describes a card scheme and the rules its card numbers follow.
+type CardBrand struct {
+	Name      string // The display name of the scheme, e.g. Visa
+	Lengths   []int  // The valid lengths of the card number (PAN) for the scheme
+	CvvLength int    // The number of digits in the scheme's card security code
+}
+
+// The card schemes supported by the gateway.
+var (
+	Visa            = CardBrand{Name: "Visa", Lengths: []int{13, 16, 19}, CvvLength: 3}
+	Mastercard      = CardBrand{Name: "Mastercard", Lengths: []int{16}, CvvLength: 3}
+	AmericanExpress = CardBrand{Name: "American Express", Lengths: []int{15}, CvvLength: 4}
+	Discover        = CardBrand{Name: "Discover", Lengths: []int{16, 17, 18, 19}, CvvLength: 3}
+	JCB             = CardBrand{Name: "JCB", Lengths: []int{16, 17, 18, 19}, CvvLength: 3}
+	UnionPay        = CardBrand{Name: "UnionPay", Lengths: []int{16, 17, 18, 19}, CvvLength: 3}
+	Maestro         = CardBrand{Name: "Maestro", Lengths: []int{12, 13, 14, 15, 16, 17, 18, 19}, CvvLength: 3}
+)
+
+// brands holds every supported card scheme, by name.
+var brands = map[string]CardBrand{
+	Visa.Name:            Visa,
+	Mastercard.Name:      Mastercard,
+	AmericanExpress.Name: AmericanExpress,
+	Discover.Name:        Discover,
+	JCB.Name:             JCB,
+	UnionPay.Name:        UnionPay,
+	Maestro.Name:         Maestro,
+}
+
+// LookupCardBrand returns the card scheme with the given name, whatever its case, and whether it
+// is supported.
+func LookupCardBrand(name string) (CardBrand, bool) {
+	if brand, ok := brands[name]; ok {
+		return brand, true
+	}
+	for _, brand := range brands {
+		if strings.EqualFold(brand.Name, name) {
+			return brand, true
+		}
+	}
+	return CardBrand{}, false
+}
+
+// binRange is an inclusive range of issuer identification numbers, compared against the
+// first digits of a card number, that belong to a card scheme.
+type binRange struct {
+	low, high int       // The bounds of the range, both with the same number of digits
+	digits    int       // The number of leading digits of the card number compared with the range
+	brand     CardBrand // The scheme the range belongs to
+}
+
+// binRanges is the table of issuer identification number ranges used to detect a card's scheme.
+// Ranges overlap, e.g. Discover's 622126-622925 sits inside UnionPay's 62, in which case the
+// range comparing the most digits wins.
+var binRanges = []binRange{
+	{4, 4, 1, Visa},
+	{51, 55, 2, Mastercard},
+	{2221, 2720, 4, Mastercard},
+	{34, 34, 2, AmericanExpress},
+	{37, 37, 2, AmericanExpress},
+	{6011, 6011, 4, Discover},
+	{644, 649, 3, Discover},
+	{65, 65, 2, Discover},
+	{622126, 622925, 6, Discover},
+	{3528, 3589, 4, JCB},
+	{62, 62, 2, UnionPay},
+	{81, 81, 2, UnionPay},
+	{5018, 5018, 4, Maestro},
+	{5020, 5020, 4, Maestro},
+	{5038, 5038, 4, Maestro},
+	{5893, 5893, 4, Maestro},
+	{6304, 6304, 4, Maestro},
+	{6759, 6759, 4, Maestro},
+	{6761, 6763, 4, Maestro},
+}
+
+// DetectCardBrand identifies the card scheme from the leading digits of the card number.
+func DetectCardBrand(cardNumber string) (CardBrand, bool) {
+	var match binRange
+	for _, r := range binRanges {
+		if len(cardNumber) < r.digits || r.digits <= match.digits {
+			continue
+		}
+		prefix, err := strconv.Atoi(cardNumber[:r.digits])
+		if err != nil {
+			continue
+		}
+		if prefix >= r.low && prefix <= r.high {
+			match = r
+		}
+	}
+	return match.brand, match.digits > 0
+}
+
+// ValidateCardLength checks if the card number has a valid length for its scheme.
+func ValidateCardLength(cardNumber string, brand CardBrand) bool {
+	for _, length := range brand.Lengths {
+		if len(cardNumber) == length {
+			return true
+		}
+	}
+	return false
+}
@@ -1,7 +1,7 @@
 package validation
 
 import (
-	"fmt"
+	"payment-gateway/money"
 	"regexp"
 	"strconv"
 	"time"
@@ -42,23 +42,25 @@ func ValidateExpirationDate(expiry string) bool {
 	return expDate.After(now)
 }
 
-// ValidateCVV checks if the CVV of the credit card is valid.
-func ValidateCVV(cvv string) bool {
-	// Assuming CVV should be a 3 or 4 digit number
-	return regexp.MustCompile(`^\d{3,4}$`).MatchString(cvv)
+// ValidateCVV checks if the CVV of the credit card is valid for the card's scheme.
+func ValidateCVV(cvv string, brand CardBrand) bool {
+	// The CVV should be a number with as many digits as the scheme uses, 4 for Amex and 3 otherwise
+	return len(cvv) == brand.CvvLength && regexp.MustCompile(`^\d+$`).MatchString(cvv)
+}
+
+// ValidateCurrency checks if the currency is an active ISO 4217 currency. The code must
+// already be normalised to upper case, see money.NormaliseCurrency.
+func ValidateCurrency(currency string) bool {
+	c, ok := money.LookupCurrency(currency)
+	return ok && c.Active
 }
 
 // ValidatePaymentAmount checks if the payment amount is valid.
-func ValidatePaymentAmount(amount float64) bool {
+// The number of decimal places is checked when the amount is parsed into Money, as once it is
+// held in minor units there is no way to express a fraction of the minor unit.
+func ValidatePaymentAmount(amount money.Money) bool {
 	// Assuming the amount should be a positive value.
-	if amount <= 0.0 {
-		return false
-	}
-	// Check if the amount has at most two decimal places.
-	amountStr := fmt.Sprintf("%.2f", amount)
-	// Check if the amount string has exactly two decimal places using a regular expression.
-	amountRegex := regexp.MustCompile(`^\d+\.\d{2}$`)
-	return amountRegex.MatchString(amountStr)
+	return amount.MinorUnits > 0
 	// We can add more sophisticated validations here if needed.
 	// For example, checking if the amount is within a valid range, bank of the card holder, etc
 }
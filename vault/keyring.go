@@ -0,0 +1,72 @@
+package vault
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Keyring holds the key-encryption keys of a vault. Cards are encrypted under the primary key,
+// and can be decrypted with any key on the keyring, so a new key can be made primary while cards
+// encrypted under the old ones are still in use, until they are rotated to it with Vault.Rotate.
+type Keyring struct {
+	primary Key            // The key new cards, and rotated cards, are encrypted under
+	keys    map[string]Key // Every key on the keyring, by id, including the primary one
+}
+
+// keyringFile is the layout of a keyring file.
+type keyringFile struct {
+	Keys []string `json:"keys"` // The hex encoded secrets of the keys, the first being the primary one
+}
+
+// NewKeyring creates a Keyring with the given primary key, and older keys that cards may still
+// be encrypted under.
+func NewKeyring(primary Key, older ...Key) *Keyring {
+	k := &Keyring{primary: primary, keys: map[string]Key{primary.ID: primary}}
+	for _, key := range older {
+		k.keys[key.ID] = key
+	}
+	return k
+}
+
+// LoadKeyring reads the Keyring in the JSON file at path, which lists the hex encoded secrets of
+// its keys as "keys", the first of them being the primary key.
+func LoadKeyring(path string) (*Keyring, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config keyringFile
+	if err := json.Unmarshal(file, &config); err != nil {
+		return nil, err
+	}
+	if len(config.Keys) == 0 {
+		return nil, errors.New("keyring has no keys")
+	}
+	keys := make([]Key, 0, len(config.Keys))
+	for i, encoded := range config.Keys {
+		secret, err := hex.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i+1, err)
+		}
+		key, err := NewKey(secret)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i+1, err)
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys[0], keys[1:]...), nil
+}
+
+// Primary returns the key cards are encrypted under.
+func (k *Keyring) Primary() Key {
+	return k.primary
+}
+
+// Key returns the key with the given id, and whether it is on the keyring.
+func (k *Keyring) Key(id string) (Key, bool) {
+	key, ok := k.keys[id]
+	return key, ok
+}
@@ -0,0 +1,98 @@
+package vault
+
+import (
+	"database/sql"
+	"errors"
+	"payment-gateway/data"
+	"time"
+)
+
+// SQLStore is a Store backed by a relational database, alongside the payments of a data.SQLStore.
+// Its table is created by the data package's migrations.
+type SQLStore struct {
+	db *sql.DB // Handle to the database, which is safe for concurrent use
+}
+
+// NewSQLStore creates a SQLStore using the given database, applying any outstanding schema
+// migrations before returning.
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	if err := data.Migrate(db); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// selectCards is the query shared by every read of cards.
+const selectCards = `SELECT token, merchant_id, last_four, expiry_date, brand, created_at, format, key_id, wrapped_key, ciphertext FROM vault_cards`
+
+// AddCard adds a new card.
+func (s *SQLStore) AddCard(record Record) error {
+	_, err := s.db.Exec(`INSERT INTO vault_cards (token, merchant_id, last_four, expiry_date, brand, created_at, format, key_id, wrapped_key, ciphertext) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.Token, record.MerchantID, record.LastFour, record.ExpiryDate, record.Brand, record.CreatedAt.UTC().Format(time.RFC3339Nano),
+		record.Format, record.KeyID, record.WrappedKey, record.Ciphertext)
+	return err
+}
+
+// RetrieveCard returns the card with the given token, and whether it was found.
+func (s *SQLStore) RetrieveCard(token string) (bool, Record, error) {
+	record, err := scanCard(s.db.QueryRow(selectCards+` WHERE token = ?`, token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, Record{}, nil
+	}
+	if err != nil {
+		return false, Record{}, err
+	}
+	return true, record, nil
+}
+
+// UpdateCard replaces the card with the same token.
+func (s *SQLStore) UpdateCard(record Record) error {
+	result, err := s.db.Exec(`UPDATE vault_cards SET merchant_id = ?, last_four = ?, expiry_date = ?, brand = ?, created_at = ?, format = ?, key_id = ?, wrapped_key = ?, ciphertext = ? WHERE token = ?`,
+		record.MerchantID, record.LastFour, record.ExpiryDate, record.Brand, record.CreatedAt.UTC().Format(time.RFC3339Nano),
+		record.Format, record.KeyID, record.WrappedKey, record.Ciphertext, record.Token)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// ListCards returns every card, oldest first.
+func (s *SQLStore) ListCards() ([]Record, error) {
+	rows, err := s.db.Query(selectCards + ` ORDER BY created_at, token`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []Record{}
+	for rows.Next() {
+		record, err := scanCard(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanCard reads a row produced by selectCards into a Record.
+func scanCard(row scanner) (Record, error) {
+	var record Record
+	var createdAt string
+	err := row.Scan(&record.Token, &record.MerchantID, &record.LastFour, &record.ExpiryDate, &record.Brand, &createdAt,
+		&record.Format, &record.KeyID, &record.WrappedKey, &record.Ciphertext)
+	if err != nil {
+		return record, err
+	}
+	record.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+	return record, err
+}
@@ -0,0 +1,141 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"payment-gateway/data"
+	"sort"
+	"sync"
+)
+
+// ErrCardExists is returned when a card is added with a token that is already in use.
+var ErrCardExists = errors.New("card token already exists")
+
+// Store is the interface that defines the contract for where encrypted cards are kept.
+type Store interface {
+	AddCard(record Record) error
+	RetrieveCard(token string) (bool, Record, error)
+	UpdateCard(record Record) error
+	ListCards() ([]Record, error)
+}
+
+// MemoryStore is a Store held in memory. When it has a path, every change is also written to a
+// JSON snapshot at the path, which is read back when the store is opened again.
+type MemoryStore struct {
+	Cards map[string]Record // A map that associates the card token with its encrypted card
+
+	path string     // Where the snapshot is written, empty to keep the store in memory only
+	mu   sync.Mutex // Mutex to protect concurrent access to the store
+}
+
+// NewMemoryStore creates an empty MemoryStore that is only held in memory.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{Cards: make(map[string]Record)}
+}
+
+// NewFileStore opens the MemoryStore snapshotted at path, creating an empty one if there is
+// no snapshot yet.
+func NewFileStore(path string) (*MemoryStore, error) {
+	s := NewMemoryStore()
+	file, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(file, s); err != nil {
+			return nil, err
+		}
+	}
+	s.path = path
+	return s, nil
+}
+
+// AddCard adds a new card.
+func (s *MemoryStore) AddCard(record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Cards[record.Token]; ok {
+		return ErrCardExists
+	}
+	s.Cards[record.Token] = record
+	if err := s.save(); err != nil {
+		delete(s.Cards, record.Token)
+		return err
+	}
+	return nil
+}
+
+// RetrieveCard returns the card with the given token, and whether it was found.
+func (s *MemoryStore) RetrieveCard(token string) (bool, Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.Cards[token]
+	return ok, record, nil
+}
+
+// UpdateCard replaces the card with the same token.
+func (s *MemoryStore) UpdateCard(record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.Cards[record.Token]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	s.Cards[record.Token] = record
+	if err := s.save(); err != nil {
+		s.Cards[record.Token] = previous
+		return err
+	}
+	return nil
+}
+
+// ListCards returns every card, oldest first.
+func (s *MemoryStore) ListCards() ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]Record, 0, len(s.Cards))
+	for _, record := range s.Cards {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].CreatedAt.Equal(records[j].CreatedAt) {
+			return records[i].CreatedAt.Before(records[j].CreatedAt)
+		}
+		return records[i].Token < records[j].Token
+	})
+	return records, nil
+}
+
+// save writes the store to its snapshot, if it has one, by way of a temporary file renamed into
+// place. It must be called with the mutex held.
+func (s *MemoryStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	snapshot, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	return data.SyncDir(filepath.Dir(s.path))
+}
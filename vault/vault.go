@@ -0,0 +1,284 @@
+// Package vault exchanges card numbers for opaque tokens, so the rest of the gateway never has to
+// hold one. Each card number is encrypted with AES-GCM under its own data key, and the data key is
+// in turn encrypted, or wrapped, with a key-encryption key that is never stored alongside the cards.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// KeySize is the length in bytes of key-encryption keys and data keys, which are AES-256 keys.
+const KeySize = 32
+
+// tokenPrefix marks card tokens, so they are easily told apart from card numbers.
+const tokenPrefix = "tok_"
+
+// Errors returned by the Vault.
+var (
+	ErrTokenNotFound = errors.New("card token not found")
+	ErrUnknownKey    = errors.New("card was encrypted under a key that is not on the keyring")
+	ErrInvalidKey    = fmt.Errorf("key-encryption key must be %d bytes", KeySize)
+)
+
+// Key is a key-encryption key, which wraps the data keys cards are encrypted with.
+type Key struct {
+	ID     string // Fingerprint of the key, recorded with every card it wraps the data key of
+	Secret []byte // The AES-256 key itself
+}
+
+// NewKey creates a Key from its secret.
+func NewKey(secret []byte) (Key, error) {
+	if len(secret) != KeySize {
+		return Key{}, ErrInvalidKey
+	}
+	fingerprint := sha256.Sum256(secret)
+	return Key{ID: hex.EncodeToString(fingerprint[:8]), Secret: secret}, nil
+}
+
+// GenerateKey creates a new random Key.
+func GenerateKey() (Key, error) {
+	secret := make([]byte, KeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
+	}
+	return NewKey(secret)
+}
+
+// Formats a Record can be encrypted in.
+const (
+	FormatCardNumber = 0 // Only the card number is encrypted, and the expiry date kept in the clear, as cards were first tokenised
+	FormatSealedCard = 1 // The card number and expiry date are encrypted together, as a sealedCard
+)
+
+// Card is what the vault tells about a tokenised card, which is safe to show anywhere.
+type Card struct {
+	Token      string    // The opaque token standing in for the card number
+	MerchantID string    // The merchant that tokenised the card, who alone can use the token
+	LastFour   string    // The last four digits of the card number
+	ExpiryDate string    // The expiry date of the card, MM/YY, which is only kept encrypted
+	Brand      string    // The card scheme, e.g. Visa
+	CreatedAt  time.Time // When the card was tokenised
+}
+
+// Record is a card as it is kept in a Store, with its card number and expiry date encrypted.
+type Record struct {
+	Card              // The details of the card that are not secret, the expiry date is left empty
+	Format     int    // How the card is encrypted, FormatSealedCard unless it is yet to be rotated
+	KeyID      string // The id of the key-encryption key the data key is wrapped with
+	WrappedKey []byte // The card's data key, encrypted with the key-encryption key
+	Ciphertext []byte // The card number and expiry date, encrypted with the data key
+}
+
+// sealedCard is the secret part of a card, which is encrypted as JSON.
+type sealedCard struct {
+	CardNumber string `json:"card-number"`
+	ExpiryDate string `json:"expiry-date"`
+}
+
+// Vault tokenises cards and keeps them, encrypted, in a Store.
+type Vault struct {
+	Store                  // Embedding Store to keep the encrypted cards
+	Clock func() time.Time // Source of the current time, replaceable in tests
+
+	keys *Keyring // The key-encryption keys data keys are wrapped with
+}
+
+// New creates a Vault keeping cards in the store, with their data keys wrapped by the keys.
+func New(store Store, keys *Keyring) *Vault {
+	return &Vault{Store: store, Clock: time.Now, keys: keys}
+}
+
+// Tokenise encrypts and stores the card for the merchant, and returns the card with its new token.
+// The brand is worked out by the caller, which has already validated the card.
+func (v *Vault) Tokenise(merchantId, cardNumber, expiryDate, brand string) (Card, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return Card{}, err
+	}
+	lastFour := cardNumber
+	if len(cardNumber) > 4 {
+		lastFour = cardNumber[len(cardNumber)-4:]
+	}
+	card := Card{
+		Token:      tokenPrefix + hex.EncodeToString(token),
+		MerchantID: merchantId,
+		LastFour:   lastFour,
+		Brand:      brand,
+		CreatedAt:  v.Clock().UTC(),
+	}
+	record, err := v.sealCard(card, sealedCard{CardNumber: cardNumber, ExpiryDate: expiryDate})
+	if err != nil {
+		return Card{}, err
+	}
+	if err := v.Store.AddCard(record); err != nil {
+		return Card{}, err
+	}
+	card.ExpiryDate = expiryDate
+	return card, nil
+}
+
+// Card returns the merchant's card with the given token, decrypting its expiry date but not
+// handing out its card number.
+func (v *Vault) Card(merchantId, token string) (Card, error) {
+	record, err := v.record(merchantId, token)
+	if err != nil {
+		return Card{}, err
+	}
+	secret, err := v.openCard(record)
+	if err != nil {
+		return Card{}, err
+	}
+	card := record.Card
+	card.ExpiryDate = secret.ExpiryDate
+	return card, nil
+}
+
+// Detokenise decrypts and returns the card number of the merchant's card with the given token.
+func (v *Vault) Detokenise(merchantId, token string) (string, error) {
+	record, err := v.record(merchantId, token)
+	if err != nil {
+		return "", err
+	}
+	secret, err := v.openCard(record)
+	if err != nil {
+		return "", err
+	}
+	return secret.CardNumber, nil
+}
+
+// Rotate re-encrypts every card that is not encrypted under the primary key, or is in an older
+// format, under the primary key with a new data key, and returns how many were. Cards are rotated
+// one at a time, and each can still be decrypted before and after, so the gateway can keep
+// serving payments throughout as long as its keyring holds both the old and new keys.
+func (v *Vault) Rotate() (int, error) {
+	records, err := v.Store.ListCards()
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for _, record := range records {
+		if record.KeyID == v.keys.Primary().ID && record.Format == FormatSealedCard {
+			continue
+		}
+		secret, err := v.openCard(record)
+		if err != nil {
+			return rotated, fmt.Errorf("card %s: %w", record.Token, err)
+		}
+		resealed, err := v.sealCard(record.Card, secret)
+		if err != nil {
+			return rotated, err
+		}
+		if err := v.Store.UpdateCard(resealed); err != nil {
+			return rotated, fmt.Errorf("card %s: %w", record.Token, err)
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+// record returns the merchant's record with the given token. Tokens of other merchants are
+// reported as not found, the same as tokens that do not exist.
+func (v *Vault) record(merchantId, token string) (Record, error) {
+	ok, record, err := v.Store.RetrieveCard(token)
+	if err != nil {
+		return Record{}, err
+	}
+	if !ok || record.MerchantID != merchantId {
+		return Record{}, ErrTokenNotFound
+	}
+	return record, nil
+}
+
+// sealCard encrypts the secret part of the card under a new data key, wrapped with the primary key.
+// The token is authenticated along with both ciphertexts, so neither can be moved to another card.
+func (v *Vault) sealCard(card Card, secret sealedCard) (Record, error) {
+	plaintext, err := json.Marshal(secret)
+	if err != nil {
+		return Record{}, err
+	}
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return Record{}, err
+	}
+	ciphertext, err := seal(dataKey, plaintext, []byte(card.Token))
+	if err != nil {
+		return Record{}, err
+	}
+	kek := v.keys.Primary()
+	wrappedKey, err := seal(kek.Secret, dataKey, []byte(card.Token))
+	if err != nil {
+		return Record{}, err
+	}
+	card.ExpiryDate = ""
+	return Record{Card: card, Format: FormatSealedCard, KeyID: kek.ID, WrappedKey: wrappedKey, Ciphertext: ciphertext}, nil
+}
+
+// openCard decrypts the secret part of the card, with whichever key on the keyring it was sealed under.
+func (v *Vault) openCard(record Record) (sealedCard, error) {
+	kek, ok := v.keys.Key(record.KeyID)
+	if !ok {
+		return sealedCard{}, ErrUnknownKey
+	}
+	dataKey, err := open(kek.Secret, record.WrappedKey, []byte(record.Token))
+	if err != nil {
+		return sealedCard{}, fmt.Errorf("unwrapping data key: %w", err)
+	}
+	plaintext, err := open(dataKey, record.Ciphertext, []byte(record.Token))
+	if err != nil {
+		return sealedCard{}, fmt.Errorf("decrypting card: %w", err)
+	}
+	// Cards tokenised before expiry dates were encrypted kept theirs in the clear
+	if record.Format == FormatCardNumber {
+		return sealedCard{CardNumber: string(plaintext), ExpiryDate: record.ExpiryDate}, nil
+	}
+	var secret sealedCard
+	if err := json.Unmarshal(plaintext, &secret); err != nil {
+		return sealedCard{}, fmt.Errorf("decrypting card: %w", err)
+	}
+	return secret, nil
+}
+
+// seal encrypts plaintext with AES-GCM under key, returning the random nonce followed by the
+// ciphertext. The additional data is authenticated but not encrypted.
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts and authenticates a ciphertext written by seal.
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// newGCM creates an AES-GCM cipher with the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,65 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// publicAddress reports whether the address is on the public internet, rather than being a
+// loopback, private, link-local, multicast or unspecified address that would let a merchant have
+// the gateway send requests into its own network.
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// checkHost resolves the host of an endpoint being registered, returning ErrPrivateURL unless
+// every address it resolves to is public.
+func (d *Dispatcher) checkHost(host string) error {
+	if d.AllowPrivateNetworks {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPrivateURL, err)
+	}
+	for _, addr := range addrs {
+		if !publicAddress(addr.IP) {
+			return ErrPrivateURL
+		}
+	}
+	return nil
+}
+
+// checkDial is the net.Dialer's Control function for deliveries, which refuses to connect to an
+// address that is not public. It is checked against the address actually dialled, so a host that
+// resolved to a public address when it was registered cannot be pointed at a private one later.
+func (d *Dispatcher) checkDial(network, address string, c syscall.RawConn) error {
+	if d.AllowPrivateNetworks {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateURL, host)
+	}
+	return nil
+}
+
+// newClient returns the client deliveries are sent with, which only connects to public addresses.
+func (d *Dispatcher) newClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second, Control: d.checkDial}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would connect to the endpoint on the gateway's behalf, out of sight of checkDial
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
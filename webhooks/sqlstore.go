@@ -0,0 +1,175 @@
+package webhooks
+
+import (
+	"database/sql"
+	"errors"
+	"payment-gateway/data"
+	"time"
+)
+
+// SQLStore is a Store backed by a relational database, alongside the payments of a data.SQLStore.
+// Its tables are created by the data package's migrations.
+type SQLStore struct {
+	db *sql.DB // Handle to the database, which is safe for concurrent use
+}
+
+// selectDeliveries is the query shared by every read of deliveries.
+const selectDeliveries = `SELECT delivery_id, merchant_id, endpoint_id, url, event_id, event_type, payload, status, attempts, next_attempt, last_error, created_at
+	FROM webhook_deliveries`
+
+// NewSQLStore creates a SQLStore using the given database, applying any outstanding schema
+// migrations before returning.
+func NewSQLStore(db *sql.DB) (*SQLStore, error) {
+	if err := data.Migrate(db); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// AddEndpoint adds a new endpoint.
+func (s *SQLStore) AddEndpoint(endpoint Endpoint) error {
+	_, err := s.db.Exec(`INSERT INTO webhook_endpoints (endpoint_id, merchant_id, url, secret, created_at) VALUES (?, ?, ?, ?, ?)`,
+		endpoint.ID, endpoint.MerchantID, endpoint.URL, endpoint.Secret, endpoint.CreatedAt.UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+// RetrieveEndpoint returns the endpoint with the given id, and whether it was found.
+func (s *SQLStore) RetrieveEndpoint(endpointId string) (bool, Endpoint, error) {
+	endpoint, err := scanEndpoint(s.db.QueryRow(`SELECT endpoint_id, merchant_id, url, secret, created_at FROM webhook_endpoints WHERE endpoint_id = ?`, endpointId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, Endpoint{}, nil
+	}
+	if err != nil {
+		return false, Endpoint{}, err
+	}
+	return true, endpoint, nil
+}
+
+// ListEndpoints returns the merchant's endpoints, oldest first.
+func (s *SQLStore) ListEndpoints(merchantId string) ([]Endpoint, error) {
+	rows, err := s.db.Query(`SELECT endpoint_id, merchant_id, url, secret, created_at FROM webhook_endpoints WHERE merchant_id = ? ORDER BY created_at, endpoint_id`, merchantId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	endpoints := []Endpoint{}
+	for rows.Next() {
+		endpoint, err := scanEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, rows.Err()
+}
+
+// DeleteEndpoint removes the endpoint with the given id.
+func (s *SQLStore) DeleteEndpoint(endpointId string) error {
+	result, err := s.db.Exec(`DELETE FROM webhook_endpoints WHERE endpoint_id = ?`, endpointId)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrEndpointNotFound
+	}
+	return nil
+}
+
+// AddDelivery queues a new delivery.
+func (s *SQLStore) AddDelivery(delivery Delivery) error {
+	_, err := s.db.Exec(`INSERT INTO webhook_deliveries (delivery_id, merchant_id, endpoint_id, url, event_id, event_type, payload, status, attempts, next_attempt, last_error, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		delivery.ID, delivery.MerchantID, delivery.EndpointID, delivery.URL, delivery.EventID, delivery.EventType, delivery.Payload,
+		string(delivery.Status), delivery.Attempts, delivery.NextAttempt.UnixNano(), delivery.LastError, delivery.CreatedAt.UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+// RetrieveDelivery returns the delivery with the given id, and whether it was found.
+func (s *SQLStore) RetrieveDelivery(deliveryId string) (bool, Delivery, error) {
+	delivery, err := scanDelivery(s.db.QueryRow(selectDeliveries+` WHERE delivery_id = ?`, deliveryId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, Delivery{}, nil
+	}
+	if err != nil {
+		return false, Delivery{}, err
+	}
+	return true, delivery, nil
+}
+
+// UpdateDelivery replaces the status, attempts and errors of an existing delivery.
+func (s *SQLStore) UpdateDelivery(delivery Delivery) error {
+	result, err := s.db.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt = ?, last_error = ? WHERE delivery_id = ?`,
+		string(delivery.Status), delivery.Attempts, delivery.NextAttempt.UnixNano(), delivery.LastError, delivery.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
+
+// ListDeliveries returns the merchant's deliveries with the given status, oldest first.
+func (s *SQLStore) ListDeliveries(merchantId string, status DeliveryStatus) ([]Delivery, error) {
+	return s.readDeliveries(`WHERE merchant_id = ? AND status = ?`, merchantId, string(status))
+}
+
+// DueDeliveries returns the pending deliveries whose next attempt is due by now, oldest first.
+func (s *SQLStore) DueDeliveries(now time.Time) ([]Delivery, error) {
+	return s.readDeliveries(`WHERE status = ? AND next_attempt <= ?`, string(DeliveryPending), now.UnixNano())
+}
+
+// readDeliveries returns the deliveries matching the where clause, in the order they were queued.
+func (s *SQLStore) readDeliveries(where string, args ...interface{}) ([]Delivery, error) {
+	rows, err := s.db.Query(selectDeliveries+` `+where+` ORDER BY rowid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []Delivery{}
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanEndpoint reads a row of webhook_endpoints into an Endpoint.
+func scanEndpoint(row scanner) (Endpoint, error) {
+	var endpoint Endpoint
+	var createdAt string
+	if err := row.Scan(&endpoint.ID, &endpoint.MerchantID, &endpoint.URL, &endpoint.Secret, &createdAt); err != nil {
+		return endpoint, err
+	}
+	var err error
+	endpoint.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+	return endpoint, err
+}
+
+// scanDelivery reads a row produced by selectDeliveries into a Delivery.
+func scanDelivery(row scanner) (Delivery, error) {
+	var delivery Delivery
+	var status, createdAt string
+	var nextAttempt int64
+	err := row.Scan(&delivery.ID, &delivery.MerchantID, &delivery.EndpointID, &delivery.URL, &delivery.EventID, &delivery.EventType, &delivery.Payload,
+		&status, &delivery.Attempts, &nextAttempt, &delivery.LastError, &createdAt)
+	if err != nil {
+		return delivery, err
+	}
+	delivery.Status = DeliveryStatus(status)
+	delivery.NextAttempt = time.Unix(0, nextAttempt).UTC()
+	delivery.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+	return delivery, err
+}
@@ -0,0 +1,196 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"payment-gateway/data"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store is the interface that defines the contract for where webhook endpoints and deliveries are kept.
+type Store interface {
+	AddEndpoint(endpoint Endpoint) error
+	RetrieveEndpoint(endpointId string) (bool, Endpoint, error)
+	ListEndpoints(merchantId string) ([]Endpoint, error)
+	DeleteEndpoint(endpointId string) error
+	AddDelivery(delivery Delivery) error
+	RetrieveDelivery(deliveryId string) (bool, Delivery, error)
+	UpdateDelivery(delivery Delivery) error
+	ListDeliveries(merchantId string, status DeliveryStatus) ([]Delivery, error)
+	DueDeliveries(now time.Time) ([]Delivery, error)
+}
+
+// MemoryStore is a Store held in memory. When it has a path, every change is also written to a
+// JSON snapshot at the path, which is read back when the store is opened again.
+type MemoryStore struct {
+	Endpoints  map[string]Endpoint // A map that associates the endpoint id with its endpoint
+	Deliveries map[string]Delivery // A map that associates the delivery id with its delivery
+
+	path string     // Where the snapshot is written, empty to keep the store in memory only
+	mu   sync.Mutex // Mutex to protect concurrent access to the store
+}
+
+// NewMemoryStore creates an empty MemoryStore that is only held in memory.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{Endpoints: make(map[string]Endpoint), Deliveries: make(map[string]Delivery)}
+}
+
+// NewFileStore opens the MemoryStore snapshotted at path, creating an empty one if there is
+// no snapshot yet.
+func NewFileStore(path string) (*MemoryStore, error) {
+	s := NewMemoryStore()
+	file, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(file, s); err != nil {
+			return nil, err
+		}
+	}
+	s.path = path
+	return s, nil
+}
+
+// AddEndpoint adds a new endpoint.
+func (s *MemoryStore) AddEndpoint(endpoint Endpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Endpoints[endpoint.ID] = endpoint
+	return s.save()
+}
+
+// RetrieveEndpoint returns the endpoint with the given id, and whether it was found.
+func (s *MemoryStore) RetrieveEndpoint(endpointId string) (bool, Endpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	endpoint, ok := s.Endpoints[endpointId]
+	return ok, endpoint, nil
+}
+
+// ListEndpoints returns the merchant's endpoints, oldest first.
+func (s *MemoryStore) ListEndpoints(merchantId string) ([]Endpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	endpoints := []Endpoint{}
+	for _, endpoint := range s.Endpoints {
+		if endpoint.MerchantID == merchantId {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if !endpoints[i].CreatedAt.Equal(endpoints[j].CreatedAt) {
+			return endpoints[i].CreatedAt.Before(endpoints[j].CreatedAt)
+		}
+		return endpoints[i].ID < endpoints[j].ID
+	})
+	return endpoints, nil
+}
+
+// DeleteEndpoint removes the endpoint with the given id.
+func (s *MemoryStore) DeleteEndpoint(endpointId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Endpoints[endpointId]; !ok {
+		return ErrEndpointNotFound
+	}
+	delete(s.Endpoints, endpointId)
+	return s.save()
+}
+
+// AddDelivery queues a new delivery.
+func (s *MemoryStore) AddDelivery(delivery Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Deliveries[delivery.ID] = delivery
+	return s.save()
+}
+
+// RetrieveDelivery returns the delivery with the given id, and whether it was found.
+func (s *MemoryStore) RetrieveDelivery(deliveryId string) (bool, Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delivery, ok := s.Deliveries[deliveryId]
+	return ok, delivery, nil
+}
+
+// UpdateDelivery replaces an existing delivery.
+func (s *MemoryStore) UpdateDelivery(delivery Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Deliveries[delivery.ID]; !ok {
+		return ErrDeliveryNotFound
+	}
+	s.Deliveries[delivery.ID] = delivery
+	return s.save()
+}
+
+// ListDeliveries returns the merchant's deliveries with the given status, oldest first.
+func (s *MemoryStore) ListDeliveries(merchantId string, status DeliveryStatus) ([]Delivery, error) {
+	return s.deliveries(func(delivery Delivery) bool {
+		return delivery.MerchantID == merchantId && delivery.Status == status
+	}), nil
+}
+
+// DueDeliveries returns the pending deliveries whose next attempt is due by now, oldest first.
+func (s *MemoryStore) DueDeliveries(now time.Time) ([]Delivery, error) {
+	return s.deliveries(func(delivery Delivery) bool {
+		return delivery.Status == DeliveryPending && !delivery.NextAttempt.After(now)
+	}), nil
+}
+
+// deliveries returns the deliveries that match, oldest first.
+func (s *MemoryStore) deliveries(match func(delivery Delivery) bool) []Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deliveries := []Delivery{}
+	for _, delivery := range s.Deliveries {
+		if match(delivery) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if !deliveries[i].CreatedAt.Equal(deliveries[j].CreatedAt) {
+			return deliveries[i].CreatedAt.Before(deliveries[j].CreatedAt)
+		}
+		return deliveries[i].ID < deliveries[j].ID
+	})
+	return deliveries
+}
+
+// save writes the snapshot of the store, if it has a path. The snapshot is written to a temporary
+// file which then replaces the old one, so a crash part way through leaves the old one intact.
+// It must be called with the mutex held.
+func (s *MemoryStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	snapshot, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	return data.SyncDir(filepath.Dir(s.path))
+}
@@ -0,0 +1,484 @@
+// Package webhooks delivers events about payments to the webhook endpoints merchants register.
+// Every delivery is queued in a Store before it is sent, so it survives a restart, and failed
+// deliveries are retried with exponential backoff until they are given up on and kept in a
+// dead-letter list, from which merchants can redeliver them by hand.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"payment-gateway/data"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Headers sent with every delivery, so merchants can check it came from the gateway.
+const (
+	TimestampHeader = "X-Gateway-Timestamp" // Unix time in seconds when the delivery was signed
+	SignatureHeader = "X-Gateway-Signature" // Hex encoded HMAC-SHA256 of the delivery, see Sign
+	EventHeader     = "X-Gateway-Event"     // The id of the event, which stays the same across retries
+)
+
+// Errors returned by the Dispatcher.
+var (
+	ErrInvalidURL         = errors.New("webhook url must be an absolute http or https url")
+	ErrPrivateURL         = errors.New("webhook url must only resolve to public addresses")
+	ErrEndpointNotFound   = errors.New("webhook endpoint not found")
+	ErrDeliveryNotFound   = errors.New("webhook delivery not found")
+	ErrDeliveryNotFailed  = errors.New("only failed webhook deliveries can be redelivered")
+	ErrDeliveryInProgress = errors.New("webhook delivery is already being sent")
+)
+
+// DeliveryStatus is a custom type representing where a delivery is in its lifecycle.
+type DeliveryStatus string
+
+// The statuses a delivery can have.
+const (
+	DeliveryPending   DeliveryStatus = "pending"   // Waiting to be sent, or to be retried
+	DeliveryDelivered DeliveryStatus = "delivered" // Accepted by the merchant with a 2xx response
+	DeliveryFailed    DeliveryStatus = "failed"    // Given up on after MaxAttempts, and kept in the dead-letter list
+)
+
+// Endpoint is a URL a merchant has registered to be sent events about their payments.
+type Endpoint struct {
+	ID         string    // The gateway's identifier for the endpoint
+	MerchantID string    // The merchant that registered the endpoint
+	URL        string    // Where events are sent
+	Secret     string    // Secret events are signed with, only shown to the merchant when the endpoint is registered
+	CreatedAt  time.Time // When the endpoint was registered
+}
+
+// Delivery is an event being sent to an endpoint. The event is encoded once when it is queued,
+// so every attempt sends the same body.
+type Delivery struct {
+	ID          string         // The gateway's identifier for the delivery
+	MerchantID  string         // The merchant the event is for
+	EndpointID  string         // The endpoint the event is sent to
+	URL         string         // The endpoint's URL when the event was queued
+	EventID     string         // The id of the event being sent
+	EventType   string         // The type of the event being sent, e.g. payment.captured
+	Payload     []byte         // The JSON encoded Event
+	Status      DeliveryStatus // Where the delivery is in its lifecycle
+	Attempts    int            // How many times the delivery has been sent
+	NextAttempt time.Time      // When a pending delivery is next sent
+	LastError   string         // Why the last attempt failed, empty if it succeeded
+	CreatedAt   time.Time      // When the delivery was queued
+}
+
+// Event is the JSON body sent to an endpoint when a payment changes state.
+type Event struct {
+	ID        string       `json:"id"`
+	Type      string       `json:"type"` // payment. followed by the state the payment moved to, e.g. payment.captured
+	CreatedAt time.Time    `json:"created-at"`
+	Data      PaymentEvent `json:"data"`
+}
+
+// PaymentEvent describes the payment an Event is about, as it was after the state change.
+type PaymentEvent struct {
+	PaymentID         string      `json:"payment-id"`
+	State             string      `json:"state"`
+	PreviousState     string      `json:"previous-state,omitempty"` // Empty when the payment was created
+	BankPaymentStatus string      `json:"bank-payment-status"`
+	Amount            json.Number `json:"amount"`
+	AmountCaptured    json.Number `json:"amount-captured"`
+	AmountRefundable  json.Number `json:"amount-refundable"`
+	Currency          string      `json:"currency"`
+	CardNumberMasked  string      `json:"card-number-masked"`
+}
+
+// Dispatcher queues and delivers events about payments to the webhook endpoints of the merchants
+// they belong to. Deliveries are sent by Run, or DeliverDue, rather than when they are queued, so
+// a slow or broken endpoint never holds up a payment. Endpoints must be on the public internet,
+// so merchants cannot have the gateway send requests into its own network.
+type Dispatcher struct {
+	Store                Store            // Where endpoints and deliveries are kept
+	Client               *http.Client     // Client deliveries are sent with, which only connects to public addresses
+	MaxAttempts          int              // The most times a delivery is sent before it is given up on
+	BaseDelay            time.Duration    // The wait before the first retry, doubled for each retry after it
+	MaxDelay             time.Duration    // The cap on the wait between retries
+	Concurrency          int              // The most endpoints sent deliveries at once
+	AllowPrivateNetworks bool             // Allow endpoints on private and loopback addresses, e.g. for local testing
+	Clock                func() time.Time // Source of the current time, which tests can replace
+
+	wake    chan struct{}       // Signalled when deliveries are queued, so Run sends them straight away
+	sending map[string]struct{} // Deliveries being sent, so that no delivery is sent twice at once
+	mu      sync.Mutex          // Mutex to protect concurrent access to sending
+}
+
+// NewDispatcher creates a Dispatcher keeping its endpoints and deliveries in store. Deliveries
+// are sent up to 8 times, waiting 30 seconds before the first retry and at most an hour between
+// retries, which spreads them over about an hour and a half. Up to 16 endpoints are sent
+// deliveries at once.
+func NewDispatcher(store Store) *Dispatcher {
+	d := &Dispatcher{
+		Store:       store,
+		MaxAttempts: 8,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    time.Hour,
+		Concurrency: 16,
+		Clock:       time.Now,
+		wake:        make(chan struct{}, 1),
+		sending:     make(map[string]struct{}),
+	}
+	d.Client = d.newClient()
+	return d
+}
+
+// AddEndpoint registers a URL for the merchant to be sent events about their payments, and
+// returns the endpoint along with the secret its events are signed with. ErrPrivateURL is
+// returned if the URL's host does not resolve, or resolves to any address that is not public.
+func (d *Dispatcher) AddEndpoint(merchantId, endpointURL string) (Endpoint, error) {
+	u, err := url.Parse(endpointURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return Endpoint{}, ErrInvalidURL
+	}
+	if err := d.checkHost(u.Hostname()); err != nil {
+		return Endpoint{}, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Endpoint{}, err
+	}
+	endpoint := Endpoint{
+		ID:         uuid.New().String(),
+		MerchantID: merchantId,
+		URL:        u.String(),
+		Secret:     "whsec_" + hex.EncodeToString(secret),
+		CreatedAt:  d.Clock().UTC(),
+	}
+	if err := d.Store.AddEndpoint(endpoint); err != nil {
+		return Endpoint{}, err
+	}
+	return endpoint, nil
+}
+
+// Endpoints returns the merchant's endpoints, oldest first.
+func (d *Dispatcher) Endpoints(merchantId string) ([]Endpoint, error) {
+	return d.Store.ListEndpoints(merchantId)
+}
+
+// RemoveEndpoint stops events being sent to one of the merchant's endpoints. Deliveries already
+// queued for it fail when they are next sent.
+func (d *Dispatcher) RemoveEndpoint(merchantId, endpointId string) error {
+	ok, endpoint, err := d.Store.RetrieveEndpoint(endpointId)
+	if err != nil {
+		return err
+	}
+	if !ok || endpoint.MerchantID != merchantId {
+		return ErrEndpointNotFound
+	}
+	return d.Store.DeleteEndpoint(endpointId)
+}
+
+// PaymentChanged queues an event for each of the transitions, which the payment has just made,
+// to every endpoint of the merchant it belongs to. Failing to queue an event never fails the
+// change to the payment, so it is logged.
+func (d *Dispatcher) PaymentChanged(payment data.Payment, transitions []data.StateTransition) {
+	if len(transitions) == 0 {
+		return
+	}
+	endpoints, err := d.Store.ListEndpoints(payment.MerchantID)
+	if err != nil {
+		log.Printf("Could not queue webhook events for payment %s with an error of: %v\n", uuid.UUID(payment.PaymentID), err)
+		return
+	}
+	if len(endpoints) == 0 {
+		return
+	}
+
+	queued := false
+	for _, transition := range transitions {
+		event := Event{
+			ID:        uuid.New().String(),
+			Type:      "payment." + string(transition.To),
+			CreatedAt: transition.At,
+			Data: PaymentEvent{
+				PaymentID:         uuid.UUID(payment.PaymentID).String(),
+				State:             string(transition.To),
+				PreviousState:     string(transition.From),
+				BankPaymentStatus: string(payment.BankPaymentStatus),
+				Amount:            json.Number(payment.Amount.String()),
+				AmountCaptured:    json.Number(payment.CapturedAmount.String()),
+				AmountRefundable:  json.Number(payment.RefundableAmount().String()),
+				Currency:          payment.Amount.Currency,
+				CardNumberMasked:  payment.MaskedCardNumber(),
+			},
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Could not encode webhook event for payment %s with an error of: %v\n", event.Data.PaymentID, err)
+			continue
+		}
+		for _, endpoint := range endpoints {
+			delivery := Delivery{
+				ID:          uuid.New().String(),
+				MerchantID:  payment.MerchantID,
+				EndpointID:  endpoint.ID,
+				URL:         endpoint.URL,
+				EventID:     event.ID,
+				EventType:   event.Type,
+				Payload:     payload,
+				Status:      DeliveryPending,
+				NextAttempt: d.Clock().UTC(),
+				CreatedAt:   d.Clock().UTC(),
+			}
+			if err := d.Store.AddDelivery(delivery); err != nil {
+				log.Printf("Could not queue webhook event %s with an error of: %v\n", event.ID, err)
+				continue
+			}
+			queued = true
+		}
+	}
+	if queued {
+		// Wake Run, unless it has already been woken
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Deliveries returns the merchant's deliveries with the given status, oldest first. The
+// failed deliveries are the dead-letter list.
+func (d *Dispatcher) Deliveries(merchantId string, status DeliveryStatus) ([]Delivery, error) {
+	return d.Store.ListDeliveries(merchantId, status)
+}
+
+// Redeliver sends one of the merchant's failed deliveries again straight away, returning the
+// delivery with the outcome. A delivery that fails again stays in the dead-letter list.
+func (d *Dispatcher) Redeliver(ctx context.Context, merchantId, deliveryId string) (Delivery, error) {
+	ok, delivery, err := d.Store.RetrieveDelivery(deliveryId)
+	if err != nil {
+		return Delivery{}, err
+	}
+	if !ok || delivery.MerchantID != merchantId {
+		return Delivery{}, ErrDeliveryNotFound
+	}
+	if delivery.Status != DeliveryFailed {
+		return Delivery{}, ErrDeliveryNotFailed
+	}
+	if !d.claim(deliveryId) {
+		return Delivery{}, ErrDeliveryInProgress
+	}
+	defer d.release(deliveryId)
+	return d.send(ctx, delivery, true)
+}
+
+// DeliverDue sends every pending delivery whose next attempt is due, returning how many were
+// delivered along with the first error. Up to Concurrency endpoints are sent their deliveries at
+// once, while each endpoint is sent its own one at a time, in order, so a slow endpoint only
+// holds up the deliveries to it.
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	due, err := d.Store.DueDeliveries(d.Clock())
+	if err != nil {
+		return 0, err
+	}
+
+	// Group the deliveries by endpoint, keeping the endpoints in the order they fell due
+	var byEndpoint [][]Delivery
+	index := make(map[string]int)
+	for _, delivery := range due {
+		i, ok := index[delivery.EndpointID]
+		if !ok {
+			i = len(byEndpoint)
+			index[delivery.EndpointID] = i
+			byEndpoint = append(byEndpoint, nil)
+		}
+		byEndpoint[i] = append(byEndpoint[i], delivery)
+	}
+
+	workers := d.Concurrency
+	if workers > len(byEndpoint) {
+		workers = len(byEndpoint)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan []Delivery)
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		delivered int
+		firstErr  error
+	)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for deliveries := range queue {
+				n, err := d.deliverToEndpoint(ctx, deliveries)
+				mu.Lock()
+				delivered += n
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, deliveries := range byEndpoint {
+		queue <- deliveries
+	}
+	close(queue)
+	wg.Wait()
+	return delivered, firstErr
+}
+
+// deliverToEndpoint sends the due deliveries to one endpoint in turn, returning how many were
+// delivered. It stops at the first delivery that cannot be updated.
+func (d *Dispatcher) deliverToEndpoint(ctx context.Context, due []Delivery) (int, error) {
+	delivered := 0
+	for _, delivery := range due {
+		if err := ctx.Err(); err != nil {
+			return delivered, err
+		}
+		ok, err := d.deliverDue(ctx, delivery.ID)
+		if err != nil {
+			return delivered, err
+		}
+		if ok {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+// deliverDue sends the delivery if it is still due once it has been claimed, as it may have
+// been sent since it was found to be due, and reports whether it was delivered.
+func (d *Dispatcher) deliverDue(ctx context.Context, deliveryId string) (bool, error) {
+	if !d.claim(deliveryId) {
+		return false, nil
+	}
+	defer d.release(deliveryId)
+	ok, delivery, err := d.Store.RetrieveDelivery(deliveryId)
+	if err != nil || !ok || delivery.Status != DeliveryPending || delivery.NextAttempt.After(d.Clock()) {
+		return false, err
+	}
+	delivery, err = d.send(ctx, delivery, false)
+	return err == nil && delivery.Status == DeliveryDelivered, err
+}
+
+// Run sends deliveries as they are queued, and retries failed ones as they fall due, checking
+// for due retries at the given interval until the context is done.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// A delivery that could not be updated stays due, so it is tried again next time
+		if _, err := d.DeliverDue(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Could not send webhook deliveries with an error of: %v\n", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-d.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send makes an attempt at the delivery and stores the outcome. Unless final, a failed attempt
+// is retried after a backoff until MaxAttempts is reached, after which the delivery has failed.
+func (d *Dispatcher) send(ctx context.Context, delivery Delivery, final bool) (Delivery, error) {
+	delivery.Attempts++
+	err := d.post(ctx, delivery)
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryDelivered
+		delivery.LastError = ""
+	case final || delivery.Attempts >= d.MaxAttempts || errors.Is(err, ErrEndpointNotFound):
+		// A delivery to a removed endpoint can never succeed, so is given up on straight away
+		delivery.Status = DeliveryFailed
+		delivery.LastError = err.Error()
+	default:
+		delivery.Status = DeliveryPending
+		delivery.LastError = err.Error()
+		delivery.NextAttempt = d.Clock().Add(d.backoff(delivery.Attempts)).UTC()
+	}
+	if err := d.Store.UpdateDelivery(delivery); err != nil {
+		return Delivery{}, err
+	}
+	return delivery, nil
+}
+
+// post signs and sends the delivery's event to its endpoint, returning why it failed, if it did.
+func (d *Dispatcher) post(ctx context.Context, delivery Delivery) error {
+	ok, endpoint, err := d.Store.RetrieveEndpoint(delivery.EndpointID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrEndpointNotFound
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(d.Clock().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign([]byte(endpoint.Secret), timestamp, delivery.Payload))
+	req.Header.Set(EventHeader, delivery.EventID)
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return nil
+}
+
+// backoff returns how long to wait before the retry following the given attempt, which doubles
+// with each attempt up to the MaxDelay.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	if shift := attempt - 1; shift < 32 && d.BaseDelay<<shift < d.MaxDelay && d.BaseDelay<<shift > 0 {
+		return d.BaseDelay << shift
+	}
+	return d.MaxDelay
+}
+
+// claim marks the delivery as being sent, returning false if it already is.
+func (d *Dispatcher) claim(deliveryId string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.sending[deliveryId]; ok {
+		return false
+	}
+	d.sending[deliveryId] = struct{}{}
+	return true
+}
+
+// release marks the delivery as no longer being sent.
+func (d *Dispatcher) release(deliveryId string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.sending, deliveryId)
+}
+
+// Sign returns the signature of a delivery. It is the hex encoded HMAC-SHA256, keyed with the
+// endpoint's secret, of the timestamp and body separated by a newline. Merchants should check
+// it, and that the timestamp is recent, before trusting an event.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}